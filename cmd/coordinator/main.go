@@ -1,41 +1,229 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sagarneeli/dist-mapreduce/internal/api"
 	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/inputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/mtls"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: coordinator <file1> <file2> ...")
-		// For docker demo, we can default to looking into a data directory
+	outputDir := flag.String("output-dir", ".", "data directory shared with workers, where they write mr-out files and job output directories")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	traceExporter := flag.String("trace-exporter", "none", "span exporter: none, stdout or otlp-file")
+	traceFile := flag.String("trace-file", "coordinator-traces.jsonl", "output file for the otlp-file exporter")
+	rpcAddr := flag.String("rpc-addr", ":1234", "address for worker RPCs")
+	localityFile := flag.String("locality-file", "", `JSON file mapping input files to preferred hosts, e.g. {"/data/part-0": ["node-a"]}`)
+	localityDelay := flag.Duration("locality-delay", 3*time.Second, "how long a map task waits for a worker on a preferred host")
+	keepIntermediate := flag.Duration("keep-intermediate", 0, "delete a finished job's intermediate files this long after it ends (default never; they can be deleted through the API)")
+	keepFailed := flag.Bool("keep-failed", false, "keep the intermediate files of failed and cancelled jobs for debugging")
+	jobTTL := flag.Duration("job-ttl", 0, "forget finished jobs and workflows this long after they end (default never)")
+	stateFile := flag.String("state-file", "", "save jobs to this file and restore them on restart (default no persistence)")
+	manifests := flag.String("manifest", "", "comma-separated files listing inputs for the initial job, one per line")
+	recursive := flag.Bool("r", false, "include files in subdirectories of directory inputs")
+	include := flag.String("include", "", "comma-separated base name patterns files in directories and globs must match, e.g. '*.txt'")
+	exclude := flag.String("exclude", "", "comma-separated base name patterns of files to leave out")
+	var tlsFiles mtls.Files
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", "", "certificate for RPCs over mutual TLS, issued for the coordinator role (default plaintext)")
+	flag.StringVar(&tlsFiles.Key, "tls-key", "", "key of -tls-cert")
+	flag.StringVar(&tlsFiles.CA, "tls-ca", "", "CA certificate worker certificates must be issued by")
+	haDir := flag.String("ha-dir", "", "directory shared by coordinator replicas for the leader lease and the state log (default a single coordinator)")
+	replicaID := flag.String("replica-id", "", "ID of this replica among those sharing -ha-dir (default the hostname)")
+	advertiseRPC := flag.String("advertise-rpc", "", "address workers reach this replica's RPCs at (default the hostname and the -rpc-addr port)")
+	advertiseAPI := flag.String("advertise-api", "", "URL API clients reach this replica at (default http://HOSTNAME:8080)")
+	gracePeriod := flag.Duration("grace-period", 30*time.Second, "on SIGTERM or SIGINT, how long to let API requests in flight finish")
+	leaseTTL := flag.Duration("lease-ttl", 5*time.Second, "how long a leader's lease lasts unless renewed; about how long failover takes")
+	authConfig := flag.String("auth-config", "", "JSON file of API tenants and their keys; requests must then authenticate (default no authentication)")
+	var limits coordinator.Limits
+	flag.IntVar(&limits.MaxReduce, "max-reduce", 0, "reject jobs with more reduce tasks (default no limit)")
+	flag.IntVar(&limits.MaxInputs, "max-inputs", 0, "reject jobs with more input files (default no limit)")
+	flag.Int64Var(&limits.MaxInputBytes, "max-input-bytes", 0, "reject jobs whose inputs add up to more bytes (default no limit)")
+	flag.IntVar(&limits.MaxRunning, "max-running", 0, "queue jobs while this many are running (default no limit)")
+	flag.IntVar(&limits.MaxRunningPerQueue, "max-running-per-queue", 0, "queue jobs while this many of their queue are running (default no limit)")
+	flag.IntVar(&limits.MaxRunningPerUser, "max-running-per-user", 0, "queue jobs while this many of their user are running (default no limit)")
+	flag.IntVar(&limits.MaxQueued, "max-queued", 0, "answer 429 Too Many Requests while this many jobs are queued (default no limit)")
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := storage.RegisterS3FromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	exporter, _, err := trace.NewExporter(*traceExporter, *traceFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsFiles.Enabled() {
+		if tlsConfig, err = mtls.ServerConfig(tlsFiles, mtls.RoleWorker); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	var auth api.Authenticator
+	if *authConfig != "" {
+		if auth, err = api.LoadAuthConfig(*authConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
 	}
 
-	// Simple simulation of reading input files from a directory or args
-	// In a real scenario, we might scan a directory or use standard input
-	files := os.Args[1:]
-	if len(files) == 0 {
+	// Inputs of the initial job: files, directories, globs and manifests
+	// from the command line, resolved now so a typo fails fast
+	spec := inputs.Spec{
+		Paths:     flag.Args(),
+		Manifests: splitList(*manifests),
+		Recursive: *recursive,
+		Include:   splitList(*include),
+		Exclude:   splitList(*exclude),
+	}
+	explicit := len(spec.Paths)+len(spec.Manifests) > 0
+	if !explicit {
 		// Default to reading from the mounted data directory in Docker
-		files = []string{"/app/data/input/test1.txt", "/app/data/input/test2.txt"}
+		spec.Paths = []string{"/app/data/input"}
+	}
+	files, err := inputs.Resolve(spec)
+	if err != nil {
+		if explicit {
+			fmt.Fprintln(os.Stderr, "Usage: coordinator [flags] <file|dir|glob> ...")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		slog.Warn("No initial job: default inputs unavailable", "error", err)
 	}
 
 	c := coordinator.NewCoordinator()
-	c.Start()
+	tracer := trace.NewTracer("coordinator", exporter)
+	tracer.OnError(func(err error) { slog.Warn("Span export failed", "error", err) })
+	c.SetTracer(tracer)
+	c.SetLocalityDelay(*localityDelay)
+	c.SetOutputDir(*outputDir)
+	c.SetRetention(coordinator.RetentionPolicy{Intermediate: *keepIntermediate, KeepFailed: *keepFailed, JobTTL: *jobTTL})
+	c.SetLimits(limits)
+	c.SetTLS(tlsConfig)
+	if *localityFile != "" {
+		resolver, err := coordinator.LoadStaticLocality(*localityFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		c.SetLocalityResolver(resolver)
+	}
+	if *haDir != "" && *stateFile != "" {
+		fmt.Fprintln(os.Stderr, "-ha-dir and -state-file are mutually exclusive: replicas keep their state in -ha-dir")
+		os.Exit(2)
+	}
+	if *haDir != "" {
+		hostname, _ := os.Hostname()
+		replica := coordinator.Replica{
+			ID:       *replicaID,
+			RPCAddr:  *advertiseRPC,
+			APIAddr:  *advertiseAPI,
+			Lock:     &coordinator.FileLock{Path: filepath.Join(*haDir, "lease.json")},
+			Log:      &coordinator.FileLog{Dir: filepath.Join(*haDir, "log")},
+			LeaseTTL: *leaseTTL,
+		}
+		if replica.ID == "" {
+			replica.ID = hostname
+		}
+		if replica.RPCAddr == "" {
+			_, port, _ := net.SplitHostPort(*rpcAddr)
+			replica.RPCAddr = net.JoinHostPort(hostname, port)
+		}
+		if replica.APIAddr == "" {
+			replica.APIAddr = "http://" + net.JoinHostPort(hostname, "8080")
+		}
+		if err := os.MkdirAll(*haDir, 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := c.SetReplica(replica); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if files != nil && explicit {
+			slog.Warn("Ignoring the initial job: submit jobs to replicated coordinators through the API")
+		}
+		files = nil
+	}
+	if *stateFile != "" {
+		if err := c.SetStateFile(*stateFile); err != nil {
+			slog.Error("Failed to restore coordinator state", "file", *stateFile, "error", err)
+			os.Exit(1)
+		}
+	}
+	if _, err := c.Listen(*rpcAddr); err != nil {
+		slog.Error("listen error", "error", err)
+		os.Exit(1)
+	}
 
-	// Submit the initial job from command line args
-	c.SubmitJob(files, 10)
+	// Submit the initial job from command line args, unless the jobs of a
+	// previous run were restored
+	if len(c.Jobs()) == 0 && files != nil {
+		c.Submit(coordinator.JobSpec{Files: inputs.Paths(files), NReduce: 10, InputSpec: &spec, Inputs: files})
+	}
 
 	// Start REST API
 	apiServer := api.NewServer(c)
+	apiServer.OutputDir = *outputDir
+	apiServer.Auth = auth
 	go func() {
-		if err := apiServer.Start("8080"); err != nil {
-			fmt.Printf("API Server failed: %v\n", err)
+		if err := apiServer.Start("8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API server failed", "error", err)
 		}
 	}()
 
-	// Keep main thread alive
-	select {}
+	// Run until SIGTERM or SIGINT, then turn new jobs away, let API requests
+	// in flight finish and save the state a last time. A second signal
+	// kills the process at once.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down", "grace_period", *gracePeriod)
+	c.Drain()
+	drainCtx, cancel := context.WithTimeout(context.Background(), *gracePeriod)
+	if err := apiServer.Shutdown(drainCtx); err != nil {
+		slog.Warn("API requests did not finish within the grace period", "error", err)
+	}
+	cancel()
+	if err := c.Shutdown(); err != nil {
+		slog.Error("Failed to stop the coordinator", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Coordinator stopped")
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
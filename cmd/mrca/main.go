@@ -0,0 +1,153 @@
+// Command mrca is a small certificate authority for local clusters. It mints
+// the CA and the coordinator and worker certificates that mutual TLS between
+// them needs.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/mtls"
+)
+
+const usage = `Usage: mrca [-dir DIR] <command> [arguments]
+
+Commands:
+  init [-name NAME] [-days N]                      create the CA: ca.pem and ca-key.pem
+  issue [-role R] [-hosts H,...] [-days N] NAME    issue NAME.pem and NAME-key.pem, signed by the CA
+
+Roles are worker (the default) and coordinator. A coordinator certificate
+needs -hosts, the host names and IP addresses workers dial it at.
+Files are read from and written to DIR, by default the working directory,
+and never overwritten.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("mrca", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	dir := fs.String("dir", ".", "directory of the CA and certificate files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	switch cmd, args := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "init":
+		err = initCA(*dir, args, stdout, stderr)
+	case "issue":
+		err = issue(*dir, args, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "mrca: unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "mrca:", err)
+		return 1
+	}
+	return 0
+}
+
+// errUsage reports a bad command line, already explained on stderr.
+var errUsage = errors.New("usage")
+
+func initCA(dir string, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	name := fs.String("name", "mapreduce CA", "name of the CA")
+	valid := fs.Int("days", 3650, "days the CA is valid")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	for _, f := range []string{certFile, keyFile} {
+		if _, err := os.Stat(f); err == nil {
+			return fmt.Errorf("%s exists; remove it to create a new CA", f)
+		}
+	}
+	ca, err := mtls.NewCA(*name, days(*valid))
+	if err != nil {
+		return err
+	}
+	if err := ca.Save(certFile, keyFile); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote %s and %s\n", certFile, keyFile)
+	return nil
+}
+
+func issue(dir string, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("issue", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	role := fs.String("role", mtls.RoleWorker, "role of the certificate: worker or coordinator")
+	hosts := fs.String("hosts", "", "comma-separated host names and IP addresses of a coordinator")
+	valid := fs.Int("days", 365, "days the certificate is valid")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "Usage: mrca issue [-role R] [-hosts H,...] [-days N] NAME")
+		return errUsage
+	}
+	name := fs.Arg(0)
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	ca, err := mtls.LoadCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	var hostList []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hostList = append(hostList, h)
+		}
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ca.Issue(name, *role, hostList, days(*valid), certFile, keyFile); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote %s and %s\n", certFile, keyFile)
+	return nil
+}
+
+// checkName rejects names that would write outside dir or over the CA's
+// files. Names must also be usable as worker IDs.
+func checkName(name string) error {
+	switch {
+	case name == "ca" || name == "ca-key":
+		return fmt.Errorf("%q is reserved for the CA", name)
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("name %q must not contain \"..\"", name)
+	case !validName.MatchString(name):
+		return fmt.Errorf("name %q may only contain letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// validName matches the names certificates can be issued for.
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
@@ -0,0 +1,758 @@
+// Command mrctl drives a MapReduce cluster through the coordinator's REST API.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/pkg/client"
+)
+
+// Exit codes.
+const (
+	exitOK        = 0
+	exitError     = 1 // The request failed
+	exitUsage     = 2 // Bad command line
+	exitJobFailed = 3 // The job ended FAILED or CANCELLED
+)
+
+const usage = `Usage: mrctl [-server URL] [-token KEY] [-json] <command> [arguments]
+
+Commands:
+  submit [-app NAME] [-n-reduce N] [-out-format F] [-wait] FILE|DIR|GLOB...
+                                                          submit a job
+  status JOB                                              show a job's progress
+  inputs JOB                                              list the files a job reads
+  list                                                    list all jobs
+  watch JOB                                               follow a job until it ends
+  cancel JOB                                              cancel a running job
+  clean JOB                                               delete a finished job's intermediate files
+  output [-sort] [-key K] [-offset N] [-limit N] [-format F] JOB
+                                                          print a completed job's output
+  workers                                                 list workers
+  logs [-attempt N] JOB map|reduce TASK                   print a task attempt's log
+  submit-workflow [-wait] FILE                            submit the workflow described in a JSON file
+  workflow WORKFLOW                                       show a workflow's stages
+
+The server defaults to $MRCTL_SERVER or http://localhost:8080; list the
+replicas of a replicated coordinator separated by commas. A coordinator
+that authenticates its callers takes an API key or JWT from -token or
+$MRCTL_TOKEN, or requests signed with $MRCTL_TENANT's $MRCTL_SECRET.
+`
+
+type cli struct {
+	client *client.Client
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("mrctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	server := fs.String("server", envOr("MRCTL_SERVER", "http://localhost:8080"), "coordinator API address")
+	token := fs.String("token", os.Getenv("MRCTL_TOKEN"), "API key or JWT to authenticate with")
+	jsonOut := fs.Bool("json", false, "print machine-readable JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := &cli{client: client.New(*server), json: *jsonOut, stdout: stdout, stderr: stderr}
+	c.client.Token = *token
+	c.client.Tenant, c.client.Secret = os.Getenv("MRCTL_TENANT"), os.Getenv("MRCTL_SECRET")
+	cmds := map[string]func(context.Context, []string) int{
+		"submit":  c.submit,
+		"status":  c.status,
+		"inputs":  c.inputs,
+		"list":    c.list,
+		"watch":   c.watch,
+		"cancel":  c.cancel,
+		"clean":   c.clean,
+		"output":  c.output,
+		"workers": c.workers,
+		"logs":    c.logs,
+
+		"submit-workflow": c.submitWorkflow,
+		"workflow":        c.workflow,
+	}
+	cmd, ok := cmds[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "mrctl: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+	return cmd(context.Background(), fs.Args()[1:])
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (c *cli) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: mrctl %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// fail reports a request error and returns the matching exit code.
+func (c *cli) fail(err error) int {
+	fmt.Fprintf(c.stderr, "mrctl: %v\n", err)
+	return exitError
+}
+
+func (c *cli) printJSON(v any) int {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return c.fail(err)
+	}
+	return exitOK
+}
+
+// jobArg checks that a command got want positional arguments and parses the
+// first one as a job ID.
+func (c *cli) jobArg(fs *flag.FlagSet, want int) (int, bool) {
+	if fs.NArg() != want {
+		fs.Usage()
+		return 0, false
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(c.stderr, "mrctl: invalid job ID %q\n", fs.Arg(0))
+		return 0, false
+	}
+	return id, true
+}
+
+// jobExitCode maps a job's final state to the process exit code.
+func jobExitCode(status string) int {
+	switch status {
+	case client.StatusFailed, client.StatusCancelled:
+		return exitJobFailed
+	}
+	return exitOK
+}
+
+func (c *cli) submit(ctx context.Context, args []string) int {
+	fs := c.flags("submit", "[-app NAME] [-n-reduce N] [-labels K=V,...] [-r] [-include P,...] [-exclude P,...] [-manifest FILE] [-out-dir DIR] [-out-prefix P] [-out-format F] [-separator S] [-success] [-out-manifest] [-dataset TAG=PATH] [-side TAG=PATH] [-param K=V] [-queue Q] [-user U] [-wait] [FILE|DIR|GLOB...]")
+	app := fs.String("app", "", "application to run (default "+common.DefaultApp+")")
+	nReduce := fs.Int("n-reduce", 10, "number of reduce tasks")
+	labelList := fs.String("labels", "", "only run on workers with these comma-separated key=value labels")
+	recursive := fs.Bool("r", false, "include files in subdirectories of directory inputs")
+	include := fs.String("include", "", "comma-separated base name patterns files in directories and globs must match, e.g. '*.txt'")
+	exclude := fs.String("exclude", "", "comma-separated base name patterns of files to leave out")
+	var manifests stringList
+	fs.Var(&manifests, "manifest", "file on the coordinator listing inputs, one per line (repeatable)")
+	var out client.OutputSpec
+	fs.StringVar(&out.Dir, "out-dir", "", "output directory, relative to the cluster's data directory unless absolute")
+	fs.StringVar(&out.Prefix, "out-prefix", "", "output file name prefix (default mr-out-<job>)")
+	fs.StringVar(&out.Format, "out-format", "", "output format: text, tsv, csv, jsonl or sequence (default text)")
+	fs.StringVar(&out.Separator, "separator", "", "separator between key and value in text output (default a space)")
+	fs.BoolVar(&out.SuccessMarker, "success", false, "write a _SUCCESS marker when the job completes")
+	fs.BoolVar(&out.Manifest, "out-manifest", false, "write a _MANIFEST.json with partition record counts and checksums when the job completes")
+	var datasets, sides datasetList
+	fs.Var(&datasets, "dataset", "input file, directory or glob of the tagged dataset TAG, e.g. users=users.csv (repeatable)")
+	fs.Var(&sides, "side", "side input file every map task reads in full, e.g. users=users.csv (repeatable)")
+	params := paramList{}
+	fs.Var(params, "param", "app parameter, e.g. key.users=0 (repeatable)")
+	queue := fs.String("queue", "", "admission queue whose running job limit applies (default the cluster's default queue)")
+	user := fs.String("user", "", "user whose running job limit applies")
+	wait := fs.Bool("wait", false, "watch the job until it ends")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 && len(manifests) == 0 && len(datasets) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	labels, err := common.ParseLabels(*labelList)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "mrctl: %v\n", err)
+		return exitUsage
+	}
+	req := client.SubmitRequest{
+		Files:     fs.Args(),
+		NReduce:   *nReduce,
+		App:       *app,
+		Labels:    labels,
+		Manifests: manifests,
+		Recursive: *recursive,
+		Include:   splitList(*include),
+		Exclude:   splitList(*exclude),
+
+		Datasets:   datasets,
+		SideInputs: sides,
+		Queue:      *queue,
+		User:       *user,
+	}
+	if len(params) > 0 {
+		req.Params = params
+	}
+	if out != (client.OutputSpec{}) {
+		req.Output = &out
+	}
+	id, err := c.client.Submit(ctx, req)
+	if err != nil {
+		return c.fail(err)
+	}
+	if *wait {
+		if !c.json {
+			fmt.Fprintf(c.stdout, "Submitted job %d\n", id)
+		}
+		return c.follow(ctx, id)
+	}
+	if c.json {
+		return c.printJSON(map[string]int{"id": id})
+	}
+	fmt.Fprintln(c.stdout, id)
+	return exitOK
+}
+
+// describeOutput summarizes a job's output settings for status.
+func describeOutput(o *client.OutputSpec) string {
+	format := o.Format
+	if format == "" {
+		format = client.FormatText
+	}
+	parts := []string{format}
+	if o.Dir != "" {
+		parts = append(parts, "dir="+o.Dir)
+	}
+	if o.Prefix != "" {
+		parts = append(parts, "prefix="+o.Prefix)
+	}
+	if o.Separator != "" {
+		parts = append(parts, fmt.Sprintf("separator=%q", o.Separator))
+	}
+	if o.SuccessMarker {
+		parts = append(parts, "_SUCCESS")
+	}
+	if o.Manifest {
+		parts = append(parts, "manifest")
+	}
+	return strings.Join(parts, " ")
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// datasetList is a repeatable TAG=PATH flag. Paths given for the same tag
+// form one dataset; datasets keep the order their tags first appear in.
+type datasetList []client.Dataset
+
+func (l *datasetList) String() string {
+	var parts []string
+	for _, ds := range *l {
+		for _, f := range ds.Files {
+			parts = append(parts, ds.Tag+"="+f)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *datasetList) Set(v string) error {
+	tag, path, ok := strings.Cut(v, "=")
+	if !ok || tag == "" || path == "" {
+		return fmt.Errorf("expected TAG=PATH, got %q", v)
+	}
+	for i := range *l {
+		if (*l)[i].Tag == tag {
+			(*l)[i].Files = append((*l)[i].Files, path)
+			return nil
+		}
+	}
+	*l = append(*l, client.Dataset{Tag: tag, Files: []string{path}})
+	return nil
+}
+
+// paramList is a repeatable K=V flag.
+type paramList map[string]string
+
+func (p paramList) String() string {
+	parts := make([]string, 0, len(p))
+	for k, v := range p {
+		parts = append(parts, k+"="+v)
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ",")
+}
+
+func (p paramList) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected K=V, got %q", v)
+	}
+	p[k] = val
+	return nil
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *cli) inputs(ctx context.Context, args []string) int {
+	fs := c.flags("inputs", "JOB")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	in, err := c.client.Inputs(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(in)
+	}
+	tagged := len(in.SideInputs) > 0
+	for _, f := range in.Files {
+		tagged = tagged || f.Tag != ""
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	if tagged {
+		fmt.Fprint(tw, "TAG\t")
+	}
+	fmt.Fprintln(tw, "SIZE\tMODIFIED\tPATH")
+	for _, f := range in.Files {
+		modified := "-"
+		if !f.ModTime.IsZero() {
+			modified = f.ModTime.Format(time.RFC3339)
+		}
+		if tagged {
+			fmt.Fprintf(tw, "%s\t", cmp.Or(f.Tag, "-"))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", f.Size, modified, f.Path)
+	}
+	// Side inputs are only resolved to paths.
+	for _, ds := range in.SideInputs {
+		for _, f := range ds.Files {
+			fmt.Fprintf(tw, "%s (side)\t-\t-\t%s\n", ds.Tag, f)
+		}
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func (c *cli) status(ctx context.Context, args []string) int {
+	fs := c.flags("status", "JOB")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	st, err := c.client.Get(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		if code := c.printJSON(st); code != exitOK {
+			return code
+		}
+		return jobExitCode(st.Status)
+	}
+	fmt.Fprintf(c.stdout, "Job:       %d\n", st.ID)
+	fmt.Fprintf(c.stdout, "App:       %s\n", st.App)
+	fmt.Fprintf(c.stdout, "Status:    %s\n", st.Status)
+	if st.Error != "" {
+		fmt.Fprintf(c.stdout, "Error:     %s\n", st.Error)
+	}
+	fmt.Fprintf(c.stdout, "Submitted: %s\n", st.SubmittedAt.Format(time.RFC3339))
+	if st.FinishedAt != nil {
+		fmt.Fprintf(c.stdout, "Finished:  %s\n", st.FinishedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(c.stdout, "Map:       %d/%d\n", st.MapDone, st.MapTasks)
+	fmt.Fprintf(c.stdout, "Reduce:    %d/%d\n", st.ReduceDone, st.ReduceTasks)
+	if l := st.Locality; l.Local+l.Remote > 0 {
+		fmt.Fprintf(c.stdout, "Locality:  %.0f%% (%d local, %d remote)\n", 100*l.HitRate, l.Local, l.Remote)
+	}
+	if st.Queue != "" {
+		queue := st.Queue
+		if st.User != "" {
+			queue += " (user " + st.User + ")"
+		}
+		if st.QueuePosition > 0 {
+			queue += fmt.Sprintf(", position %d", st.QueuePosition)
+		}
+		fmt.Fprintf(c.stdout, "Queue:     %s\n", queue)
+	}
+	if st.Tenant != "" {
+		fmt.Fprintf(c.stdout, "Tenant:    %s\n", st.Tenant)
+	}
+	if len(st.Labels) > 0 {
+		fmt.Fprintf(c.stdout, "Labels:    %s\n", common.FormatLabels(st.Labels))
+	}
+	if o := st.Output; o != nil {
+		fmt.Fprintf(c.stdout, "Output:    %s\n", describeOutput(o))
+	}
+	if len(st.Datasets) > 0 {
+		fmt.Fprintf(c.stdout, "Datasets:  %s\n", strings.Join(st.Datasets, ", "))
+	}
+	if len(st.Params) > 0 {
+		fmt.Fprintf(c.stdout, "Params:    %s\n", paramList(st.Params))
+	}
+	if len(st.Counters) > 0 {
+		fmt.Fprintln(c.stdout, "Counters:")
+		tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		for _, name := range sortedKeys(st.Counters) {
+			fmt.Fprintf(tw, "  %s\t%d\n", name, st.Counters[name])
+		}
+		tw.Flush()
+	}
+	return jobExitCode(st.Status)
+}
+
+func (c *cli) list(ctx context.Context, args []string) int {
+	fs := c.flags("list", "")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	jobs, err := c.client.List(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(jobs)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAPP\tSTATUS\tMAP\tREDUCE\tSUBMITTED")
+	for _, j := range jobs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d/%d\t%d/%d\t%s\n", j.ID, j.App, j.Status,
+			j.MapDone, j.MapTasks, j.ReduceDone, j.ReduceTasks, j.SubmittedAt.Format(time.RFC3339))
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func (c *cli) watch(ctx context.Context, args []string) int {
+	fs := c.flags("watch", "JOB")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	return c.follow(ctx, id)
+}
+
+// follow waits for a job to stop running, drawing a progress bar or, with
+// -json, printing one status object per change in progress.
+func (c *cli) follow(ctx context.Context, id int) int {
+	var last *client.Job
+	var writeErr error
+	job, err := c.client.Watch(ctx, id, func(job *client.Job) {
+		if c.json {
+			if last == nil || progressChanged(last, job) {
+				if err := json.NewEncoder(c.stdout).Encode(job); err != nil && writeErr == nil {
+					writeErr = err
+				}
+			}
+		} else {
+			fmt.Fprintf(c.stdout, "\r%s", progressLine(job))
+		}
+		last = job
+	})
+	if last != nil && !c.json {
+		fmt.Fprintln(c.stdout)
+	}
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	return jobExitCode(job.Status)
+}
+
+func progressChanged(a, b *client.Job) bool {
+	return a.Status != b.Status || a.MapDone != b.MapDone || a.ReduceDone != b.ReduceDone
+}
+
+const barWidth = 30
+
+// progressLine renders e.g. "job 3 [#########.....]  45%  map 9/10  reduce 0/10  IN_PROGRESS".
+// Map and reduce tasks count equally towards the bar.
+func progressLine(st *client.Job) string {
+	total := st.MapTasks + st.ReduceTasks
+	done := st.MapDone + st.ReduceDone
+	pct := 0
+	if total > 0 {
+		pct = done * 100 / total
+	}
+	filled := pct * barWidth / 100
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled)
+	status := st.Status
+	if st.QueuePosition > 0 {
+		status = fmt.Sprintf("%s #%d", status, st.QueuePosition)
+	}
+	return fmt.Sprintf("job %d [%s] %3d%%  map %d/%d  reduce %d/%d  %-11s",
+		st.ID, bar, pct, st.MapDone, st.MapTasks, st.ReduceDone, st.ReduceTasks, status)
+}
+
+func (c *cli) cancel(ctx context.Context, args []string) int {
+	fs := c.flags("cancel", "JOB")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	st, err := c.client.Cancel(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(st)
+	}
+	fmt.Fprintf(c.stdout, "Job %d %s\n", st.ID, st.Status)
+	return exitOK
+}
+
+func (c *cli) clean(ctx context.Context, args []string) int {
+	fs := c.flags("clean", "JOB")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	st, err := c.client.DeleteData(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(st)
+	}
+	fmt.Fprintf(c.stdout, "Deleted intermediate files of job %d\n", st.ID)
+	return exitOK
+}
+
+func (c *cli) output(ctx context.Context, args []string) int {
+	fs := c.flags("output", "[-sort] [-key K] [-offset N] [-limit N] [-format F] JOB")
+	sorted := fs.Bool("sort", false, "merge partitions in key order")
+	key := fs.String("key", "", "only print records with this key")
+	offset := fs.Int("offset", 0, "skip this many records")
+	limit := fs.Int("limit", 0, "print at most this many records (0 for all)")
+	format := fs.String("format", "", "text, csv or json (default text, or json with -json)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 1)
+	if !ok {
+		return exitUsage
+	}
+	opts := client.OutputOptions{Sorted: *sorted, Offset: *offset, Limit: *limit, Format: *format}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "key" {
+			opts.Key, opts.HasKey = *key, true
+		}
+	})
+	if opts.Format == "" && c.json {
+		opts.Format = "json"
+	}
+	body, err := c.client.ReadOutput(ctx, id, opts)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer body.Close()
+	if _, err := io.Copy(c.stdout, body); err != nil {
+		return c.fail(err)
+	}
+	return exitOK
+}
+
+func (c *cli) workers(ctx context.Context, args []string) int {
+	fs := c.flags("workers", "")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	workers, err := c.client.Workers(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(workers)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOST\tLIVE\tRUNNING\tSLOTS\tLABELS\tLAST SEEN")
+	for _, w := range workers {
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%d\t%d\t%s\t%s\n", w.ID, w.Hostname, w.Live, w.RunningTasks, w.Slots,
+			common.FormatLabels(w.Labels), w.LastSeen.Format(time.RFC3339))
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func (c *cli) logs(ctx context.Context, args []string) int {
+	fs := c.flags("logs", "[-attempt N] JOB map|reduce TASK")
+	attempt := fs.Int("attempt", -1, "attempt number (default latest)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	id, ok := c.jobArg(fs, 3)
+	if !ok {
+		return exitUsage
+	}
+	if _, err := common.ParseTaskType(fs.Arg(1)); err != nil {
+		fmt.Fprintf(c.stderr, "mrctl: %v\n", err)
+		return exitUsage
+	}
+	taskID, err := strconv.Atoi(fs.Arg(2))
+	if err != nil {
+		fmt.Fprintf(c.stderr, "mrctl: invalid task ID %q\n", fs.Arg(2))
+		return exitUsage
+	}
+	text, err := c.client.TaskLogs(ctx, id, fs.Arg(1), taskID, *attempt)
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.json {
+		return c.printJSON(map[string]any{"job": id, "type": fs.Arg(1), "task": taskID, "logs": text})
+	}
+	fmt.Fprint(c.stdout, text)
+	return exitOK
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (c *cli) submitWorkflow(ctx context.Context, args []string) int {
+	fs := c.flags("submit-workflow", "[-wait] FILE")
+	wait := fs.Bool("wait", false, "wait for the workflow to finish and exit non-zero unless it completed")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return c.fail(err)
+	}
+	var req client.WorkflowRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return c.fail(fmt.Errorf("%s: %w", fs.Arg(0), err))
+	}
+	id, err := c.client.SubmitWorkflow(ctx, req)
+	if err != nil {
+		return c.fail(err)
+	}
+	if !*wait {
+		if c.json {
+			return c.printJSON(map[string]int{"id": id})
+		}
+		fmt.Fprintf(c.stdout, "Submitted workflow %d\n", id)
+		return exitOK
+	}
+	wf, err := c.client.WaitWorkflow(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.printWorkflow(wf)
+}
+
+func (c *cli) workflow(ctx context.Context, args []string) int {
+	fs := c.flags("workflow", "WORKFLOW")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(c.stderr, "mrctl: invalid workflow ID %q\n", fs.Arg(0))
+		return exitUsage
+	}
+	wf, err := c.client.GetWorkflow(ctx, id)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.printWorkflow(wf)
+}
+
+// printWorkflow prints a workflow and its stages, and returns the exit code
+// for its state.
+func (c *cli) printWorkflow(wf *client.Workflow) int {
+	if c.json {
+		if code := c.printJSON(wf); code != exitOK {
+			return code
+		}
+		return jobExitCode(wf.Status)
+	}
+	fmt.Fprintf(c.stdout, "Workflow:  %d %s\n", wf.ID, wf.Name)
+	fmt.Fprintf(c.stdout, "Status:    %s\n", wf.Status)
+	if wf.Error != "" {
+		fmt.Fprintf(c.stdout, "Error:     %s\n", wf.Error)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tAFTER\tSTATUS\tJOB")
+	for _, st := range wf.Stages {
+		job := "-"
+		if st.JobID != nil {
+			job = strconv.Itoa(*st.JobID)
+		}
+		after := strings.Join(st.After, ",")
+		if after == "" {
+			after = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", st.Name, after, st.Status, job)
+	}
+	tw.Flush()
+	return jobExitCode(wf.Status)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/api"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/pkg/client"
+)
+
+func TestRun_ExitCodes(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	ts := httptest.NewServer(api.NewServer(c).Handler())
+	defer ts.Close()
+
+	mrctl := func(args ...string) (int, string) {
+		var out, errOut bytes.Buffer
+		code := run(append([]string{"-server", ts.URL}, args...), &out, &errOut)
+		return code, out.String()
+	}
+
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"in-0.txt", "in-1.txt"} {
+		if err := os.WriteFile(name, []byte("hello\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _ := mrctl("submit", "missing-*.txt"); code != exitError {
+		t.Errorf("Expected exit %d for inputs that do not exist, got %d", exitError, code)
+	}
+	if code, out := mrctl("submit", "-n-reduce", "2", "in-*.txt"); code != exitOK || strings.TrimSpace(out) != "0" {
+		t.Fatalf("Expected job 0 submitted, got %d %q", code, out)
+	}
+	if code, _ := mrctl("status", "0"); code != exitOK {
+		t.Errorf("Expected exit %d for a running job, got %d", exitOK, code)
+	}
+	if code, _ := mrctl("submit", "-out-format", "xml", "in-0.txt"); code != exitError {
+		t.Errorf("Expected exit %d for an unknown output format, got %d", exitError, code)
+	}
+	if code, _ := mrctl("submit", "-out-dir", "out", "-out-format", "csv", "-success", "in-0.txt"); code != exitOK {
+		t.Fatalf("Expected job 1 submitted, got %d", code)
+	}
+	if _, out := mrctl("status", "1"); !strings.Contains(out, "Output:    csv dir=out _SUCCESS") {
+		t.Errorf("Expected the output settings in the status, got %q", out)
+	}
+	if code, _ := mrctl("cancel", "0"); code != exitOK {
+		t.Errorf("Expected cancel to succeed, got %d", code)
+	}
+	if code, out := mrctl("-json", "watch", "0"); code != exitJobFailed || !strings.Contains(out, `"CANCELLED"`) {
+		t.Errorf("Expected exit %d for a cancelled job, got %d %q", exitJobFailed, code, out)
+	}
+	if code, _ := mrctl("status", "7"); code != exitError {
+		t.Errorf("Expected exit %d for an unknown job, got %d", exitError, code)
+	}
+	if code, _ := mrctl("frobnicate"); code != exitUsage {
+		t.Errorf("Expected exit %d for an unknown command, got %d", exitUsage, code)
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	line := progressLine(&client.Job{ID: 2, Status: "IN_PROGRESS", MapTasks: 4, ReduceTasks: 6, MapDone: 4, ReduceDone: 1})
+	if !strings.HasPrefix(line, "job 2 [###############...............]  50%  map 4/4  reduce 1/6") {
+		t.Errorf("Unexpected progress line %q", line)
+	}
+	line = progressLine(&client.Job{ID: 3, Status: "QUEUED", MapTasks: 1, ReduceTasks: 1, QueuePosition: 2})
+	if !strings.Contains(line, "QUEUED #2") {
+		t.Errorf("Expected the queue position in %q", line)
+	}
+}
@@ -0,0 +1,100 @@
+// Command mrlocal runs a MapReduce job in a single process and prints its
+// output in key order, for developing and debugging apps without a cluster.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/local"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	app := flag.String("app", common.DefaultApp, "application to run")
+	nReduce := flag.Int("n-reduce", 10, "number of reduce tasks")
+	workers := flag.Int("workers", local.DefaultWorkers, "number of goroutine workers")
+	dir := flag.String("dir", "", "keep intermediate and mr-out files in this directory (default a temporary directory)")
+	out := flag.String("o", "", "write the sorted output to this file instead of standard output")
+	counters := flag.Bool("counters", false, "print job counters to standard error")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "warn", "minimum log level: debug, info, warn or error")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mrlocal [flags] <file1> <file2> ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return 2
+	}
+
+	workDir := *dir
+	if workDir == "" {
+		tmp, err := os.MkdirTemp("", "mrlocal-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		workDir = tmp
+	} else if err := os.MkdirAll(workDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	res, err := local.Run(ctx, local.Config{
+		App:     *app,
+		Files:   flag.Args(),
+		NReduce: *nReduce,
+		Workers: *workers,
+		Dir:     workDir,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mrlocal:", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := res.WriteSorted(w); err != nil {
+		fmt.Fprintln(os.Stderr, "mrlocal:", err)
+		return 1
+	}
+
+	if *counters {
+		names := make([]string, 0, len(res.Counters))
+		for name := range res.Counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "%s=%d\n", name, res.Counters[name])
+		}
+	}
+	return 0
+}
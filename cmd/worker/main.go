@@ -1,15 +1,127 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/mtls"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
 	"github.com/sagarneeli/dist-mapreduce/internal/worker"
 )
 
 func main() {
+	metricsPort := flag.String("metrics-port", os.Getenv("WORKER_METRICS_PORT"), "port for the /metrics endpoint (disabled if empty)")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	traceExporter := flag.String("trace-exporter", "none", "span exporter: none, stdout or otlp-file")
+	traceFile := flag.String("trace-file", "worker-traces.jsonl", "output file for the otlp-file exporter")
+	slots := flag.Int("slots", envInt("WORKER_SLOTS", 1), "number of tasks to run at once")
+	labelList := flag.String("labels", os.Getenv("WORKER_LABELS"), "comma-separated key=value labels jobs can require, e.g. zone=us-east-1a")
+	gracePeriod := flag.Duration("grace-period", envDuration("WORKER_GRACE_PERIOD", 30*time.Second), "on SIGTERM or SIGINT, how long running tasks may take to finish before they are handed back")
+	var tlsFiles mtls.Files
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", os.Getenv("WORKER_TLS_CERT"), "certificate for mutual TLS with the coordinator, issued for the worker role (default plaintext)")
+	flag.StringVar(&tlsFiles.Key, "tls-key", os.Getenv("WORKER_TLS_KEY"), "key of -tls-cert")
+	flag.StringVar(&tlsFiles.CA, "tls-ca", os.Getenv("WORKER_TLS_CA"), "CA certificate the coordinator's certificate must be issued by")
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := storage.RegisterS3FromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	labels, err := common.ParseLabels(*labelList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	exporter, closeExporter, err := trace.NewExporter(*traceExporter, *traceFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer closeExporter()
+	tracer := trace.NewTracer("worker", exporter)
+	tracer.OnError(func(err error) { slog.Warn("Span export failed", "error", err) })
+	worker.SetTracer(tracer)
+
+	var tlsConfig *tls.Config
+	if tlsFiles.Enabled() {
+		if tlsConfig, err = mtls.ClientConfig(tlsFiles, mtls.RoleCoordinator); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
 	coordinatorHost := os.Getenv("COORDINATOR_HOST")
 	if coordinatorHost == "" {
 		coordinatorHost = "localhost"
 	}
-	worker.Worker(coordinatorHost)
+
+	if *metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", worker.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(":"+*metricsPort, mux); err != nil {
+				slog.Error("Metrics server failed", "error", err)
+			}
+		}()
+	}
+
+	// The first SIGTERM or SIGINT stops the worker gracefully; a second one
+	// kills the process at once.
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		slog.Info("Shutting down", "signal", sig.String(), "grace_period", *gracePeriod)
+		signal.Stop(signals)
+		close(stop)
+	}()
+
+	err = worker.Run(context.Background(), worker.Config{
+		CoordinatorAddr: coordinatorHost,
+		Slots:           *slots,
+		Labels:          labels,
+		TLS:             tlsConfig,
+		Stop:            stop,
+		GracePeriod:     *gracePeriod,
+	})
+	if err != nil {
+		slog.Error("Worker stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// envDuration returns the duration in the environment variable name, e.g.
+// "45s", or def if it is unset or not a duration.
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return def
+}
+
+// envInt returns the integer in the environment variable name, or def if it
+// is unset or not a number.
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
 }
@@ -0,0 +1,513 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/inputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// Tenant is an authenticated caller of the API. Tenants only see their own
+// jobs and workflows, and may only submit jobs that read below one of
+// InputPrefixes and write below one of OutputPrefixes. Admins see every
+// job and are not limited to any paths.
+type Tenant struct {
+	Name           string   `json:"name"`
+	APIKeys        []string `json:"api_keys,omitempty"`
+	HMACSecret     string   `json:"hmac_secret,omitempty"`
+	InputPrefixes  []string `json:"input_prefixes,omitempty"`  // Local paths are relative to the coordinator's working directory
+	OutputPrefixes []string `json:"output_prefixes,omitempty"` // Relative prefixes are below the data directory
+	Admin          bool     `json:"admin,omitempty"`
+}
+
+// Authenticator identifies the tenant behind a request.
+type Authenticator interface {
+	// Authenticate returns the request's tenant, or an error if the
+	// request carries no valid credentials.
+	Authenticate(r *http.Request) (*Tenant, error)
+}
+
+// ErrUnauthenticated is returned by authenticators for requests without
+// credentials they accept.
+var ErrUnauthenticated = errors.New("missing or invalid credentials")
+
+// Headers of HMAC-signed requests, see HMACAuth.
+const (
+	HeaderTenant    = "X-MR-Tenant"
+	HeaderTimestamp = "X-MR-Timestamp"
+	HeaderNonce     = "X-MR-Nonce"
+	HeaderSignature = "X-MR-Signature"
+)
+
+// APIKeys authenticates requests by the API key in their
+// "Authorization: Bearer <key>" or X-API-Key header.
+type APIKeys struct {
+	Tenants []*Tenant
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Tenant, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearer(r)
+	}
+	if key == "" {
+		return nil, ErrUnauthenticated
+	}
+	var found *Tenant
+	for _, t := range a.Tenants {
+		for _, k := range t.APIKeys {
+			// Compare every key so the time taken does not tell which
+			// tenant's keys came close.
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				found = t
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+// HMACAuth authenticates requests signed with a tenant's secret. A signed
+// request names its tenant in X-MR-Tenant, the Unix time it was signed at in
+// X-MR-Timestamp, a string unique to the request in X-MR-Nonce and carries
+// in X-MR-Signature the hex HMAC-SHA256 of
+//
+//	METHOD "\n" REQUEST-URI "\n" TIMESTAMP "\n" NONCE "\n" hex(SHA-256(body))
+//
+// Requests signed more than MaxSkew from now are rejected, and so are
+// requests reusing a nonce the tenant signed within that window, so a
+// captured request cannot be replayed.
+type HMACAuth struct {
+	Tenants []*Tenant
+	MaxSkew time.Duration // Default 5 minutes
+	now     func() time.Time
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // Tenant and nonce -> when it may be forgotten
+	nextPrune time.Time
+}
+
+// maxNonce caps the length of the nonces HMACAuth remembers.
+const maxNonce = 128
+
+// maxRequestBody caps the request bodies HMACAuth reads to verify them.
+const maxRequestBody = 16 << 20
+
+func (a *HMACAuth) Authenticate(r *http.Request) (*Tenant, error) {
+	name, ts, sig := r.Header.Get(HeaderTenant), r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature)
+	nonce := r.Header.Get(HeaderNonce)
+	if name == "" || ts == "" || sig == "" || nonce == "" || len(nonce) > maxNonce {
+		return nil, ErrUnauthenticated
+	}
+	var tenant *Tenant
+	for _, t := range a.Tenants {
+		if t.Name == name && t.HMACSecret != "" {
+			tenant = t
+		}
+	}
+	if tenant == nil {
+		return nil, ErrUnauthenticated
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	now, skew := time.Now(), a.MaxSkew
+	if a.now != nil {
+		now = a.now()
+	}
+	if skew <= 0 {
+		skew = 5 * time.Minute
+	}
+	signed := time.Unix(unix, 0)
+	if d := now.Sub(signed); d > skew || d < -skew {
+		return nil, fmt.Errorf("%w: request signed at %s", ErrUnauthenticated, signed.UTC().Format(time.RFC3339))
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(io.LimitReader(r.Body, maxRequestBody)); err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body)) // Let the handler read it again
+	}
+	want := hmacSignature(tenant.HMACSecret, r.Method, r.URL.RequestURI(), ts, nonce, body)
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, want) {
+		return nil, ErrUnauthenticated
+	}
+	// Only remember nonces of genuine requests, so others cannot fill the
+	// map. Once its timestamp leaves the window a request is refused
+	// anyway, and its nonce can be forgotten.
+	if !a.useNonce(tenant.Name+"\n"+nonce, signed.Add(skew), now, skew) {
+		return nil, fmt.Errorf("%w: nonce already used", ErrUnauthenticated)
+	}
+	return tenant, nil
+}
+
+// useNonce records key until expires and reports whether it was new.
+func (a *HMACAuth) useNonce(key string, expires, now time.Time, skew time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.After(a.nextPrune) {
+		for k, t := range a.nonces {
+			if now.After(t) {
+				delete(a.nonces, k)
+			}
+		}
+		a.nextPrune = now.Add(skew / 4)
+	}
+	if t, ok := a.nonces[key]; ok && !now.After(t) {
+		return false
+	}
+	if a.nonces == nil {
+		a.nonces = make(map[string]time.Time)
+	}
+	a.nonces[key] = expires
+	return true
+}
+
+func hmacSignature(secret, method, uri, ts, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, ts, nonce, hex.EncodeToString(sum[:]))
+	return mac.Sum(nil)
+}
+
+// JWTAuth authenticates requests with an "Authorization: Bearer <token>"
+// JSON Web Token signed with HS256 using Key. The token's "sub" claim names
+// the tenant, and "exp" and "nbf" are enforced when present.
+type JWTAuth struct {
+	Key     []byte
+	Tenants []*Tenant
+	now     func() time.Time
+}
+
+func (a *JWTAuth) Authenticate(r *http.Request) (*Tenant, error) {
+	token := bearer(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthenticated
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported token", ErrUnauthenticated)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrUnauthenticated
+	}
+
+	var claims struct {
+		Sub string   `json:"sub"`
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrUnauthenticated
+	}
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	if claims.Exp != nil && now.Unix() >= int64(*claims.Exp) {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	}
+	if claims.Nbf != nil && now.Unix() < int64(*claims.Nbf) {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrUnauthenticated)
+	}
+	for _, t := range a.Tenants {
+		if t.Name == claims.Sub {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown tenant %q", ErrUnauthenticated, claims.Sub)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// bearer returns the token of an "Authorization: Bearer" header.
+func bearer(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// MultiAuth accepts requests any of its authenticators accepts: HMAC-signed
+// requests, JWTs and API keys, each as configured. A request one of them
+// rejects with an error wrapping ErrUnauthenticated goes on to the next;
+// any other error, such as a body that cannot be read, ends the attempt.
+type MultiAuth []Authenticator
+
+func (m MultiAuth) Authenticate(r *http.Request) (*Tenant, error) {
+	err := ErrUnauthenticated
+	for _, a := range m {
+		t, aerr := a.Authenticate(r)
+		if aerr == nil {
+			return t, nil
+		}
+		if !errors.Is(aerr, ErrUnauthenticated) {
+			return nil, aerr
+		}
+		if aerr != ErrUnauthenticated {
+			err = aerr // Keep the more specific reason over the bare sentinel
+		}
+	}
+	return nil, err
+}
+
+// AuthConfig is the file read by LoadAuthConfig.
+type AuthConfig struct {
+	JWTKey  string    `json:"jwt_key,omitempty"` // HS256 key; empty disables JWTs
+	Tenants []*Tenant `json:"tenants"`
+}
+
+// LoadAuthConfig reads the tenants and keys in a JSON AuthConfig file and
+// returns an authenticator accepting every kind of credentials it sets up.
+func LoadAuthConfig(file string) (Authenticator, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg AuthConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return cfg.Authenticator()
+}
+
+// Authenticator checks the configuration and returns an authenticator for
+// it.
+func (cfg AuthConfig) Authenticator() (Authenticator, error) {
+	seen := make(map[string]bool)
+	for _, t := range cfg.Tenants {
+		if t.Name == "" {
+			return nil, errors.New("a tenant needs a name")
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	auth := MultiAuth{&HMACAuth{Tenants: cfg.Tenants}}
+	if cfg.JWTKey != "" {
+		auth = append(auth, &JWTAuth{Key: []byte(cfg.JWTKey), Tenants: cfg.Tenants})
+	}
+	return append(auth, &APIKeys{Tenants: cfg.Tenants}), nil
+}
+
+type tenantKey struct{}
+
+// TenantFrom returns the tenant a request was authenticated as, or nil if
+// the server has no Authenticator.
+func TenantFrom(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return t
+}
+
+// authenticate wraps h so every request must authenticate as a tenant.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := s.Auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mapreduce"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	})
+}
+
+// tenantName returns the name of the request's tenant, or "" without
+// authentication.
+func tenantName(r *http.Request) string {
+	if t := TenantFrom(r.Context()); t != nil {
+		return t.Name
+	}
+	return ""
+}
+
+// canSee reports whether the request's tenant may see a job or workflow
+// owned by owner.
+func canSee(r *http.Request, owner string) bool {
+	t := TenantFrom(r.Context())
+	return t == nil || t.Admin || t.Name == owner
+}
+
+// isAdmin reports whether the request's tenant is an admin, or the server
+// has no Authenticator.
+func isAdmin(r *http.Request) bool {
+	t := TenantFrom(r.Context())
+	return t == nil || t.Admin
+}
+
+// within reports whether p is one of prefixes or below one of them. Paths
+// and prefixes that are not absolute are relative to dir. Local paths are
+// compared with symlinks resolved, so a link below a prefix cannot lead
+// outside it, and a path that cannot be resolved is never within; URIs are
+// compared after cleaning their path.
+func within(p string, prefixes []string, dir string) bool {
+	clean := func(p string) (string, bool) {
+		if !storage.IsAbs(p) {
+			p = storage.Join(dir, p)
+		}
+		if storage.IsURI(p) {
+			scheme, name, _ := strings.Cut(p, "://")
+			return scheme + "://" + strings.TrimPrefix(path.Clean("/"+name), "/"), true
+		}
+		real, err := resolve(p)
+		if err != nil {
+			return "", false
+		}
+		return filepath.ToSlash(real), true
+	}
+	p, ok := clean(p)
+	if !ok {
+		return false
+	}
+	for _, prefix := range prefixes {
+		prefix, ok := clean(prefix)
+		if !ok {
+			continue
+		}
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the absolute form of the local path p with its symlinks
+// resolved. The part of p that does not exist yet, such as an output
+// directory or a glob, is kept as it is below the deepest part that does;
+// a dangling symlink there is an error, as it may be created later.
+func resolve(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(p); lerr == nil {
+			return "", err // A symlink to nowhere
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// authorize checks the paths of a job request against the prefixes of the
+// request's tenant. It runs before the inputs are resolved, so nothing
+// outside them is listed or read; authorizeInputs then checks the files
+// found, which manifests may name anywhere.
+func (s *Server) authorize(r *http.Request, req SubmitJobRequest) error {
+	t := TenantFrom(r.Context())
+	if t == nil || t.Admin {
+		return nil
+	}
+	paths := append(slices.Clone(req.Files), req.Manifests...)
+	for _, ds := range append(slices.Clone(req.Datasets), req.SideInputs...) {
+		paths = append(paths, ds.Files...)
+	}
+	for _, p := range paths {
+		if !within(p, t.InputPrefixes, "") {
+			return fmt.Errorf("tenant %q may not read %s", t.Name, p)
+		}
+	}
+	if dir := req.Output.DirPath(s.OutputDir); !within(dir, t.OutputPrefixes, s.OutputDir) {
+		return fmt.Errorf("tenant %q may not write to %s", t.Name, dir)
+	}
+	return nil
+}
+
+// authorizeInputs checks the resolved input files of a job and makes the
+// request's tenant its owner and user.
+func authorizeInputs(r *http.Request, spec *coordinator.JobSpec) error {
+	t := TenantFrom(r.Context())
+	if t == nil {
+		return nil
+	}
+	spec.Tenant = t.Name
+	if !t.Admin || spec.User == "" {
+		spec.User = t.Name // Tenants are limited as users, see Limits
+	}
+	if t.Admin {
+		return nil
+	}
+	files := inputs.Paths(spec.Inputs)
+	for _, ds := range spec.SideInputs {
+		files = append(files, ds.Files...)
+	}
+	for _, f := range files {
+		if !within(f, t.InputPrefixes, "") {
+			return fmt.Errorf("tenant %q may not read %s", t.Name, f)
+		}
+	}
+	return nil
+}
+
+// snapshot returns the job id if the request's tenant may see it.
+func (s *Server) snapshot(r *http.Request, id int) (coordinator.Job, bool) {
+	job, ok := s.coordinator.Snapshot(id)
+	if !ok || !canSee(r, job.Tenant) {
+		return coordinator.Job{}, false
+	}
+	return job, true
+}
+
+// snapshotWorkflow returns the workflow id if the request's tenant may see
+// it.
+func (s *Server) snapshotWorkflow(r *http.Request, id int) (coordinator.Workflow, bool) {
+	wf, ok := s.coordinator.SnapshotWorkflow(id)
+	if !ok || !canSee(r, wf.Tenant) {
+		return coordinator.Workflow{}, false
+	}
+	return wf, true
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/appkeys"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// OutputRecord is one key/value line of a job's reduce output.
+type OutputRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PartitionInfo describes a single reduce output file. Records and CRC32
+// are reported by the reducer that wrote it, when known.
+type PartitionInfo struct {
+	Partition int     `json:"partition"`
+	File      string  `json:"file"`
+	Size      int64   `json:"size"`
+	Records   *int64  `json:"records,omitempty"`
+	CRC32     *uint32 `json:"crc32,omitempty"`
+}
+
+// PartitionsResponse lists the output partitions of a job.
+type PartitionsResponse struct {
+	JobID      int             `json:"id"`
+	Partitions []PartitionInfo `json:"partitions"`
+	TotalSize  int64           `json:"total_size"`
+}
+
+func (s *Server) handleJobOutput(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.completedJob(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	offset, err := intParam(q.Get("offset"))
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(q.Get("limit"))
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	sorted := false
+	if v := q.Get("sort"); v != "" {
+		sorted, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid sort flag", http.StatusBadRequest)
+			return
+		}
+	}
+	key, hasKey := q.Get("key"), q.Has("key")
+
+	format := q.Get("format")
+	if format == "" {
+		format = "text"
+	}
+	enc, ok := newRecordEncoder(format, w)
+	if !ok {
+		http.Error(w, "Unsupported format (want text, csv or json)", http.StatusBadRequest)
+		return
+	}
+
+	// A key can only be in the partition its app sent it to. Apps the API
+	// server does not know may partition keys their own way, so all their
+	// partitions are searched.
+	partitions := make([]int, 0, job.NReduce)
+	if p, ok := appkeys.Partition(job.App, key, job.NReduce); hasKey && ok {
+		partitions = append(partitions, p)
+	} else {
+		for i := 0; i < job.NReduce; i++ {
+			partitions = append(partitions, i)
+		}
+	}
+	readers := make([]outputs.Reader, 0, len(partitions))
+	for _, i := range partitions {
+		f, err := storage.Open(s.outputPath(job, i))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Output partition %d unavailable", i), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		readers = append(readers, outputs.NewReader(f, job.Output))
+	}
+
+	var next func() (OutputRecord, bool, error)
+	if sorted {
+		// Partitions are merged in the order reducers sorted them in, e.g.
+		// numerically for an app with int64 keys. Apps the API server does
+		// not know are taken to sort their keys as strings.
+		next = mergeSorted(readers, appkeys.Compare(job.App))
+	} else {
+		next = concat(readers)
+	}
+
+	// Errors past this point can no longer change the status code. A
+	// partition that cannot be read aborts the response instead, so the
+	// client sees a broken stream rather than a complete but short one.
+	enc.begin()
+	skipped, written := 0, 0
+	for limit == 0 || written < limit {
+		rec, ok, err := next()
+		if err != nil {
+			slog.Error("Failed to read job output", logging.KeyJobID, job.ID, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		if !ok {
+			break
+		}
+		if hasKey && rec.Key != key {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if err := enc.encode(rec); err != nil {
+			return
+		}
+		written++
+	}
+	enc.end()
+}
+
+func (s *Server) handleJobPartitions(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.completedJob(w, r)
+	if !ok {
+		return
+	}
+
+	resp := PartitionsResponse{JobID: job.ID, Partitions: []PartitionInfo{}}
+	for i := 0; i < job.NReduce; i++ {
+		info, err := storage.Stat(s.outputPath(job, i))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Output partition %d unavailable", i), http.StatusInternalServerError)
+			return
+		}
+		p := PartitionInfo{
+			Partition: i,
+			File:      job.Output.FileName(job.ID, i),
+			Size:      info.Size,
+		}
+		if out := job.ReduceTasks[i].Output; out != nil {
+			p.Records, p.CRC32 = &out.Records, &out.CRC32
+		}
+		resp.Partitions = append(resp.Partitions, p)
+		resp.TotalSize += info.Size
+	}
+
+	writeJSON(w, resp)
+}
+
+// completedJob resolves the job named in the request path and makes sure its
+// output is ready to be read.
+func (s *Server) completedJob(w http.ResponseWriter, r *http.Request) (coordinator.Job, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Job ID", http.StatusBadRequest)
+		return coordinator.Job{}, false
+	}
+	job, ok := s.snapshot(r, id)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return coordinator.Job{}, false
+	}
+	if job.Status != coordinator.StatusCompleted {
+		http.Error(w, "Job has not completed", http.StatusConflict)
+		return coordinator.Job{}, false
+	}
+	return job, true
+}
+
+func (s *Server) outputPath(job coordinator.Job, partition int) string {
+	return job.Output.Path(s.OutputDir, job.ID, partition)
+}
+
+func intParam(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value %q", v)
+	}
+	return n, nil
+}
+
+// read returns the next record of r, or false at the end of the file.
+func read(r outputs.Reader) (OutputRecord, bool, error) {
+	key, value, err := r.Read()
+	if err == io.EOF {
+		return OutputRecord{}, false, nil
+	}
+	if err != nil {
+		return OutputRecord{}, false, err
+	}
+	return OutputRecord{Key: key, Value: value}, true, nil
+}
+
+// concat yields the records of each partition in partition order.
+func concat(readers []outputs.Reader) func() (OutputRecord, bool, error) {
+	i := 0
+	return func() (OutputRecord, bool, error) {
+		for i < len(readers) {
+			rec, ok, err := read(readers[i])
+			if ok || err != nil {
+				return rec, ok, err
+			}
+			i++
+		}
+		return OutputRecord{}, false, nil
+	}
+}
+
+// mergeSorted yields the records of all partitions ordered by key with
+// compare. Each reducer already writes its partition in that order, so a
+// k-way merge keeps memory use proportional to the number of partitions.
+func mergeSorted(readers []outputs.Reader, compare func(a, b string) int) func() (OutputRecord, bool, error) {
+	h := &recordHeap{compare: compare}
+	var initErr error
+	for _, r := range readers {
+		rec, ok, err := read(r)
+		if ok {
+			heap.Push(h, heapItem{rec: rec, r: r})
+		} else if err != nil {
+			initErr = err
+		}
+	}
+	return func() (OutputRecord, bool, error) {
+		if initErr != nil {
+			return OutputRecord{}, false, initErr
+		}
+		if h.Len() == 0 {
+			return OutputRecord{}, false, nil
+		}
+		top := h.items[0]
+		rec, ok, err := read(top.r)
+		if err != nil {
+			return OutputRecord{}, false, err
+		}
+		if ok {
+			h.items[0].rec = rec
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		return top.rec, true, nil
+	}
+}
+
+type heapItem struct {
+	rec OutputRecord
+	r   outputs.Reader
+}
+
+type recordHeap struct {
+	items   []heapItem
+	compare func(a, b string) int
+}
+
+func (h *recordHeap) Len() int { return len(h.items) }
+func (h *recordHeap) Less(i, j int) bool {
+	return h.compare(h.items[i].rec.Key, h.items[j].rec.Key) < 0
+}
+func (h *recordHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *recordHeap) Push(x any)    { h.items = append(h.items, x.(heapItem)) }
+func (h *recordHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// recordEncoder streams output records in one of the supported formats.
+type recordEncoder interface {
+	begin()
+	encode(OutputRecord) error
+	end()
+}
+
+func newRecordEncoder(format string, w http.ResponseWriter) (recordEncoder, bool) {
+	switch format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return &textEncoder{w: w}, true
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		return &csvEncoder{w: csv.NewWriter(w)}, true
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		return &jsonEncoder{w: w}, true
+	}
+	return nil, false
+}
+
+type textEncoder struct{ w io.Writer }
+
+func (e *textEncoder) begin() {}
+func (e *textEncoder) end()   {}
+func (e *textEncoder) encode(rec OutputRecord) error {
+	_, err := fmt.Fprintf(e.w, "%s %s\n", rec.Key, rec.Value)
+	return err
+}
+
+type csvEncoder struct{ w *csv.Writer }
+
+func (e *csvEncoder) begin() {
+	_ = e.w.Write([]string{"key", "value"})
+}
+
+func (e *csvEncoder) encode(rec OutputRecord) error {
+	return e.w.Write([]string{rec.Key, rec.Value})
+}
+
+func (e *csvEncoder) end() { e.w.Flush() }
+
+// jsonEncoder writes a JSON array one element at a time so large outputs are
+// never buffered in full.
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonEncoder) begin() { _, _ = io.WriteString(e.w, "[") }
+func (e *jsonEncoder) end()   { _, _ = io.WriteString(e.w, "]\n") }
+func (e *jsonEncoder) encode(rec OutputRecord) error {
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
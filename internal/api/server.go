@@ -1,53 +1,312 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
 	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/inputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/worker"
 )
 
 type Server struct {
 	coordinator *coordinator.Coordinator
+
+	// OutputDir is the directory reducers write their mr-out files to, as
+	// seen from the coordinator (usually a shared volume). Jobs with a
+	// relative output directory write below it.
+	OutputDir string
+
+	// Auth, if set, authenticates every request but health checks and
+	// metrics scrapes as a Tenant, which then only sees its own jobs.
+	Auth Authenticator
+
+	mu       sync.Mutex
+	http     *http.Server // Set by Start
+	shutdown bool
 }
 
 func NewServer(c *coordinator.Coordinator) *Server {
-	return &Server{coordinator: c}
+	return &Server{coordinator: c, OutputDir: "."}
 }
 
-func (s *Server) Start(port string) error {
+// Handler returns the HTTP handler serving the REST API.
+func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/jobs", s.handleJobs)
 	mux.HandleFunc("/jobs/", s.handleJobStatus)
-	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("GET /jobs/{id}/output", s.handleJobOutput)
+	mux.HandleFunc("GET /jobs/{id}/output/partitions", s.handleJobPartitions)
+	mux.HandleFunc("GET /jobs/{id}/inputs", s.handleJobInputs)
+	mux.HandleFunc("GET /jobs/{id}/tasks/{type}/{task}/logs", s.handleTaskLogs)
+	mux.HandleFunc("POST /jobs/{id}/cancel", s.handleCancelJob)
+	mux.HandleFunc("DELETE /jobs/{id}/data", s.handleDeleteJobData)
+	mux.HandleFunc("POST /workflows", s.handleSubmitWorkflow)
+	mux.HandleFunc("GET /workflows", s.handleListWorkflows)
+	mux.HandleFunc("GET /workflows/{id}", s.handleWorkflowStatus)
+	mux.HandleFunc("POST /workflows/{id}/cancel", s.handleCancelWorkflow)
+	mux.HandleFunc("GET /workers", s.handleWorkers)
+
+	// Probes and scrapers do not authenticate, and reach standby replicas
+	// too.
+	outer := http.NewServeMux()
+	outer.HandleFunc("/health", s.handleHealth)
+	outer.Handle("GET /metrics", s.coordinator.Metrics())
+	var api http.Handler = mux
+	if s.Auth != nil {
+		api = s.authenticate(mux)
+	}
+	outer.Handle("/", s.followLeader(api))
+	return outer
+}
+
+// HeaderLeader carries the API address of the leading coordinator replica
+// in answers from a standby.
+const HeaderLeader = "X-MR-Leader"
+
+// followLeader answers requests to a standby coordinator replica with 503
+// Service Unavailable, naming the leader in HeaderLeader once one is
+// elected.
+func (s *Server) followLeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.coordinator.IsLeader() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		notLeader(w, s.coordinator)
+	})
+}
+
+// shuttingDown answers a submission to a draining coordinator.
+func shuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Shutting down, not accepting jobs", http.StatusServiceUnavailable)
+}
+
+// notLeader writes the answer of a standby replica.
+func notLeader(w http.ResponseWriter, c *coordinator.Coordinator) {
+	msg := "Not the leader; no leader elected yet"
+	if lease, ok := c.Leader(); ok && lease.APIAddr != "" {
+		w.Header().Set(HeaderLeader, lease.APIAddr)
+		msg = "Not the leader; the leader is at " + lease.APIAddr
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
 
+// Start serves the API on port until Shutdown, after which it returns
+// http.ErrServerClosed.
+func (s *Server) Start(port string) error {
 	// We need to run this on a different port than RPC (which is on 1234)
 	// Let's use 8080 for REST API
-	fmt.Printf("Starting REST API on port %s\n", port)
-	return http.ListenAndServe(":"+port, mux)
+	slog.Info("Starting REST API", "port", port)
+	hs := &http.Server{Addr: ":" + port, Handler: s.Handler()}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	s.http = hs
+	s.mu.Unlock()
+	return hs.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits for requests in flight to
+// finish, or for ctx to end. Call Coordinator.Drain first so long polls
+// return and new jobs are turned away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	hs := s.http
+	s.shutdown = true
+	s.mu.Unlock()
+	if hs == nil {
+		return nil
+	}
+	return hs.Shutdown(ctx)
 }
 
 type SubmitJobRequest struct {
+	// Files are input files, directories or glob patterns, resolved on the
+	// coordinator when the job is submitted.
 	Files   []string `json:"files"`
 	NReduce int      `json:"nReduce"`
+	App     string   `json:"app,omitempty"`
+
+	// Manifests are files listing further inputs, one per line.
+	Manifests []string `json:"manifests,omitempty"`
+	// Recursive makes directories contribute every file below them.
+	Recursive bool `json:"recursive,omitempty"`
+	// Include and Exclude filter files found in directories and globs by
+	// base name, e.g. "*.txt".
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Labels restricts the job to workers registered with all of them.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// PreferredHosts maps input files to the hosts that hold their data.
+	PreferredHosts map[string][]string `json:"preferred_hosts,omitempty"`
+
+	// Output sets the output directory, file prefix and format, and asks
+	// for a _SUCCESS marker and manifest.
+	Output *outputs.Spec `json:"output,omitempty"`
+
+	// Datasets are tagged inputs, resolved like Files. Map tasks are told
+	// the tag of the file they read, e.g. to join users with events.
+	Datasets []common.Dataset `json:"datasets,omitempty"`
+	// SideInputs are small tables every map task reads in full, e.g. for
+	// a broadcast join.
+	SideInputs []common.Dataset `json:"side_inputs,omitempty"`
+	// Params configure the app, e.g. the join key column.
+	Params map[string]string `json:"params,omitempty"`
+
+	// Queue and User select the limits on running jobs that apply; jobs
+	// over them wait as QUEUED.
+	Queue string `json:"queue,omitempty"`
+	User  string `json:"user,omitempty"`
 }
 
 type SubmitJobResponse struct {
-	JobID int `json:"id"`
+	JobID         int    `json:"id"`
+	Status        string `json:"status,omitempty"`         // QUEUED if the job waits for admission
+	QueuePosition int    `json:"queue_position,omitempty"` // Its place in its queue, counting from 1
 }
 
 type JobStatusResponse struct {
-	ID         int    `json:"id"`
-	Status     string `json:"status"`
-	Files      int    `json:"files_count"`
-	MapDone    int    `json:"map_tasks_completed"`
-	ReduceDone int    `json:"reduce_tasks_completed"`
+	ID          int               `json:"id"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	App         string            `json:"app"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Files       int               `json:"files_count"`
+	NReduce     int               `json:"reduce_tasks_total"`
+	MapDone     int               `json:"map_tasks_completed"`
+	ReduceDone  int               `json:"reduce_tasks_completed"`
+	Counters    map[string]int64  `json:"counters"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Locality    LocalityResponse  `json:"locality"`
+	Output      *outputs.Spec     `json:"output,omitempty"`
+	Datasets    []string          `json:"datasets,omitempty"` // Tags of the job's tagged inputs
+	Params      map[string]string `json:"params,omitempty"`
+	Queue       string            `json:"queue,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Version     int64             `json:"version"`
+
+	// QueuePosition is the job's place among the jobs waiting in its
+	// queue while it is QUEUED, and AdmittedAt when it started running.
+	QueuePosition int        `json:"queue_position,omitempty"`
+	AdmittedAt    *time.Time `json:"admitted_at,omitempty"`
+
+	// IntermediateDeleted reports that the job's intermediate files are
+	// gone, deleted by the retention policy or DELETE /jobs/{id}/data.
+	IntermediateDeleted bool `json:"intermediate_deleted,omitempty"`
+}
+
+// LocalityResponse counts map task assignments by where they ran relative to
+// their input. HitRate is the fraction of tasks with preferred hosts that
+// ran on one of them.
+type LocalityResponse struct {
+	Local        int     `json:"local"`
+	Remote       int     `json:"remote"`
+	NoPreference int     `json:"no_preference"`
+	HitRate      float64 `json:"hit_rate"`
+}
+
+type WorkerResponse struct {
+	ID           string            `json:"id"`
+	Hostname     string            `json:"hostname,omitempty"`
+	LastSeen     time.Time         `json:"last_seen"`
+	RegisteredAt *time.Time        `json:"registered_at,omitempty"`
+	Live         bool              `json:"live"`
+	Slots        int               `json:"slots"`
+	RunningTasks int               `json:"running_tasks"`
+	MemoryBytes  int64             `json:"memory_bytes,omitempty"`
+	Apps         []string          `json:"apps,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+func newJobStatus(job coordinator.Job) JobStatusResponse {
+	// Calculate progress
+	mapDone := 0
+	for _, t := range job.MapTasks {
+		if t.Status == common.TaskStatusCompleted {
+			mapDone++
+		}
+	}
+	reduceDone := 0
+	for _, t := range job.ReduceTasks {
+		if t.Status == common.TaskStatusCompleted {
+			reduceDone++
+		}
+	}
+
+	var finished, admitted *time.Time
+	if !job.FinishedAt.IsZero() {
+		finished = &job.FinishedAt
+	}
+	if !job.AdmittedAt.IsZero() {
+		admitted = &job.AdmittedAt
+	}
+
+	return JobStatusResponse{
+		ID:          job.ID,
+		Status:      job.Status,
+		Error:       job.Error,
+		App:         job.App,
+		SubmittedAt: job.StartTime,
+		FinishedAt:  finished,
+		Files:       len(job.Files),
+		NReduce:     job.NReduce,
+		MapDone:     mapDone,
+		ReduceDone:  reduceDone,
+		Counters:    job.Counters,
+		Labels:      job.Labels,
+		Locality: LocalityResponse{
+			Local:        job.Locality.Local,
+			Remote:       job.Locality.Remote,
+			NoPreference: job.Locality.NoPreference,
+			HitRate:      job.Locality.HitRate(),
+		},
+		Output:   job.Output,
+		Datasets: datasetTags(job.Datasets),
+		Params:   job.Params,
+		Queue:    job.Queue,
+		User:     job.User,
+		Tenant:   job.Tenant,
+		Version:  job.Version,
+
+		QueuePosition: job.QueuePosition,
+		AdmittedAt:    admitted,
+
+		IntermediateDeleted: job.IntermediateDeleted,
+	}
+}
+
+func datasetTags(datasets []common.Dataset) []string {
+	var tags []string
+	for _, ds := range datasets {
+		tags = append(tags, ds.Tag)
+	}
+	return tags
 }
 
 func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.handleListJobs(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -59,19 +318,141 @@ func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Files) == 0 || req.NReduce <= 0 {
-		http.Error(w, "Invalid parameters", http.StatusBadRequest)
+	if err := s.authorize(r, req); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	spec, err := jobSpec(req, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authorizeInputs(r, &spec); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	jobID, err := s.coordinator.TrySubmit(spec)
+	var limitErr *coordinator.LimitError
+	var notLeaderErr *common.NotLeaderError
+	switch {
+	case errors.As(err, &notLeaderErr):
+		notLeader(w, s.coordinator) // Lost the lease since followLeader checked
+		return
+	case errors.Is(err, coordinator.ErrDraining):
+		shuttingDown(w)
+		return
+	case errors.As(err, &limitErr):
+		http.Error(w, "Job exceeds limits: "+err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, coordinator.ErrQueueFull):
+		http.Error(w, "Too many jobs queued, try again later", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	jobID := s.coordinator.SubmitJob(req.Files, req.NReduce)
-
+	resp := SubmitJobResponse{JobID: jobID}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(SubmitJobResponse{JobID: jobID}); err != nil {
+	if job, ok := s.coordinator.Snapshot(jobID); ok && job.Status == coordinator.StatusQueued {
+		// Accepted, but not started yet
+		resp.Status, resp.QueuePosition = job.Status, job.QueuePosition
+		w.WriteHeader(http.StatusAccepted)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
+// jobSpec validates a job request and resolves its inputs. A stage of a
+// workflow that reads earlier stages' output may have no inputs of its own.
+func jobSpec(req SubmitJobRequest, upstream bool) (coordinator.JobSpec, error) {
+	if len(req.Files)+len(req.Manifests)+len(req.Datasets) == 0 && !upstream || req.NReduce <= 0 {
+		return coordinator.JobSpec{}, errors.New("Invalid parameters")
+	}
+
+	app, ok := worker.LookupApp(req.App)
+	if !ok {
+		return coordinator.JobSpec{}, fmt.Errorf("Unknown app %q", req.App)
+	}
+	if app.CheckParams != nil {
+		if err := app.CheckParams(req.Params); err != nil {
+			return coordinator.JobSpec{}, errors.New("Invalid params: " + err.Error())
+		}
+	}
+
+	if err := req.Output.Validate(); err != nil {
+		return coordinator.JobSpec{}, errors.New("Invalid output: " + err.Error())
+	}
+
+	spec := coordinator.JobSpec{
+		NReduce:        req.NReduce,
+		App:            req.App,
+		Labels:         req.Labels,
+		PreferredHosts: req.PreferredHosts,
+		Output:         req.Output,
+		Params:         req.Params,
+		Queue:          req.Queue,
+		User:           req.User,
+	}
+	resolve := func(paths []string) ([]inputs.File, error) {
+		return inputs.Resolve(inputs.Spec{Paths: paths, Recursive: req.Recursive, Include: req.Include, Exclude: req.Exclude})
+	}
+	var err error
+	if spec.Datasets, err = resolveDatasets(req.Datasets, resolve, &spec.Inputs); err != nil {
+		return coordinator.JobSpec{}, errors.New("Invalid datasets: " + err.Error())
+	}
+	if spec.SideInputs, err = resolveDatasets(req.SideInputs, resolve, nil); err != nil {
+		return coordinator.JobSpec{}, errors.New("Invalid side inputs: " + err.Error())
+	}
+	if len(req.Files)+len(req.Manifests) == 0 {
+		return spec, nil
+	}
+	inputSpec := inputs.Spec{
+		Paths:     req.Files,
+		Manifests: req.Manifests,
+		Recursive: req.Recursive,
+		Include:   req.Include,
+		Exclude:   req.Exclude,
+	}
+	files, err := inputs.Resolve(inputSpec)
+	if err != nil {
+		return coordinator.JobSpec{}, errors.New("Invalid inputs: " + err.Error())
+	}
+	spec.Files = inputs.Paths(files)
+	spec.InputSpec = &inputSpec
+	spec.Inputs = append(files, spec.Inputs...) // Dataset files are read after Files
+	return spec, nil
+}
+
+// resolveDatasets checks that datasets have distinct tags and resolves their
+// paths, appending the files found to record if it is not nil.
+func resolveDatasets(datasets []common.Dataset, resolve func([]string) ([]inputs.File, error), record *[]inputs.File) ([]common.Dataset, error) {
+	var resolved []common.Dataset
+	seen := make(map[string]bool)
+	for _, ds := range datasets {
+		if ds.Tag == "" {
+			return nil, errors.New("a dataset needs a tag")
+		}
+		if seen[ds.Tag] {
+			return nil, fmt.Errorf("duplicate tag %q", ds.Tag)
+		}
+		seen[ds.Tag] = true
+		files, err := resolve(ds.Files)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ds.Tag, err)
+		}
+		for i := range files {
+			files[i].Tag = ds.Tag
+		}
+		if record != nil {
+			*record = append(*record, files...)
+		}
+		resolved = append(resolved, common.Dataset{Tag: ds.Tag, Files: inputs.Paths(files)})
+	}
+	return resolved, nil
+}
+
 func (s *Server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -92,36 +473,218 @@ func (s *Server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, ok := s.coordinator.GetJobStatus(id)
+	// Long poll: ?wait=30s&version=N holds the request until the job's
+	// version differs from N, the job stops running, or the wait expires.
+	if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+		wait, err := time.ParseDuration(waitParam)
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.snapshot(r, id); !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxLongPoll))
+		defer cancel()
+		job, err := s.coordinator.WaitJob(ctx, id, version)
+		if errors.Is(err, coordinator.ErrJobNotFound) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, newJobStatus(job))
+		return
+	}
+
+	job, ok := s.snapshot(r, id)
 	if !ok {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
 
-	// Calculate progress
-	mapDone := 0
-	for _, t := range job.MapTasks {
-		if t.Status == 2 { // TaskStatusCompleted
-			mapDone++
+	writeJSON(w, newJobStatus(job))
+}
+
+// maxLongPoll caps how long a status request may wait for a change.
+const maxLongPoll = time.Minute
+
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := s.coordinator.Jobs()
+	resp := make([]JobStatusResponse, 0, len(jobs))
+	for _, job := range jobs {
+		if canSee(r, job.Tenant) {
+			resp = append(resp, newJobStatus(job))
 		}
 	}
-	reduceDone := 0
-	for _, t := range job.ReduceTasks {
-		if t.Status == 2 { // TaskStatusCompleted
-			reduceDone++
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Job ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := s.snapshot(r, id); !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	switch err := s.coordinator.Cancel(id); {
+	case errors.Is(err, coordinator.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, coordinator.ErrJobNotRunning):
+		http.Error(w, "Job is not running", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	job, _ := s.coordinator.Snapshot(id)
+	writeJSON(w, newJobStatus(job))
+}
+
+// handleDeleteJobData deletes a finished job's intermediate files without
+// waiting for the retention policy.
+func (s *Server) handleDeleteJobData(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Job ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := s.snapshot(r, id); !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	switch err := s.coordinator.DeleteJobData(id); {
+	case errors.Is(err, coordinator.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, coordinator.ErrJobRunning):
+		http.Error(w, "Job is still running", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	job, _ := s.coordinator.Snapshot(id)
+	writeJSON(w, newJobStatus(job))
+}
+
+// InputsResponse lists the files a job reads, as resolved at submit time,
+// and the request they were resolved from.
+type InputsResponse struct {
+	JobID      int              `json:"job_id"`
+	Spec       *inputs.Spec     `json:"spec,omitempty"`
+	Files      []inputs.File    `json:"files"`
+	SideInputs []common.Dataset `json:"side_inputs,omitempty"`
+}
+
+func (s *Server) handleJobInputs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Job ID", http.StatusBadRequest)
+		return
+	}
+	job, ok := s.snapshot(r, id)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	resp := InputsResponse{JobID: job.ID, Spec: job.InputSpec, Files: job.Inputs, SideInputs: job.SideInputs}
+	if resp.Files == nil {
+		// Submitted without resolution, e.g. from the coordinator's command
+		// line in older versions: only the paths are known.
+		for _, f := range job.Files {
+			resp.Files = append(resp.Files, inputs.File{Path: f})
 		}
 	}
+	writeJSON(w, resp)
+}
 
-	resp := JobStatusResponse{
-		ID:         job.ID,
-		Status:     job.Status,
-		Files:      len(job.Files),
-		MapDone:    mapDone,
-		ReduceDone: reduceDone,
+// handleWorkers lists the workers. Their hostnames, labels and machines are
+// the cluster's, not any tenant's, so only admins may see them.
+func (s *Server) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Forbidden: only admins may list workers", http.StatusForbidden)
+		return
+	}
+	workers := s.coordinator.Workers()
+	resp := make([]WorkerResponse, 0, len(workers))
+	for _, wk := range workers {
+		wr := WorkerResponse{
+			ID:           wk.ID,
+			Hostname:     wk.Hostname,
+			LastSeen:     wk.LastSeen,
+			Live:         wk.Live,
+			Slots:        wk.Slots,
+			RunningTasks: wk.RunningTasks,
+			MemoryBytes:  wk.MemoryBytes,
+			Apps:         wk.Apps,
+			Labels:       wk.Labels,
+		}
+		if !wk.RegisteredAt.IsZero() {
+			wr.RegisteredAt = &wk.RegisteredAt
+		}
+		resp = append(resp, wr)
 	}
+	writeJSON(w, resp)
+}
 
+// handleTaskLogs returns the log uploaded by a task attempt. Without an
+// attempt query parameter the most recent attempt is returned.
+func (s *Server) handleTaskLogs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Job ID", http.StatusBadRequest)
+		return
+	}
+	taskType, err := common.ParseTaskType(r.PathValue("type"))
+	if err != nil {
+		http.Error(w, "Task type must be map or reduce", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(r.PathValue("task"))
+	if err != nil {
+		http.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+	attempt := -1
+	if v := r.URL.Query().Get("attempt"); v != "" {
+		if attempt, err = intParam(v); err != nil {
+			http.Error(w, "Invalid attempt", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, ok := s.snapshot(r, id); !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	logs, ok := s.coordinator.TaskLogs(id, taskType, taskID, attempt)
+	if !ok {
+		http.Error(w, "No logs for task", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, logs); err != nil {
+		slog.Warn("Failed to write response", "error", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -130,6 +693,6 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	// w.Write value check
 	if _, err := w.Write([]byte("OK")); err != nil {
-		log.Printf("Failed to write response: %v", err)
+		slog.Warn("Failed to write response", "error", err)
 	}
 }
@@ -0,0 +1,1045 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+)
+
+// newCompletedJob submits a job, marks it completed and writes the given
+// partition contents into a temporary output directory.
+func newCompletedJob(t *testing.T, partitions []string) (*Server, int) {
+	t.Helper()
+	c := coordinator.NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, len(partitions))
+	job, _ := c.GetJobStatus(jobID)
+	job.MapTasks[0].Status = common.TaskStatusCompleted
+	for i := range job.ReduceTasks {
+		job.ReduceTasks[i].Status = common.TaskStatusCompleted
+	}
+	job.Status = "COMPLETED"
+
+	dir := t.TempDir()
+	for i, content := range partitions {
+		if err := os.WriteFile(filepath.Join(dir, common.OutputName(jobID, i)), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewServer(c)
+	s.OutputDir = dir
+	return s, jobID
+}
+
+// newCompletedJobWithOutput is like newCompletedJob for a job that writes
+// its output as spec describes. Each partition lists its records.
+func newCompletedJobWithOutput(t *testing.T, spec *outputs.Spec, partitions [][]OutputRecord) (*Server, int) {
+	t.Helper()
+	c := coordinator.NewCoordinator()
+	jobID := c.Submit(coordinator.JobSpec{Files: []string{"f1"}, NReduce: len(partitions), Output: spec})
+	job, _ := c.GetJobStatus(jobID)
+	job.MapTasks[0].Status = common.TaskStatusCompleted
+	job.Status = "COMPLETED"
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(spec.DirPath(dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i, recs := range partitions {
+		var buf bytes.Buffer
+		w := outputs.NewWriter(&buf, spec)
+		for _, rec := range recs {
+			w.Write(rec.Key, rec.Value)
+		}
+		w.Flush()
+		if err := os.WriteFile(spec.Path(dir, jobID, i), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		job.ReduceTasks[i].Status = common.TaskStatusCompleted
+		job.ReduceTasks[i].Output = &outputs.Partition{Partition: i, File: spec.FileName(jobID, i), Records: int64(len(recs)), Bytes: int64(buf.Len())}
+	}
+
+	s := NewServer(c)
+	s.OutputDir = dir
+	return s, jobID
+}
+
+func get(t *testing.T, s *Server, url string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestJobOutput_Text(t *testing.T) {
+	s, _ := newCompletedJob(t, []string{"b 2\nd 4\n", "a 1\nc 3\n"})
+
+	code, body := get(t, s, "/jobs/0/output")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	if body != "b 2\nd 4\na 1\nc 3\n" {
+		t.Errorf("Unexpected unsorted output %q", body)
+	}
+
+	_, body = get(t, s, "/jobs/0/output?sort=true")
+	if body != "a 1\nb 2\nc 3\nd 4\n" {
+		t.Errorf("Unexpected sorted output %q", body)
+	}
+}
+
+func TestJobOutput_SortedTypedKeys(t *testing.T) {
+	// word-lengths has int64 keys, so each reducer sorts them numerically.
+	s, id := newCompletedJob(t, []string{"2 5\n10 1\n", "3 4\n"})
+	job, _ := s.coordinator.GetJobStatus(id)
+	job.App = "word-lengths"
+
+	_, body := get(t, s, "/jobs/0/output?sort=true")
+	if body != "2 5\n3 4\n10 1\n" {
+		t.Errorf("Expected keys in numeric order, got %q", body)
+	}
+}
+
+func TestJobOutput_Pagination(t *testing.T) {
+	s, _ := newCompletedJob(t, []string{"b 2\nd 4\n", "a 1\nc 3\n"})
+
+	_, body := get(t, s, "/jobs/0/output?sort=true&offset=1&limit=2")
+	if body != "b 2\nc 3\n" {
+		t.Errorf("Unexpected page %q", body)
+	}
+
+	code, _ := get(t, s, "/jobs/0/output?limit=-1")
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for negative limit, got %d", code)
+	}
+}
+
+func TestJobOutput_KeyLookupJSON(t *testing.T) {
+	// Keys are in the partitions the default app sends them to.
+	s, id := newCompletedJob(t, []string{"a 1\nc 3\n", "b 2\nd 4\n"})
+
+	// Only the key's partition is read, so the others need not exist.
+	if err := os.Remove(filepath.Join(s.OutputDir, common.OutputName(id, 1))); err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(t, s, "/jobs/0/output?key=c&format=json")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	var recs []OutputRecord
+	if err := json.Unmarshal([]byte(body), &recs); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", body, err)
+	}
+	if len(recs) != 1 || recs[0] != (OutputRecord{Key: "c", Value: "3"}) {
+		t.Errorf("Unexpected records %v", recs)
+	}
+	if code, _ := get(t, s, "/jobs/0/output?key=b"); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a key in the missing partition, got %d", code)
+	}
+}
+
+func TestJobOutput_KeyLookupUnknownApp(t *testing.T) {
+	// An app the server does not know may partition keys any way it likes.
+	s, id := newCompletedJob(t, []string{"b 2\nd 4\n", "a 1\nc 3\n"})
+	job, _ := s.coordinator.GetJobStatus(id)
+	job.App = "unknown-app"
+
+	_, body := get(t, s, "/jobs/0/output?key=c")
+	if body != "c 3\n" {
+		t.Errorf("Expected every partition to be searched, got %q", body)
+	}
+}
+
+func TestJobOutput_CSV(t *testing.T) {
+	s, _ := newCompletedJob(t, []string{"a 1\n"})
+
+	_, body := get(t, s, "/jobs/0/output?format=csv")
+	if body != "key,value\na,1\n" {
+		t.Errorf("Unexpected CSV %q", body)
+	}
+
+	code, _ := get(t, s, "/jobs/0/output?format=xml")
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown format, got %d", code)
+	}
+}
+
+func TestJobOutput_Formats(t *testing.T) {
+	partitions := [][]OutputRecord{
+		{{Key: "b", Value: "2"}, {Key: "d", Value: "4\tfour"}},
+		{{Key: "a", Value: "1"}, {Key: "c", Value: "3"}},
+	}
+	for _, spec := range []*outputs.Spec{
+		{Dir: "out", Prefix: "part", Format: outputs.FormatTSV},
+		{Format: outputs.FormatCSV},
+		{Format: outputs.FormatJSONL},
+		{Format: outputs.FormatSequence},
+		{Format: outputs.FormatText, Separator: "|"},
+	} {
+		s, _ := newCompletedJobWithOutput(t, spec, partitions)
+		code, body := get(t, s, "/jobs/0/output?sort=true&format=csv")
+		if code != http.StatusOK || body != "key,value\na,1\nb,2\nc,3\nd,4\tfour\n" {
+			t.Errorf("Unexpected %s output %d %q", spec.Format, code, body)
+		}
+	}
+
+	s, _ := newCompletedJobWithOutput(t, &outputs.Spec{Dir: "out", Prefix: "part", Format: outputs.FormatJSONL}, partitions)
+	_, body := get(t, s, "/jobs/0/output/partitions")
+	var resp PartitionsResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if p := resp.Partitions[1]; p.File != "part-1.jsonl" || p.Records == nil || *p.Records != 2 {
+		t.Errorf("Unexpected partition entry %+v", p)
+	}
+}
+
+func TestJobOutput_CorruptPartition(t *testing.T) {
+	spec := &outputs.Spec{Format: outputs.FormatJSONL}
+	s, id := newCompletedJobWithOutput(t, spec, [][]OutputRecord{{{Key: "a", Value: "1"}}})
+	f, err := os.OpenFile(spec.Path(s.OutputDir, id, 0), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{not json\n")
+	f.Close()
+
+	// The response is cut off rather than ended as if the output were
+	// complete.
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/jobs/0/output?format=json")
+	if err == nil {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err == nil {
+			t.Errorf("Expected the response to be aborted, got %q", body)
+		}
+	}
+}
+
+func TestJobOutput_NotCompleted(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	c.SubmitJob([]string{"f1"}, 1)
+	s := NewServer(c)
+
+	code, _ := get(t, s, "/jobs/0/output")
+	if code != http.StatusConflict {
+		t.Errorf("Expected 409 for running job, got %d", code)
+	}
+	code, _ = get(t, s, "/jobs/7/output")
+	if code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", code)
+	}
+}
+
+func TestJobPartitions(t *testing.T) {
+	s, jobID := newCompletedJob(t, []string{"b 2\nd 4\n", "a 1\n"})
+
+	code, body := get(t, s, "/jobs/0/output/partitions")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	var resp PartitionsResponse
+	if err := json.NewDecoder(strings.NewReader(body)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Partitions) != 2 || resp.TotalSize != 12 {
+		t.Fatalf("Unexpected partitions %+v", resp)
+	}
+	if resp.Partitions[1].File != common.OutputName(jobID, 1) || resp.Partitions[1].Size != 4 {
+		t.Errorf("Unexpected partition entry %+v", resp.Partitions[1])
+	}
+}
+
+func TestSubmitJob_App(t *testing.T) {
+	s := NewServer(coordinator.NewCoordinator())
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("f1", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := post(`{"files":["f1"],"nReduce":1,"app":"nope"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown app, got %d", code)
+	}
+	if code := post(`{"files":["f1"],"nReduce":1,"app":"wordcount-mq","labels":{"zone":"a"}}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	_, body := get(t, s, "/jobs/0")
+	var status JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.App != "wordcount-mq" || status.Counters == nil || status.Labels["zone"] != "a" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	if code := post(`{"files":["f1"],"nReduce":1,"output":{"format":"parquet"}}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown output format, got %d", code)
+	}
+	if code := post(`{"files":["f1"],"nReduce":1,"output":{"dir":"out","format":"csv","success_marker":true}}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	_, body = get(t, s, "/jobs/1")
+	status = JobStatusResponse{}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Output == nil || status.Output.Format != "csv" || !status.Output.SuccessMarker {
+		t.Errorf("Expected the output spec in the status, got %+v", status.Output)
+	}
+}
+
+func TestTaskLogs(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, 1)
+	reply := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	err := c.ReportTask(&common.ReportTaskArgs{
+		JobID:    jobID,
+		TaskType: common.TaskTypeMap,
+		WorkerID: "w1",
+		Logs:     "level=INFO msg=\"Starting map task\"\n",
+	}, &common.ReportTaskReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+
+	code, body := get(t, s, "/jobs/0/tasks/map/0/logs")
+	if code != http.StatusOK || !strings.Contains(body, "Starting map task") {
+		t.Errorf("Unexpected logs response %d %q", code, body)
+	}
+	if code, _ := get(t, s, "/jobs/0/tasks/map/0/logs?attempt=3"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing attempt, got %d", code)
+	}
+	if code, _ := get(t, s, "/jobs/0/tasks/shuffle/0/logs"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad task type, got %d", code)
+	}
+}
+
+func TestListAndCancelJobs(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	c.SubmitJob([]string{"f1"}, 1)
+	c.SubmitJob([]string{"f2", "f3"}, 2)
+	s := NewServer(c)
+
+	_, body := get(t, s, "/jobs")
+	var jobs []JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != 0 || jobs[1].ID != 1 || jobs[1].Files != 2 {
+		t.Fatalf("Unexpected job list %+v", jobs)
+	}
+
+	post := func(url string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, url, nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := post("/jobs/1/cancel")
+	if code != http.StatusOK || !strings.Contains(body, coordinator.StatusCancelled) {
+		t.Errorf("Expected cancelled job, got %d %s", code, body)
+	}
+	if code, _ := post("/jobs/1/cancel"); code != http.StatusConflict {
+		t.Errorf("Expected 409 cancelling a cancelled job, got %d", code)
+	}
+	if code, _ := post("/jobs/9/cancel"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", code)
+	}
+}
+
+func TestDeleteJobData(t *testing.T) {
+	dir := t.TempDir()
+	c := coordinator.NewCoordinator()
+	c.SetOutputDir(dir)
+	c.SetRetention(coordinator.RetentionPolicy{Intermediate: -1})
+	finished := c.SubmitJob([]string{"f1"}, 1)
+	running := c.SubmitJob([]string{"f2"}, 1)
+	file := filepath.Join(dir, common.IntermediateName(finished, 0, 0))
+	if err := os.WriteFile(file, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Cancel(finished); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(c)
+
+	del := func(url string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, url, nil))
+		return rec.Code, rec.Body.String()
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("Expected the retention policy to keep the file: %v", err)
+	}
+	code, body := del(fmt.Sprintf("/jobs/%d/data", finished))
+	var st JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &st); err != nil || code != http.StatusOK {
+		t.Fatalf("Expected 200 with the job's status, got %d %s", code, body)
+	}
+	if !st.IntermediateDeleted || st.FinishedAt == nil {
+		t.Errorf("Expected the status to show the files deleted, got %s", body)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected the intermediate file to be deleted, got %v", err)
+	}
+	if code, _ := del(fmt.Sprintf("/jobs/%d/data", running)); code != http.StatusConflict {
+		t.Errorf("Expected 409 for a running job, got %d", code)
+	}
+	if code, _ := del("/jobs/9/data"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", code)
+	}
+	if code, _ := del("/jobs/x/data"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad job ID, got %d", code)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	c.SubmitJob([]string{"f1"}, 1)
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, &common.TaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+	reg := &common.RegisterReply{}
+	c.Register(&common.RegisterArgs{Hostname: "box", Slots: 4, MemoryBytes: 1 << 30, Labels: map[string]string{"zone": "a"}}, reg)
+	s := NewServer(c)
+
+	_, body := get(t, s, "/workers")
+	var workers []WorkerResponse
+	if err := json.Unmarshal([]byte(body), &workers); err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 2 {
+		t.Fatalf("Expected 2 workers, got %+v", workers)
+	}
+	byID := map[string]WorkerResponse{workers[0].ID: workers[0], workers[1].ID: workers[1]}
+	if w := byID["w1"]; !w.Live || w.RunningTasks != 1 || w.Slots != 1 || w.RegisteredAt != nil {
+		t.Errorf("Unexpected anonymous worker %+v", w)
+	}
+	if w := byID[reg.WorkerID]; w.Hostname != "box" || w.Slots != 4 || w.MemoryBytes != 1<<30 || w.Labels["zone"] != "a" || w.RegisteredAt == nil {
+		t.Errorf("Unexpected registered worker %+v", w)
+	}
+}
+
+func TestJobStatus_LongPoll(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, 1)
+	s := NewServer(c)
+
+	_, body := get(t, s, "/jobs/0")
+	var before JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &before); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, body = get(t, s, fmt.Sprintf("/jobs/0?wait=50ms&version=%d", before.Version))
+	if time.Since(start) < 50*time.Millisecond || !strings.Contains(body, `"IN_PROGRESS"`) {
+		t.Errorf("Expected the unchanged job after the wait expired, got %s", body)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Cancel(jobID)
+	}()
+	_, body = get(t, s, fmt.Sprintf("/jobs/0?wait=10s&version=%d", before.Version))
+	if !strings.Contains(body, `"CANCELLED"`) {
+		t.Errorf("Expected the long poll to return the cancelled job, got %s", body)
+	}
+
+	if code, _ := get(t, s, "/jobs/0?wait=forever&version=0"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad wait, got %d", code)
+	}
+}
+
+func TestSubmitJob_Inputs(t *testing.T) {
+	s := NewServer(coordinator.NewCoordinator())
+	t.Chdir(t.TempDir())
+	for _, f := range []string{"logs/a.log", "logs/b.log", "logs/b.tmp", "logs/old/c.log"} {
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(body string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := post(`{"files":["logs/a.log","missing.log"],"nReduce":1}`); code != http.StatusBadRequest || !strings.Contains(body, "missing.log") {
+		t.Errorf("Expected 400 naming the missing input, got %d %q", code, body)
+	}
+	if code, _ := post(`{"files":["logs/*.csv"],"nReduce":1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a glob matching nothing, got %d", code)
+	}
+	if code, body := post(`{"files":["logs"],"recursive":true,"include":["*.log"],"exclude":["a.*"],"nReduce":1}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %q", code, body)
+	}
+
+	code, body := get(t, s, "/jobs/0/inputs")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	var resp InputsResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range resp.Files {
+		paths = append(paths, filepath.ToSlash(f.Path))
+	}
+	if strings.Join(paths, " ") != "logs/b.log logs/old/c.log" || resp.Files[0].Size != 1 {
+		t.Errorf("Unexpected resolved inputs %+v", resp.Files)
+	}
+	if resp.Spec == nil || !resp.Spec.Recursive || resp.Spec.Paths[0] != "logs" {
+		t.Errorf("Expected the submitted spec to be recorded, got %+v", resp.Spec)
+	}
+	if code, _ := get(t, s, "/jobs/5/inputs"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", code)
+	}
+}
+
+func TestSubmitJob_Datasets(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	s := NewServer(c)
+	t.Chdir(t.TempDir())
+	for _, f := range []string{"users.csv", "events-1.csv", "events-2.csv", "countries.csv"} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(body string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+	for name, body := range map[string]string{
+		"unknown param":   `{"app":"join","nReduce":1,"datasets":[{"tag":"users","files":["users.csv"]}],"params":{"nope":"1"}}`,
+		"bad join mode":   `{"app":"join","nReduce":1,"datasets":[{"tag":"users","files":["users.csv"]}],"params":{"join":"outer"}}`,
+		"duplicate tag":   `{"app":"join","nReduce":1,"datasets":[{"tag":"users","files":["users.csv"]},{"tag":"users","files":["events-1.csv"]}]}`,
+		"missing tag":     `{"app":"join","nReduce":1,"datasets":[{"files":["users.csv"]}]}`,
+		"missing dataset": `{"app":"join","nReduce":1,"datasets":[{"tag":"users","files":["nope.csv"]}]}`,
+		"missing side":    `{"app":"broadcast-join","nReduce":1,"files":["users.csv"],"side_inputs":[{"tag":"c","files":["nope.csv"]}]}`,
+	} {
+		if code, resp := post(body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %q", name, code, resp)
+		}
+	}
+
+	body := `{"app":"join","nReduce":1,"datasets":[{"tag":"users","files":["users.csv"]},{"tag":"events","files":["events-*.csv"]}],` +
+		`"side_inputs":[{"tag":"countries","files":["countries.csv"]}],"params":{"key.events":"1","header":"true"}}`
+	if code, resp := post(body); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %q", code, resp)
+	}
+
+	_, resp := get(t, s, "/jobs/0")
+	var status JobStatusResponse
+	if err := json.Unmarshal([]byte(resp), &status); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(status.Datasets, ",") != "users,events" || status.Params["key.events"] != "1" || status.Files != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	_, resp = get(t, s, "/jobs/0/inputs")
+	var inputs InputsResponse
+	if err := json.Unmarshal([]byte(resp), &inputs); err != nil {
+		t.Fatal(err)
+	}
+	var tagged []string
+	for _, f := range inputs.Files {
+		tagged = append(tagged, f.Tag+"="+f.Path)
+	}
+	if strings.Join(tagged, " ") != "users=users.csv events=events-1.csv events=events-2.csv" {
+		t.Errorf("Unexpected inputs %v", tagged)
+	}
+	if len(inputs.SideInputs) != 1 || inputs.SideInputs[0].Files[0] != "countries.csv" {
+		t.Errorf("Unexpected side inputs %+v", inputs.SideInputs)
+	}
+
+	// Map tasks are told their file's dataset, and carry the job's side
+	// inputs and parameters.
+	tags := map[string]string{}
+	for range 3 {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1", Slots: 3}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.TaskType != common.TaskTypeMap {
+			t.Fatalf("Expected a map task, got %+v", reply)
+		}
+		tags[reply.FileName] = reply.Tag
+		if len(reply.SideInputs) != 1 || reply.Params["header"] != "true" || len(reply.Datasets) != 2 {
+			t.Errorf("Unexpected map task %+v", reply)
+		}
+	}
+	if tags["users.csv"] != "users" || tags["events-2.csv"] != "events" {
+		t.Errorf("Unexpected map task tags %v", tags)
+	}
+}
+
+func TestSubmitJob_Limits(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	c.SetLimits(coordinator.Limits{MaxReduce: 2, MaxInputBytes: 4, MaxRunning: 1, MaxQueued: 1})
+	s := NewServer(c)
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("small", []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("big", []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(body string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := post(`{"files":["small"],"nReduce":3}`); code != http.StatusBadRequest || !strings.Contains(body, "nReduce 3 exceeds the limit of 2") {
+		t.Errorf("Expected 400 for too many reduce tasks, got %d %q", code, body)
+	}
+	if code, body := post(`{"files":["big"],"nReduce":1}`); code != http.StatusBadRequest || !strings.Contains(body, "input bytes") {
+		t.Errorf("Expected 400 for too large inputs, got %d %q", code, body)
+	}
+	if code, body := post(`{"files":["small"],"nReduce":1}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %q", code, body)
+	}
+
+	code, body := post(`{"files":["small"],"nReduce":1,"queue":"etl","user":"ann"}`)
+	var resp SubmitJobResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusAccepted || resp.Status != coordinator.StatusQueued || resp.QueuePosition != 1 {
+		t.Errorf("Expected 202 with the queue position, got %d %q", code, body)
+	}
+	if code, _ := post(`{"files":["small"],"nReduce":1}`); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 with a full queue, got %d", code)
+	}
+
+	_, body = get(t, s, fmt.Sprintf("/jobs/%d", resp.JobID))
+	var status JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != coordinator.StatusQueued || status.QueuePosition != 1 || status.Queue != "etl" || status.User != "ann" || status.AdmittedAt != nil {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	wf := `{"stages":[{"name":"a","files":["small"],"nReduce":9}]}`
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workflows", strings.NewReader(wf)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "nReduce") {
+		t.Errorf("Expected 400 for a stage over the limits, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A coordinator shutting down turns jobs away, but still answers.
+	s.coordinator.Drain()
+	if code, body := post(`{"files":["small"],"nReduce":1}`); code != http.StatusServiceUnavailable || !strings.Contains(body, "Shutting down") {
+		t.Errorf("Expected 503 while draining, got %d %q", code, body)
+	}
+	if code, _ := get(t, s, fmt.Sprintf("/jobs/%d", resp.JobID)); code != http.StatusOK {
+		t.Errorf("Expected job status while draining, got %d", code)
+	}
+}
+
+func TestWorkflows(t *testing.T) {
+	s := NewServer(coordinator.NewCoordinator())
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("in.txt", []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(url, body string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+	for _, body := range []string{
+		`{"stages":[]}`,
+		`{"stages":[{"name":"a","files":["missing.txt"],"nReduce":1}]}`,
+		`{"stages":[{"name":"a","nReduce":1}]}`,
+		`{"stages":[{"name":"a","after":["a"],"nReduce":1}]}`,
+		`{"stages":[{"name":"a","files":["in.txt"],"nReduce":1},{"name":"b","after":["a"],"app":"nope","nReduce":1}]}`,
+	} {
+		if code, resp := post("/workflows", body); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d %s", body, code, resp)
+		}
+	}
+
+	code, body := post("/workflows", `{"name":"chain","stages":[
+		{"name":"count","files":["in.txt"],"nReduce":2},
+		{"name":"recount","after":["count"],"nReduce":1}]}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", code, body)
+	}
+	var submitted SubmitJobResponse
+	if err := json.Unmarshal([]byte(body), &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body = get(t, s, fmt.Sprintf("/workflows/%d", submitted.JobID))
+	var wf WorkflowResponse
+	if err := json.Unmarshal([]byte(body), &wf); err != nil || code != http.StatusOK {
+		t.Fatalf("Expected 200 with the workflow, got %d %s", code, body)
+	}
+	if wf.Name != "chain" || wf.Status != coordinator.StatusInProgress || len(wf.Stages) != 2 {
+		t.Fatalf("Unexpected workflow %s", body)
+	}
+	if st := wf.Stages[0]; st.Status != coordinator.StatusInProgress || st.JobID == nil {
+		t.Errorf("Expected the first stage to run a job, got %+v", st)
+	}
+	if st := wf.Stages[1]; st.Status != coordinator.StagePending || st.JobID != nil || st.After[0] != "count" {
+		t.Errorf("Expected the second stage to wait, got %+v", st)
+	}
+
+	code, body = post(fmt.Sprintf("/workflows/%d/cancel", wf.ID), "")
+	if code != http.StatusOK || !strings.Contains(body, coordinator.StageSkipped) {
+		t.Errorf("Expected the cancelled workflow, got %d %s", code, body)
+	}
+	if code, _ := post(fmt.Sprintf("/workflows/%d/cancel", wf.ID), ""); code != http.StatusConflict {
+		t.Errorf("Expected 409 cancelling a cancelled workflow, got %d", code)
+	}
+	_, body = get(t, s, fmt.Sprintf("/workflows/%d?wait=1s&version=%d", wf.ID, wf.Version))
+	if !strings.Contains(body, coordinator.StatusCancelled) {
+		t.Errorf("Expected the long poll to return the cancelled workflow, got %s", body)
+	}
+	_, body = get(t, s, "/workflows")
+	var wfs []WorkflowResponse
+	if err := json.Unmarshal([]byte(body), &wfs); err != nil || len(wfs) != 1 {
+		t.Errorf("Expected one workflow, got %s", body)
+	}
+	if code, _ := get(t, s, "/workflows/7"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown workflow, got %d", code)
+	}
+}
+
+// newAuthServer serves the API to tenants "ann" and "bob", who read and
+// write below their own directories, and the admin "ops".
+func newAuthServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"ann", "bob"} {
+		if err := os.MkdirAll(filepath.Join(root, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name, "in.txt"), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := AuthConfig{JWTKey: "jwt-key", Tenants: []*Tenant{
+		{Name: "ann", APIKeys: []string{"ann-key"}, HMACSecret: "ann-secret", InputPrefixes: []string{filepath.Join(root, "ann")}, OutputPrefixes: []string{"ann"}},
+		{Name: "bob", APIKeys: []string{"bob-key"}, InputPrefixes: []string{filepath.Join(root, "bob")}, OutputPrefixes: []string{"bob"}},
+		{Name: "ops", APIKeys: []string{"ops-key"}, Admin: true},
+	}}
+	auth, err := cfg.Authenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(coordinator.NewCoordinator())
+	s.OutputDir = t.TempDir()
+	s.Auth = auth
+	return s, root
+}
+
+// call sends a request with the given headers and returns the response.
+func call(s *Server, method, url, body string, header map[string]string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func apiKey(key string) map[string]string { return map[string]string{"X-API-Key": key} }
+
+func TestAuth_TenantIsolation(t *testing.T) {
+	s, root := newAuthServer(t)
+	submit := func(key, body string) int {
+		t.Helper()
+		code, resp := call(s, http.MethodPost, "/jobs", body, apiKey(key))
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200 submitting as %s, got %d %q", key, code, resp)
+		}
+		var r SubmitJobResponse
+		if err := json.Unmarshal([]byte(resp), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r.JobID
+	}
+	annJob := submit("ann-key", fmt.Sprintf(`{"files":[%q],"nReduce":1,"user":"bob","output":{"dir":"ann"}}`, filepath.Join(root, "ann", "in.txt")))
+	bobJob := submit("bob-key", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"bob"}}`, filepath.Join(root, "bob", "in.txt")))
+
+	if code, _ := call(s, http.MethodGet, "/jobs", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", code)
+	}
+	if code, _ := call(s, http.MethodGet, "/jobs", "", apiKey("eve-key")); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown key, got %d", code)
+	}
+	if code, _ := call(s, http.MethodGet, "/health", "", nil); code != http.StatusOK {
+		t.Errorf("Expected health checks without credentials, got %d", code)
+	}
+
+	code, body := call(s, http.MethodGet, fmt.Sprintf("/jobs/%d", annJob), "", map[string]string{"Authorization": "Bearer ann-key"})
+	var status JobStatusResponse
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("Expected ann's job, got %d %q", code, body)
+	}
+	if status.Tenant != "ann" || status.User != "ann" {
+		t.Errorf("Expected tenant and user ann, got %q and %q", status.Tenant, status.User)
+	}
+
+	for _, req := range []struct{ method, url string }{
+		{http.MethodGet, fmt.Sprintf("/jobs/%d", annJob)},
+		{http.MethodGet, fmt.Sprintf("/jobs/%d?wait=1s&version=0", annJob)},
+		{http.MethodGet, fmt.Sprintf("/jobs/%d/inputs", annJob)},
+		{http.MethodGet, fmt.Sprintf("/jobs/%d/output", annJob)},
+		{http.MethodPost, fmt.Sprintf("/jobs/%d/cancel", annJob)},
+		{http.MethodDelete, fmt.Sprintf("/jobs/%d/data", annJob)},
+	} {
+		if code, _ := call(s, req.method, req.url, "", apiKey("bob-key")); code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s %s as bob, got %d", req.method, req.url, code)
+		}
+	}
+	if job, _ := s.coordinator.Snapshot(annJob); job.Status != coordinator.StatusInProgress {
+		t.Errorf("Expected bob not to cancel ann's job, got %s", job.Status)
+	}
+
+	list := func(key string) []int {
+		_, body := call(s, http.MethodGet, "/jobs", "", apiKey(key))
+		var jobs []JobStatusResponse
+		if err := json.Unmarshal([]byte(body), &jobs); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+	if ids := list("bob-key"); len(ids) != 1 || ids[0] != bobJob {
+		t.Errorf("Expected bob to list only job %d, got %v", bobJob, ids)
+	}
+	if ids := list("ops-key"); len(ids) != 2 {
+		t.Errorf("Expected the admin to list both jobs, got %v", ids)
+	}
+	if code, _ := call(s, http.MethodGet, "/workers", "", apiKey("bob-key")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 listing workers as bob, got %d", code)
+	}
+	if code, _ := call(s, http.MethodGet, "/workers", "", apiKey("ops-key")); code != http.StatusOK {
+		t.Errorf("Expected the admin to list workers, got %d", code)
+	}
+	if code, _ := call(s, http.MethodPost, fmt.Sprintf("/jobs/%d/cancel", bobJob), "", apiKey("ops-key")); code != http.StatusOK {
+		t.Errorf("Expected the admin to cancel bob's job, got %d", code)
+	}
+
+	wf := fmt.Sprintf(`{"stages":[{"name":"a","files":[%q],"nReduce":1,"output":{"dir":"ann/wf"}}]}`, filepath.Join(root, "ann", "in.txt"))
+	code, body = call(s, http.MethodPost, "/workflows", wf, apiKey("ann-key"))
+	var submitted SubmitJobResponse
+	if err := json.Unmarshal([]byte(body), &submitted); err != nil {
+		t.Fatalf("Expected 200 submitting a workflow, got %d %q", code, body)
+	}
+	url := fmt.Sprintf("/workflows/%d", submitted.JobID)
+	if code, _ := call(s, http.MethodGet, url, "", apiKey("bob-key")); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for ann's workflow as bob, got %d", code)
+	}
+	_, body = call(s, http.MethodGet, url, "", apiKey("ann-key"))
+	var wfStatus WorkflowResponse
+	if err := json.Unmarshal([]byte(body), &wfStatus); err != nil || wfStatus.Tenant != "ann" {
+		t.Errorf("Expected ann's workflow, got %q", body)
+	}
+}
+
+func TestAuth_PathPrefixes(t *testing.T) {
+	s, root := newAuthServer(t)
+	manifest := filepath.Join(root, "ann", "manifest")
+	if err := os.WriteFile(manifest, []byte(filepath.Join(root, "bob", "in.txt")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Links in ann's output directory that lead to bob's.
+	for _, dir := range []string{filepath.Join(s.OutputDir, "ann"), filepath.Join(s.OutputDir, "bob")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(s.OutputDir, "ann", "link"):   filepath.Join(s.OutputDir, "bob"),
+		filepath.Join(s.OutputDir, "ann", "future"): filepath.Join(s.OutputDir, "bob", "new"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"own input", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "ann")), http.StatusOK},
+		{"other input", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "bob", "in.txt")), http.StatusForbidden},
+		{"escaping input", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "ann")+"/../bob/in.txt"), http.StatusForbidden},
+		{"manifest entry", fmt.Sprintf(`{"manifests":[%q],"nReduce":1,"output":{"dir":"ann"}}`, manifest), http.StatusForbidden},
+		{"side input", fmt.Sprintf(`{"files":[%q],"side_inputs":[{"tag":"t","files":[%q]}],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "ann", "in.txt"), filepath.Join(root, "bob", "in.txt")), http.StatusForbidden},
+		{"own output below", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann/out"}}`, filepath.Join(root, "ann", "in.txt")), http.StatusOK},
+		{"data directory", fmt.Sprintf(`{"files":[%q],"nReduce":1}`, filepath.Join(root, "ann", "in.txt")), http.StatusForbidden},
+		{"other output", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"bob"}}`, filepath.Join(root, "ann", "in.txt")), http.StatusForbidden},
+		{"escaping output", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann/../bob"}}`, filepath.Join(root, "ann", "in.txt")), http.StatusForbidden},
+		{"symlinked output", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann/link/out"}}`, filepath.Join(root, "ann", "in.txt")), http.StatusForbidden},
+		{"dangling symlinked output", fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann/future/out"}}`, filepath.Join(root, "ann", "in.txt")), http.StatusForbidden},
+	} {
+		if code, body := call(s, http.MethodPost, "/jobs", tc.body, apiKey("ann-key")); code != tc.want {
+			t.Errorf("%s: expected %d, got %d %q", tc.name, tc.want, code, body)
+		}
+	}
+
+	// Neither can a link in ann's input directory lead to bob's files.
+	if err := os.Symlink(filepath.Join(root, "bob"), filepath.Join(root, "ann", "link")); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "ann", "link", "in.txt"))
+	if code, _ := call(s, http.MethodPost, "/jobs", body, apiKey("ann-key")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 reading bob's file through a link, got %d", code)
+	}
+
+	body = fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"/anywhere"}}`, filepath.Join(root, "bob", "in.txt"))
+	if code, resp := call(s, http.MethodPost, "/jobs", body, apiKey("ops-key")); code != http.StatusOK {
+		t.Errorf("Expected the admin to read and write anywhere, got %d %q", code, resp)
+	}
+	wf := fmt.Sprintf(`{"stages":[{"name":"a","files":[%q],"nReduce":1,"output":{"dir":"ann"}}]}`, filepath.Join(root, "bob", "in.txt"))
+	if code, _ := call(s, http.MethodPost, "/workflows", wf, apiKey("ann-key")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a workflow stage reading bob's files, got %d", code)
+	}
+}
+
+// authFunc adapts a function to Authenticator.
+type authFunc func(r *http.Request) (*Tenant, error)
+
+func (f authFunc) Authenticate(r *http.Request) (*Tenant, error) { return f(r) }
+
+func TestAuth_Multi(t *testing.T) {
+	ann := &Tenant{Name: "ann", APIKeys: []string{"ann-key"}}
+	keys := &APIKeys{Tenants: []*Tenant{ann}}
+	expired := authFunc(func(*http.Request) (*Tenant, error) {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	})
+	broken := authFunc(func(*http.Request) (*Tenant, error) { return nil, io.ErrUnexpectedEOF })
+
+	req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	req.Header.Set("X-API-Key", "ann-key")
+	if got, err := (MultiAuth{expired, keys}).Authenticate(req); err != nil || got != ann {
+		t.Errorf("Expected a wrapped ErrUnauthenticated to fall through to the API key, got %v, %v", got, err)
+	}
+	if _, err := (MultiAuth{broken, keys}).Authenticate(req); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected other errors to end authentication, got %v", err)
+	}
+	req.Header.Set("X-API-Key", "eve-key")
+	if _, err := (MultiAuth{expired, keys}).Authenticate(req); err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("Expected the more specific reason, got %v", err)
+	}
+}
+
+// jwt returns an HS256 token with the given claims.
+func jwt(key string, claims map[string]any) string {
+	enc := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuth_JWT(t *testing.T) {
+	s, _ := newAuthServer(t)
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", jwt("jwt-key", map[string]any{"sub": "ann", "exp": now + 60}), http.StatusOK},
+		{"expired", jwt("jwt-key", map[string]any{"sub": "ann", "exp": now - 60}), http.StatusUnauthorized},
+		{"not yet valid", jwt("jwt-key", map[string]any{"sub": "ann", "nbf": now + 60}), http.StatusUnauthorized},
+		{"wrong key", jwt("other-key", map[string]any{"sub": "ann"}), http.StatusUnauthorized},
+		{"unknown tenant", jwt("jwt-key", map[string]any{"sub": "eve"}), http.StatusUnauthorized},
+	} {
+		code, body := call(s, http.MethodGet, "/jobs", "", map[string]string{"Authorization": "Bearer " + tc.token})
+		if code != tc.want {
+			t.Errorf("%s: expected %d, got %d %q", tc.name, tc.want, code, body)
+		}
+	}
+}
+
+func TestAuth_HMAC(t *testing.T) {
+	s, root := newAuthServer(t)
+	body := fmt.Sprintf(`{"files":[%q],"nReduce":1,"output":{"dir":"ann"}}`, filepath.Join(root, "ann", "in.txt"))
+	nonces := 0
+	sign := func(secret, body string, at time.Time) map[string]string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		nonces++
+		nonce := strconv.Itoa(nonces)
+		return map[string]string{
+			HeaderTenant:    "ann",
+			HeaderTimestamp: ts,
+			HeaderNonce:     nonce,
+			HeaderSignature: hex.EncodeToString(hmacSignature(secret, http.MethodPost, "/jobs", ts, nonce, []byte(body))),
+		}
+	}
+	headers := sign("ann-secret", body, time.Now())
+	if code, resp := call(s, http.MethodPost, "/jobs", body, headers); code != http.StatusOK {
+		t.Errorf("Expected a signed request to be accepted, got %d %q", code, resp)
+	}
+	if code, resp := call(s, http.MethodPost, "/jobs", body, headers); code != http.StatusUnauthorized || !strings.Contains(resp, "nonce") {
+		t.Errorf("Expected 401 for a replayed request, got %d %q", code, resp)
+	}
+	unsigned := sign("ann-secret", body, time.Now())
+	delete(unsigned, HeaderNonce)
+	if code, _ := call(s, http.MethodPost, "/jobs", body, unsigned); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a nonce, got %d", code)
+	}
+	if code, _ := call(s, http.MethodPost, "/jobs", body+" ", sign("ann-secret", body, time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a changed body, got %d", code)
+	}
+	if code, _ := call(s, http.MethodPost, "/jobs", body, sign("bob-secret", body, time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the wrong secret, got %d", code)
+	}
+	if code, resp := call(s, http.MethodPost, "/jobs", body, sign("ann-secret", body, time.Now().Add(-time.Hour))); code != http.StatusUnauthorized || !strings.Contains(resp, "signed at") {
+		t.Errorf("Expected 401 for a stale signature, got %d %q", code, resp)
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+)
+
+// SubmitWorkflowRequest describes a DAG of jobs. Each stage reads the reduce
+// output of the stages named in its After, plus any files of its own.
+type SubmitWorkflowRequest struct {
+	Name   string         `json:"name,omitempty"`
+	Stages []StageRequest `json:"stages"`
+}
+
+// StageRequest is one stage of a workflow: a job request with a name and the
+// stages it runs after.
+type StageRequest struct {
+	Name  string   `json:"name"`
+	After []string `json:"after,omitempty"`
+	SubmitJobRequest
+}
+
+type WorkflowResponse struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name,omitempty"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	Stages      []StageResponse `json:"stages"`
+	Version     int64           `json:"version"`
+	Tenant      string          `json:"tenant,omitempty"`
+}
+
+type StageResponse struct {
+	Name   string   `json:"name"`
+	After  []string `json:"after,omitempty"`
+	Status string   `json:"status"`
+	JobID  *int     `json:"job_id,omitempty"` // Set once the stage has started
+}
+
+func newWorkflowStatus(wf coordinator.Workflow) WorkflowResponse {
+	resp := WorkflowResponse{
+		ID:          wf.ID,
+		Name:        wf.Name,
+		Status:      wf.Status,
+		Error:       wf.Error,
+		SubmittedAt: wf.StartTime,
+		Stages:      make([]StageResponse, 0, len(wf.Stages)),
+		Version:     wf.Version,
+		Tenant:      wf.Tenant,
+	}
+	if !wf.FinishedAt.IsZero() {
+		resp.FinishedAt = &wf.FinishedAt
+	}
+	for _, st := range wf.Stages {
+		sr := StageResponse{Name: st.Name, After: st.After, Status: st.Status}
+		if st.Status != coordinator.StagePending && st.Status != coordinator.StageSkipped {
+			sr.JobID = &st.JobID
+		}
+		resp.Stages = append(resp.Stages, sr)
+	}
+	return resp
+}
+
+func (s *Server) handleSubmitWorkflow(w http.ResponseWriter, r *http.Request) {
+	var req SubmitWorkflowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	spec := coordinator.WorkflowSpec{Name: req.Name, Tenant: tenantName(r)}
+	for _, st := range req.Stages {
+		if err := s.authorize(r, st.SubmitJobRequest); err != nil {
+			http.Error(w, fmt.Sprintf("Forbidden: stage %q: %v", st.Name, err), http.StatusForbidden)
+			return
+		}
+		job, err := jobSpec(st.SubmitJobRequest, len(st.After) > 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Stage %q: %v", st.Name, err), http.StatusBadRequest)
+			return
+		}
+		if err := authorizeInputs(r, &job); err != nil {
+			http.Error(w, fmt.Sprintf("Forbidden: stage %q: %v", st.Name, err), http.StatusForbidden)
+			return
+		}
+		spec.Stages = append(spec.Stages, coordinator.StageSpec{Name: st.Name, After: st.After, Job: job})
+	}
+	id, err := s.coordinator.SubmitWorkflow(spec)
+	var notLeaderErr *common.NotLeaderError
+	if errors.As(err, &notLeaderErr) {
+		notLeader(w, s.coordinator)
+		return
+	}
+	if errors.Is(err, coordinator.ErrDraining) {
+		shuttingDown(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid workflow: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, SubmitJobResponse{JobID: id})
+}
+
+func (s *Server) handleListWorkflows(w http.ResponseWriter, r *http.Request) {
+	wfs := s.coordinator.Workflows()
+	resp := make([]WorkflowResponse, 0, len(wfs))
+	for _, wf := range wfs {
+		if canSee(r, wf.Tenant) {
+			resp = append(resp, newWorkflowStatus(wf))
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// handleWorkflowStatus returns a workflow's status. It long polls like
+// GET /jobs/{id} when given ?wait=&version=.
+func (s *Server) handleWorkflowStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Workflow ID", http.StatusBadRequest)
+		return
+	}
+
+	if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+		wait, err := time.ParseDuration(waitParam)
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.snapshotWorkflow(r, id); !ok {
+			http.Error(w, "Workflow not found", http.StatusNotFound)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxLongPoll))
+		defer cancel()
+		wf, err := s.coordinator.WaitWorkflow(ctx, id, version)
+		if errors.Is(err, coordinator.ErrWorkflowNotFound) {
+			http.Error(w, "Workflow not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, newWorkflowStatus(wf))
+		return
+	}
+
+	wf, ok := s.snapshotWorkflow(r, id)
+	if !ok {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, newWorkflowStatus(wf))
+}
+
+func (s *Server) handleCancelWorkflow(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid Workflow ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := s.snapshotWorkflow(r, id); !ok {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+	switch err := s.coordinator.CancelWorkflow(id); {
+	case errors.Is(err, coordinator.ErrWorkflowNotFound):
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	case errors.Is(err, coordinator.ErrWorkflowNotRunning):
+		http.Error(w, "Workflow is not running", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wf, _ := s.coordinator.SnapshotWorkflow(id)
+	writeJSON(w, newWorkflowStatus(wf))
+}
@@ -0,0 +1,61 @@
+// Package appkeys records how each application orders and partitions its
+// keys. Workers register an app's keys along with the app, and code that
+// reads job output, such as the API server, looks them up here without
+// depending on the worker runtime.
+package appkeys
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// Keys describes an app's keys.
+type Keys struct {
+	Compare   func(a, b string) int             // The order reducers sort keys in
+	Partition func(key string, nReduce int) int // The reduce partition a key goes to
+}
+
+var (
+	mu   sync.RWMutex
+	apps = map[string]Keys{}
+)
+
+// Register records the keys of the app called name.
+func Register(name string, keys Keys) {
+	mu.Lock()
+	defer mu.Unlock()
+	apps[name] = keys
+}
+
+func lookup(name string) (Keys, bool) {
+	if name == "" {
+		name = common.DefaultApp
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	keys, ok := apps[name]
+	return keys, ok
+}
+
+// Compare returns the key order of the app called name. An empty name
+// selects the default app, and apps nobody registered sort their keys as
+// strings.
+func Compare(name string) func(a, b string) int {
+	if keys, ok := lookup(name); ok && keys.Compare != nil {
+		return keys.Compare
+	}
+	return strings.Compare
+}
+
+// Partition returns the reduce partition key goes to in a job of the app
+// called name with nReduce partitions. ok is false for apps nobody
+// registered, whose key could be in any partition.
+func Partition(name, key string, nReduce int) (partition int, ok bool) {
+	keys, ok := lookup(name)
+	if !ok || keys.Partition == nil {
+		return 0, false
+	}
+	return keys.Partition(key, nReduce), true
+}
@@ -0,0 +1,34 @@
+package appkeys
+
+import (
+	"cmp"
+	"strconv"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	if got := Compare("unregistered")("10", "9"); got >= 0 {
+		t.Errorf("Expected unknown apps to sort keys as strings, got %d", got)
+	}
+	if _, ok := Partition("unregistered", "10", 4); ok {
+		t.Error("Expected no partition for an unknown app")
+	}
+
+	Register("test-numeric", Keys{
+		Compare: func(a, b string) int {
+			x, _ := strconv.Atoi(a)
+			y, _ := strconv.Atoi(b)
+			return cmp.Compare(x, y)
+		},
+		Partition: func(key string, nReduce int) int {
+			n, _ := strconv.Atoi(key)
+			return n % nReduce
+		},
+	})
+	if got := Compare("test-numeric")("10", "9"); got <= 0 {
+		t.Errorf("Expected the registered order, got %d", got)
+	}
+	if p, ok := Partition("test-numeric", "10", 4); !ok || p != 2 {
+		t.Errorf("Expected partition 2, got %d %v", p, ok)
+	}
+}
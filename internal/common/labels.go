@@ -0,0 +1,34 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ParseLabels parses comma-separated key=value pairs such as
+// "zone=us-east-1a,gpu=true". An empty string yields nil.
+func ParseLabels(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: want key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// FormatLabels is the inverse of ParseLabels, with keys in sorted order.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,24 @@
+package common
+
+import "testing"
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" zone=us-east-1a, gpu=true,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || labels["zone"] != "us-east-1a" || labels["gpu"] != "true" || labels["empty"] != "" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if got := FormatLabels(labels); got != "empty=,gpu=true,zone=us-east-1a" {
+		t.Errorf("Expected sorted pairs, got %q", got)
+	}
+	if labels, err := ParseLabels(""); err != nil || labels != nil {
+		t.Errorf("Expected no labels for an empty string, got %v, %v", labels, err)
+	}
+	for _, bad := range []string{"zone", "=a", "a=b,,c=d"} {
+		if _, err := ParseLabels(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
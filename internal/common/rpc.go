@@ -1,6 +1,15 @@
 package common
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+)
+
+// DefaultApp is the application jobs run when none is specified.
+const DefaultApp = "wordcount"
 
 // TaskType represents the type of task (Map or Reduce).
 type TaskType int
@@ -10,6 +19,27 @@ const (
 	TaskTypeReduce
 )
 
+func (t TaskType) String() string {
+	switch t {
+	case TaskTypeMap:
+		return "map"
+	case TaskTypeReduce:
+		return "reduce"
+	}
+	return fmt.Sprintf("TaskType(%d)", int(t))
+}
+
+// ParseTaskType converts "map" or "reduce" into a TaskType.
+func ParseTaskType(s string) (TaskType, error) {
+	switch s {
+	case "map":
+		return TaskTypeMap, nil
+	case "reduce":
+		return TaskTypeReduce, nil
+	}
+	return 0, fmt.Errorf("unknown task type %q", s)
+}
+
 // TaskStatus represents the status of a task.
 type TaskStatus int
 
@@ -20,21 +50,107 @@ const (
 	TaskStatusFailed
 )
 
+func (s TaskStatus) String() string {
+	switch s {
+	case TaskStatusIdle:
+		return "idle"
+	case TaskStatusInProgress:
+		return "in_progress"
+	case TaskStatusCompleted:
+		return "completed"
+	case TaskStatusFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("TaskStatus(%d)", int(s))
+}
+
 // TaskArgs holds the arguments for a task request.
 type TaskArgs struct {
 	WorkerID string
+	Slots    int // Tasks the worker can run at once; 0 means 1
+}
+
+// RegisterArgs describes a worker process when it joins the cluster.
+type RegisterArgs struct {
+	WorkerID    string // ID from an earlier registration to keep; empty asks for a new one
+	Hostname    string
+	Slots       int               // Tasks the worker can run at once
+	MemoryBytes int64             // Memory available to the worker; 0 if unknown
+	Apps        []string          // Apps the worker can run; nil means any
+	Labels      map[string]string // Free-form labels jobs can require, e.g. zone=us-east-1a
+}
+
+// RegisterReply carries the ID assigned to a registering worker.
+type RegisterReply struct {
+	WorkerID string
+}
+
+// DeregisterArgs is sent by a worker that is shutting down. Tasks it still
+// holds are handed back to be run elsewhere.
+type DeregisterArgs struct {
+	WorkerID string
+}
+
+// DeregisterReply holds the response to a deregistration.
+type DeregisterReply struct {
+	Requeued int // Tasks taken back from the worker
+}
+
+// HeartbeatArgs is sent periodically by every worker process, whether or not
+// it is running tasks, so the coordinator knows it is alive and how much
+// capacity it has.
+type HeartbeatArgs struct {
+	WorkerID string
+	Slots    int // Tasks the worker can run at once
+	Busy     int // Slots currently running a task
+}
+
+// HeartbeatReply holds the response to a heartbeat.
+type HeartbeatReply struct {
+	Ack        bool
+	Registered bool // False if the coordinator has no registration for the worker
+
+	// Cleanup lists finished jobs whose intermediate files the worker
+	// should delete from its own directory. Each job is sent once.
+	Cleanup []IntermediateFiles
+}
+
+// IntermediateFiles names the intermediate files of a job: one for every
+// map task and reduce partition, see IntermediateName.
+type IntermediateFiles struct {
+	JobID   int
+	NMap    int
+	NReduce int
 }
 
 // TaskReply holds the task details assigned to a worker.
 type TaskReply struct {
-	JobID     int
-	TaskType  TaskType
-	TaskID    int
-	FileName  string // For Map tasks
-	NReduce   int    // Number of reduce tasks
-	NMap      int    // Number of map tasks
-	Timestamp time.Time
-	Task      *Task
+	JobID       int
+	TaskType    TaskType
+	TaskID      int
+	App         string // Registered application to run
+	FileName    string // For Map tasks
+	NReduce     int    // Number of reduce tasks
+	NMap        int    // Number of map tasks
+	Timestamp   time.Time
+	Attempt     int           // Number of earlier attempts at this task
+	TraceParent string        // W3C traceparent of the coordinator's task span
+	Checksums   []uint32      // For Reduce tasks: CRC-32 of this partition's file from each map task, if known
+	Output      *outputs.Spec // For Reduce tasks: where and how to write the output; nil for the defaults
+	Task        *Task
+
+	Tag        string            // For Map tasks: dataset of FileName, if the job's inputs are tagged
+	Datasets   []string          // Tags of the job's datasets in submission order
+	SideInputs []Dataset         // For Map tasks: small tables every map task reads in full
+	Params     map[string]string // The job's parameters for its app
+}
+
+// Dataset is a named group of input files. Jobs that join several datasets
+// tag their inputs this way so map functions know where a record came
+// from.
+type Dataset struct {
+	Tag   string   `json:"tag"`
+	Files []string `json:"files"`
 }
 
 // Task represents a unit of work.
@@ -46,17 +162,69 @@ type Task struct {
 	FileName  string
 	StartTime time.Time
 	WorkerID  string
+	Attempt   int                // Number of earlier attempts that were abandoned
+	QueuedAt  time.Time          // When the task last became ready to run
+	Counters  map[string]int64   // Counters of the completed attempt
+	Checksums []uint32           // For Map tasks: CRC-32 of each intermediate partition of the completed attempt
+	Output    *outputs.Partition // For Reduce tasks: the output file of the completed attempt
+
+	PreferredHosts []string // For Map tasks: hosts that hold the input locally
+	Tag            string   // For Map tasks: dataset the input belongs to, if any
 }
 
 // ReportTaskArgs holds arguments for reporting task completion.
 type ReportTaskArgs struct {
-	JobID    int
-	TaskID   int
-	TaskType TaskType
-	WorkerID string
+	JobID       int
+	TaskID      int
+	TaskType    TaskType
+	WorkerID    string
+	Attempt     int
+	Counters    map[string]int64   // Task counters, summed into the job on success
+	Logs        string             // Log lines captured while the attempt ran
+	TraceParent string             // W3C traceparent of the worker's execution span
+	Checksums   []uint32           // Map tasks: CRC-32 of each intermediate partition written
+	BadInputs   []int              // Reduce tasks: map tasks whose intermediate files were missing or corrupt
+	Output      *outputs.Partition // Reduce tasks: the output file written
 }
 
 // ReportTaskReply holds the response for task completion report.
 type ReportTaskReply struct {
 	Ack bool
 }
+
+// NotLeaderError is returned by RPCs sent to a standby coordinator replica.
+// It travels to workers as its message, which ParseNotLeader reads back.
+type NotLeaderError struct {
+	Leader string // RPC address of the leader; empty while none is elected
+}
+
+// notLeaderPrefix starts the message of every NotLeaderError.
+const notLeaderPrefix = "not the coordinator leader"
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return notLeaderPrefix + "; no leader elected"
+	}
+	return notLeaderPrefix + "; leader is at " + e.Leader
+}
+
+// ParseNotLeader reports whether err is a NotLeaderError, as returned by an
+// RPC, and returns the leader's address if it names one.
+func ParseNotLeader(err error) (leader string, ok bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), notLeaderPrefix) {
+		return "", false
+	}
+	_, leader, _ = strings.Cut(err.Error(), "; leader is at ")
+	return leader, true
+}
+
+// IntermediateName returns the file a map task writes for one reduce partition.
+func IntermediateName(jobID, mapTask, reduceTask int) string {
+	return fmt.Sprintf("mr-%d-%d-%d", jobID, mapTask, reduceTask)
+}
+
+// OutputName returns the file a reduce task writes its output to when the
+// job uses the default output settings.
+func OutputName(jobID, reduceTask int) string {
+	return fmt.Sprintf("mr-out-%d-%d", jobID, reduceTask)
+}
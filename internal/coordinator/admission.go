@@ -0,0 +1,194 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+)
+
+// StatusQueued is the state of a job waiting for admission: its tasks are
+// not handed out until running jobs finish and Limits allow it to start.
+const StatusQueued = "QUEUED"
+
+// DefaultQueue is the admission queue of jobs submitted without one.
+const DefaultQueue = "default"
+
+// Limits caps what a job may ask for and how many jobs run at once. The
+// zero value allows anything.
+type Limits struct {
+	// MaxReduce, MaxInputs and MaxInputBytes cap a single job's reduce
+	// tasks, input files and total input size. Jobs over them can never
+	// run and are rejected by TrySubmit with a *LimitError.
+	MaxReduce     int
+	MaxInputs     int
+	MaxInputBytes int64
+
+	// MaxRunning caps the jobs running at once, and MaxRunningPerQueue and
+	// MaxRunningPerUser the jobs running at once in each queue and for
+	// each user. Jobs over them wait as StatusQueued and are admitted in
+	// submission order as running jobs finish.
+	MaxRunning         int
+	MaxRunningPerQueue int
+	MaxRunningPerUser  int
+
+	// MaxQueued caps the jobs waiting for admission. TrySubmit returns
+	// ErrQueueFull beyond it.
+	MaxQueued int
+}
+
+// ErrQueueFull is returned by TrySubmit when Limits.MaxQueued jobs are
+// already waiting.
+var ErrQueueFull = errors.New("too many jobs are queued")
+
+// LimitError reports a job that asks for more than Limits allow.
+type LimitError struct {
+	Limit string // What is over the limit, e.g. "nReduce"
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %d exceeds the limit of %d", e.Limit, e.Value, e.Max)
+}
+
+// Check returns a *LimitError if spec asks for more reduce tasks, input
+// files or input bytes than l allows. Input bytes are only known for
+// inputs resolved at submit time.
+func (l Limits) Check(spec JobSpec) error {
+	if l.MaxReduce > 0 && spec.NReduce > l.MaxReduce {
+		return &LimitError{Limit: "nReduce", Value: int64(spec.NReduce), Max: int64(l.MaxReduce)}
+	}
+	files := len(spec.Files)
+	for _, ds := range spec.Datasets {
+		files += len(ds.Files)
+	}
+	if l.MaxInputs > 0 && files > l.MaxInputs {
+		return &LimitError{Limit: "input files", Value: int64(files), Max: int64(l.MaxInputs)}
+	}
+	var size int64
+	for _, f := range spec.Inputs {
+		size += f.Size
+	}
+	if l.MaxInputBytes > 0 && size > l.MaxInputBytes {
+		return &LimitError{Limit: "input bytes", Value: size, Max: l.MaxInputBytes}
+	}
+	return nil
+}
+
+// SetLimits changes the admission limits and admits queued jobs the new
+// limits allow to start.
+func (c *Coordinator) SetLimits(l Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = l
+	c.admit(time.Now())
+}
+
+// TrySubmit is Submit for requests from outside the cluster: it rejects a
+// job over the per-job limits with a *LimitError, and returns ErrQueueFull
+// if the job would have to wait while Limits.MaxQueued jobs already do. A
+// standby replica returns a *common.NotLeaderError, and a draining
+// coordinator ErrDraining.
+func (c *Coordinator) TrySubmit(spec JobSpec) (int, error) {
+	c.mu.Lock()
+	id, err := c.trySubmit(spec)
+	gen := c.saveGen
+	c.mu.Unlock()
+	if err == nil {
+		c.waitSaved(gen)
+	}
+	return id, err
+}
+
+// trySubmit is TrySubmit with c.mu held.
+func (c *Coordinator) trySubmit(spec JobSpec) (int, error) {
+	if err := c.serving(); err != nil {
+		return 0, err
+	}
+	if c.draining {
+		return 0, ErrDraining
+	}
+	if err := c.limits.Check(spec); err != nil {
+		return 0, err
+	}
+	// Jobs already queued do not fit, so admitting them cannot make room:
+	// the new job waits exactly when it does not fit either.
+	probe := &Job{Queue: queueName(spec.Queue), User: spec.User}
+	if c.limits.MaxQueued > 0 && len(c.queued()) >= c.limits.MaxQueued && !c.canAdmit(probe) {
+		return 0, ErrQueueFull
+	}
+	return c.submit(spec), nil
+}
+
+// queueName returns the queue a job submitted to queue waits in.
+func queueName(queue string) string {
+	if queue == "" {
+		return DefaultQueue
+	}
+	return queue
+}
+
+// queued returns the jobs waiting for admission, oldest first. c.mu must be
+// held.
+func (c *Coordinator) queued() []*Job {
+	var jobs []*Job
+	for _, job := range c.jobs {
+		if job.Status == StatusQueued {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// canAdmit reports whether the running limits leave room for job. c.mu must
+// be held.
+func (c *Coordinator) canAdmit(job *Job) bool {
+	l := c.limits
+	var running, inQueue, forUser int
+	for _, j := range c.jobs {
+		if j.Status != StatusInProgress {
+			continue
+		}
+		running++
+		if j.Queue == job.Queue {
+			inQueue++
+		}
+		if j.User == job.User {
+			forUser++
+		}
+	}
+	return (l.MaxRunning <= 0 || running < l.MaxRunning) &&
+		(l.MaxRunningPerQueue <= 0 || inQueue < l.MaxRunningPerQueue) &&
+		(l.MaxRunningPerUser <= 0 || job.User == "" || forUser < l.MaxRunningPerUser)
+}
+
+// admit starts queued jobs, oldest first, while the running limits leave
+// room, and updates the queue positions of the rest. A job that does not
+// fit does not hold back later jobs of other queues or users. c.mu must be
+// held.
+func (c *Coordinator) admit(now time.Time) {
+	positions := make(map[string]int)
+	for _, job := range c.queued() {
+		if !c.canAdmit(job) {
+			positions[job.Queue]++
+			if job.QueuePosition != positions[job.Queue] {
+				job.QueuePosition = positions[job.Queue]
+				c.touch(job)
+			}
+			continue
+		}
+		job.Status = StatusInProgress
+		job.QueuePosition = 0
+		job.AdmittedAt = now
+		for i := range job.MapTasks {
+			job.MapTasks[i].QueuedAt = now // Start the locality delay now
+		}
+		c.touch(job)
+		slog.Info("Admitted job", logging.KeyJobID, job.ID, "queue", job.Queue, "user", job.User, "waited", now.Sub(job.StartTime))
+	}
+}
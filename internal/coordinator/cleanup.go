@@ -0,0 +1,236 @@
+package coordinator
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// RetentionPolicy decides how long a finished job's intermediate files and
+// its record in the coordinator are kept. The zero value keeps both
+// forever, as coordinators did before retention could be set.
+type RetentionPolicy struct {
+	// Intermediate is how long the mr-<job>-<map>-<reduce> files of a job
+	// are kept after it completes, fails or is cancelled. Zero or a
+	// negative value keeps them, e.g. to debug a reducer, until
+	// DeleteJobData is called or the job is evicted.
+	Intermediate time.Duration
+
+	// KeepFailed keeps the intermediate files of failed and cancelled jobs
+	// even when Intermediate is positive.
+	KeepFailed bool
+
+	// JobTTL evicts a finished job from the coordinator this long after it
+	// finished, deleting any intermediate files still left, and a finished
+	// workflow this long after its last stage ended. Zero keeps jobs and
+	// workflows forever.
+	JobTTL time.Duration
+}
+
+// ErrJobRunning is returned when deleting the data of a job that has not
+// finished.
+var ErrJobRunning = errors.New("job is still running")
+
+// SetRetention changes how long finished jobs and their intermediate files
+// are kept. Intermediate files are deleted from the data directory set with
+// SetOutputDir, and workers delete those they wrote to a directory of their
+// own when their next heartbeat tells them to.
+func (c *Coordinator) SetRetention(p RetentionPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retention = p
+	c.sweep(time.Now())
+}
+
+// finish records that a job stopped running, moves its workflow on, admits
+// queued jobs it made room for and deletes its intermediate files now if
+// the retention policy keeps none. c.mu must be held.
+func (c *Coordinator) finish(job *Job, status string, now time.Time) {
+	job.Status = status
+	job.FinishedAt = now
+	job.QueuePosition = 0
+	c.jobFinished(job)
+	c.admit(now)
+	c.sweepJob(job, now)
+}
+
+// sweep deletes intermediate files and evicts jobs and workflows whose
+// retention has run out. c.mu must be held.
+func (c *Coordinator) sweep(now time.Time) {
+	for _, job := range c.jobs {
+		c.sweepJob(job, now)
+	}
+	if c.retention.JobTTL <= 0 {
+		return
+	}
+	for id, wf := range c.workflows {
+		if wf.FinishedAt.IsZero() || now.Sub(wf.FinishedAt) < c.retention.JobTTL {
+			continue
+		}
+		delete(c.workflows, id)
+		c.dirtyFlows[id] = true
+		c.persist()
+		c.notify()
+		slog.Info("Evicted workflow", "workflow_id", id)
+	}
+}
+
+func (c *Coordinator) sweepJob(job *Job, now time.Time) {
+	if !job.Done() || job.cleaning {
+		return
+	}
+	if !job.IntermediateDeleted && c.intermediateExpired(job, now) {
+		c.startCleanup(job, now)
+		return
+	}
+	if job.IntermediateDeleted && c.retention.JobTTL > 0 && now.Sub(job.FinishedAt) >= c.retention.JobTTL {
+		delete(c.jobs, job.ID)
+		// Attempts still running when the job was cancelled may have
+		// written files since the first cleanup.
+		go c.deleteIntermediate(job.ID, len(job.MapTasks), job.NReduce, c.outputDir)
+		c.announceCleanup(job.ID, len(job.MapTasks), job.NReduce, now)
+		c.dirtyJobs[job.ID] = true
+		c.persist()
+		c.notify()
+		slog.Info("Evicted job", logging.KeyJobID, job.ID)
+	}
+}
+
+// intermediateExpired reports whether the retention policy lets the job's
+// intermediate files go. c.mu must be held.
+func (c *Coordinator) intermediateExpired(job *Job, now time.Time) bool {
+	if c.retention.JobTTL > 0 && now.Sub(job.FinishedAt) >= c.retention.JobTTL {
+		return true
+	}
+	if c.retention.Intermediate <= 0 || c.retention.KeepFailed && job.Status != StatusCompleted {
+		return false
+	}
+	return now.Sub(job.FinishedAt) >= c.retention.Intermediate
+}
+
+// startCleanup deletes the job's intermediate files in the background and
+// marks them deleted once done, or leaves them for the next sweep if that
+// fails. Workers are told to delete their copies too. c.mu must be held.
+func (c *Coordinator) startCleanup(job *Job, now time.Time) {
+	job.cleaning = true
+	id, nMap, nReduce, dir := job.ID, len(job.MapTasks), job.NReduce, c.outputDir
+	c.announceCleanup(id, nMap, nReduce, now)
+	go func() {
+		err := c.deleteIntermediate(id, nMap, nReduce, dir)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		job.cleaning = false
+		if c.jobs[id] != job {
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to delete intermediate files", logging.KeyJobID, id, "error", err)
+			return
+		}
+		job.IntermediateDeleted = true
+		c.touch(job)
+	}()
+}
+
+// deleteIntermediate removes every intermediate file a job may have written
+// to dir. Files that do not exist are skipped.
+func (c *Coordinator) deleteIntermediate(jobID, nMap, nReduce int, dir string) error {
+	deleted := 0
+	for m := 0; m < nMap; m++ {
+		for r := 0; r < nReduce; r++ {
+			err := storage.Delete(storage.Join(dir, common.IntermediateName(jobID, m, r)))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	c.metrics.filesDeleted.With().Add(float64(deleted))
+	slog.Debug("Deleted intermediate files", logging.KeyJobID, jobID, "files", deleted)
+	return nil
+}
+
+// DeleteJobData deletes a finished job's intermediate files now, whatever
+// the retention policy says. It returns when they are gone.
+func (c *Coordinator) DeleteJobData(jobID int) error {
+	c.mu.Lock()
+	job, ok := c.jobs[jobID]
+	if !ok {
+		c.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if !job.Done() {
+		c.mu.Unlock()
+		return ErrJobRunning
+	}
+	nMap, nReduce, dir := len(job.MapTasks), job.NReduce, c.outputDir
+	c.mu.Unlock()
+
+	if err := c.deleteIntermediate(jobID, nMap, nReduce, dir); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.announceCleanup(jobID, nMap, nReduce, time.Now())
+	if c.jobs[jobID] == job && !job.IntermediateDeleted {
+		job.IntermediateDeleted = true
+		c.touch(job)
+	}
+	slog.Info("Deleted job data", logging.KeyJobID, jobID)
+	return nil
+}
+
+// pendingCleanup is a job whose intermediate files workers delete from
+// their own directories, which the coordinator may not see, once a
+// heartbeat reply tells them to.
+type pendingCleanup struct {
+	seq   int
+	at    time.Time
+	files common.IntermediateFiles
+}
+
+// announceCleanup tells workers to delete the job's intermediate files with
+// the reply to their next heartbeat. c.mu must be held.
+func (c *Coordinator) announceCleanup(jobID, nMap, nReduce int, now time.Time) {
+	c.cleanupSeq++
+	c.cleanups = append(c.cleanups, pendingCleanup{
+		seq:   c.cleanupSeq,
+		at:    now,
+		files: common.IntermediateFiles{JobID: jobID, NMap: nMap, NReduce: nReduce},
+	})
+}
+
+// cleanupsFor returns the cleanups announced since the worker's last
+// heartbeat, or every pending one to a worker new to the coordinator. c.mu
+// must be held.
+func (c *Coordinator) cleanupsFor(w *workerState) []common.IntermediateFiles {
+	var files []common.IntermediateFiles
+	for _, p := range c.cleanups {
+		if p.seq > w.cleanupSeq {
+			files = append(files, p.files)
+		}
+	}
+	w.cleanupSeq = c.cleanupSeq
+	return files
+}
+
+// pruneCleanups forgets cleanups announced more than a task timeout ago.
+// Every worker still live has sent a heartbeat and heard of them since.
+// c.mu must be held.
+func (c *Coordinator) pruneCleanups(now time.Time) {
+	i := 0
+	for i < len(c.cleanups) && now.Sub(c.cleanups[i].at) > c.taskTimeout {
+		i++
+	}
+	c.cleanups = slices.Delete(c.cleanups, 0, i)
+}
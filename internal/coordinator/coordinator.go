@@ -1,49 +1,252 @@
 package coordinator
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/inputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
+)
+
+// Job states reported in Job.Status.
+const (
+	StatusInProgress = "IN_PROGRESS"
+	StatusCompleted  = "COMPLETED"
+	StatusFailed     = "FAILED"
+	StatusCancelled  = "CANCELLED"
 )
 
 type Job struct {
 	ID          int
 	Files       []string
 	NReduce     int
+	App         string
 	MapTasks    []common.Task
 	ReduceTasks []common.Task
+	Labels      map[string]string // Labels a worker must have to run the job's tasks
 	StartTime   time.Time
-	Status      string // "IN_PROGRESS", "COMPLETED", "FAILED"
+	FinishedAt  time.Time        // When the job completed, failed or was cancelled
+	Status      string           // One of the Status* constants
+	Error       string           // Why the job failed, if it did
+	Counters    map[string]int64 // Summed from each task's successful attempt
+	Locality    LocalityStats    // Where map tasks ran relative to their input
+
+	// InputSpec and Inputs record how Files was resolved at submit time and
+	// each file's size and modification time then, if the job was
+	// submitted through inputs.Resolve.
+	InputSpec *inputs.Spec
+	Inputs    []inputs.File
+	Output    *outputs.Spec // Where and how reducers write; nil for the defaults
+	Version   int64         // Incremented on every change to the job's state
+
+	// Datasets are the job's tagged inputs; their files are at the end of
+	// Files. SideInputs are read in full by every map task, and Params are
+	// passed to the app. See JobSpec.
+	Datasets   []common.Dataset
+	SideInputs []common.Dataset
+	Params     map[string]string
+
+	// IntermediateDeleted is set once the job's intermediate files have
+	// been deleted, see RetentionPolicy.
+	IntermediateDeleted bool
+
+	// Queue and User decide which running limits apply to the job, see
+	// Limits. QueuePosition is its place among the jobs waiting in its
+	// queue while it is StatusQueued, counting from 1, and AdmittedAt is
+	// when it started running.
+	Queue         string
+	User          string
+	QueuePosition int
+	AdmittedAt    time.Time
+
+	// Tenant is the API tenant that submitted the job, if the API
+	// authenticates its callers. Only it and admins see the job.
+	Tenant string
+
+	cleaning  bool                    // Intermediate files are being deleted
+	logs      map[taskLogKey]string   // Logs uploaded by each task attempt
+	span      *trace.Span             // Root span covering the whole job
+	taskSpans map[taskKey]*trace.Span // Spans of in-progress task attempts
+}
+
+// Done reports whether the job has stopped running: it is neither queued
+// nor in progress.
+func (j *Job) Done() bool {
+	return j.Status != StatusInProgress && j.Status != StatusQueued
+}
+
+// datasetTags returns the tags of the job's datasets in submission order.
+func (j *Job) datasetTags() []string {
+	var tags []string
+	for _, ds := range j.Datasets {
+		tags = append(tags, ds.Tag)
+	}
+	return tags
+}
+
+// taskLogKey identifies one attempt of one task within a job.
+type taskLogKey struct {
+	Type    common.TaskType
+	TaskID  int
+	Attempt int
+}
+
+// JobSpec describes a job to submit.
+type JobSpec struct {
+	Files   []string
+	NReduce int
+	App     string // Registered application name; empty selects common.DefaultApp
+
+	// Labels restricts the job to workers registered with all of these
+	// labels, e.g. {"zone": "us-east-1a"}.
+	Labels map[string]string
+
+	// InputSpec and Inputs record how Files was resolved, see Job.
+	InputSpec *inputs.Spec
+	Inputs    []inputs.File
+
+	// Output sets the directory, file names and format of the reduce
+	// output, and whether a _SUCCESS marker and manifest are written when
+	// the job completes. It must pass Validate.
+	Output *outputs.Spec
+
+	// PreferredHosts maps input files to hosts that hold their data. Files
+	// not listed here are looked up with the coordinator's
+	// LocalityResolver, if any.
+	PreferredHosts map[string][]string
+
+	// Datasets are tagged inputs, read after Files. Each map task is told
+	// the tag of its file, e.g. to join users with their events.
+	Datasets []common.Dataset
+
+	// SideInputs are small tables every map task reads in full next to its
+	// own input, e.g. for a broadcast join.
+	SideInputs []common.Dataset
+
+	// Params configure the job's app, e.g. the join key column.
+	Params map[string]string
+
+	// Queue and User decide which of the coordinator's Limits on running
+	// jobs apply. An empty Queue is DefaultQueue.
+	Queue string
+	User  string
+
+	// Tenant owns the job, see Job.Tenant.
+	Tenant string
 }
 
+// defaultTaskTimeout is how long a task may stay in progress before it is
+// handed to another worker.
+const defaultTaskTimeout = 10 * time.Second
+
 type Coordinator struct {
-	mu      sync.Mutex
-	jobs    map[int]*Job
-	nextJob int
-	workers map[string]time.Time // WorkerID -> LastHeartbeat
+	mu            sync.Mutex
+	jobs          map[int]*Job
+	nextJob       int
+	workflows     map[int]*Workflow
+	nextWorkflow  int
+	workers       map[string]*workerState
+	departed      map[string]time.Time // When workers deregistered; RPCs they sent before are ignored
+	taskTimeout   time.Duration
+	locality      LocalityResolver
+	localityDelay time.Duration
+	metrics       *coordinatorMetrics
+	tracer        *trace.Tracer
+	changed       chan struct{} // Closed and replaced whenever a job or workflow changes
+	stateFile     string        // Where job state is persisted, if set
+	saves         chan struct{} // Wakes the goroutine saving the state; nil until the first change
+	saveMu        sync.Mutex    // Held while a save is written, so saves land in order
+	saveGen       uint64        // Counts the saves persist asked for
+	savedGen      uint64        // The last of those written
+	saved         chan struct{} // Closed and replaced whenever a save is written
+	dirtyJobs     map[int]bool  // Jobs changed or evicted since the last save
+	dirtyFlows    map[int]bool  // Workflows changed or evicted since the last save
+	logEntries    int           // Log entries appended since the last snapshot
+	needSnapshot  bool          // The next log entry must be a snapshot
+	outputDir     string        // Data directory that relative output directories are in
+	retention     RetentionPolicy
+	cleanups      []pendingCleanup // Intermediate files workers are told to delete, oldest first
+	cleanupSeq    int              // Numbers the cleanups announced so far
+	limits        Limits
+	tlsConfig     *tls.Config // Set to serve RPCs over mutual TLS
+	replica       *Replica    // Set if the coordinator is one of several replicas
+	lease         Lease       // The lease as the replica last saw it
+	leading       bool        // Whether the replica took the lease and has not lost it since
+	listener      net.Listener
+	stop          chan struct{} // Closed by Close to stop the monitor
+	draining      bool          // Set by Drain: no new jobs or workflows
+	closed        bool
 }
 
 // NewCoordinator creates a new Coordinator instance.
 func NewCoordinator() *Coordinator {
 	c := &Coordinator{
-		jobs:    make(map[int]*Job),
-		nextJob: 0,
-		workers: make(map[string]time.Time),
+		jobs:          make(map[int]*Job),
+		nextJob:       0,
+		workflows:     make(map[int]*Workflow),
+		workers:       make(map[string]*workerState),
+		departed:      make(map[string]time.Time),
+		taskTimeout:   defaultTaskTimeout,
+		localityDelay: defaultLocalityDelay,
+		tracer:        trace.NewTracer("coordinator", nil),
+		changed:       make(chan struct{}),
+		saved:         make(chan struct{}),
+		dirtyJobs:     make(map[int]bool),
+		dirtyFlows:    make(map[int]bool),
+		stop:          make(chan struct{}),
 	}
+	c.metrics = newCoordinatorMetrics(c)
 	// c.server() is called explicitly via Start()
 	return c
 }
 
-// SubmitJob adds a new job to be processed.
+// SubmitJob adds a new word count job to be processed.
 func (c *Coordinator) SubmitJob(files []string, nReduce int) int {
+	return c.Submit(JobSpec{Files: files, NReduce: nReduce})
+}
+
+// Submit adds a new job described by spec to be processed. It starts at
+// once unless the running limits set with SetLimits make it wait as
+// StatusQueued.
+func (c *Coordinator) Submit(spec JobSpec) int {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	id := c.submit(spec)
+	gen := c.saveGen
+	c.mu.Unlock()
+	c.waitSaved(gen)
+	return id
+}
+
+// submit creates the job for spec and returns its ID. c.mu must be held.
+func (c *Coordinator) submit(spec JobSpec) int {
+	files, nReduce := spec.Files, spec.NReduce
+	tags := make([]string, len(files))
+	if len(spec.Datasets) > 0 {
+		files = append([]string(nil), files...)
+		for _, ds := range spec.Datasets {
+			for _, f := range ds.Files {
+				files = append(files, f)
+				tags = append(tags, ds.Tag)
+			}
+		}
+	}
+	app := spec.App
+	if app == "" {
+		app = common.DefaultApp
+	}
 
 	jobID := c.nextJob
 	c.nextJob++
@@ -52,8 +255,24 @@ func (c *Coordinator) SubmitJob(files []string, nReduce int) int {
 		ID:        jobID,
 		Files:     files,
 		NReduce:   nReduce,
+		App:       app,
+		Labels:    spec.Labels,
+		InputSpec: spec.InputSpec,
+		Inputs:    spec.Inputs,
+		Output:    spec.Output,
 		StartTime: time.Now(),
-		Status:    "IN_PROGRESS",
+		Status:    StatusQueued,
+		Counters:  make(map[string]int64),
+		logs:      make(map[taskLogKey]string),
+		taskSpans: make(map[taskKey]*trace.Span),
+
+		Datasets:   spec.Datasets,
+		SideInputs: spec.SideInputs,
+		Params:     spec.Params,
+
+		Queue:  queueName(spec.Queue),
+		User:   spec.User,
+		Tenant: spec.Tenant,
 	}
 
 	// Initialize Map tasks
@@ -63,6 +282,10 @@ func (c *Coordinator) SubmitJob(files []string, nReduce int) int {
 			Type:     common.TaskTypeMap,
 			Status:   common.TaskStatusIdle,
 			FileName: file,
+			QueuedAt: job.StartTime,
+			Tag:      tags[i],
+
+			PreferredHosts: c.preferredHosts(spec, file),
 		}
 		job.MapTasks = append(job.MapTasks, task)
 	}
@@ -78,7 +301,10 @@ func (c *Coordinator) SubmitJob(files []string, nReduce int) int {
 	}
 
 	c.jobs[jobID] = job
-	log.Printf("Submitted Job %d with %d files and %d reduce tasks", jobID, len(files), nReduce)
+	c.touch(job)
+	c.startJobTrace(job, time.Now())
+	slog.Info("Submitted job", logging.KeyJobID, jobID, "app", app, "files", len(files), "n_reduce", nReduce, "labels", spec.Labels, "queue", job.Queue)
+	c.admit(job.StartTime)
 	return jobID
 }
 
@@ -90,74 +316,481 @@ func (c *Coordinator) GetJobStatus(jobID int) (*Job, bool) {
 	return job, ok
 }
 
-// Start starts the RPC server.
+// SetTaskTimeout changes how long a task may run before it is reassigned.
+// A d of zero or less restores the default of 10 seconds.
+func (c *Coordinator) SetTaskTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultTaskTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.taskTimeout = d
+}
+
+// SetTLS makes Listen serve RPCs over TLS with cfg, e.g. from
+// mtls.ServerConfig to only accept workers with a certificate from the
+// cluster's CA. Workers must present a certificate, and may only use worker
+// IDs derived from its name. It must be called before Listen.
+func (c *Coordinator) SetTLS(cfg *tls.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = cfg
+}
+
+// SetOutputDir sets the data directory the coordinator shares with workers.
+// Jobs that ask for a _SUCCESS marker or manifest get them written into
+// their output directory there; it defaults to the working directory.
+func (c *Coordinator) SetOutputDir(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outputDir = dir
+}
+
+// Snapshot returns a copy of the job that is safe to read without holding the
+// coordinator's lock.
+func (c *Coordinator) Snapshot(jobID int) (Job, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.jobs[jobID]
+	if !ok {
+		return Job{}, false
+	}
+	return job.clone(), true
+}
+
+// WaitJob blocks until the job's version differs from version or the job is
+// no longer running, and returns a copy of it. If ctx ends first, it returns
+// the job as it is along with the context's error. It does not block once
+// the coordinator is draining, so long polls end promptly.
+func (c *Coordinator) WaitJob(ctx context.Context, jobID int, version int64) (Job, error) {
+	for {
+		c.mu.Lock()
+		job, ok := c.jobs[jobID]
+		if !ok {
+			c.mu.Unlock()
+			return Job{}, ErrJobNotFound
+		}
+		if job.Version != version || job.Done() || c.draining {
+			cp := job.clone()
+			c.mu.Unlock()
+			return cp, nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			job, _ := c.Snapshot(jobID)
+			return job, ctx.Err()
+		}
+	}
+}
+
+// touch bumps the job's version, saves it and wakes WaitJob callers. c.mu
+// must be held.
+func (c *Coordinator) touch(job *Job) {
+	job.Version++
+	c.dirtyJobs[job.ID] = true
+	c.persist()
+	c.notify()
+}
+
+// notify wakes everything waiting for a job or workflow to change. c.mu
+// must be held.
+func (c *Coordinator) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (j *Job) clone() Job {
+	cp := *j
+	cp.Files = append([]string(nil), j.Files...)
+	cp.MapTasks = append([]common.Task(nil), j.MapTasks...)
+	cp.ReduceTasks = append([]common.Task(nil), j.ReduceTasks...)
+	cp.Counters = make(map[string]int64, len(j.Counters))
+	for name, v := range j.Counters {
+		cp.Counters[name] = v
+	}
+	cp.logs = nil
+	cp.span = nil
+	cp.taskSpans = nil
+	return cp
+}
+
+// Jobs returns copies of all jobs ordered by ID.
+func (c *Coordinator) Jobs() []Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	jobs := make([]Job, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		jobs = append(jobs, job.clone())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+var (
+	// ErrJobNotFound is returned for operations on an unknown job ID.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotRunning is returned when cancelling a job that already finished.
+	ErrJobNotRunning = errors.New("job is not running")
+)
+
+// Cancel stops a running or queued job. No further tasks are assigned and
+// reports from tasks already handed out are ignored.
+func (c *Coordinator) Cancel(jobID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.jobs[jobID]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if job.Done() {
+		return ErrJobNotRunning
+	}
+	c.cancel(job)
+	return nil
+}
+
+// cancel stops a running job. c.mu must be held.
+func (c *Coordinator) cancel(job *Job) {
+	c.finish(job, StatusCancelled, time.Now())
+	for _, tasks := range [][]common.Task{job.MapTasks, job.ReduceTasks} {
+		for i := range tasks {
+			c.traceAbandon(job, &tasks[i], "job cancelled")
+		}
+	}
+	job.span.SetError("cancelled")
+	job.span.End()
+	c.touch(job)
+	slog.Info("Job cancelled", logging.KeyJobID, job.ID)
+}
+
+// TaskLogs returns the log captured by one attempt of a task. A negative
+// attempt selects the most recent attempt that uploaded logs.
+func (c *Coordinator) TaskLogs(jobID int, taskType common.TaskType, taskID, attempt int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.jobs[jobID]
+	if !ok {
+		return "", false
+	}
+	if attempt >= 0 {
+		logs, ok := job.logs[taskLogKey{Type: taskType, TaskID: taskID, Attempt: attempt}]
+		return logs, ok
+	}
+	latest := -1
+	for key := range job.logs {
+		if key.Type == taskType && key.TaskID == taskID && key.Attempt > latest {
+			latest = key.Attempt
+		}
+	}
+	if latest < 0 {
+		return "", false
+	}
+	return job.logs[taskLogKey{Type: taskType, TaskID: taskID, Attempt: latest}], true
+}
+
+// Start starts the RPC server on the default port, exiting the process if
+// it cannot listen.
 func (c *Coordinator) Start() {
-	err := rpc.Register(c)
+	if _, err := c.Listen(":1234"); err != nil {
+		slog.Error("listen error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// ErrClosed is returned by RPCs made after Close.
+var ErrClosed = errors.New("coordinator is shut down")
+
+// ErrDraining is returned for jobs and workflows submitted after Drain.
+var ErrDraining = errors.New("coordinator is shutting down and not accepting jobs")
+
+// Listen serves the coordinator's RPCs on addr, e.g. ":1234" or
+// "127.0.0.1:0" for a random port, and starts requeueing timed-out tasks in
+// the background. A replica starts campaigning for the lease. It returns the
+// address actually bound.
+func (c *Coordinator) Listen(addr string) (net.Addr, error) {
+	srv := rpc.NewServer()
+	if err := srv.Register(c); err != nil {
+		return nil, err
+	}
+	tl, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal("rpc register error:", err)
+		return nil, err
+	}
+	l := &trackingListener{Listener: tl, conns: make(map[net.Conn]struct{})}
+	var served net.Listener = l
+	c.mu.Lock()
+	if c.tlsConfig != nil {
+		// Wrapping the tracked connections lets Close shut them down, and
+		// lets the HTTP server see TLS connections and log failed
+		// handshakes.
+		served = tls.NewListener(l, c.tlsConfig)
+	}
+	c.listener = l
+	if c.replica != nil && c.replica.RPCAddr == "" {
+		c.replica.RPCAddr = l.Addr().String()
 	}
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", ":1234")
-	if e != nil {
-		log.Fatal("listen error:", e)
+	replica := c.replica != nil
+	c.mu.Unlock()
+	var handler http.Handler = srv
+	if served != l {
+		handler = http.HandlerFunc(c.serveTLSPeer)
 	}
 	go func() {
-		if err := http.Serve(l, nil); err != nil {
-			log.Fatal("http serve error:", err)
+		// The RPC server answers the HTTP CONNECT handshake rpc.DialHTTP
+		// sends, whatever the path. Failed TLS handshakes, e.g. of workers
+		// without a valid certificate, are logged as warnings.
+		hs := &http.Server{Handler: handler, ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)}
+		if err := hs.Serve(served); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("http serve error", "error", err)
 		}
 	}()
+	go c.monitor()
+	if replica {
+		go c.campaign()
+	}
+	return l.Addr(), nil
 }
 
-// GetTask assigns a task to a worker.
-func (c *Coordinator) GetTask(args *common.TaskArgs, reply *common.TaskReply) error {
+// Drain prepares the coordinator to shut down: TrySubmit and SubmitWorkflow
+// return ErrDraining from now on, and WaitJob and WaitWorkflow stop
+// blocking. Workers keep getting and reporting tasks until Close.
+func (c *Coordinator) Drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.draining {
+		c.draining = true
+		c.notify()
+	}
+}
+
+// Shutdown is Close for a clean exit: a leading replica also gives up its
+// lease, so a standby takes over at once instead of when the lease runs
+// out.
+func (c *Coordinator) Shutdown() error {
+	c.mu.Lock()
+	var release func() error
+	if c.replica != nil && c.leading {
+		lock, id := c.replica.Lock, c.replica.ID
+		release = func() error { return lock.Release(id) }
+	}
+	c.mu.Unlock()
+	err := c.Close()
+	if release != nil {
+		if rerr := release(); rerr != nil {
+			slog.Warn("Failed to release the coordinator lease", "error", rerr)
+		} else {
+			slog.Info("Released the coordinator lease")
+		}
+	}
+	return err
+}
+
+// Close saves the coordinator's state a last time and stops serving RPCs and
+// requeueing tasks. Calls already in flight fail with ErrClosed, so a
+// coordinator that replaces this one can take over its state file. Open
+// worker connections are closed so workers redial.
+func (c *Coordinator) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.flush()
+	c.closed = true
+	c.notifySaved()
+	close(c.stop)
+	if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+// trackingListener remembers the connections it accepted so Close can shut
+// down the long-lived connections workers keep open, not just the listener.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, l: l}
+	l.mu.Lock()
+	l.conns[tc] = struct{}{}
+	l.mu.Unlock()
+	return tc, nil
+}
+
+func (l *trackingListener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for conn := range l.conns {
+		conn.(*trackedConn).Conn.Close()
+		delete(l.conns, conn)
+	}
+	return err
+}
+
+type trackedConn struct {
+	net.Conn
+	l *trackingListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// monitor periodically requeues tasks whose worker has gone quiet and
+// applies the retention policy to finished jobs. Standby replicas leave
+// both to the leader.
+func (c *Coordinator) monitor() {
+	c.mu.Lock()
+	// Tick at most every millisecond however short the timeout; NewTicker
+	// panics for an interval of zero.
+	interval := max(min(time.Second, c.taskTimeout/4), time.Millisecond)
+	c.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mu.Lock()
+			if c.replica == nil || c.leads(now) {
+				c.requeueExpired(now)
+				c.sweep(now)
+				c.pruneCleanups(now)
+				c.pruneDeparted(now)
+			}
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
 
-	// Prioritize oldest active job
-	// Since map iteration order is random, we should probably iterate in ID order if fairness matters.
-	// For simplicity, we just iterate.
+// requeueExpired resets in-progress tasks that exceeded the task timeout so
+// another worker can pick them up. c.mu must be held.
+func (c *Coordinator) requeueExpired(now time.Time) {
 	for _, job := range c.jobs {
-		if job.Status == "COMPLETED" || job.Status == "FAILED" {
+		if job.Status != StatusInProgress {
 			continue
 		}
+		for _, tasks := range [][]common.Task{job.MapTasks, job.ReduceTasks} {
+			for i := range tasks {
+				task := &tasks[i]
+				if task.Status != common.TaskStatusInProgress || now.Sub(task.StartTime) <= c.taskTimeout {
+					continue
+				}
+				slog.Warn("Task timed out, requeueing",
+					logging.TaskAttrs(job.ID, task.ID, task.Type, task.WorkerID, task.Attempt)...)
+				c.traceAbandon(job, task, "timed out")
+				reset(task, now)
+				c.metrics.timeouts.With(task.Type.String()).Inc()
+				c.touch(job)
+			}
+		}
+	}
+}
 
-		// 1. Assign Map Tasks
-		for i, task := range job.MapTasks {
-			if task.Status == common.TaskStatusIdle {
-				job.MapTasks[i].Status = common.TaskStatusInProgress
-				job.MapTasks[i].WorkerID = args.WorkerID
-				job.MapTasks[i].StartTime = time.Now()
+// assign hands task to a worker and records scheduling metrics and spans. It
+// returns the traceparent to send with the task. c.mu must be held.
+func (c *Coordinator) assign(job *Job, task *common.Task, workerID string, now time.Time) string {
+	slog.Debug("Assigned task", logging.TaskAttrs(job.ID, task.ID, task.Type, workerID, task.Attempt)...)
+	task.Status = common.TaskStatusInProgress
+	task.WorkerID = workerID
+	task.StartTime = now
+	c.touch(job)
+	if !task.QueuedAt.IsZero() {
+		c.metrics.assignmentLatency.With(task.Type.String()).Observe(now.Sub(task.QueuedAt).Seconds())
+	}
+	if task.Attempt > 0 {
+		c.metrics.retries.With(task.Type.String()).Inc()
+	}
+	return c.traceAssignment(job, task, workerID, now)
+}
 
-				reply.TaskType = common.TaskTypeMap
-				reply.JobID = job.ID
-				reply.TaskID = task.ID
-				reply.FileName = task.FileName
-				reply.NReduce = job.NReduce
-				reply.NMap = len(job.Files)
-				reply.Timestamp = time.Now()
-
-				// HACK: We need to tell the worker WHICH job this task belongs to if we want full multi-tenancy.
-				// However, the worker currently writes `mr-X-Y` files based on task ID. If multiple jobs run,
-				// they will overwrite each other's intermediate files unless we scope them by job ID.
-				// For this portfolio refactor, let's assume we handle output naming correctly or just accept conflict risk
-				// if jobs run concurrently.
-				// Better fix: Prepend JobID to filenames in worker logic. But that requires changing RPC protocol.
-				// Let's stick to simplest path: Coordinator supports multiple jobs, but maybe we only run one at a time effectively?
-				// Actually, reply structure doesn't have JobID. We should add it to TaskReply in rpc.go first.
-				// Wait, let's keep scope minimal. We can reuse TaskID logic but maybe map it internally.
-				// Or... updated rpc.go is better. Let's do that in next step.
-				// For now, let's assume one active job or ignore collision risk for the first pass.
-				// Actually, I should update rpc.go. I'll do that concurrently.
-				// For this step, let's create the logic assuming rpc.go will have JobID soon.
-
-				// Let's create a temporary field in common.TaskReply? No, invalid.
-				// Use a dedicated field if updated. I'll update rpc.go in parallel.
+// running returns the jobs in progress, oldest first. c.mu must be held.
+func (c *Coordinator) running() []*Job {
+	var jobs []*Job
+	for _, job := range c.jobs {
+		if job.Status == StatusInProgress {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
 
-				return nil
-			}
+// GetTask assigns a task to a worker.
+func (c *Coordinator) GetTask(args *common.TaskArgs, reply *common.TaskReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.metrics.rpcRequests.With("GetTask").Inc()
+	if err := c.serving(); err != nil {
+		c.metrics.rpcErrors.With("GetTask").Inc()
+		return err
+	}
+	if c.gone(args.WorkerID) {
+		reply.TaskType = -1
+		return nil
+	}
+	w := c.seen(args.WorkerID, args.Slots, now)
+
+	// A worker never gets more tasks than it has slots. It asks once per
+	// free slot, but the coordinator may still count a task the worker has
+	// given up on until that task times out.
+	if c.runningTasks()[args.WorkerID] >= w.slots {
+		reply.TaskType = -1
+		return nil
+	}
+
+	// The oldest job with a task the worker can run goes first, so newer
+	// jobs cannot starve it.
+	for _, job := range c.running() {
+		if !w.canRun(job) {
+			continue
+		}
+
+		// 1. Assign Map Tasks, preferring ones whose input is on the
+		// worker's host
+		if i := c.pickMap(job, w.hostname, now); i >= 0 {
+			task := job.MapTasks[i]
+			locality := c.recordLocality(job, &job.MapTasks[i], w.hostname)
+			slog.Debug("Map task locality", logging.KeyJobID, job.ID, logging.KeyTaskID, task.ID,
+				"host", w.hostname, "locality", locality)
+			reply.TraceParent = c.assign(job, &job.MapTasks[i], args.WorkerID, now)
+
+			reply.TaskType = common.TaskTypeMap
+			reply.JobID = job.ID
+			reply.TaskID = task.ID
+			reply.App = job.App
+			reply.FileName = task.FileName
+			reply.NReduce = job.NReduce
+			reply.NMap = len(job.Files)
+			reply.Timestamp = now
+			reply.Attempt = task.Attempt
+			reply.Tag = task.Tag
+			reply.Datasets = job.datasetTags()
+			reply.SideInputs = job.SideInputs
+			reply.Params = job.Params
+			return nil
 		}
 
-		// Check if all maps are done for this job
+		// Reduces wait until every map of the job has completed.
 		allMapsDone := true
 		for _, task := range job.MapTasks {
 			if task.Status != common.TaskStatusCompleted {
@@ -167,25 +800,26 @@ func (c *Coordinator) GetTask(args *common.TaskArgs, reply *common.TaskReply) er
 		}
 
 		if !allMapsDone {
-			// This job is blocked on maps. Move to next job or return Wait?
-			// If we return Wait here, we block OTHER jobs that might be ready for Reduce.
-			// Ideally we continue loop. But for simplicity, let's just return Wait if we found work but it's not ready.
-			// Actually, if we return Wait, the worker sleeps. We should check NEXT job.
-			continue
+			continue // Another job may have a task ready
 		}
 
 		// 2. Assign Reduce Tasks
 		for i, task := range job.ReduceTasks {
 			if task.Status == common.TaskStatusIdle {
-				job.ReduceTasks[i].Status = common.TaskStatusInProgress
-				job.ReduceTasks[i].WorkerID = args.WorkerID
-				job.ReduceTasks[i].StartTime = time.Now()
+				reply.TraceParent = c.assign(job, &job.ReduceTasks[i], args.WorkerID, now)
 
 				reply.TaskType = common.TaskTypeReduce
 				reply.JobID = job.ID
 				reply.TaskID = task.ID
+				reply.App = job.App
 				reply.NReduce = job.NReduce
 				reply.NMap = len(job.Files)
+				reply.Timestamp = now
+				reply.Attempt = task.Attempt
+				reply.Checksums = partitionChecksums(job, task.ID)
+				reply.Output = job.Output
+				reply.Datasets = job.datasetTags()
+				reply.Params = job.Params
 				return nil
 			}
 		}
@@ -200,8 +834,7 @@ func (c *Coordinator) GetTask(args *common.TaskArgs, reply *common.TaskReply) er
 		}
 
 		if allReducesDone {
-			job.Status = "COMPLETED"
-			log.Printf("Job %d COMPLETED", job.ID)
+			c.complete(job)
 		}
 	}
 
@@ -214,31 +847,19 @@ func (c *Coordinator) ReportTask(args *common.ReportTaskArgs, reply *common.Repo
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// We need JobID in ReportTaskArgs too! Without it, we don't know which job's task finished.
-	// For now, since args doesn't have JobID, we have to iterate all jobs and find matching worker/task combo?
-	// That's risky if TaskIDs overlap between jobs (they do, 0..N).
-	// We MUST update RPC definitions first.
-	// I will update this code assuming rpc.go has JobID.
-
-	// Assuming args.JobID exists... wait, I can't assume that if it doesn't compile.
-	// I should probably update rpc.go FIRST.
-	// But let's write this to be compatible with a loop search for now (inefficient but safe if worker ID is unique per task assignment... no it's not).
-	// Actually, worker ID is per worker process.
-	// We really need JobID in RPC.
-
-	// Implementation Strategy:
-	// 1. Update rpc.go to include JobID.
-	// 2. Update worker.go to handle JobID.
-	// 3. Update coordinator.go (this file).
-
-	// Since I'm editing this file NOW, I'll write it as if JobID is available, and then update rpc.go immediately after.
-	// Go compiler will fail until I update rpc.go, which is fine in a multi-step change.
-
-	// However, I can't add fields to struct from here.
-	// I'll assume args has JobID.
+	now := time.Now()
+	c.metrics.rpcRequests.With("ReportTask").Inc()
+	if err := c.serving(); err != nil {
+		c.metrics.rpcErrors.With("ReportTask").Inc()
+		return err
+	}
+	if !c.gone(args.WorkerID) {
+		c.seen(args.WorkerID, 0, now)
+	}
 
 	job, ok := c.jobs[args.JobID]
 	if !ok {
+		c.metrics.rpcErrors.With("ReportTask").Inc()
 		return fmt.Errorf("job not found")
 	}
 
@@ -250,42 +871,154 @@ func (c *Coordinator) ReportTask(args *common.ReportTaskArgs, reply *common.Repo
 	}
 
 	if args.TaskID < 0 || args.TaskID >= len(tasks) {
+		c.metrics.rpcErrors.With("ReportTask").Inc()
 		return fmt.Errorf("invalid task ID")
 	}
 
-	// Verify worker ID matches
-	if tasks[args.TaskID].WorkerID == args.WorkerID {
-		if args.TaskType == common.TaskTypeMap {
-			job.MapTasks[args.TaskID].Status = common.TaskStatusCompleted
-		} else {
-			job.ReduceTasks[args.TaskID].Status = common.TaskStatusCompleted
+	if args.Logs != "" {
+		job.logs[taskLogKey{Type: args.TaskType, TaskID: args.TaskID, Attempt: args.Attempt}] = args.Logs
+	}
+
+	// Verify worker ID and attempt match. A task that timed out has its
+	// worker cleared, so late reports from the original attempt are ignored
+	// and only the winning attempt's counters reach the job.
+	task := &tasks[args.TaskID]
+	if job.Status == StatusInProgress && task.Status == common.TaskStatusInProgress &&
+		task.WorkerID == args.WorkerID && task.Attempt == args.Attempt {
+		if len(args.BadInputs) > 0 {
+			c.rerunMaps(job, task, args.BadInputs, now)
+			return nil
+		}
+		task.Status = common.TaskStatusCompleted
+		task.Counters = args.Counters
+		task.Checksums = args.Checksums
+		task.Output = args.Output
+		slog.Debug("Task completed", logging.TaskAttrs(job.ID, task.ID, task.Type, args.WorkerID, args.Attempt)...)
+		for name, v := range args.Counters {
+			job.Counters[name] += v
 		}
+		c.metrics.taskDuration.With(task.Type.String()).Observe(now.Sub(task.StartTime).Seconds())
+		c.traceCommit(job, task, args, now)
 		reply.Ack = true
+
+		c.touch(job)
+
+		if args.TaskType == common.TaskTypeMap && allCompleted(job.MapTasks) {
+			for i := range job.ReduceTasks {
+				job.ReduceTasks[i].QueuedAt = now
+			}
+		}
+		if allCompleted(job.MapTasks) && allCompleted(job.ReduceTasks) {
+			c.complete(job)
+		}
 	}
 
 	return nil
 }
 
-// Done checks if ALL jobs are finished?
-// Or maybe specific job?
-// The original main loop checks c.Done().
-// We should probably expose active job count or similar.
+// complete marks a job whose tasks have all finished as completed, after
+// writing its _SUCCESS marker and manifest if it asked for them. A job whose
+// output cannot be committed fails instead. c.mu must be held.
+func (c *Coordinator) complete(job *Job) {
+	if err := c.commitOutput(job); err != nil {
+		job.Error = err.Error()
+		c.finish(job, StatusFailed, time.Now())
+		job.span.SetError(job.Error)
+		job.span.End()
+		c.touch(job)
+		slog.Error("Job failed", logging.KeyJobID, job.ID, "error", err)
+		return
+	}
+	c.finish(job, StatusCompleted, time.Now())
+	job.span.End()
+	c.touch(job)
+	slog.Info("Job completed", logging.KeyJobID, job.ID)
+}
+
+// commitOutput writes the job's _SUCCESS marker and manifest. c.mu must be
+// held.
+func (c *Coordinator) commitOutput(job *Job) error {
+	if job.Output == nil || !job.Output.SuccessMarker && !job.Output.Manifest {
+		return nil
+	}
+	partitions := make([]outputs.Partition, len(job.ReduceTasks))
+	for i, task := range job.ReduceTasks {
+		if task.Output == nil {
+			return fmt.Errorf("reduce task %d did not report its output file", i)
+		}
+		partitions[i] = *task.Output
+	}
+	m := outputs.NewManifest(job.ID, job.App, job.Output, partitions, time.Now())
+	return outputs.Commit(job.Output.DirPath(c.outputDir), job.Output, m)
+}
+
+// rerunMaps handles a reduce task that could not read the output of some map
+// tasks: those maps run again and the reduce is retried once they finish.
+// c.mu must be held.
+func (c *Coordinator) rerunMaps(job *Job, reduce *common.Task, mapIDs []int, now time.Time) {
+	slog.Warn("Intermediate files missing or corrupt, rerunning map tasks",
+		append(logging.TaskAttrs(job.ID, reduce.ID, reduce.Type, reduce.WorkerID, reduce.Attempt), "map_tasks", mapIDs)...)
+	c.traceAbandon(job, reduce, "bad intermediate input")
+	reset(reduce, now)
+	for _, id := range mapIDs {
+		if id < 0 || id >= len(job.MapTasks) || job.MapTasks[id].Status != common.TaskStatusCompleted {
+			continue
+		}
+		task := &job.MapTasks[id]
+		for name, v := range task.Counters {
+			job.Counters[name] -= v
+		}
+		reset(task, now)
+	}
+	c.touch(job)
+}
+
+// reset returns a task to the queue for a fresh attempt.
+func reset(task *common.Task, now time.Time) {
+	task.Status = common.TaskStatusIdle
+	task.WorkerID = ""
+	task.Attempt++
+	task.QueuedAt = now
+	task.Counters = nil
+	task.Checksums = nil
+	task.Output = nil
+}
+
+// partitionChecksums returns the checksum of each map task's file for the
+// given reduce partition, or nil if any is unknown.
+func partitionChecksums(job *Job, partition int) []uint32 {
+	sums := make([]uint32, len(job.MapTasks))
+	for i, task := range job.MapTasks {
+		if partition >= len(task.Checksums) {
+			return nil
+		}
+		sums[i] = task.Checksums[partition]
+	}
+	return sums
+}
+
+func allCompleted(tasks []common.Task) bool {
+	for _, task := range tasks {
+		if task.Status != common.TaskStatusCompleted {
+			return false
+		}
+	}
+	return true
+}
+
+// Done reports whether every job has finished. It is false while the
+// coordinator has no jobs at all.
 func (c *Coordinator) Done() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if len(c.jobs) == 0 {
-		return false // Keep running if no jobs? Or done?
-		// For the CLI behavior, we want to exit when the initial job is done.
-		// But for API server, we want to run forever.
-		// Let's change semantic: Done() returns true only if NO jobs are running AND we decide to stop.
-		// Actually, for the API server refactor, main.go will likely run forever.
-		// So this method might be deprecated or just check if "initial job" is done if we want to support legacy CLI mode.
+		return false
 	}
 
 	allDone := true
 	for _, job := range c.jobs {
-		if job.Status != "COMPLETED" && job.Status != "FAILED" {
+		if !job.Done() {
 			allDone = false
 			break
 		}
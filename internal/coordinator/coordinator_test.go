@@ -1,9 +1,20 @@
 package coordinator
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
 )
 
 func TestCoordinatorSequence(t *testing.T) {
@@ -113,3 +124,1235 @@ func TestCoordinator_Wait(t *testing.T) {
 		t.Errorf("Expected Wait (-1), got %v", reply.TaskType)
 	}
 }
+
+func TestCoordinator_TaskTimeout(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, 1)
+
+	args := &common.TaskArgs{WorkerID: "w1"}
+	reply := &common.TaskReply{}
+	if err := c.GetTask(args, reply); err != nil {
+		t.Fatalf("GetTask failed: %v", err)
+	}
+
+	// Expire the task as the monitor would after the timeout.
+	job, _ := c.GetJobStatus(jobID)
+	c.mu.Lock()
+	c.requeueExpired(job.MapTasks[0].StartTime.Add(defaultTaskTimeout + time.Second))
+	c.mu.Unlock()
+
+	reply2 := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w2"}, reply2); err != nil {
+		t.Fatalf("GetTask failed: %v", err)
+	}
+	if reply2.TaskType != common.TaskTypeMap || reply2.Attempt != 1 {
+		t.Fatalf("Expected map task retry with attempt 1, got type %v attempt %d", reply2.TaskType, reply2.Attempt)
+	}
+
+	// The original worker's late report must not complete the reassigned task.
+	late := &common.ReportTaskReply{}
+	if err := c.ReportTask(&common.ReportTaskArgs{JobID: jobID, TaskType: common.TaskTypeMap, WorkerID: "w1"}, late); err != nil {
+		t.Fatalf("ReportTask failed: %v", err)
+	}
+	if late.Ack {
+		t.Error("Late report from timed-out worker was acknowledged")
+	}
+
+	var sb strings.Builder
+	if err := c.Metrics().WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`mr_task_timeouts_total{type="map"} 1`,
+		`mr_task_retries_total{type="map"} 1`,
+		`mr_tasks{type="map",state="in_progress"} 1`,
+		`mr_jobs{state="IN_PROGRESS"} 1`,
+		`mr_live_workers 2`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+}
+
+func TestCoordinator_ShortTaskTimeout(t *testing.T) {
+	c := NewCoordinator()
+	c.SetTaskTimeout(0)
+	if c.taskTimeout != defaultTaskTimeout {
+		t.Errorf("Expected a zero timeout to restore the default, got %v", c.taskTimeout)
+	}
+
+	// The monitor must not tick at an interval of zero.
+	c.SetTaskTimeout(time.Nanosecond)
+	if _, err := c.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+}
+
+func TestCoordinator_CountersFromWinningAttempt(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, 1)
+
+	first := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, first); err != nil {
+		t.Fatalf("GetTask failed: %v", err)
+	}
+	job, _ := c.GetJobStatus(jobID)
+	c.mu.Lock()
+	c.requeueExpired(job.MapTasks[0].StartTime.Add(defaultTaskTimeout + time.Second))
+	c.mu.Unlock()
+
+	second := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w2"}, second); err != nil {
+		t.Fatalf("GetTask failed: %v", err)
+	}
+
+	report := func(workerID string, attempt int) bool {
+		reply := &common.ReportTaskReply{}
+		err := c.ReportTask(&common.ReportTaskArgs{
+			JobID:    jobID,
+			TaskType: common.TaskTypeMap,
+			WorkerID: workerID,
+			Attempt:  attempt,
+			Counters: map[string]int64{"MAP_OUTPUT_RECORDS": 5},
+		}, reply)
+		if err != nil {
+			t.Fatalf("ReportTask failed: %v", err)
+		}
+		return reply.Ack
+	}
+
+	if report("w1", first.Attempt) {
+		t.Error("Stale attempt was acknowledged")
+	}
+	if !report("w2", second.Attempt) {
+		t.Error("Winning attempt was not acknowledged")
+	}
+	if report("w2", second.Attempt) {
+		t.Error("Duplicate report was acknowledged")
+	}
+
+	snap, _ := c.Snapshot(jobID)
+	if got := snap.Counters["MAP_OUTPUT_RECORDS"]; got != 5 {
+		t.Errorf("Expected counters from one attempt (5), got %d", got)
+	}
+}
+
+func TestCoordinator_WaitJob(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1"}, 1)
+	snap, _ := c.Snapshot(jobID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitJob(ctx, jobID, snap.Version); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded for an unchanged job, got %v", err)
+	}
+
+	done := make(chan Job)
+	go func() {
+		job, err := c.WaitJob(context.Background(), jobID, snap.Version)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- job
+	}()
+	if err := c.Cancel(jobID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-done:
+		if job.Status != StatusCancelled || job.Version <= snap.Version {
+			t.Errorf("Unexpected job after wait: status %s version %d", job.Status, job.Version)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitJob did not return after the job changed")
+	}
+
+	if _, err := c.WaitJob(context.Background(), 99, 0); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestCoordinator_BadInputsRerunMaps(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1", "f2"}, 1)
+
+	for i := 0; i < 2; i++ {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+			t.Fatal(err)
+		}
+		c.ReportTask(&common.ReportTaskArgs{
+			JobID: jobID, TaskID: reply.TaskID, TaskType: common.TaskTypeMap, WorkerID: "w1",
+			Counters: map[string]int64{"MAP_INPUT_RECORDS": 3}, Checksums: []uint32{uint32(10 + i)},
+		}, &common.ReportTaskReply{})
+	}
+
+	reduce := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w2"}, reduce); err != nil {
+		t.Fatal(err)
+	}
+	if reduce.TaskType != common.TaskTypeReduce || len(reduce.Checksums) != 2 || reduce.Checksums[1] != 11 {
+		t.Fatalf("Expected a reduce task with both maps' checksums, got %+v", reduce)
+	}
+	c.ReportTask(&common.ReportTaskArgs{
+		JobID: jobID, TaskID: reduce.TaskID, TaskType: common.TaskTypeReduce, WorkerID: "w2",
+		Attempt: reduce.Attempt, BadInputs: []int{1},
+	}, &common.ReportTaskReply{})
+
+	snap, _ := c.Snapshot(jobID)
+	if snap.MapTasks[1].Status != common.TaskStatusIdle || snap.MapTasks[1].Attempt != 1 {
+		t.Errorf("Expected map 1 to be requeued, got %v attempt %d", snap.MapTasks[1].Status, snap.MapTasks[1].Attempt)
+	}
+	if snap.MapTasks[0].Status != common.TaskStatusCompleted {
+		t.Error("Expected map 0 to stay completed")
+	}
+	if snap.ReduceTasks[0].Status != common.TaskStatusIdle {
+		t.Error("Expected the reduce task to be requeued")
+	}
+	if got := snap.Counters["MAP_INPUT_RECORDS"]; got != 3 {
+		t.Errorf("Expected the rerun map's counters to be subtracted (3), got %d", got)
+	}
+
+	next := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w3"}, next); err != nil {
+		t.Fatal(err)
+	}
+	if next.TaskType != common.TaskTypeMap || next.TaskID != 1 {
+		t.Errorf("Expected map 1 to be assigned before the reduce, got %v %d", next.TaskType, next.TaskID)
+	}
+}
+
+func TestCoordinator_StateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	c := NewCoordinator()
+	if err := c.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	jobID := c.SubmitJob([]string{"f1", "f2"}, 1)
+	reply := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	c.ReportTask(&common.ReportTaskArgs{
+		JobID: jobID, TaskID: reply.TaskID, TaskType: common.TaskTypeMap, WorkerID: "w1",
+		Counters: map[string]int64{"MAP_INPUT_RECORDS": 4},
+	}, &common.ReportTaskReply{})
+	c.Close()
+
+	restored := NewCoordinator()
+	if err := restored.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	snap, ok := restored.Snapshot(jobID)
+	if !ok {
+		t.Fatal("Expected the job to be restored")
+	}
+	if snap.MapTasks[0].Status != common.TaskStatusCompleted || snap.Counters["MAP_INPUT_RECORDS"] != 4 {
+		t.Errorf("Unexpected restored job: %+v", snap)
+	}
+	// Finishing the job on the restored coordinator must work as usual.
+	reply = &common.TaskReply{}
+	if err := restored.GetTask(&common.TaskArgs{WorkerID: "w2"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.TaskType != common.TaskTypeMap || reply.TaskID != 1 {
+		t.Errorf("Expected map 1 to be assigned, got %v %d", reply.TaskType, reply.TaskID)
+	}
+
+	if next := restored.SubmitJob([]string{"f3"}, 1); next == jobID {
+		t.Errorf("Expected a new job ID after restore, got %d again", next)
+	}
+}
+
+func TestCoordinator_WorkerSlots(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.SubmitJob([]string{"f1", "f2", "f3"}, 1)
+
+	get := func(slots int) *common.TaskReply {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1", Slots: slots}, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	first, second := get(2), get(2)
+	if first.TaskType != common.TaskTypeMap || second.TaskType != common.TaskTypeMap {
+		t.Fatalf("Expected two map tasks for two slots, got %v and %v", first.TaskType, second.TaskType)
+	}
+	if third := get(2); third.TaskType != -1 {
+		t.Errorf("Expected no task while all slots are busy, got %v %d", third.TaskType, third.TaskID)
+	}
+
+	c.ReportTask(&common.ReportTaskArgs{
+		JobID: jobID, TaskID: first.TaskID, TaskType: common.TaskTypeMap, WorkerID: "w1",
+	}, &common.ReportTaskReply{})
+	if next := get(2); next.TaskType != common.TaskTypeMap {
+		t.Errorf("Expected a task once a slot was freed, got %v", next.TaskType)
+	}
+
+	if err := c.Heartbeat(&common.HeartbeatArgs{WorkerID: "w1", Slots: 4, Busy: 2}, &common.HeartbeatReply{}); err != nil {
+		t.Fatal(err)
+	}
+	workers := c.Workers()
+	if len(workers) != 1 || workers[0].Slots != 4 || workers[0].RunningTasks != 2 {
+		t.Errorf("Unexpected workers %+v", workers)
+	}
+}
+
+func TestCoordinator_Register(t *testing.T) {
+	c := NewCoordinator()
+	register := func(args common.RegisterArgs) string {
+		reply := &common.RegisterReply{}
+		if err := c.Register(&args, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.WorkerID
+	}
+
+	// Containers often share a hostname and PID; IDs must still differ.
+	a := register(common.RegisterArgs{Hostname: "box", Slots: 2})
+	b := register(common.RegisterArgs{Hostname: "box", Slots: 2})
+	if a == b || !strings.HasPrefix(a, "box-") {
+		t.Errorf("Expected distinct IDs based on the hostname, got %q and %q", a, b)
+	}
+	// A live worker's ID cannot be taken over.
+	if taken := register(common.RegisterArgs{WorkerID: a, Hostname: "other"}); taken == a || !strings.HasPrefix(taken, "other-") {
+		t.Errorf("Expected a new ID instead of live worker %q's, got %q", a, taken)
+	}
+	// It can be registered again once the coordinator has forgotten the
+	// worker or not heard from it within the task timeout.
+	c.mu.Lock()
+	c.workers[a].lastSeen = time.Now().Add(-2 * c.taskTimeout)
+	c.mu.Unlock()
+	if again := register(common.RegisterArgs{WorkerID: a, Hostname: "box"}); again != a {
+		t.Errorf("Expected re-registration to keep ID %q, got %q", a, again)
+	}
+	if fresh := register(common.RegisterArgs{WorkerID: "box-restored", Hostname: "box"}); fresh != "box-restored" {
+		t.Errorf("Expected an unknown ID to be kept, got %q", fresh)
+	}
+
+	hb := &common.HeartbeatReply{}
+	c.Heartbeat(&common.HeartbeatArgs{WorkerID: a}, hb)
+	if !hb.Registered {
+		t.Error("Expected heartbeat from a registered worker to report it as registered")
+	}
+	c.Heartbeat(&common.HeartbeatArgs{WorkerID: "stranger"}, hb)
+	if hb.Registered {
+		t.Error("Expected heartbeat from an unknown worker to ask it to register")
+	}
+
+	// A worker that only sent heartbeats so far, e.g. one registered with
+	// a coordinator that restarted, keeps its ID.
+	if again := register(common.RegisterArgs{WorkerID: "stranger", Hostname: "box"}); again != "stranger" {
+		t.Errorf("Expected an unregistered worker to keep its ID, got %q", again)
+	}
+
+	workers := c.Workers()
+	if len(workers) != 5 {
+		t.Fatalf("Expected 5 workers, got %+v", workers)
+	}
+	for _, w := range workers {
+		if w.ID == a && (w.Hostname != "box" || w.RegisteredAt.IsZero()) {
+			t.Errorf("Unexpected registered worker %+v", w)
+		}
+	}
+}
+
+func TestCoordinator_LabelsAndApps(t *testing.T) {
+	c := NewCoordinator()
+	jobID := c.Submit(JobSpec{Files: []string{"f1"}, NReduce: 1, Labels: map[string]string{"zone": "a"}})
+
+	register := func(apps []string, labels map[string]string) string {
+		reply := &common.RegisterReply{}
+		c.Register(&common.RegisterArgs{Hostname: "h", Apps: apps, Labels: labels}, reply)
+		return reply.WorkerID
+	}
+	get := func(workerID string) common.TaskType {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: workerID}, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.TaskType
+	}
+
+	if got := get("anonymous"); got != -1 {
+		t.Errorf("Expected an unlabelled worker to get no task, got %v", got)
+	}
+	if got := get(register(nil, map[string]string{"zone": "b"})); got != -1 {
+		t.Errorf("Expected a worker in another zone to get no task, got %v", got)
+	}
+	if got := get(register([]string{"wordcount-mq"}, map[string]string{"zone": "a"})); got != -1 {
+		t.Errorf("Expected a worker without the job's app to get no task, got %v", got)
+	}
+	match := register([]string{common.DefaultApp}, map[string]string{"zone": "a", "gpu": "true"})
+	if got := get(match); got != common.TaskTypeMap {
+		t.Errorf("Expected the matching worker to get the map task, got %v", got)
+	}
+	if snap, _ := c.Snapshot(jobID); snap.MapTasks[0].WorkerID != match {
+		t.Errorf("Expected the task to run on %s, got %s", match, snap.MapTasks[0].WorkerID)
+	}
+}
+
+func TestCoordinator_Locality(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locality.json")
+	if err := os.WriteFile(path, []byte(`{"f1": ["node-a"], "f2": ["node-b"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := LoadStaticLocality(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCoordinator()
+	c.SetLocalityResolver(resolver)
+	c.SetLocalityDelay(time.Hour)
+	jobID := c.Submit(JobSpec{
+		Files:          []string{"f0", "f1", "f2", "f3"},
+		NReduce:        1,
+		PreferredHosts: map[string][]string{"f3": {"node-c"}},
+	})
+
+	reg := &common.RegisterReply{}
+	c.Register(&common.RegisterArgs{Hostname: "NODE-B"}, reg)
+	get := func() *common.TaskReply {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: reg.WorkerID, Slots: 3}, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := get(); reply.TaskType != common.TaskTypeMap || reply.FileName != "f2" {
+		t.Fatalf("Expected the local split f2 first, got %v %q", reply.TaskType, reply.FileName)
+	}
+	if reply := get(); reply.TaskType != common.TaskTypeMap || reply.FileName != "f0" {
+		t.Fatalf("Expected the split without preferences next, got %v %q", reply.TaskType, reply.FileName)
+	}
+	if reply := get(); reply.TaskType != -1 {
+		t.Errorf("Expected remote splits to wait for their hosts, got %q", reply.FileName)
+	}
+
+	c.SetLocalityDelay(0)
+	if reply := get(); reply.TaskType != common.TaskTypeMap || reply.FileName != "f1" {
+		t.Errorf("Expected f1 to run remotely once the delay passed, got %v %q", reply.TaskType, reply.FileName)
+	}
+	snap, _ := c.Snapshot(jobID)
+	if got := snap.MapTasks[3].PreferredHosts; len(got) != 1 || got[0] != "node-c" {
+		t.Errorf("Expected explicit hosts to override the resolver, got %v", got)
+	}
+	if l := snap.Locality; l.Local != 1 || l.Remote != 1 || l.NoPreference != 1 || l.HitRate() != 0.5 {
+		t.Errorf("Unexpected locality stats %+v", l)
+	}
+}
+
+func TestCoordinator_JobOrder(t *testing.T) {
+	c := NewCoordinator()
+	var ids []int
+	for i := 0; i < 8; i++ {
+		ids = append(ids, c.SubmitJob([]string{fmt.Sprintf("f%d", i)}, 1))
+	}
+	// Each job's only map task goes out in submission order, every time.
+	for _, want := range ids {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1", Slots: len(ids)}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.TaskType != common.TaskTypeMap || reply.JobID != want {
+			t.Errorf("Expected the map task of job %d, got %v of job %d", want, reply.TaskType, reply.JobID)
+		}
+	}
+}
+
+func TestCoordinator_OutputCommit(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCoordinator()
+	c.SetOutputDir(dir)
+	spec := &outputs.Spec{Dir: "out", Prefix: "part", Format: outputs.FormatJSONL, SuccessMarker: true, Manifest: true}
+	jobID := c.Submit(JobSpec{Files: []string{"f1"}, NReduce: 2, Output: spec})
+
+	run := func(want common.TaskType) *common.TaskReply {
+		t.Helper()
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil || reply.TaskType != want {
+			t.Fatalf("Expected a %v task, got %v (%v)", want, reply.TaskType, err)
+		}
+		return reply
+	}
+	report := func(reply *common.TaskReply, out *outputs.Partition) {
+		t.Helper()
+		args := &common.ReportTaskArgs{JobID: jobID, TaskID: reply.TaskID, TaskType: reply.TaskType, WorkerID: "w1", Output: out}
+		if err := c.ReportTask(args, &common.ReportTaskReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report(run(common.TaskTypeMap), nil)
+	for i := 0; i < 2; i++ {
+		reply := run(common.TaskTypeReduce)
+		if reply.Output == nil || *reply.Output != *spec {
+			t.Errorf("Expected reduce tasks to carry the output spec, got %+v", reply.Output)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out", outputs.SuccessName)); err == nil {
+			t.Error("Expected no _SUCCESS marker before every reducer committed")
+		}
+		report(reply, &outputs.Partition{Partition: reply.TaskID, File: spec.FileName(jobID, reply.TaskID), Records: 3, Bytes: 40, CRC32: 7})
+	}
+
+	if job, _ := c.Snapshot(jobID); job.Status != StatusCompleted {
+		t.Fatalf("Expected the job to complete, got %s (%s)", job.Status, job.Error)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", outputs.SuccessName)); err != nil {
+		t.Errorf("Expected a _SUCCESS marker: %v", err)
+	}
+	m, err := outputs.ReadManifest(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.JobID != jobID || m.Format != outputs.FormatJSONL || m.Records != 6 || m.Bytes != 80 ||
+		len(m.Partitions) != 2 || m.Partitions[1].File != "part-1.jsonl" {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+
+	// A reducer that does not report its file leaves nothing to commit.
+	c.SetOutputDir(t.TempDir())
+	jobID = c.Submit(JobSpec{Files: []string{"f1"}, NReduce: 1, Output: spec})
+	report(run(common.TaskTypeMap), nil)
+	report(run(common.TaskTypeReduce), nil)
+	if job, _ := c.Snapshot(jobID); job.Status != StatusFailed || !strings.Contains(job.Error, "reduce task 0") {
+		t.Errorf("Expected the job to fail without a committed manifest, got %s (%s)", job.Status, job.Error)
+	}
+}
+
+func TestCoordinator_Retention(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCoordinator()
+	c.SetOutputDir(dir)
+
+	// Each job has two map tasks and two reduce partitions.
+	submit := func() int {
+		t.Helper()
+		id := c.Submit(JobSpec{Files: []string{"f1", "f2"}, NReduce: 2})
+		for m := 0; m < 2; m++ {
+			for r := 0; r < 2; r++ {
+				if err := os.WriteFile(filepath.Join(dir, common.IntermediateName(id, m, r)), []byte("{}"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return id
+	}
+	left := func(id int) int {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("mr-%d-*", id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(matches)
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting until %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	complete := func(id int) {
+		t.Helper()
+		for i := 0; i < 4; i++ {
+			reply := &common.TaskReply{}
+			if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+				t.Fatal(err)
+			}
+			args := &common.ReportTaskArgs{JobID: id, TaskID: reply.TaskID, TaskType: reply.TaskType, WorkerID: "w1"}
+			if err := c.ReportTask(args, &common.ReportTaskReply{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The default policy keeps every file.
+	completed := submit()
+	complete(completed)
+	if job, _ := c.Snapshot(completed); job.Status != StatusCompleted || job.IntermediateDeleted || left(completed) != 4 {
+		t.Errorf("Expected the default policy to keep the 4 files of a %s job, got %d", job.Status, left(completed))
+	}
+
+	c.SetRetention(RetentionPolicy{Intermediate: time.Nanosecond, KeepFailed: true, JobTTL: time.Hour})
+	waitFor("the completed job's files are deleted", func() bool {
+		job, _ := c.Snapshot(completed)
+		return job.IntermediateDeleted
+	})
+	if job, _ := c.Snapshot(completed); job.Status != StatusCompleted || job.FinishedAt.IsZero() || left(completed) != 0 {
+		t.Errorf("Expected a completed job without intermediate files, got %s with %d files", job.Status, left(completed))
+	}
+
+	// Workers are told once to delete the files from their own directory.
+	heartbeat := func(workerID string) []common.IntermediateFiles {
+		t.Helper()
+		reply := &common.HeartbeatReply{}
+		if err := c.Heartbeat(&common.HeartbeatArgs{WorkerID: workerID}, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Cleanup
+	}
+	want := []common.IntermediateFiles{{JobID: completed, NMap: 2, NReduce: 2}}
+	if got := heartbeat("w1"); !slices.Equal(got, want) {
+		t.Errorf("Expected the heartbeat reply to list %v, got %v", want, got)
+	}
+	if got := heartbeat("w1"); len(got) != 0 {
+		t.Errorf("Expected the next heartbeat to list nothing, got %v", got)
+	}
+	c.mu.Lock()
+	c.pruneCleanups(time.Now().Add(time.Hour))
+	c.mu.Unlock()
+	if got := heartbeat("w2"); len(got) != 0 {
+		t.Errorf("Expected cleanups older than the task timeout to be forgotten, got %v", got)
+	}
+
+	// Files of a cancelled job are kept until asked for.
+	cancelled := submit()
+	if err := c.Cancel(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	running := submit()
+	if job, _ := c.Snapshot(cancelled); job.IntermediateDeleted || left(cancelled) != 4 {
+		t.Errorf("Expected a cancelled job to keep its 4 files, got %d", left(cancelled))
+	}
+	if err := c.DeleteJobData(running); err != ErrJobRunning {
+		t.Errorf("Expected ErrJobRunning, got %v", err)
+	}
+	if err := c.DeleteJobData(99); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+	if err := c.DeleteJobData(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := c.Snapshot(cancelled); !job.IntermediateDeleted || left(cancelled) != 0 {
+		t.Errorf("Expected DeleteJobData to remove every file, %d left", left(cancelled))
+	}
+
+	// Past the TTL, jobs are forgotten along with any files still kept.
+	kept := submit()
+	c.Cancel(kept)
+	later := time.Now().Add(2 * time.Hour)
+	waitFor("finished jobs are evicted", func() bool {
+		c.mu.Lock()
+		c.sweep(later)
+		c.mu.Unlock()
+		return len(c.Jobs()) == 1
+	})
+	if _, ok := c.Snapshot(running); !ok {
+		t.Error("Expected the running job to stay")
+	}
+	if left(kept) != 0 {
+		t.Errorf("Expected an evicted job's files to be deleted, %d left", left(kept))
+	}
+	if _, err := c.WaitJob(context.Background(), completed, 0); err != ErrJobNotFound {
+		t.Errorf("Expected an evicted job to be unknown, got %v", err)
+	}
+}
+
+func TestCoordinator_Workflow(t *testing.T) {
+	c := NewCoordinator()
+	c.SetOutputDir("/data")
+
+	// run hands out and completes tasks until job id finishes.
+	run := func(id int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if job, _ := c.Snapshot(id); job.Status != StatusInProgress {
+				return
+			}
+			reply := &common.TaskReply{}
+			if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.TaskType != common.TaskTypeMap && reply.TaskType != common.TaskTypeReduce {
+				continue
+			}
+			args := &common.ReportTaskArgs{JobID: reply.JobID, TaskID: reply.TaskID, TaskType: reply.TaskType, WorkerID: "w1", Attempt: reply.Attempt}
+			if err := c.ReportTask(args, &common.ReportTaskReply{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Fatalf("Job %d did not finish", id)
+	}
+	stage := func(id int, name string) Stage {
+		t.Helper()
+		wf, ok := c.SnapshotWorkflow(id)
+		if !ok {
+			t.Fatalf("Workflow %d not found", id)
+		}
+		for _, st := range wf.Stages {
+			if st.Name == name {
+				return st
+			}
+		}
+		t.Fatalf("Stage %q not found", name)
+		return Stage{}
+	}
+
+	// a feeds b and c, which both feed d.
+	id, err := c.SubmitWorkflow(WorkflowSpec{Name: "diamond", Stages: []StageSpec{
+		{Name: "d", After: []string{"b", "c"}, Job: JobSpec{NReduce: 1}},
+		{Name: "b", After: []string{"a"}, Job: JobSpec{NReduce: 1}},
+		{Name: "c", After: []string{"a"}, Job: JobSpec{Files: []string{"extra"}, NReduce: 1}},
+		{Name: "a", Job: JobSpec{Files: []string{"f1", "f2"}, NReduce: 2}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := stage(id, "a"); st.Status != StatusInProgress {
+		t.Fatalf("Expected stage a to start, got %s", st.Status)
+	}
+	if st := stage(id, "b"); st.Status != StagePending {
+		t.Errorf("Expected stage b to wait for a, got %s", st.Status)
+	}
+
+	a := stage(id, "a").JobID
+	run(a)
+	b, cs := stage(id, "b"), stage(id, "c")
+	if b.Status != StatusInProgress || cs.Status != StatusInProgress {
+		t.Fatalf("Expected b and c to start after a, got %s and %s", b.Status, cs.Status)
+	}
+	job, _ := c.Snapshot(cs.JobID)
+	want := []string{"extra", fmt.Sprintf("/data/mr-out-%d-0", a), fmt.Sprintf("/data/mr-out-%d-1", a)}
+	if fmt.Sprint(job.Files) != fmt.Sprint(want) {
+		t.Errorf("Expected stage c to read %v, got %v", want, job.Files)
+	}
+
+	// Cancelling c skips d, but b runs to the end.
+	if err := c.Cancel(cs.JobID); err != nil {
+		t.Fatal(err)
+	}
+	if st := stage(id, "d"); st.Status != StageSkipped {
+		t.Errorf("Expected d to be skipped, got %s", st.Status)
+	}
+	if wf, _ := c.SnapshotWorkflow(id); wf.Status != StatusInProgress {
+		t.Errorf("Expected the workflow to run until b ends, got %s", wf.Status)
+	}
+	run(b.JobID)
+	wf, _ := c.SnapshotWorkflow(id)
+	if wf.Status != StatusFailed || !strings.Contains(wf.Error, `stage "c"`) || wf.FinishedAt.IsZero() {
+		t.Errorf("Expected the workflow to fail because of stage c, got %s %q", wf.Status, wf.Error)
+	}
+
+	// A chain whose stages all complete.
+	id, err = c.SubmitWorkflow(WorkflowSpec{Stages: []StageSpec{
+		{Name: "first", Job: JobSpec{Files: []string{"f1"}, NReduce: 1}},
+		{Name: "second", After: []string{"first"}, Job: JobSpec{NReduce: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	run(stage(id, "first").JobID)
+	run(stage(id, "second").JobID)
+	if wf, err := c.WaitWorkflow(ctx, id, wf.Version); err != nil || wf.Status != StatusCompleted {
+		t.Errorf("Expected the chain to complete, got %s (%v)", wf.Status, err)
+	}
+	if err := c.CancelWorkflow(id); err != ErrWorkflowNotRunning {
+		t.Errorf("Expected ErrWorkflowNotRunning, got %v", err)
+	}
+
+	// A stage whose inputs, with the upstream partitions, exceed the limits
+	// fails the workflow instead of starting.
+	c.SetLimits(Limits{MaxInputs: 3})
+	id, err = c.SubmitWorkflow(WorkflowSpec{Stages: []StageSpec{
+		{Name: "first", Job: JobSpec{Files: []string{"f1"}, NReduce: 3}},
+		{Name: "second", After: []string{"first"}, Job: JobSpec{Files: []string{"extra"}, NReduce: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(stage(id, "first").JobID)
+	if st := stage(id, "second"); st.Status != StatusFailed {
+		t.Errorf("Expected the second stage to fail, got %s", st.Status)
+	}
+	if wf, _ := c.SnapshotWorkflow(id); wf.Status != StatusFailed || !strings.Contains(wf.Error, "input files") {
+		t.Errorf("Expected the workflow to fail over the input limit, got %s %q", wf.Status, wf.Error)
+	}
+	c.SetLimits(Limits{})
+
+	invalid := map[string][]StageSpec{
+		"cycle": {
+			{Name: "x", After: []string{"y"}, Job: JobSpec{NReduce: 1}},
+			{Name: "y", After: []string{"x"}, Job: JobSpec{NReduce: 1}},
+		},
+		"unknown":   {{Name: "x", After: []string{"nope"}, Job: JobSpec{NReduce: 1}}},
+		"no inputs": {{Name: "x", Job: JobSpec{NReduce: 1}}},
+		"duplicate": {
+			{Name: "x", Job: JobSpec{Files: []string{"f"}, NReduce: 1}},
+			{Name: "x", Job: JobSpec{Files: []string{"f"}, NReduce: 1}},
+		},
+	}
+	for name, stages := range invalid {
+		if _, err := c.SubmitWorkflow(WorkflowSpec{Stages: stages}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCoordinator_StateFileInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	c := NewCoordinator()
+	if err := c.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	read := func() persistedState {
+		t.Helper()
+		var st persistedState
+		b, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(b, &st)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	// A submitted job is saved by the time Submit returns.
+	id := c.SubmitJob([]string{"f1"}, 1)
+	if st := read(); len(st.Jobs) != 1 || st.Jobs[0].ID != id {
+		t.Fatalf("Expected the submitted job to be saved, got %+v", st.Jobs)
+	}
+
+	// Task assignments are saved shortly after, without blocking GetTask.
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, &common.TaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for read().Jobs[0].MapTasks[0].Status != common.TaskStatusInProgress {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the assignment to be saved in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCoordinator_CancelWorkflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	c := NewCoordinator()
+	if err := c.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SubmitWorkflow(WorkflowSpec{Stages: []StageSpec{
+		{Name: "first", Job: JobSpec{Files: []string{"f1"}, NReduce: 1}},
+		{Name: "second", After: []string{"first"}, Job: JobSpec{NReduce: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CancelWorkflow(id); err != nil {
+		t.Fatal(err)
+	}
+	wf, _ := c.SnapshotWorkflow(id)
+	if wf.Status != StatusCancelled || wf.Stages[0].Status != StatusCancelled || wf.Stages[1].Status != StageSkipped {
+		t.Errorf("Unexpected cancelled workflow: %+v", wf)
+	}
+	if job, _ := c.Snapshot(wf.Stages[0].JobID); job.Status != StatusCancelled {
+		t.Errorf("Expected the first stage's job to be cancelled, got %s", job.Status)
+	}
+	c.Close()
+
+	restored := NewCoordinator()
+	if err := restored.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := restored.SnapshotWorkflow(id); !ok || got.Status != StatusCancelled || len(got.Stages) != 2 {
+		t.Errorf("Expected the workflow to be restored, got %+v", got)
+	}
+	next, _ := restored.SubmitWorkflow(WorkflowSpec{Stages: []StageSpec{{Name: "x", Job: JobSpec{Files: []string{"f"}, NReduce: 1}}}})
+	if next == id {
+		t.Errorf("Expected a new workflow ID after restore, got %d again", next)
+	}
+
+	// Past the TTL, the finished workflow is evicted and the next save
+	// records its removal.
+	restored.SetRetention(RetentionPolicy{JobTTL: time.Hour})
+	restored.mu.Lock()
+	restored.sweep(time.Now().Add(2 * time.Hour))
+	changes := restored.changes()
+	restored.mu.Unlock()
+	if _, ok := restored.SnapshotWorkflow(id); ok {
+		t.Error("Expected the cancelled workflow to be evicted")
+	}
+	if _, ok := restored.SnapshotWorkflow(next); !ok {
+		t.Error("Expected the running workflow to stay")
+	}
+	if !slices.Equal(changes.RemovedWorkflows, []int{id}) {
+		t.Errorf("Expected the changes to remove workflow %d, got %v", id, changes.RemovedWorkflows)
+	}
+	var entries [][]byte
+	for _, e := range []persistedState{{Workflows: []Workflow{{ID: id}, {ID: next}}}, changes} {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, b)
+	}
+	if st, err := replay(entries); err != nil || len(st.Workflows) != 1 || st.Workflows[0].ID != next {
+		t.Errorf("Expected replaying the changes to drop workflow %d, got %+v, %v", id, st.Workflows, err)
+	}
+}
+
+func TestCoordinator_Admission(t *testing.T) {
+	c := NewCoordinator()
+	c.SetLimits(Limits{MaxReduce: 4, MaxInputs: 2, MaxRunningPerQueue: 1, MaxRunningPerUser: 2, MaxQueued: 1})
+
+	var limitErr *LimitError
+	if _, err := c.TrySubmit(JobSpec{Files: []string{"f1"}, NReduce: 5}); !errors.As(err, &limitErr) || limitErr.Limit != "nReduce" {
+		t.Errorf("Expected an nReduce limit error, got %v", err)
+	}
+	if _, err := c.TrySubmit(JobSpec{Files: []string{"f1", "f2", "f3"}, NReduce: 1}); !errors.As(err, &limitErr) || limitErr.Limit != "input files" {
+		t.Errorf("Expected an input files limit error, got %v", err)
+	}
+
+	a, _ := c.TrySubmit(JobSpec{Files: []string{"f1"}, NReduce: 1, Queue: "etl", User: "ann"})
+	b, _ := c.TrySubmit(JobSpec{Files: []string{"f2"}, NReduce: 1, Queue: "etl", User: "bob"})
+	other, _ := c.TrySubmit(JobSpec{Files: []string{"f3"}, NReduce: 1, User: "ann"})
+	for id, want := range map[int]string{a: StatusInProgress, b: StatusQueued, other: StatusInProgress} {
+		if job, _ := c.Snapshot(id); job.Status != want {
+			t.Errorf("Expected job %d to be %s, got %s", id, want, job.Status)
+		}
+	}
+	if job, _ := c.Snapshot(b); job.QueuePosition != 1 || job.Queue != "etl" {
+		t.Errorf("Expected job %d first in the etl queue, got %+v", b, job)
+	}
+	if job, _ := c.Snapshot(other); job.Queue != DefaultQueue {
+		t.Errorf("Expected the default queue, got %q", job.Queue)
+	}
+
+	// The queue is full for etl jobs, but jobs that can start at once are
+	// still accepted.
+	if _, err := c.TrySubmit(JobSpec{Files: []string{"f4"}, NReduce: 1, Queue: "etl"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if _, err := c.TrySubmit(JobSpec{Files: []string{"f4"}, NReduce: 1, Queue: "adhoc"}); err != nil {
+		t.Errorf("Expected a job of another queue to start, got %v", err)
+	}
+
+	// Queued jobs get no tasks.
+	for range 3 {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1", Slots: 10}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.TaskType == common.TaskTypeMap && reply.JobID == b {
+			t.Fatalf("Expected no tasks of queued job %d", b)
+		}
+	}
+
+	// Finishing the running etl job admits the queued one.
+	job, _ := c.Snapshot(b)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan Job)
+	go func() {
+		job, _ := c.WaitJob(ctx, b, job.Version)
+		done <- job
+	}()
+	if err := c.Cancel(a); err != nil {
+		t.Fatal(err)
+	}
+	if job := <-done; job.Status != StatusInProgress || job.QueuePosition != 0 || job.AdmittedAt.IsZero() {
+		t.Errorf("Expected job %d to be admitted, got %+v", b, job)
+	}
+
+	// Queued jobs can be cancelled.
+	d := c.Submit(JobSpec{Files: []string{"f5"}, NReduce: 1, Queue: "etl"})
+	if err := c.Cancel(d); err != nil {
+		t.Errorf("Expected a queued job to be cancellable, got %v", err)
+	}
+	if job, _ := c.Snapshot(d); job.Status != StatusCancelled {
+		t.Errorf("Expected job %d to be cancelled, got %s", d, job.Status)
+	}
+}
+
+func TestCoordinator_AdmissionPerUser(t *testing.T) {
+	c := NewCoordinator()
+	c.SetLimits(Limits{MaxRunningPerUser: 1})
+	first := c.Submit(JobSpec{Files: []string{"f1"}, NReduce: 1, User: "ann"})
+	second := c.Submit(JobSpec{Files: []string{"f2"}, NReduce: 1, User: "ann"})
+	third := c.Submit(JobSpec{Files: []string{"f3"}, NReduce: 1, User: "bob"})
+	if job, _ := c.Snapshot(second); job.Status != StatusQueued {
+		t.Errorf("Expected ann's second job to wait, got %s", job.Status)
+	}
+	if job, _ := c.Snapshot(third); job.Status != StatusInProgress {
+		t.Errorf("Expected bob's job to start past ann's, got %s", job.Status)
+	}
+
+	// Raising the limit admits waiting jobs.
+	c.SetLimits(Limits{MaxRunningPerUser: 2})
+	if job, _ := c.Snapshot(second); job.Status != StatusInProgress {
+		t.Errorf("Expected ann's second job to start, got %s", job.Status)
+	}
+	if job, _ := c.Snapshot(first); job.Status != StatusInProgress {
+		t.Errorf("Expected ann's first job to keep running, got %s", job.Status)
+	}
+}
+
+func TestCoordinator_Replicas(t *testing.T) {
+	dir := t.TempDir()
+	replica := func(id string) *Coordinator {
+		c := NewCoordinator()
+		err := c.SetReplica(Replica{
+			ID:       id,
+			APIAddr:  "http://" + id,
+			Lock:     &FileLock{Path: filepath.Join(dir, "lease.json")},
+			Log:      &FileLog{Dir: filepath.Join(dir, "log")},
+			LeaseTTL: 200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	waitLeader := func(c *Coordinator) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !c.IsLeader() {
+			if time.Now().After(deadline) {
+				t.Fatal("Replica did not become the leader")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	a := replica("a")
+	waitLeader(a)
+	b := replica("b")
+	time.Sleep(100 * time.Millisecond) // Let b see a's lease
+
+	// The standby sends workers and submitters to the leader.
+	leaseA, ok := a.Leader()
+	if !ok || leaseA.Holder != "a" {
+		t.Fatalf("Expected a to hold the lease, got %+v", leaseA)
+	}
+	err := b.GetTask(&common.TaskArgs{WorkerID: "w1"}, &common.TaskReply{})
+	if leader, ok := common.ParseNotLeader(err); !ok || leader != leaseA.RPCAddr {
+		t.Errorf("Expected the standby to name the leader at %s, got %v", leaseA.RPCAddr, err)
+	}
+	var notLeader *common.NotLeaderError
+	if _, err := b.TrySubmit(JobSpec{Files: []string{"f"}, NReduce: 1}); !errors.As(err, &notLeader) {
+		t.Errorf("Expected NotLeaderError from the standby, got %v", err)
+	}
+	if lease, _ := b.Leader(); lease.APIAddr != "http://a" {
+		t.Errorf("Expected the standby to know the leader's API address, got %+v", lease)
+	}
+
+	id := a.Submit(JobSpec{Files: []string{"f1", "f2"}, NReduce: 1})
+	reply := &common.TaskReply{}
+	if err := a.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil || reply.TaskType != common.TaskTypeMap {
+		t.Fatalf("Expected a map task, got %+v, %v", reply, err)
+	}
+
+	// a dies without releasing the lease; b takes over once it runs out,
+	// with the task still assigned to w1, which can report it.
+	a.Close()
+	waitLeader(b)
+	job, ok := b.Snapshot(id)
+	if !ok || job.MapTasks[reply.TaskID].Status != common.TaskStatusInProgress || job.MapTasks[reply.TaskID].WorkerID != "w1" {
+		t.Fatalf("Expected the new leader to resume the job with the task on w1, got %+v", job)
+	}
+	err = b.ReportTask(&common.ReportTaskArgs{JobID: id, TaskID: reply.TaskID, TaskType: reply.TaskType, WorkerID: "w1", Attempt: reply.Attempt}, &common.ReportTaskReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := b.Snapshot(id); job.MapTasks[reply.TaskID].Status != common.TaskStatusCompleted {
+		t.Errorf("Expected the reported task to complete, got %v", job.MapTasks[reply.TaskID].Status)
+	}
+
+	// The deposed leader's term is fenced off the log.
+	leaseB, _ := b.Leader()
+	if leaseB.Term <= leaseA.Term {
+		t.Errorf("Expected a new term after %d, got %d", leaseA.Term, leaseB.Term)
+	}
+	log := &FileLog{Dir: filepath.Join(dir, "log")}
+	if err := log.Append(leaseA.Term, []byte("{}"), false); !errors.Is(err, ErrStaleTerm) {
+		t.Errorf("Expected ErrStaleTerm appending in the old term, got %v", err)
+	}
+	// Only b's snapshot and the changes after it are left, and they hold
+	// the job as b has it.
+	b.mu.Lock()
+	b.flush()
+	b.mu.Unlock()
+	indexes, _ := log.indexes()
+	_, entries, err := log.Read()
+	if err != nil || len(entries) != len(indexes) {
+		t.Errorf("Expected the log to drop the entries before the last snapshot, got %d of %d: %v", len(entries), len(indexes), err)
+	}
+	if first, err := log.read(indexes[0]); err != nil || !first.Snapshot || first.Term != leaseB.Term {
+		t.Errorf("Expected the log to start with b's snapshot, got %+v, %v", first, err)
+	}
+	st, err := replay(entries)
+	if err != nil || len(st.Jobs) != 1 || st.Jobs[0].MapTasks[reply.TaskID].Status != common.TaskStatusCompleted {
+		t.Errorf("Expected the log to hold the completed task, got %+v, %v", st, err)
+	}
+
+	// A clean shutdown gives the lease up at once.
+	if err := b.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	lock := &FileLock{Path: filepath.Join(dir, "lease.json")}
+	if lease, err := lock.Acquire(Lease{Holder: "c"}, time.Second); err != nil || lease.Holder != "c" {
+		t.Errorf("Expected the lease to be free after Shutdown, got %+v, %v", lease, err)
+	}
+}
+
+func TestCoordinator_DrainAndDeregister(t *testing.T) {
+	c := NewCoordinator()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	if err := c.SetStateFile(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	id := c.Submit(JobSpec{Files: []string{"f1", "f2"}, NReduce: 1})
+	for _, w := range []string{"w1", "w2"} {
+		if err := c.GetTask(&common.TaskArgs{WorkerID: w}, &common.TaskReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A deregistering worker's task is requeued at once; others keep theirs.
+	reply := &common.DeregisterReply{}
+	if err := c.Deregister(&common.DeregisterArgs{WorkerID: "w1"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Requeued != 1 {
+		t.Errorf("Expected 1 requeued task, got %d", reply.Requeued)
+	}
+	job, _ := c.Snapshot(id)
+	if job.MapTasks[0].Status != common.TaskStatusIdle || job.MapTasks[0].Attempt != 1 || job.MapTasks[1].WorkerID != "w2" {
+		t.Errorf("Unexpected map tasks after deregistering w1: %+v", job.MapTasks)
+	}
+	// Requests w1 sent before deregistering but that arrive late neither
+	// bring it back nor get it a task.
+	if err := c.Heartbeat(&common.HeartbeatArgs{WorkerID: "w1"}, &common.HeartbeatReply{}); err != nil {
+		t.Fatal(err)
+	}
+	late := &common.TaskReply{}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, late); err != nil {
+		t.Fatal(err)
+	}
+	if late.TaskType != -1 {
+		t.Errorf("Expected no task for a deregistered worker, got %+v", late)
+	}
+	for _, w := range c.Workers() {
+		if w.ID == "w1" {
+			t.Error("Expected w1 to be forgotten")
+		}
+	}
+	// Its departure is only remembered until no such request can come.
+	c.mu.Lock()
+	c.pruneDeparted(time.Now())
+	kept := c.gone("w1")
+	c.pruneDeparted(time.Now().Add(2 * c.taskTimeout))
+	pruned := !c.gone("w1")
+	c.mu.Unlock()
+	if !kept || !pruned {
+		t.Errorf("Expected w1's departure to be kept for the task timeout and then forgotten, kept %v, pruned %v", kept, pruned)
+	}
+
+	// Draining turns new jobs away and ends long polls, while workers
+	// carry on.
+	c.Drain()
+	if _, err := c.TrySubmit(JobSpec{Files: []string{"f"}, NReduce: 1}); !errors.Is(err, ErrDraining) {
+		t.Errorf("Expected ErrDraining, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.WaitJob(ctx, id, job.Version); err != nil {
+		t.Errorf("Expected WaitJob to return at once while draining, got %v", err)
+	}
+	if err := c.GetTask(&common.TaskArgs{WorkerID: "w3"}, &common.TaskReply{}); err != nil {
+		t.Errorf("Expected workers to be served while draining, got %v", err)
+	}
+
+	// Close saves the state a last time.
+	if err := os.Remove(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("Expected Close to persist the state: %v", err)
+	}
+}
+
+func TestOwnsWorkerID(t *testing.T) {
+	for _, tc := range []struct {
+		name, id string
+		want     bool
+	}{
+		{"worker-1", "worker-1", true},
+		{"worker-1", newWorkerID("worker-1"), true},
+		{"worker", "worker-1", false},
+		{"worker", newWorkerID("worker-1"), false}, // Not "worker" with a suffix
+		{"worker-1", "worker-2-0123abcd", false},
+		{"worker-1", "worker-1-0123ABCD", false},
+		{"worker-1", "", false},
+	} {
+		if got := ownsWorkerID(tc.name, tc.id); got != tc.want {
+			t.Errorf("Expected ownsWorkerID(%q, %q) = %v, got %v", tc.name, tc.id, tc.want, got)
+		}
+	}
+}
+
+func TestWithFileMutex_StaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	lock := path + ".lock"
+	leave := func() fs.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(lock, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * fileMutexStale)
+		if err := os.Chtimes(lock, old, old); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	// A crashed holder's mutex is taken over.
+	leave()
+	ran := false
+	if err := withFileMutex(path, func() error { ran = true; return nil }); err != nil || !ran {
+		t.Fatalf("Expected to take over a stale mutex, got %v", err)
+	}
+
+	// Another caller that saw the same stale file broke it and holds a new
+	// mutex by now, which must survive.
+	stale := leave()
+	if err := os.Remove(lock); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lock, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if breakStale(lock, stale) {
+		t.Error("Expected breakStale to leave a mutex taken after the stale one")
+	}
+	if _, err := os.Stat(lock); err != nil {
+		t.Errorf("Expected the new mutex to survive, got %v", err)
+	}
+	if _, err := os.Stat(lock + ".break"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the break file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// defaultLeaseTTL is how long a leader's lease lasts unless renewed.
+const defaultLeaseTTL = 5 * time.Second
+
+// Replica makes a coordinator one of several replicas sharing a Lock and a
+// Log. The replica holding the lease leads: it serves workers and API
+// clients and appends its changes to the Log. The others
+// stand by, answer with a *common.NotLeaderError naming the leader, and take
+// over from the Log once the leader's lease runs out.
+//
+// FileLock and FileLog share the lease and the log through a common
+// directory. Other implementations of Lock and Log, e.g. on top of Raft,
+// plug in the same way.
+type Replica struct {
+	ID      string // Unique among the replicas
+	RPCAddr string // Where workers reach this replica; defaults to the address Listen binds
+	APIAddr string // Where API clients reach this replica, e.g. "http://node-a:8080"
+
+	Lock Lock
+	Log  Log
+
+	// LeaseTTL is how long the lease lasts unless renewed, and so about how
+	// long it takes a standby to take over from a leader that died. The
+	// leader renews it every third of LeaseTTL. Defaults to 5s.
+	LeaseTTL time.Duration
+}
+
+// SetReplica makes the coordinator a replica, see Replica. It starts as a
+// standby and campaigns for the lease once Listen is called. A replica keeps
+// its state in r.Log, so it cannot have a state file as well.
+func (c *Coordinator) SetReplica(r Replica) error {
+	if r.ID == "" || r.Lock == nil || r.Log == nil {
+		return errors.New("a replica needs an ID, a lock and a log")
+	}
+	if r.LeaseTTL <= 0 {
+		r.LeaseTTL = defaultLeaseTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateFile != "" {
+		return errors.New("a replica keeps its state in the log, not in a state file")
+	}
+	c.replica = &r
+	return nil
+}
+
+// IsLeader reports whether the coordinator serves requests: it holds the
+// lease, or is not a replica at all.
+func (c *Coordinator) IsLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replica == nil || c.leads(time.Now())
+}
+
+// Leader returns the lease as this replica last saw it, and whether someone
+// held it then.
+func (c *Coordinator) Leader() (Lease, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease, c.lease.Held(time.Now())
+}
+
+// leads reports whether this replica holds the lease at now. c.mu must be
+// held.
+func (c *Coordinator) leads(now time.Time) bool {
+	return c.leading && now.Before(c.lease.Expires)
+}
+
+// serving returns the error requests fail with when the coordinator is shut
+// down or a standby replica, or nil. c.mu must be held.
+func (c *Coordinator) serving() error {
+	if c.closed {
+		return ErrClosed
+	}
+	if now := time.Now(); c.replica != nil && !c.leads(now) {
+		err := &common.NotLeaderError{}
+		if !c.leading && c.lease.Held(now) {
+			err.Leader = c.lease.RPCAddr
+		}
+		return err
+	}
+	return nil
+}
+
+// campaign tries to take or renew the lease every third of its TTL until
+// the coordinator is closed. A closed leader does not release its lease, as
+// if it had crashed; the standbys take over once it runs out.
+func (c *Coordinator) campaign() {
+	c.mu.Lock()
+	r := *c.replica
+	c.mu.Unlock()
+	self := Lease{Holder: r.ID, RPCAddr: r.RPCAddr, APIAddr: r.APIAddr}
+	ticker := time.NewTicker(r.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		// The lease is taken to start now, before Acquire returns, so the
+		// leader never believes it holds the lease for longer than it does.
+		start := time.Now()
+		lease, err := r.Lock.Acquire(self, r.LeaseTTL)
+		c.mu.Lock()
+		switch {
+		case c.closed:
+		case err != nil:
+			slog.Warn("Failed to acquire the coordinator lease", "replica", r.ID, "error", err)
+			if c.leading && !c.leads(time.Now()) {
+				c.stepDown("lease expired")
+			}
+		case lease.Holder == r.ID:
+			lease.Expires = start.Add(r.LeaseTTL)
+			if !c.leading || lease.Term != c.lease.Term {
+				c.lead(lease)
+			} else {
+				c.lease = lease
+			}
+		default:
+			if c.leading {
+				c.stepDown("lease taken by " + lease.Holder)
+			}
+			if lease.Holder != c.lease.Holder {
+				slog.Info("Following the coordinator leader", "replica", r.ID, "leader", lease.Holder, "rpc_addr", lease.RPCAddr, "term", lease.Term)
+			}
+			c.lease = lease
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// lead makes this replica the leader for lease's term: it resumes from the
+// log and appends a snapshot at once, which fences off any earlier leader
+// still writing. Workers are forgotten and register again. c.mu must be
+// held.
+func (c *Coordinator) lead(lease Lease) {
+	c.lease = lease
+	c.leading = true
+	var st persistedState
+	_, entries, err := c.replica.Log.Read()
+	if err == nil {
+		st, err = replay(entries)
+	}
+	if err != nil {
+		c.stepDown(fmt.Sprintf("cannot read the log: %v", err))
+		return
+	}
+	c.workers = make(map[string]*workerState)
+	c.departed = make(map[string]time.Time)
+	c.restore(st)
+	c.needSnapshot = true
+	c.flush()
+	c.notify()
+	slog.Info("Became the coordinator leader", "replica", c.replica.ID, "term", lease.Term,
+		"jobs", len(st.Jobs), "workflows", len(st.Workflows))
+}
+
+// stepDown makes a leader a standby. Requests fail with NotLeaderError
+// until the lease says who leads now. c.mu must be held.
+func (c *Coordinator) stepDown(reason string) {
+	if !c.leading {
+		return
+	}
+	c.leading = false
+	c.lease = Lease{Term: c.lease.Term}
+	c.notify()
+	c.notifySaved()
+	slog.Warn("No longer the coordinator leader", "replica", c.replica.ID, "reason", reason)
+}
@@ -0,0 +1,107 @@
+package coordinator
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"strings"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/mtls"
+)
+
+// Under mutual TLS a worker's ID is bound to the name in its certificate:
+// Register hands out IDs made of that name and a random suffix, as
+// newWorkerID does with hostnames, and every RPC naming a worker ID that
+// does not derive from the caller's certificate is rejected. Workers with
+// different certificates thus cannot register as, report the tasks of or
+// deregister each other. Nothing needs to be remembered, so the binding
+// holds across restarts and leader changes.
+
+// ownsWorkerID reports whether the worker with certificate name may use id:
+// id is name itself or name followed by the suffix newWorkerID appends.
+func ownsWorkerID(name, id string) bool {
+	if id == name {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(id, name+"-")
+	if !ok || len(suffix) != 8 {
+		return false
+	}
+	return strings.Trim(suffix, "0123456789abcdef") == ""
+}
+
+// serveTLSPeer serves the RPCs of a worker connected over mutual TLS as the
+// worker its certificate names. The RPC server answers the HTTP CONNECT
+// handshake and then serves the hijacked connection with a receiver bound
+// to that certificate.
+func (c *Coordinator) serveTLSPeer(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "a client certificate is required", http.StatusForbidden)
+		return
+	}
+	name, _ := mtls.Identity(r.TLS.PeerCertificates[0])
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Coordinator", &peer{c: c, name: name}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// peer is the RPC receiver of one worker connected over mutual TLS. It
+// checks the worker IDs in requests against the certificate's name before
+// handing them to the coordinator.
+type peer struct {
+	c    *Coordinator
+	name string
+}
+
+// check returns the error an RPC naming workerID fails with, or nil.
+func (p *peer) check(method, workerID string) error {
+	if unsafeIDChars.MatchString(p.name) || p.name == "" {
+		p.c.metrics.rpcErrors.With(method).Inc()
+		return fmt.Errorf("certificate name %q cannot name a worker", p.name)
+	}
+	if !ownsWorkerID(p.name, workerID) {
+		p.c.metrics.rpcErrors.With(method).Inc()
+		return fmt.Errorf("worker ID %q does not belong to certificate %q", workerID, p.name)
+	}
+	return nil
+}
+
+func (p *peer) Register(args *common.RegisterArgs, reply *common.RegisterReply) error {
+	if err := p.check("Register", cmp.Or(args.WorkerID, p.name)); err != nil {
+		return err
+	}
+	return p.c.register(args, reply, p.name)
+}
+
+func (p *peer) GetTask(args *common.TaskArgs, reply *common.TaskReply) error {
+	if err := p.check("GetTask", args.WorkerID); err != nil {
+		return err
+	}
+	return p.c.GetTask(args, reply)
+}
+
+func (p *peer) ReportTask(args *common.ReportTaskArgs, reply *common.ReportTaskReply) error {
+	if err := p.check("ReportTask", args.WorkerID); err != nil {
+		return err
+	}
+	return p.c.ReportTask(args, reply)
+}
+
+func (p *peer) Heartbeat(args *common.HeartbeatArgs, reply *common.HeartbeatReply) error {
+	if err := p.check("Heartbeat", args.WorkerID); err != nil {
+		return err
+	}
+	return p.c.Heartbeat(args, reply)
+}
+
+func (p *peer) Deregister(args *common.DeregisterArgs, reply *common.DeregisterReply) error {
+	if err := p.check("Deregister", args.WorkerID); err != nil {
+		return err
+	}
+	return p.c.Deregister(args, reply)
+}
@@ -0,0 +1,290 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is a replica's claim to lead the coordinators sharing a Lock. Term
+// grows every time the lease changes hands; the leader tags what it appends
+// to the Log with it, so a deposed leader cannot overwrite its successor's
+// state.
+type Lease struct {
+	Holder  string // ID of the replica holding the lease
+	RPCAddr string // Where workers reach the holder
+	APIAddr string // Where API clients reach the holder, e.g. "http://node-a:8080"
+	Term    int64
+	Expires time.Time
+}
+
+// Held reports whether the lease is held by someone at now.
+func (l Lease) Held(now time.Time) bool {
+	return l.Holder != "" && now.Before(l.Expires)
+}
+
+// Lock elects the leader among coordinator replicas.
+type Lock interface {
+	// Acquire takes the lease for self if it is free or has expired, or
+	// renews it if self already holds it, until ttl from now. It returns
+	// the lease as it stands afterwards, held by self or not. Only
+	// self.Holder, RPCAddr and APIAddr are read.
+	Acquire(self Lease, ttl time.Duration) (Lease, error)
+
+	// Release gives up the lease if holder holds it, so a standby can
+	// take over without waiting for it to expire.
+	Release(holder string) error
+}
+
+// ErrStaleTerm is returned by Log.Append for a term older than the last
+// entry's: a newer leader has taken over.
+var ErrStaleTerm = errors.New("a newer leader has written to the log")
+
+// Log is the replicated log coordinator replicas share their state through.
+// The leader appends the jobs and workflows that changed, and now and then a
+// snapshot of all of them; a replica that becomes leader resumes from the
+// last snapshot and the entries after it.
+type Log interface {
+	// Append adds an entry written in term. It returns ErrStaleTerm if the
+	// log already holds an entry of a later term. Entries before a snapshot
+	// are no longer needed and may be dropped.
+	Append(term int64, entry []byte, snapshot bool) error
+
+	// Read returns the last snapshot followed by the entries appended after
+	// it, and the term of the last entry. It returns no entries if the log
+	// is empty.
+	Read() (term int64, entries [][]byte, err error)
+}
+
+// FileLock is a Lock kept in a file on a filesystem all replicas share, such
+// as an NFS volume. It suits local clusters and tests; replicas must have
+// roughly synchronized clocks, as leases expire by the wall clock.
+type FileLock struct {
+	Path string
+}
+
+func (l *FileLock) Acquire(self Lease, ttl time.Duration) (Lease, error) {
+	var lease Lease
+	err := withFileMutex(l.Path, func() error {
+		cur, err := readLease(l.Path)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if cur.Held(now) && cur.Holder != self.Holder {
+			lease = cur
+			return nil
+		}
+		lease = self
+		lease.Term = cur.Term
+		if cur.Holder != self.Holder || !cur.Held(now) {
+			lease.Term++ // The lease changes hands, or its holder lost it for a while
+		}
+		lease.Expires = now.Add(ttl)
+		return writeJSON(l.Path, lease)
+	})
+	return lease, err
+}
+
+func (l *FileLock) Release(holder string) error {
+	return withFileMutex(l.Path, func() error {
+		cur, err := readLease(l.Path)
+		if err != nil || cur.Holder != holder {
+			return err
+		}
+		cur.Expires = time.Time{}
+		return writeJSON(l.Path, cur)
+	})
+}
+
+func readLease(path string) (Lease, error) {
+	var lease Lease
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lease, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &lease)
+	}
+	return lease, err
+}
+
+// FileLog is a Log kept as numbered files in a directory all replicas share.
+// Entries before the last snapshot are deleted once it is written.
+type FileLog struct {
+	Dir string
+}
+
+// logEntry is one entry of a FileLog.
+type logEntry struct {
+	Term     int64
+	Snapshot bool
+	State    json.RawMessage
+}
+
+func (l *FileLog) Append(term int64, entry []byte, snapshot bool) error {
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return err
+	}
+	return withFileMutex(filepath.Join(l.Dir, "append"), func() error {
+		indexes, err := l.indexes()
+		if err != nil {
+			return err
+		}
+		next := int64(1)
+		if n := len(indexes); n > 0 {
+			last, err := l.read(indexes[n-1])
+			if err != nil {
+				return err
+			}
+			if last.Term > term {
+				return fmt.Errorf("%w: term %d, log at term %d", ErrStaleTerm, term, last.Term)
+			}
+			next = indexes[n-1] + 1
+		}
+		if err := writeJSON(l.entryPath(next), logEntry{Term: term, Snapshot: snapshot, State: entry}); err != nil {
+			return err
+		}
+		if snapshot {
+			for _, i := range indexes {
+				_ = os.Remove(l.entryPath(i))
+			}
+		}
+		return nil
+	})
+}
+
+func (l *FileLog) Read() (int64, [][]byte, error) {
+	indexes, err := l.indexes()
+	if err != nil || len(indexes) == 0 {
+		return 0, nil, err
+	}
+	// Walk back to the last snapshot. Older entries are only left behind
+	// by a leader that died before deleting them.
+	var entries []logEntry
+	for i := len(indexes) - 1; i >= 0; i-- {
+		e, err := l.read(indexes[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		entries = append(entries, e)
+		if e.Snapshot {
+			break
+		}
+	}
+	states := make([][]byte, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		states = append(states, entries[i].State)
+	}
+	return entries[0].Term, states, nil
+}
+
+func (l *FileLog) entryPath(index int64) string {
+	return filepath.Join(l.Dir, fmt.Sprintf("%020d.json", index))
+}
+
+func (l *FileLog) read(index int64) (logEntry, error) {
+	var e logEntry
+	b, err := os.ReadFile(l.entryPath(index))
+	if err == nil {
+		err = json.Unmarshal(b, &e)
+	}
+	return e, err
+}
+
+// indexes returns the indexes of the entries in the log, in order.
+func (l *FileLog) indexes() ([]int64, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int64
+	for _, e := range entries {
+		if i, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".json"), 10, 64); err == nil && strings.HasSuffix(e.Name(), ".json") {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes, nil
+}
+
+// writeJSON replaces path atomically with v encoded as JSON.
+func writeJSON(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Tuning of withFileMutex.
+const (
+	fileMutexStale   = 10 * time.Second // A mutex file older than this was left by a crashed holder
+	fileMutexTimeout = 5 * time.Second
+)
+
+// withFileMutex runs fn while holding a mutex shared through the file
+// path+".lock", which exists exactly while someone holds it. Creating it
+// exclusively works on any filesystem, unlike advisory locks.
+func withFileMutex(path string, fn func() error) error {
+	lock := path + ".lock"
+	deadline := time.Now().Add(fileMutexTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > fileMutexStale && breakStale(lock, fi) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", lock)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer os.Remove(lock)
+	return fn()
+}
+
+// breakStale removes the mutex file lock left by a crashed holder if it is
+// still the file stale describes, and reports whether it did. Callers that
+// found the same stale file take turns through lock+".break", so none can
+// remove a mutex another has taken in the meantime. A break file is only
+// held for an instant; one older than fileMutexStale was left by a crash.
+func breakStale(lock string, stale fs.FileInfo) bool {
+	brk := lock + ".break"
+	f, err := os.OpenFile(brk, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if fi, err := os.Stat(brk); err == nil && time.Since(fi.ModTime()) > fileMutexStale {
+			_ = os.Remove(brk)
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(brk)
+	// The file system may give a new mutex file the stale one's inode, but
+	// not its modification time.
+	fi, err := os.Stat(lock)
+	if err != nil || !os.SameFile(fi, stale) || !fi.ModTime().Equal(stale.ModTime()) {
+		return false
+	}
+	return os.Remove(lock) == nil
+}
@@ -0,0 +1,148 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// defaultLocalityDelay is how long a map task with preferred hosts waits for
+// a worker on one of them before it may run anywhere.
+const defaultLocalityDelay = 3 * time.Second
+
+// LocalityResolver tells the coordinator where an input file's data lives,
+// e.g. the nodes holding a local disk or a replica of a shared volume.
+type LocalityResolver interface {
+	// PreferredHosts returns the hostnames that can read file locally, or
+	// nil if it does not matter where the file is read.
+	PreferredHosts(file string) []string
+}
+
+// StaticLocality is a LocalityResolver backed by a fixed map from input
+// file to preferred hosts.
+type StaticLocality map[string][]string
+
+// PreferredHosts implements LocalityResolver.
+func (s StaticLocality) PreferredHosts(file string) []string {
+	return s[file]
+}
+
+// LoadStaticLocality reads a StaticLocality from a JSON file of the form
+// {"/data/part-0": ["node-a", "node-b"]}.
+func LoadStaticLocality(path string) (StaticLocality, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s StaticLocality
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LocalityStats counts map task assignments by where they ran relative to
+// their input. Every attempt counts, so retries show up too.
+type LocalityStats struct {
+	Local        int // Ran on one of the task's preferred hosts
+	Remote       int // Had preferred hosts but ran elsewhere
+	NoPreference int // Had no preferred hosts
+}
+
+// HitRate is the fraction of map tasks with preferred hosts that ran on one
+// of them, or 0 if none had any.
+func (s LocalityStats) HitRate() float64 {
+	if s.Local+s.Remote == 0 {
+		return 0
+	}
+	return float64(s.Local) / float64(s.Local+s.Remote)
+}
+
+// SetLocalityResolver sets where preferred hosts of new jobs' input files
+// come from. Hosts given explicitly in JobSpec.PreferredHosts take
+// precedence.
+func (c *Coordinator) SetLocalityResolver(r LocalityResolver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.locality = r
+}
+
+// SetLocalityDelay sets how long a map task waits for a worker on one of its
+// preferred hosts before it is given to any worker. Zero disables waiting
+// while still preferring local tasks.
+func (c *Coordinator) SetLocalityDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localityDelay = d
+}
+
+// preferredHosts returns the hosts a job's map over file should run on.
+// c.mu must be held.
+func (c *Coordinator) preferredHosts(spec JobSpec, file string) []string {
+	if hosts, ok := spec.PreferredHosts[file]; ok {
+		return hosts
+	}
+	if c.locality != nil {
+		return c.locality.PreferredHosts(file)
+	}
+	return nil
+}
+
+// isLocal reports whether a worker on host can read the task's input
+// locally.
+func isLocal(task *common.Task, host string) bool {
+	return host != "" && slices.ContainsFunc(task.PreferredHosts, func(h string) bool {
+		return strings.EqualFold(h, host)
+	})
+}
+
+// pickMap chooses the idle map task of job to hand to a worker on host, or
+// returns -1. Following delay scheduling, a local task comes first, then a
+// task without preferences, and only then a task whose preferred hosts have
+// had localityDelay to pick it up since it was queued.
+func (c *Coordinator) pickMap(job *Job, host string, now time.Time) int {
+	anywhere, fallback := -1, -1
+	for i := range job.MapTasks {
+		task := &job.MapTasks[i]
+		if task.Status != common.TaskStatusIdle {
+			continue
+		}
+		switch {
+		case isLocal(task, host):
+			return i
+		case len(task.PreferredHosts) == 0:
+			if anywhere < 0 {
+				anywhere = i
+			}
+		case fallback < 0 && now.Sub(task.QueuedAt) >= c.localityDelay:
+			fallback = i
+		}
+	}
+	if anywhere >= 0 {
+		return anywhere
+	}
+	return fallback
+}
+
+// recordLocality counts a map assignment in the job's locality stats and
+// returns its locality for logs and metrics. c.mu must be held.
+func (c *Coordinator) recordLocality(job *Job, task *common.Task, host string) string {
+	var locality string
+	switch {
+	case len(task.PreferredHosts) == 0:
+		job.Locality.NoPreference++
+		locality = "none"
+	case isLocal(task, host):
+		job.Locality.Local++
+		locality = "local"
+	default:
+		job.Locality.Remote++
+		locality = "remote"
+	}
+	c.metrics.mapLocality.With(locality).Inc()
+	return locality
+}
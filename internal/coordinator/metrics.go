@@ -0,0 +1,139 @@
+package coordinator
+
+import (
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/metrics"
+)
+
+// coordinatorMetrics holds the instruments updated by the scheduler.
+type coordinatorMetrics struct {
+	registry          *metrics.Registry
+	assignmentLatency *metrics.HistogramVec
+	taskDuration      *metrics.HistogramVec
+	rpcRequests       *metrics.CounterVec
+	rpcErrors         *metrics.CounterVec
+	retries           *metrics.CounterVec
+	timeouts          *metrics.CounterVec
+	mapLocality       *metrics.CounterVec
+	filesDeleted      *metrics.CounterVec
+}
+
+var jobStates = []string{StatusQueued, StatusInProgress, StatusCompleted, StatusFailed, StatusCancelled}
+
+var taskTypes = []common.TaskType{common.TaskTypeMap, common.TaskTypeReduce}
+
+var taskStatuses = []common.TaskStatus{
+	common.TaskStatusIdle,
+	common.TaskStatusInProgress,
+	common.TaskStatusCompleted,
+	common.TaskStatusFailed,
+}
+
+func newCoordinatorMetrics(c *Coordinator) *coordinatorMetrics {
+	r := metrics.NewRegistry()
+	m := &coordinatorMetrics{
+		registry: r,
+		assignmentLatency: r.NewHistogram("mr_task_assignment_latency_seconds",
+			"Time a task waited in the queue before being assigned to a worker.", metrics.DefBuckets, "type"),
+		taskDuration: r.NewHistogram("mr_task_duration_seconds",
+			"Time from task assignment to its accepted completion report.", metrics.DurationBuckets, "type"),
+		rpcRequests: r.NewCounter("mr_rpc_requests_total", "RPC requests handled by the coordinator.", "method"),
+		rpcErrors:   r.NewCounter("mr_rpc_errors_total", "RPC requests that returned an error.", "method"),
+		retries:     r.NewCounter("mr_task_retries_total", "Task assignments that re-ran a previously attempted task.", "type"),
+		timeouts:    r.NewCounter("mr_task_timeouts_total", "In-progress tasks requeued after exceeding the task timeout.", "type"),
+		mapLocality: r.NewCounter("mr_map_locality_total",
+			"Map task assignments by locality: local, remote, or none for tasks without preferred hosts.", "locality"),
+		filesDeleted: r.NewCounter("mr_intermediate_files_deleted_total", "Intermediate files deleted after their job finished."),
+	}
+
+	r.NewGaugeFunc("mr_jobs", "Jobs known to the coordinator by state.", []string{"state"},
+		func(emit func(float64, ...string)) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			counts := make(map[string]int)
+			for _, job := range c.jobs {
+				counts[job.Status]++
+			}
+			for _, state := range jobStates {
+				emit(float64(counts[state]), state)
+			}
+		})
+
+	r.NewGaugeFunc("mr_tasks", "Tasks of all jobs by type and state.", []string{"type", "state"},
+		func(emit func(float64, ...string)) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			counts := make(map[common.TaskType]map[common.TaskStatus]int)
+			for _, t := range taskTypes {
+				counts[t] = make(map[common.TaskStatus]int)
+			}
+			for _, job := range c.jobs {
+				for _, task := range job.MapTasks {
+					counts[common.TaskTypeMap][task.Status]++
+				}
+				for _, task := range job.ReduceTasks {
+					counts[common.TaskTypeReduce][task.Status]++
+				}
+			}
+			for _, t := range taskTypes {
+				for _, s := range taskStatuses {
+					emit(float64(counts[t][s]), t.String(), s.String())
+				}
+			}
+		})
+
+	r.NewGaugeFunc("mr_live_workers", "Workers that contacted the coordinator recently or hold a running task.", nil,
+		func(emit func(float64, ...string)) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			emit(float64(c.liveWorkers(time.Now())))
+		})
+
+	r.NewGaugeFunc("mr_task_slots", "Task slots of live workers by state.", []string{"state"},
+		func(emit func(float64, ...string)) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			busy, free := c.slotUsage(time.Now())
+			emit(float64(busy), "busy")
+			emit(float64(free), "free")
+		})
+
+	return m
+}
+
+// Metrics returns the registry backing the coordinator's /metrics endpoint.
+func (c *Coordinator) Metrics() *metrics.Registry {
+	return c.metrics.registry
+}
+
+// liveWorkers counts workers seen within the task timeout plus any worker
+// still holding an in-progress task. c.mu must be held.
+func (c *Coordinator) liveWorkers(now time.Time) int {
+	live := make(map[string]bool)
+	for id, w := range c.workers {
+		if now.Sub(w.lastSeen) <= c.taskTimeout {
+			live[id] = true
+		}
+	}
+	for id := range c.runningTasks() {
+		live[id] = true
+	}
+	return len(live)
+}
+
+// slotUsage sums the busy and free task slots of live workers. c.mu must be
+// held.
+func (c *Coordinator) slotUsage(now time.Time) (busy, free int) {
+	running := c.runningTasks()
+	for id, w := range c.workers {
+		if now.Sub(w.lastSeen) > c.taskTimeout && running[id] == 0 {
+			continue
+		}
+		b := min(running[id], w.slots)
+		busy += b
+		free += w.slots - b
+	}
+	return busy, free
+}
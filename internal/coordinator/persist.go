@@ -0,0 +1,327 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
+)
+
+// Tuning of persist.
+const (
+	// persistInterval is the least time between two saves. Changes made
+	// meanwhile are saved together, so a busy cluster does not make the
+	// coordinator write its state on every request.
+	persistInterval = 50 * time.Millisecond
+
+	// snapshotEvery is how many entries a leader appends to the log
+	// between two snapshots of its whole state.
+	snapshotEvery = 64
+)
+
+// persistedState is what the coordinator writes to its state file, and to
+// the log in snapshots. Other log entries hold the jobs and workflows that
+// changed since the previous entry, and those evicted since.
+type persistedState struct {
+	NextJob          int
+	Jobs             []Job
+	NextWorkflow     int
+	Workflows        []Workflow
+	RemovedJobs      []int `json:",omitempty"`
+	RemovedWorkflows []int `json:",omitempty"`
+}
+
+// SetStateFile makes the coordinator save its jobs and workflows to path shortly after every
+// change and restores them from path if the file exists, so a restarted
+// coordinator picks up where the previous one stopped. Tasks that were in
+// progress stay assigned to their workers and are requeued by the usual
+// timeout if those workers do not report back. Call it before Listen.
+func (c *Coordinator) SetStateFile(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replica != nil {
+		return errors.New("a replica keeps its state in the log, not in a state file")
+	}
+	c.stateFile = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st persistedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	c.restore(st)
+	slog.Info("Restored coordinator state", "file", path, "jobs", len(st.Jobs), "workflows", len(st.Workflows))
+	return nil
+}
+
+// restore replaces the coordinator's jobs and workflows with st. c.mu must
+// be held.
+func (c *Coordinator) restore(st persistedState) {
+	c.jobs = make(map[int]*Job, len(st.Jobs))
+	for i := range st.Jobs {
+		job := &st.Jobs[i]
+		if job.Counters == nil {
+			job.Counters = make(map[string]int64)
+		}
+		if job.Done() && job.FinishedAt.IsZero() {
+			job.FinishedAt = time.Now() // Saved before jobs recorded it; start the retention clock now
+		}
+		job.logs = make(map[taskLogKey]string)
+		job.taskSpans = make(map[taskKey]*trace.Span)
+		job.span = c.tracer.StartAt("job", trace.SpanContext{}, job.StartTime,
+			trace.Int(logging.KeyJobID, job.ID), trace.String("app", job.App), trace.Bool("restored", true))
+		c.jobs[job.ID] = job
+	}
+	c.nextJob = st.NextJob
+	c.workflows = make(map[int]*Workflow, len(st.Workflows))
+	for i := range st.Workflows {
+		c.workflows[st.Workflows[i].ID] = &st.Workflows[i]
+	}
+	c.nextWorkflow = st.NextWorkflow
+	c.admit(time.Now())
+}
+
+// persist asks for the state to be saved to the state file, if one is set,
+// or appended to the replicated log while this replica leads. A saver
+// goroutine writes it outside c.mu, at most every persistInterval, so
+// changes made in the meantime are saved together. c.mu must be held.
+func (c *Coordinator) persist() {
+	if (c.stateFile == "" && c.replica == nil) || c.closed {
+		return
+	}
+	c.saveGen++
+	if c.saves == nil {
+		c.saves = make(chan struct{}, 1)
+		go c.saver(c.saves)
+	}
+	select {
+	case c.saves <- struct{}{}:
+	default: // A save is already due
+	}
+}
+
+// saver saves the state whenever persist asks it to, until the coordinator
+// is closed.
+func (c *Coordinator) saver(saves <-chan struct{}) {
+	for {
+		select {
+		case <-saves:
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		s := c.encodeSave()
+		if s == nil {
+			c.mu.Unlock()
+			continue
+		}
+		// Taking saveMu before letting go of c.mu keeps saves in the order
+		// they were encoded in.
+		c.saveMu.Lock()
+		c.mu.Unlock()
+		err := s.write()
+		c.saveMu.Unlock()
+		c.mu.Lock()
+		c.finishSave(s, err)
+		c.mu.Unlock()
+
+		select {
+		case <-time.After(persistInterval):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// flush saves the state at once. c.mu must be held.
+func (c *Coordinator) flush() {
+	if s := c.encodeSave(); s != nil {
+		c.saveMu.Lock()
+		err := s.write()
+		c.saveMu.Unlock()
+		c.finishSave(s, err)
+	}
+}
+
+// waitSaved waits until the changes persist was asked to save up to gen
+// are written, or can no longer be.
+func (c *Coordinator) waitSaved(gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.savedGen < gen && !c.closed && (c.replica == nil || c.leading) {
+		saved := c.saved
+		c.mu.Unlock()
+		<-saved
+		c.mu.Lock()
+	}
+}
+
+// pendingSave is a save encoded under c.mu and written outside it.
+type pendingSave struct {
+	gen      uint64 // saveGen when encoded
+	data     []byte
+	file     string // The state file, or empty for the log
+	log      Log
+	term     int64
+	snapshot bool
+}
+
+// write writes the save. The state file is replaced atomically so a crash
+// never leaves it half written.
+func (s *pendingSave) write() error {
+	if s.log != nil {
+		return s.log.Append(s.term, s.data, s.snapshot)
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, s.data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// encodeSave encodes what the next save writes: all jobs and workflows for
+// the state file or a snapshot, else those that changed since the previous
+// log entry. It returns nil if there is nothing to write. c.mu must be
+// held.
+func (c *Coordinator) encodeSave() *pendingSave {
+	if (c.stateFile == "" && c.replica == nil) || c.closed || (c.replica != nil && !c.leading) {
+		return nil
+	}
+	s := &pendingSave{gen: c.saveGen, file: c.stateFile}
+	st := c.state()
+	if c.replica != nil {
+		s.log, s.term = c.replica.Log, c.lease.Term
+		s.snapshot = c.needSnapshot || c.logEntries >= snapshotEvery
+		if !s.snapshot {
+			st = c.changes()
+		}
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		slog.Error("Failed to encode coordinator state", "error", err)
+		return nil
+	}
+	s.data = b
+	clear(c.dirtyJobs)
+	clear(c.dirtyFlows)
+	if s.snapshot {
+		c.logEntries, c.needSnapshot = 0, false
+	} else {
+		c.logEntries++
+	}
+	return s
+}
+
+// finishSave records how a save went and wakes waitSaved callers. A
+// replica whose log has a newer leader steps down; other failures are
+// retried, with a snapshot in case the log missed changes. c.mu must be
+// held.
+func (c *Coordinator) finishSave(s *pendingSave, err error) {
+	switch {
+	case errors.Is(err, ErrStaleTerm):
+		if c.lease.Term == s.term {
+			c.stepDown(err.Error())
+		}
+	case err != nil:
+		slog.Error("Failed to persist coordinator state", "file", s.file, "error", err)
+		if s.log != nil {
+			c.needSnapshot = true
+		}
+		c.persist()
+	}
+	c.savedGen = max(c.savedGen, s.gen)
+	c.notifySaved()
+}
+
+// notifySaved wakes waitSaved callers. c.mu must be held.
+func (c *Coordinator) notifySaved() {
+	close(c.saved)
+	c.saved = make(chan struct{})
+}
+
+// state returns all jobs and workflows ordered by ID. c.mu must be held.
+func (c *Coordinator) state() persistedState {
+	st := persistedState{NextJob: c.nextJob, Jobs: make([]Job, 0, len(c.jobs)), NextWorkflow: c.nextWorkflow}
+	for _, job := range c.jobs {
+		st.Jobs = append(st.Jobs, *job)
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].ID < st.Jobs[j].ID })
+	for _, wf := range c.workflows {
+		st.Workflows = append(st.Workflows, *wf)
+	}
+	sort.Slice(st.Workflows, func(i, j int) bool { return st.Workflows[i].ID < st.Workflows[j].ID })
+	return st
+}
+
+// changes returns the jobs and workflows that changed since the last save,
+// and the IDs of those evicted since. c.mu must be held.
+func (c *Coordinator) changes() persistedState {
+	st := persistedState{NextJob: c.nextJob, NextWorkflow: c.nextWorkflow}
+	for id := range c.dirtyJobs {
+		if job, ok := c.jobs[id]; ok {
+			st.Jobs = append(st.Jobs, *job)
+		} else {
+			st.RemovedJobs = append(st.RemovedJobs, id)
+		}
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].ID < st.Jobs[j].ID })
+	sort.Ints(st.RemovedJobs)
+	for id := range c.dirtyFlows {
+		if wf, ok := c.workflows[id]; ok {
+			st.Workflows = append(st.Workflows, *wf)
+		} else {
+			st.RemovedWorkflows = append(st.RemovedWorkflows, id)
+		}
+	}
+	sort.Slice(st.Workflows, func(i, j int) bool { return st.Workflows[i].ID < st.Workflows[j].ID })
+	sort.Ints(st.RemovedWorkflows)
+	return st
+}
+
+// replay rebuilds the state from the entries Log.Read returns: a snapshot
+// and the changes appended after it.
+func replay(entries [][]byte) (persistedState, error) {
+	jobs := make(map[int]Job)
+	workflows := make(map[int]Workflow)
+	var st persistedState
+	for _, b := range entries {
+		var e persistedState
+		if err := json.Unmarshal(b, &e); err != nil {
+			return st, err
+		}
+		for _, job := range e.Jobs {
+			jobs[job.ID] = job
+		}
+		for _, id := range e.RemovedJobs {
+			delete(jobs, id)
+		}
+		for _, wf := range e.Workflows {
+			workflows[wf.ID] = wf
+		}
+		for _, id := range e.RemovedWorkflows {
+			delete(workflows, id)
+		}
+		st.NextJob, st.NextWorkflow = e.NextJob, e.NextWorkflow
+	}
+	for _, job := range jobs {
+		st.Jobs = append(st.Jobs, job)
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].ID < st.Jobs[j].ID })
+	for _, wf := range workflows {
+		st.Workflows = append(st.Workflows, wf)
+	}
+	sort.Slice(st.Workflows, func(i, j int) bool { return st.Workflows[i].ID < st.Workflows[j].ID })
+	return st, nil
+}
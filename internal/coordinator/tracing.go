@@ -0,0 +1,87 @@
+package coordinator
+
+import (
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
+)
+
+// taskKey identifies a task within a job.
+type taskKey struct {
+	Type   common.TaskType
+	TaskID int
+}
+
+// SetTracer replaces the tracer used for job and task spans.
+func (c *Coordinator) SetTracer(t *trace.Tracer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracer = t
+}
+
+func taskSpanAttrs(jobID int, task *common.Task, workerID string) []trace.Attr {
+	return []trace.Attr{
+		trace.Int(logging.KeyJobID, jobID),
+		trace.Int(logging.KeyTaskID, task.ID),
+		trace.String(logging.KeyTaskType, task.Type.String()),
+		trace.String(logging.KeyWorkerID, workerID),
+		trace.Int(logging.KeyAttempt, task.Attempt),
+	}
+}
+
+// startJobTrace opens the job's root span and records its submission. c.mu
+// must be held.
+func (c *Coordinator) startJobTrace(job *Job, submitted time.Time) {
+	job.span = c.tracer.StartAt("job", trace.SpanContext{}, job.StartTime,
+		trace.Int(logging.KeyJobID, job.ID), trace.String("app", job.App))
+	c.tracer.StartAt("submit", job.span.Context(), job.StartTime,
+		trace.Int(logging.KeyJobID, job.ID),
+		trace.Int("files", len(job.Files)),
+		trace.Int("n_reduce", job.NReduce),
+	).EndAt(submitted)
+}
+
+// traceAssignment records how long the task queued and opens the span for
+// the new attempt. It returns the traceparent the worker continues from. c.mu
+// must be held.
+func (c *Coordinator) traceAssignment(job *Job, task *common.Task, workerID string, now time.Time) string {
+	attrs := taskSpanAttrs(job.ID, task, workerID)
+	parent := job.span.Context()
+	if !task.QueuedAt.IsZero() {
+		c.tracer.StartAt("queue_wait", parent, task.QueuedAt, attrs...).EndAt(now)
+	}
+	span := c.tracer.StartAt(task.Type.String()+"_task", parent, now, attrs...)
+	job.taskSpans[taskKey{Type: task.Type, TaskID: task.ID}] = span
+	return span.Context().TraceParent()
+}
+
+// traceCommit records the coordinator accepting a task attempt's result and
+// closes the attempt's span. The commit span continues from the worker's
+// execution span when the report carries one. c.mu must be held.
+func (c *Coordinator) traceCommit(job *Job, task *common.Task, args *common.ReportTaskArgs, now time.Time) {
+	key := taskKey{Type: task.Type, TaskID: task.ID}
+	span, ok := job.taskSpans[key]
+	if !ok {
+		return
+	}
+	parent := span.Context()
+	if sc, err := trace.ParseTraceParent(args.TraceParent); err == nil && sc.IsValid() {
+		parent = sc
+	}
+	c.tracer.StartAt("commit", parent, now, taskSpanAttrs(job.ID, task, args.WorkerID)...).End()
+	span.End()
+	delete(job.taskSpans, key)
+}
+
+// traceAbandon closes the span of an attempt that will not complete. c.mu
+// must be held.
+func (c *Coordinator) traceAbandon(job *Job, task *common.Task, reason string) {
+	key := taskKey{Type: task.Type, TaskID: task.ID}
+	if span, ok := job.taskSpans[key]; ok {
+		span.SetError(reason)
+		span.End()
+		delete(job.taskSpans, key)
+	}
+}
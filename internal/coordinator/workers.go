@@ -0,0 +1,259 @@
+package coordinator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+)
+
+// WorkerInfo describes a worker the coordinator has heard from.
+type WorkerInfo struct {
+	ID           string
+	Hostname     string // Empty for workers that never registered
+	LastSeen     time.Time
+	RegisteredAt time.Time
+	Live         bool
+	Slots        int // Tasks the worker can run at once
+	RunningTasks int
+	MemoryBytes  int64
+	Apps         []string // Apps the worker can run; nil means any
+	Labels       map[string]string
+}
+
+// workerState is what the coordinator knows about a worker process.
+type workerState struct {
+	lastSeen     time.Time
+	slots        int
+	registered   bool
+	registeredAt time.Time
+	hostname     string
+	memoryBytes  int64
+	apps         []string
+	labels       map[string]string
+	cleanupSeq   int // The last cleanup sent to the worker
+}
+
+// canRun reports whether the worker may run tasks of job: it must support
+// the job's app and carry every label the job requires. Workers that never
+// registered support every app and have no labels.
+func (w *workerState) canRun(job *Job) bool {
+	if w.apps != nil && !slices.Contains(w.apps, job.App) {
+		return false
+	}
+	for k, v := range job.Labels {
+		if got, ok := w.labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// unsafeIDChars matches characters dropped from hostnames used in worker
+// IDs, which end up in logs and file names.
+var unsafeIDChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// newWorkerID returns an ID that is unique even across coordinator restarts
+// and containers that share a hostname or PID.
+func newWorkerID(hostname string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	host := unsafeIDChars.ReplaceAllString(hostname, "")
+	if host == "" {
+		host = "worker"
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// Register records a worker's capabilities and returns the ID it must use in
+// every later call. A worker that already has an ID, for instance after the
+// coordinator restarted and forgot it, passes it to keep the tasks it holds.
+// It gets a new ID instead if a registered worker used that one within the
+// task timeout, so no caller can take over a live worker's tasks.
+func (c *Coordinator) Register(args *common.RegisterArgs, reply *common.RegisterReply) error {
+	return c.register(args, reply, args.Hostname)
+}
+
+// register registers a worker, naming it after prefix if it has no ID yet or
+// its ID is taken.
+func (c *Coordinator) register(args *common.RegisterArgs, reply *common.RegisterReply, prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.rpcRequests.With("Register").Inc()
+	if err := c.serving(); err != nil {
+		c.metrics.rpcErrors.With("Register").Inc()
+		return err
+	}
+
+	now := time.Now()
+	id := args.WorkerID
+	if w := c.workers[id]; w != nil && w.registered && now.Sub(w.lastSeen) <= c.taskTimeout {
+		slog.Warn("Worker ID in use by a live worker, assigning another", logging.KeyWorkerID, id, "hostname", args.Hostname)
+		id = ""
+	}
+	for id == "" {
+		if id = newWorkerID(prefix); c.workers[id] != nil {
+			id = ""
+		}
+	}
+	delete(c.departed, id)
+	w := c.seen(id, args.Slots, now)
+	w.registered = true
+	w.registeredAt = now
+	w.hostname = args.Hostname
+	w.memoryBytes = args.MemoryBytes
+	w.apps = slices.Clone(args.Apps)
+	w.labels = maps.Clone(args.Labels)
+
+	slog.Info("Worker registered", logging.KeyWorkerID, id, "hostname", args.Hostname,
+		"slots", w.slots, "memory_bytes", args.MemoryBytes, "apps", args.Apps, "labels", args.Labels)
+	reply.WorkerID = id
+	return nil
+}
+
+// Deregister forgets a worker that is shutting down and requeues the tasks
+// it still holds at once, rather than when they time out. Heartbeats and
+// requests the worker sent before, but that arrive late, are ignored rather
+// than bring it back.
+func (c *Coordinator) Deregister(args *common.DeregisterArgs, reply *common.DeregisterReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.rpcRequests.With("Deregister").Inc()
+	if err := c.serving(); err != nil {
+		c.metrics.rpcErrors.With("Deregister").Inc()
+		return err
+	}
+
+	now := time.Now()
+	for _, job := range c.jobs {
+		if job.Status != StatusInProgress {
+			continue
+		}
+		requeued := 0
+		for _, tasks := range [][]common.Task{job.MapTasks, job.ReduceTasks} {
+			for i := range tasks {
+				task := &tasks[i]
+				if task.Status != common.TaskStatusInProgress || task.WorkerID != args.WorkerID {
+					continue
+				}
+				slog.Info("Worker handed back task, requeueing",
+					logging.TaskAttrs(job.ID, task.ID, task.Type, task.WorkerID, task.Attempt)...)
+				c.traceAbandon(job, task, "handed back")
+				reset(task, now)
+				requeued++
+			}
+		}
+		if requeued > 0 {
+			reply.Requeued += requeued
+			c.touch(job)
+		}
+	}
+	delete(c.workers, args.WorkerID)
+	c.departed[args.WorkerID] = now
+	slog.Info("Worker deregistered", logging.KeyWorkerID, args.WorkerID, "requeued", reply.Requeued)
+	return nil
+}
+
+// gone reports whether the worker deregistered, so requests it sent before
+// but that arrive late are to be ignored. c.mu must be held.
+func (c *Coordinator) gone(workerID string) bool {
+	_, ok := c.departed[workerID]
+	return ok
+}
+
+// pruneDeparted forgets workers that deregistered more than a task timeout
+// ago. Requests they sent before have arrived or been given up on by then.
+// c.mu must be held.
+func (c *Coordinator) pruneDeparted(now time.Time) {
+	for id, at := range c.departed {
+		if now.Sub(at) > c.taskTimeout {
+			delete(c.departed, id)
+		}
+	}
+}
+
+// seen records contact from a worker. A positive slots updates its capacity.
+// c.mu must be held.
+func (c *Coordinator) seen(workerID string, slots int, now time.Time) *workerState {
+	w, ok := c.workers[workerID]
+	if !ok {
+		w = &workerState{slots: 1}
+		c.workers[workerID] = w
+	}
+	w.lastSeen = now
+	if slots > 0 {
+		w.slots = slots
+	}
+	return w
+}
+
+// runningTasks counts in-progress tasks per worker. c.mu must be held.
+func (c *Coordinator) runningTasks() map[string]int {
+	running := make(map[string]int)
+	for _, job := range c.jobs {
+		for _, tasks := range [][]common.Task{job.MapTasks, job.ReduceTasks} {
+			for _, task := range tasks {
+				if task.Status == common.TaskStatusInProgress && task.WorkerID != "" {
+					running[task.WorkerID]++
+				}
+			}
+		}
+	}
+	return running
+}
+
+// Heartbeat records that a worker process is alive along with its slot
+// usage. Workers send it on a timer independently of their task slots, so a
+// worker whose slots are all busy with long tasks still shows up as live.
+// The reply tells a worker the coordinator does not know it, e.g. after a
+// restart, so it registers again, and which jobs' intermediate files it may
+// delete.
+func (c *Coordinator) Heartbeat(args *common.HeartbeatArgs, reply *common.HeartbeatReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.rpcRequests.With("Heartbeat").Inc()
+	if err := c.serving(); err != nil {
+		c.metrics.rpcErrors.With("Heartbeat").Inc()
+		return err
+	}
+	reply.Ack = true
+	if c.gone(args.WorkerID) {
+		return nil // Sent before the worker deregistered
+	}
+	w := c.seen(args.WorkerID, args.Slots, time.Now())
+	reply.Registered = w.registered
+	reply.Cleanup = c.cleanupsFor(w)
+	return nil
+}
+
+// Workers returns every worker seen so far ordered by ID.
+func (c *Coordinator) Workers() []WorkerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	running := c.runningTasks()
+	workers := make([]WorkerInfo, 0, len(c.workers))
+	for id, w := range c.workers {
+		workers = append(workers, WorkerInfo{
+			ID:           id,
+			Hostname:     w.hostname,
+			LastSeen:     w.lastSeen,
+			RegisteredAt: w.registeredAt,
+			Live:         now.Sub(w.lastSeen) <= c.taskTimeout || running[id] > 0,
+			Slots:        w.slots,
+			RunningTasks: running[id],
+			MemoryBytes:  w.memoryBytes,
+			Apps:         slices.Clone(w.apps),
+			Labels:       maps.Clone(w.labels),
+		})
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+	return workers
+}
@@ -0,0 +1,420 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+)
+
+// Stage states reported in Stage.Status besides the Status* constants, which
+// a stage takes over from its job once it has started.
+const (
+	StagePending = "PENDING" // Waiting for the stages it reads from
+	StageSkipped = "SKIPPED" // Never started because a stage it reads from did not complete
+)
+
+// StageSpec describes one stage of a workflow.
+type StageSpec struct {
+	Name string
+
+	// After names the stages whose reduce output this stage reads. The
+	// stage starts once all of them have completed.
+	After []string
+
+	// Job describes the stage's job. Its Files are read in addition to the
+	// output partitions of the stages in After; a stage without After needs
+	// some. If the job has Datasets, each stage in After becomes another
+	// dataset tagged with that stage's name instead.
+	Job JobSpec
+}
+
+// WorkflowSpec describes a workflow: a DAG of stages, each a MapReduce job
+// whose map tasks read the reduce output of the stages before it.
+type WorkflowSpec struct {
+	Name   string
+	Stages []StageSpec
+	Tenant string // Owns the workflow and its stages' jobs, see Job.Tenant
+}
+
+// Workflow is the state of a submitted workflow.
+type Workflow struct {
+	ID         int
+	Name       string
+	Status     string // StatusInProgress until no stage is pending or running
+	Error      string // Why the workflow failed, if it did
+	Stages     []Stage
+	StartTime  time.Time
+	FinishedAt time.Time
+	Version    int64 // Incremented on every change to the workflow's state
+	Tenant     string
+}
+
+// Stage is the state of one stage of a workflow.
+type Stage struct {
+	Name   string
+	After  []string
+	Status string // StagePending, StageSkipped or the status of the stage's job
+	JobID  int    // The stage's job, once Status is not pending or skipped
+	Spec   JobSpec
+}
+
+func (s *Stage) finished() bool {
+	return s.Status != StagePending && s.Status != StatusInProgress
+}
+
+var (
+	// ErrWorkflowNotFound is returned for operations on an unknown workflow
+	// ID.
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	// ErrWorkflowNotRunning is returned when cancelling a workflow that
+	// already finished.
+	ErrWorkflowNotRunning = errors.New("workflow is not running")
+)
+
+// SubmitWorkflow checks that spec describes a DAG whose stages are within
+// the per-job Limits and starts the stages that depend on no others. The
+// rest start as the stages they read from complete. Stage jobs wait for
+// admission like other jobs. A standby replica returns a
+// *common.NotLeaderError, and a draining coordinator ErrDraining.
+func (c *Coordinator) SubmitWorkflow(spec WorkflowSpec) (int, error) {
+	if err := validateWorkflow(spec); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	id, err := c.submitWorkflow(spec)
+	gen := c.saveGen
+	c.mu.Unlock()
+	if err == nil {
+		c.waitSaved(gen)
+	}
+	return id, err
+}
+
+// submitWorkflow is SubmitWorkflow for a valid spec, with c.mu held.
+func (c *Coordinator) submitWorkflow(spec WorkflowSpec) (int, error) {
+	if err := c.serving(); err != nil {
+		return 0, err
+	}
+	if c.draining {
+		return 0, ErrDraining
+	}
+	for _, st := range spec.Stages {
+		if err := c.limits.Check(st.Job); err != nil {
+			return 0, fmt.Errorf("stage %q: %w", st.Name, err)
+		}
+	}
+	wf := &Workflow{
+		ID:        c.nextWorkflow,
+		Name:      spec.Name,
+		Status:    StatusInProgress,
+		StartTime: time.Now(),
+		Tenant:    spec.Tenant,
+	}
+	c.nextWorkflow++
+	for _, st := range spec.Stages {
+		st.Job.Tenant = spec.Tenant
+		wf.Stages = append(wf.Stages, Stage{Name: st.Name, After: st.After, Status: StagePending, Spec: st.Job})
+	}
+	c.workflows[wf.ID] = wf
+	slog.Info("Submitted workflow", "workflow_id", wf.ID, "name", wf.Name, "stages", len(wf.Stages))
+	c.advance(wf)
+	c.touchWorkflow(wf)
+	return wf.ID, nil
+}
+
+// validateWorkflow checks stage names and dependencies and rejects cycles.
+func validateWorkflow(spec WorkflowSpec) error {
+	if len(spec.Stages) == 0 {
+		return errors.New("a workflow needs at least one stage")
+	}
+	stages := make(map[string]*StageSpec, len(spec.Stages))
+	for i := range spec.Stages {
+		st := &spec.Stages[i]
+		if st.Name == "" {
+			return fmt.Errorf("stage %d has no name", i)
+		}
+		if stages[st.Name] != nil {
+			return fmt.Errorf("duplicate stage %q", st.Name)
+		}
+		if st.Job.NReduce <= 0 {
+			return fmt.Errorf("stage %q needs at least one reduce task", st.Name)
+		}
+		if len(st.After) == 0 && len(st.Job.Files) == 0 && len(st.Job.Datasets) == 0 {
+			return fmt.Errorf("stage %q has no inputs", st.Name)
+		}
+		stages[st.Name] = st
+	}
+	for _, st := range spec.Stages {
+		for _, dep := range st.After {
+			up, ok := stages[dep]
+			if !ok {
+				return fmt.Errorf("stage %q runs after unknown stage %q", st.Name, dep)
+			}
+			if up.Job.Output != nil && up.Job.Output.Format == outputs.FormatSequence {
+				return fmt.Errorf("stage %q cannot read the %s output of stage %q", st.Name, outputs.FormatSequence, dep)
+			}
+		}
+	}
+
+	// Depth-first search for a path that comes back to a stage on it.
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int, len(stages))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("stages form a cycle through %q", name)
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range stages[name].After {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, st := range spec.Stages {
+		if err := visit(st.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance starts every pending stage whose inputs are complete, skips those
+// that can no longer run, and finishes the workflow once no stage is left
+// running. c.mu must be held.
+func (c *Coordinator) advance(wf *Workflow) {
+	if !wf.FinishedAt.IsZero() {
+		return
+	}
+	byName := make(map[string]*Stage, len(wf.Stages))
+	for i := range wf.Stages {
+		byName[wf.Stages[i].Name] = &wf.Stages[i]
+	}
+	// Skipping a stage can make its dependents skippable in turn, so repeat
+	// until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for i := range wf.Stages {
+			st := &wf.Stages[i]
+			if st.Status != StagePending {
+				continue
+			}
+			ready := true
+			for _, dep := range st.After {
+				switch byName[dep].Status {
+				case StatusCompleted:
+				case StagePending, StatusInProgress:
+					ready = false
+				default:
+					st.Status = StageSkipped
+				}
+			}
+			if st.Status == StageSkipped {
+				slog.Info("Skipping workflow stage", "workflow_id", wf.ID, "stage", st.Name)
+				changed = true
+			} else if ready && wf.Status == StatusInProgress {
+				c.startStage(wf, st, byName)
+				changed = true
+			}
+		}
+	}
+
+	for _, st := range wf.Stages {
+		if !st.finished() {
+			return
+		}
+	}
+	if wf.Status == StatusInProgress {
+		wf.Status = StatusCompleted
+		for _, st := range wf.Stages {
+			if st.Status != StatusCompleted {
+				wf.Status = StatusFailed
+				break
+			}
+		}
+	}
+	wf.FinishedAt = time.Now()
+	slog.Info("Workflow finished", "workflow_id", wf.ID, "status", wf.Status)
+}
+
+// startStage submits the stage's job, reading the output partitions of the
+// stages it runs after. c.mu must be held.
+func (c *Coordinator) startStage(wf *Workflow, st *Stage, byName map[string]*Stage) {
+	spec := st.Spec
+	spec.Files = append([]string(nil), st.Spec.Files...)
+	spec.Datasets = append([]common.Dataset(nil), st.Spec.Datasets...)
+	for _, dep := range st.After {
+		up, ok := c.jobs[byName[dep].JobID]
+		if !ok {
+			st.Status = StatusFailed
+			c.failWorkflow(wf, fmt.Sprintf("stage %q: output of stage %q is no longer known", st.Name, dep))
+			return
+		}
+		var parts []string
+		for p := 0; p < up.NReduce; p++ {
+			parts = append(parts, up.Output.Path(c.outputDir, up.ID, p))
+		}
+		if len(st.Spec.Datasets) > 0 {
+			// A join stage sees each upstream stage as a dataset of its own.
+			spec.Datasets = append(spec.Datasets, common.Dataset{Tag: dep, Files: parts})
+		} else {
+			spec.Files = append(spec.Files, parts...)
+		}
+	}
+	// Submission only checked the stage's own inputs; upstream partitions
+	// count against the limits too.
+	if err := c.limits.Check(spec); err != nil {
+		st.Status = StatusFailed
+		c.failWorkflow(wf, fmt.Sprintf("stage %q: %v", st.Name, err))
+		return
+	}
+	st.JobID = c.submit(spec)
+	st.Status = StatusInProgress
+	slog.Info("Started workflow stage", "workflow_id", wf.ID, "stage", st.Name, "job_id", st.JobID)
+}
+
+// failWorkflow records the first reason a workflow failed. c.mu must be
+// held.
+func (c *Coordinator) failWorkflow(wf *Workflow, reason string) {
+	if wf.Error == "" {
+		wf.Error = reason
+	}
+}
+
+// jobFinished moves the workflow a finished job belongs to, if any, on to
+// its next stages. c.mu must be held.
+func (c *Coordinator) jobFinished(job *Job) {
+	for _, wf := range c.workflows {
+		if wf.FinishedAt.IsZero() {
+			for i := range wf.Stages {
+				st := &wf.Stages[i]
+				if st.Status != StatusInProgress || st.JobID != job.ID {
+					continue
+				}
+				st.Status = job.Status
+				if job.Status != StatusCompleted {
+					reason := fmt.Sprintf("stage %q: job %d %s", st.Name, job.ID, job.Status)
+					if job.Error != "" {
+						reason += ": " + job.Error
+					}
+					c.failWorkflow(wf, reason)
+				}
+				c.advance(wf)
+				c.touchWorkflow(wf)
+				return
+			}
+		}
+	}
+}
+
+// CancelWorkflow cancels a workflow's running jobs and skips the stages that
+// have not started.
+func (c *Coordinator) CancelWorkflow(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[id]
+	if !ok {
+		return ErrWorkflowNotFound
+	}
+	if wf.Status != StatusInProgress {
+		return ErrWorkflowNotRunning
+	}
+	wf.Status = StatusCancelled
+	for i := range wf.Stages {
+		st := &wf.Stages[i]
+		switch st.Status {
+		case StagePending:
+			st.Status = StageSkipped
+		case StatusInProgress:
+			if job, ok := c.jobs[st.JobID]; ok && !job.Done() {
+				c.cancel(job) // Records the stage as cancelled through jobFinished
+			} else {
+				st.Status = StatusCancelled
+			}
+		}
+	}
+	c.advance(wf)
+	c.touchWorkflow(wf)
+	slog.Info("Workflow cancelled", "workflow_id", id)
+	return nil
+}
+
+// touchWorkflow bumps the workflow's version, saves it and wakes
+// WaitWorkflow callers. c.mu must be held.
+func (c *Coordinator) touchWorkflow(wf *Workflow) {
+	wf.Version++
+	c.dirtyFlows[wf.ID] = true
+	c.persist()
+	c.notify()
+}
+
+func (wf *Workflow) clone() Workflow {
+	cp := *wf
+	cp.Stages = append([]Stage(nil), wf.Stages...)
+	return cp
+}
+
+// SnapshotWorkflow returns a copy of a workflow.
+func (c *Coordinator) SnapshotWorkflow(id int) (Workflow, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[id]
+	if !ok {
+		return Workflow{}, false
+	}
+	return wf.clone(), true
+}
+
+// Workflows returns copies of all workflows ordered by ID.
+func (c *Coordinator) Workflows() []Workflow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wfs := make([]Workflow, 0, len(c.workflows))
+	for _, wf := range c.workflows {
+		wfs = append(wfs, wf.clone())
+	}
+	sort.Slice(wfs, func(i, j int) bool { return wfs[i].ID < wfs[j].ID })
+	return wfs
+}
+
+// WaitWorkflow is WaitJob for workflows: it blocks until the workflow's
+// version differs from version or it is no longer running.
+func (c *Coordinator) WaitWorkflow(ctx context.Context, id int, version int64) (Workflow, error) {
+	for {
+		c.mu.Lock()
+		wf, ok := c.workflows[id]
+		if !ok {
+			c.mu.Unlock()
+			return Workflow{}, ErrWorkflowNotFound
+		}
+		if wf.Version != version || wf.Status != StatusInProgress || c.draining {
+			cp := wf.clone()
+			c.mu.Unlock()
+			return cp, nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			wf, _ := c.SnapshotWorkflow(id)
+			return wf, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package inputs turns the input section of a job submission — files,
+// directories, glob patterns and manifest files — into the exact list of
+// files the job reads. Resolution happens once, at submit time, so missing
+// or unreadable inputs are rejected before any task runs and the job
+// records precisely what it read.
+package inputs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// Spec describes a job's inputs.
+type Spec struct {
+	// Paths are files, directories or glob patterns (as understood by
+	// filepath.Match). A directory contributes the files directly inside it,
+	// or every file below it if Recursive is set. Storage URIs such as
+	// s3://bucket/logs/*.gz work the same way, with key prefixes standing in
+	// for directories.
+	Paths []string `json:"paths,omitempty"`
+
+	// Manifests are text files listing one path per line in the same forms
+	// as Paths. Blank lines and lines starting with # are ignored, and
+	// relative entries are taken relative to the manifest's directory.
+	Manifests []string `json:"manifests,omitempty"`
+
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Include and Exclude filter files found by expanding directories and
+	// globs, matching patterns against the file's base name. A file is kept
+	// if it matches some Include pattern (or there are none) and no Exclude
+	// pattern. Files named explicitly are always kept.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// File is one resolved input file as it was at submit time.
+type File struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Tag     string    `json:"tag,omitempty"` // Dataset the file was listed under, for tagged inputs
+}
+
+// Error reports an input that cannot be used.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("input %q: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// ErrNoInputs is returned when a spec resolves to no files at all.
+var ErrNoInputs = errors.New("no input files")
+
+// errNoMatch reports a glob pattern that matched nothing.
+var errNoMatch = errors.New("pattern matches no files")
+
+// Resolve expands spec into the files it names, in sorted order without
+// duplicates. Every file is checked to exist and be readable.
+func Resolve(spec Spec) ([]File, error) {
+	for _, patterns := range [][]string{spec.Include, spec.Exclude} {
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("bad filter pattern %q: %w", p, err)
+			}
+		}
+	}
+
+	r := &resolver{spec: spec, seen: make(map[string]bool)}
+	for _, p := range spec.Paths {
+		if err := r.add(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range spec.Manifests {
+		entries, err := readManifest(m)
+		if err != nil {
+			return nil, &Error{Path: m, Err: err}
+		}
+		for _, p := range entries {
+			if err := r.add(p); err != nil {
+				return nil, fmt.Errorf("manifest %q: %w", m, err)
+			}
+		}
+	}
+	if len(r.files) == 0 {
+		return nil, ErrNoInputs
+	}
+	sort.Slice(r.files, func(i, j int) bool { return r.files[i].Path < r.files[j].Path })
+	return r.files, nil
+}
+
+// Paths returns the paths of files.
+func Paths(files []File) []string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+type resolver struct {
+	spec  Spec
+	seen  map[string]bool
+	files []File
+}
+
+// add resolves one path, directory or glob pattern.
+func (r *resolver) add(p string) error {
+	if p == "" {
+		return &Error{Path: p, Err: errors.New("empty path")}
+	}
+	if storage.IsURI(p) {
+		return r.addURI(p)
+	}
+	if !hasMeta(p) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return &Error{Path: p, Err: unwrapPathError(err)}
+		}
+		if info.IsDir() {
+			return r.addDir(p)
+		}
+		return r.addFile(p, info)
+	}
+
+	matches, err := filepath.Glob(p)
+	if err != nil {
+		return &Error{Path: p, Err: err}
+	}
+	if len(matches) == 0 {
+		return &Error{Path: p, Err: errNoMatch}
+	}
+	for _, m := range matches {
+		if hidden(filepath.Base(m)) {
+			continue
+		}
+		info, err := os.Stat(m)
+		if err != nil {
+			return &Error{Path: m, Err: unwrapPathError(err)}
+		}
+		if info.IsDir() {
+			if err := r.addDir(m); err != nil {
+				return err
+			}
+		} else if r.keep(m) {
+			if err := r.addFile(m, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addDir adds the files in dir. Like glob matches, hidden files and
+// directories whose names start with "." or "_" (such as _SUCCESS markers)
+// are skipped.
+func (r *resolver) addDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return &Error{Path: path, Err: unwrapPathError(err)}
+		}
+		if path == dir {
+			return nil
+		}
+		if hidden(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !r.spec.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !r.keep(path) {
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return &Error{Path: path, Err: unwrapPathError(err)}
+		}
+		return r.addFile(path, info)
+	})
+}
+
+// addFile checks that path is a readable regular file and records it.
+func (r *resolver) addFile(path string, info fs.FileInfo) error {
+	if r.seen[path] {
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return &Error{Path: path, Err: errors.New("not a regular file")}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return &Error{Path: path, Err: unwrapPathError(err)}
+	}
+	f.Close()
+	r.seen[path] = true
+	r.files = append(r.files, File{Path: path, Size: info.Size(), ModTime: info.ModTime().UTC()})
+	return nil
+}
+
+// addURI resolves a file, key prefix or glob pattern in a storage backend.
+// Object stores have no directories to walk, so prefixes and patterns are
+// expanded by listing every file below the longest literal prefix.
+func (r *resolver) addURI(p string) error {
+	if err := storage.Check(p); err != nil {
+		return &Error{Path: p, Err: err}
+	}
+	if !hasMeta(p) {
+		info, err := storage.Stat(p)
+		if err == nil && !info.IsDir {
+			return r.addInfo(info)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return &Error{Path: p, Err: unwrapPathError(err)}
+		}
+		n, err := r.addListed(strings.TrimSuffix(p, "/"), nil)
+		if err == nil && n == 0 {
+			err = &Error{Path: p, Err: fs.ErrNotExist}
+		}
+		return err
+	}
+
+	literal := p[:strings.IndexAny(p, `*?[\`)]
+	dir := strings.TrimSuffix(storage.Dir(literal+"x"), "/")
+	n, err := r.addListed(dir, func(file string) bool {
+		ok, _ := path.Match(p, file)
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &Error{Path: p, Err: errNoMatch}
+	}
+	return nil
+}
+
+// addListed adds the files below dir, skipping hidden ones as addDir does.
+// A non-nil match selects the files themselves, as for a glob pattern;
+// otherwise dir is treated as a directory, honouring Recursive. It returns
+// the number of files that matched before filtering.
+func (r *resolver) addListed(dir string, match func(string) bool) (int, error) {
+	files, err := storage.List(dir)
+	if err != nil {
+		return 0, &Error{Path: dir, Err: unwrapPathError(err)}
+	}
+	n := 0
+	for _, f := range files {
+		rel := strings.TrimPrefix(f.Path, dir+"/")
+		if hiddenPath(rel) {
+			continue
+		}
+		if match != nil {
+			if !match(f.Path) {
+				continue
+			}
+		} else if !r.spec.Recursive && strings.Contains(rel, "/") {
+			continue
+		}
+		n++
+		if !r.keep(f.Path) {
+			continue
+		}
+		if err := r.addInfo(f); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// addInfo records a file found in a storage backend.
+func (r *resolver) addInfo(info storage.FileInfo) error {
+	if r.seen[info.Path] {
+		return nil
+	}
+	r.seen[info.Path] = true
+	r.files = append(r.files, File{Path: info.Path, Size: info.Size, ModTime: info.ModTime.UTC()})
+	return nil
+}
+
+// keep applies the include and exclude filters to a discovered file.
+func (r *resolver) keep(path string) bool {
+	name := storage.Base(path)
+	if len(r.spec.Include) > 0 && !matchAny(r.spec.Include, name) {
+		return false
+	}
+	return !matchAny(r.spec.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// hiddenPath reports whether any element of a slash-separated relative
+// path is hidden.
+func hiddenPath(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		if hidden(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// unwrapPathError drops the *fs.PathError wrapper, whose message repeats the
+// path already carried by Error.
+func unwrapPathError(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
+
+// readManifest returns the entries of a manifest file.
+func readManifest(path string) ([]string, error) {
+	f, err := storage.Open(path)
+	if err != nil {
+		return nil, unwrapPathError(err)
+	}
+	defer f.Close()
+	base := storage.Dir(path)
+	var entries []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !storage.IsAbs(line) {
+			line = storage.Join(base, line)
+		}
+		entries = append(entries, line)
+	}
+	return entries, sc.Err()
+}
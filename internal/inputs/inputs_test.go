@@ -0,0 +1,195 @@
+package inputs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// tree creates files (with parent directories) under a temporary root.
+func tree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func relPaths(t *testing.T, root string, files []File) []string {
+	t.Helper()
+	var rel []string
+	for _, f := range files {
+		r, err := filepath.Rel(root, f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return rel
+}
+
+func TestResolve(t *testing.T) {
+	root := tree(t,
+		"a.txt", "b.txt", "c.log", ".hidden.txt", "_SUCCESS",
+		"sub/d.txt", "sub/deeper/e.txt", "_tmp/f.txt",
+	)
+	in := func(p string) string { return filepath.Join(root, p) }
+
+	tests := []struct {
+		name string
+		spec Spec
+		want []string
+	}{
+		{"file", Spec{Paths: []string{in("a.txt")}}, []string{"a.txt"}},
+		{"glob", Spec{Paths: []string{in("*.txt")}}, []string{"a.txt", "b.txt"}},
+		{"directory", Spec{Paths: []string{root}}, []string{"a.txt", "b.txt", "c.log"}},
+		{"recursive", Spec{Paths: []string{root}, Recursive: true},
+			[]string{"a.txt", "b.txt", "c.log", "sub/d.txt", "sub/deeper/e.txt"}},
+		{"include", Spec{Paths: []string{root}, Recursive: true, Include: []string{"*.txt"}},
+			[]string{"a.txt", "b.txt", "sub/d.txt", "sub/deeper/e.txt"}},
+		{"exclude", Spec{Paths: []string{root}, Exclude: []string{"b.*", "*.log"}}, []string{"a.txt"}},
+		{"explicit file ignores filters", Spec{Paths: []string{in("c.log")}, Include: []string{"*.txt"}}, []string{"c.log"}},
+		{"duplicates", Spec{Paths: []string{in("a.txt"), in("*.txt"), root}}, []string{"a.txt", "b.txt", "c.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Resolve(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := relPaths(t, root, files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	files, err := Resolve(Spec{Paths: []string{in("a.txt")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].Size != int64(len("a.txt")) || files[0].ModTime.IsZero() {
+		t.Errorf("Expected size and modification time to be recorded, got %+v", files[0])
+	}
+}
+
+func TestResolve_Manifest(t *testing.T) {
+	root := tree(t, "a.txt", "b.txt", "logs/1.log", "logs/2.log")
+	manifest := filepath.Join(root, "inputs.txt")
+	content := "# inputs for the nightly job\n\na.txt\n" + filepath.Join(root, "b.txt") + "\nlogs/*.log\n"
+	if err := os.WriteFile(manifest, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Resolve(Spec{Manifests: []string{manifest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.txt", "b.txt", "logs/1.log", "logs/2.log"}
+	if got := relPaths(t, root, files); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if err := os.WriteFile(manifest, []byte("a.txt\nmissing.txt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resolve(Spec{Manifests: []string{manifest}}); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("Expected an error naming the missing manifest entry, got %v", err)
+	}
+}
+
+func TestResolve_Errors(t *testing.T) {
+	root := tree(t, "a.txt", "empty/.keep")
+
+	_, err := Resolve(Spec{Paths: []string{filepath.Join(root, "nope.txt")}})
+	var inputErr *Error
+	if !errors.As(err, &inputErr) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a not-exist input error, got %v", err)
+	}
+	if _, err := Resolve(Spec{Paths: []string{filepath.Join(root, "*.csv")}}); !errors.Is(err, errNoMatch) {
+		t.Errorf("Expected a no-match error for a glob, got %v", err)
+	}
+	if _, err := Resolve(Spec{Paths: []string{filepath.Join(root, "empty")}}); !errors.Is(err, ErrNoInputs) {
+		t.Errorf("Expected ErrNoInputs for an empty directory, got %v", err)
+	}
+	if _, err := Resolve(Spec{Manifests: []string{filepath.Join(root, "nope.manifest")}}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a not-exist error for a missing manifest, got %v", err)
+	}
+	if _, err := Resolve(Spec{Paths: []string{root}, Include: []string{"["}}); err == nil {
+		t.Error("Expected an error for a malformed filter pattern")
+	}
+	if _, err := Resolve(Spec{}); !errors.Is(err, ErrNoInputs) {
+		t.Errorf("Expected ErrNoInputs for an empty spec, got %v", err)
+	}
+}
+
+func TestResolve_URI(t *testing.T) {
+	root := "mem://" + t.Name()
+	for _, f := range []string{
+		"a.txt", "b.txt", "c.log", ".hidden.txt", "_SUCCESS",
+		"sub/d.txt", "sub/deeper/e.txt", "_tmp/f.txt", "list",
+	} {
+		data := f
+		if f == "list" {
+			data = "# inputs\nb.txt\nsub/\n"
+		}
+		if err := storage.WriteFile(root+"/"+f, func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := func(p string) string { return root + "/" + p }
+
+	tests := []struct {
+		name string
+		spec Spec
+		want []string
+	}{
+		{"file", Spec{Paths: []string{in("a.txt")}}, []string{"a.txt"}},
+		{"glob", Spec{Paths: []string{in("*.txt")}}, []string{"a.txt", "b.txt"}},
+		{"nested glob", Spec{Paths: []string{in("s*/*.txt")}}, []string{"sub/d.txt"}},
+		{"prefix", Spec{Paths: []string{root}, Exclude: []string{"list"}}, []string{"a.txt", "b.txt", "c.log"}},
+		{"recursive", Spec{Paths: []string{root + "/"}, Recursive: true, Include: []string{"*.txt"}},
+			[]string{"a.txt", "b.txt", "sub/d.txt", "sub/deeper/e.txt"}},
+		{"manifest", Spec{Manifests: []string{in("list")}}, []string{"b.txt", "sub/d.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Resolve(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range files {
+				got = append(got, strings.TrimPrefix(f.Path, root+"/"))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	for _, p := range []string{in("missing.txt"), in("*.csv"), "nope://x/y"} {
+		if _, err := Resolve(Spec{Paths: []string{p}}); err == nil {
+			t.Errorf("Expected an error resolving %s", p)
+		}
+	}
+	if files, _ := Resolve(Spec{Paths: []string{in("a.txt")}}); len(files) == 1 && files[0].Size != int64(len("a.txt")) {
+		t.Errorf("Expected the size to be recorded, got %d", files[0].Size)
+	}
+}
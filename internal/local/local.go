@@ -0,0 +1,184 @@
+// Package local runs a MapReduce job inside one process. A real coordinator
+// schedules the tasks and goroutine workers execute them with the same code
+// and file formats as the distributed workers, minus the RPC hop, which makes
+// it a quick way to try out a new app.
+package local
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/worker"
+)
+
+// DefaultWorkers is the number of goroutine workers used when Config.Workers
+// is not set.
+const DefaultWorkers = 4
+
+// idlePoll is how long a worker waits before asking again when no task is
+// ready, e.g. while reduces wait for the last map.
+const idlePoll = 5 * time.Millisecond
+
+// Config describes a local job.
+type Config struct {
+	App     string // Registered app name; empty selects common.DefaultApp
+	Files   []string
+	NReduce int
+	Workers int    // Goroutine workers; defaults to DefaultWorkers
+	Dir     string // Directory for intermediate and output files; defaults to the working directory
+}
+
+// Result describes a finished local job.
+type Result struct {
+	JobID    int
+	App      string
+	Status   string
+	Outputs  []string // Paths of the reduce output files in partition order
+	Counters map[string]int64
+}
+
+// Run executes the job described by cfg and blocks until it completes, a
+// task fails, or ctx ends. The output is deterministic: it depends only on
+// the inputs, the app and NReduce, not on how tasks were scheduled.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	if cfg.NReduce <= 0 {
+		return nil, fmt.Errorf("nReduce must be positive, got %d", cfg.NReduce)
+	}
+	if len(cfg.Files) == 0 {
+		return nil, errors.New("no input files")
+	}
+	if _, ok := worker.LookupApp(cfg.App); !ok {
+		return nil, fmt.Errorf("unknown app %q", cfg.App)
+	}
+	for _, f := range cfg.Files {
+		if _, err := os.Stat(f); err != nil {
+			return nil, err
+		}
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	c := coordinator.NewCoordinator()
+	c.SetOutputDir(cfg.Dir)
+	jobID := c.Submit(coordinator.JobSpec{Files: cfg.Files, NReduce: cfg.NReduce, App: cfg.App})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			c.Cancel(jobID)
+			cancel()
+		})
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			if err := runWorker(ctx, c, jobID, workerID, cfg.Dir); err != nil {
+				fail(err)
+			}
+		}(fmt.Sprintf("local-%d", i))
+	}
+	wg.Wait()
+
+	job, _ := c.Snapshot(jobID)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil && job.Status != coordinator.StatusCompleted {
+		return nil, err
+	}
+	res := &Result{JobID: jobID, App: cfg.App, Status: job.Status, Counters: job.Counters}
+	for r := 0; r < cfg.NReduce; r++ {
+		res.Outputs = append(res.Outputs, filepath.Join(cfg.Dir, common.OutputName(jobID, r)))
+	}
+	return res, nil
+}
+
+// runWorker asks the coordinator for tasks and runs them until the job is no
+// longer in progress.
+func runWorker(ctx context.Context, c *coordinator.Coordinator, jobID int, workerID, dir string) error {
+	for ctx.Err() == nil {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: workerID}, reply); err != nil {
+			return err
+		}
+		if reply.TaskType != common.TaskTypeMap && reply.TaskType != common.TaskTypeReduce {
+			if job, _ := c.Snapshot(jobID); job.Done() {
+				return nil
+			}
+			select {
+			case <-time.After(idlePoll):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		report, err := worker.RunTask(reply, workerID, dir)
+		if err != nil {
+			return fmt.Errorf("%s task %d: %w", reply.TaskType, reply.TaskID, err)
+		}
+		if err := c.ReportTask(report, &common.ReportTaskReply{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSorted writes the job's output to w as "key value" lines in the order
+// the app sorts its keys in, e.g. numerically for int64 keys. Each partition
+// is already sorted and holds a disjoint set of keys, so the lines only need
+// to be ordered across partitions.
+func (r *Result) WriteSorted(w io.Writer) error {
+	var lines []string
+	for _, path := range r.Outputs {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+	compare := strings.Compare
+	if app, ok := worker.LookupApp(r.App); ok {
+		compare = app.CompareKeys
+	}
+	slices.SortStableFunc(lines, func(a, b string) int { return compare(lineKey(a), lineKey(b)) })
+
+	bw := bufio.NewWriter(w)
+	for _, line := range lines {
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func lineKey(line string) string {
+	key, _, _ := strings.Cut(line, " ")
+	return key
+}
@@ -0,0 +1,163 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/worker"
+)
+
+func writeInputs(t *testing.T) []string {
+	t.Helper()
+	dir := t.TempDir()
+	contents := []string{
+		"the quick brown fox\njumps over the lazy dog\n",
+		"the dog barks\nthe fox runs\n",
+		"Quick quick QUICK\n",
+	}
+	var files []string
+	for i, c := range contents {
+		path := filepath.Join(dir, fmt.Sprintf("in-%d.txt", i))
+		if err := os.WriteFile(path, []byte(c), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+// sequential computes the expected output by running the app's functions
+// directly, without partitioning.
+func sequential(t *testing.T, app string, files []string) string {
+	t.Helper()
+	a, _ := worker.LookupApp(app)
+	ctr := worker.NewCounters()
+	groups := make(map[string][]string)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range a.Map(f, string(b), ctr) {
+			groups[kv.Key] = append(groups[kv.Key], kv.Value)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s %s\n", k, a.Reduce(k, groups[k], ctr))
+	}
+	return sb.String()
+}
+
+func TestRun_MatchesSequential(t *testing.T) {
+	files := writeInputs(t)
+	want := sequential(t, "wordcount", files)
+
+	var outputs [][]byte
+	for _, workers := range []int{1, 3, 8} {
+		res, err := Run(context.Background(), Config{Files: files, NReduce: 3, Workers: workers, Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Run with %d workers: %v", workers, err)
+		}
+		if res.Status != "COMPLETED" || len(res.Outputs) != 3 {
+			t.Fatalf("Unexpected result %+v", res)
+		}
+		if got := res.Counters[worker.CounterMapInputRecords]; got != 5 {
+			t.Errorf("Expected 5 map input records, got %d", got)
+		}
+
+		var buf bytes.Buffer
+		if err := res.WriteSorted(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("Output with %d workers differs from sequential run:\n%s\nwant:\n%s", workers, buf.String(), want)
+		}
+
+		// Partition files must be identical from run to run.
+		var all []byte
+		for _, path := range res.Outputs {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, b...)
+		}
+		outputs = append(outputs, all)
+	}
+	for i := 1; i < len(outputs); i++ {
+		if !bytes.Equal(outputs[0], outputs[i]) {
+			t.Errorf("Partition output of run %d differs from run 0", i)
+		}
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	files := writeInputs(t)
+	ctx := context.Background()
+
+	if _, err := Run(ctx, Config{Files: append(files, "missing.txt"), NReduce: 1, Dir: t.TempDir()}); err == nil {
+		t.Error("Expected an error for a missing input")
+	}
+	if _, err := Run(ctx, Config{App: "nope", Files: files, NReduce: 1, Dir: t.TempDir()}); err == nil {
+		t.Error("Expected an error for an unknown app")
+	}
+	// Intermediate files cannot be created below a regular file.
+	if _, err := Run(ctx, Config{Files: files, NReduce: 1, Dir: files[0]}); err == nil {
+		t.Error("Expected a task error when the output directory is a file")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Run(cancelled, Config{Files: files, NReduce: 1, Dir: t.TempDir()}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestResult_WriteSortedTypedKeys(t *testing.T) {
+	// Each input line emits its line number, so there are keys 1 to 12,
+	// which sort differently as numbers and as strings.
+	worker.RegisterApp("test-line-numbers", worker.TypedApp[int64, int64]{
+		Key:   worker.Int64,
+		Value: worker.Int64,
+		Map: func(in *worker.Input, emit func(int64, int64), _ *worker.Counters) {
+			for i := range strings.Count(in.Contents, "\n") {
+				emit(int64(i+1), 1)
+			}
+		},
+		Reduce: func(n int64, counts []int64, emit func(int64, int64), _ *worker.Counters) {
+			emit(n, int64(len(counts)))
+		},
+	}.App())
+
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("line\n", 12)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(context.Background(), Config{App: "test-line-numbers", Files: []string{path}, NReduce: 3, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := res.WriteSorted(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for n := 1; n <= 12; n++ {
+		fmt.Fprintf(&want, "%d 1\n", n)
+	}
+	if buf.String() != want.String() {
+		t.Errorf("Expected keys in numeric order:\n%s\ngot:\n%s", want.String(), buf.String())
+	}
+}
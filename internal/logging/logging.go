@@ -0,0 +1,143 @@
+// Package logging sets up structured logging for the coordinator and workers
+// and defines the attribute names used to correlate a job across processes.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// Attribute keys attached to every task-related log line.
+const (
+	KeyJobID    = "job_id"
+	KeyTaskID   = "task_id"
+	KeyTaskType = "task_type"
+	KeyWorkerID = "worker_id"
+	KeyAttempt  = "attempt"
+)
+
+// New builds a logger writing to w in the given format ("json" or "text").
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want json or text)", format)
+}
+
+// Setup installs a logger writing to stderr as the process default, so both
+// slog and the standard log package use it. levelName is a slog level name.
+func Setup(format, levelName string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	logger, err := New(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// ParseLevel converts a level name such as "debug" or "warn" into a slog.Level.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// TaskAttrs returns the correlation attributes for one task attempt.
+func TaskAttrs(jobID, taskID int, taskType common.TaskType, workerID string, attempt int) []any {
+	return []any{
+		slog.Int(KeyJobID, jobID),
+		slog.Int(KeyTaskID, taskID),
+		slog.String(KeyTaskType, taskType.String()),
+		slog.String(KeyWorkerID, workerID),
+		slog.Int(KeyAttempt, attempt),
+	}
+}
+
+// Tee returns a handler that passes every record to all of the given handlers.
+// Workers use it to copy a task's log lines into a per-task buffer while still
+// writing them to the process log.
+func Tee(handlers ...slog.Handler) slog.Handler {
+	return teeHandler(handlers)
+}
+
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// LimitedBuffer is an io.Writer that keeps at most Max bytes and silently
+// drops the rest, noting the truncation once.
+type LimitedBuffer struct {
+	Max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	if room := b.Max - len(b.buf); room > 0 {
+		if len(p) <= room {
+			b.buf = append(b.buf, p...)
+			return len(p), nil
+		}
+		b.buf = append(b.buf, p[:room]...)
+	}
+	b.truncated = true
+	return len(p), nil
+}
+
+// String returns the captured output.
+func (b *LimitedBuffer) String() string {
+	if b.truncated {
+		return string(b.buf) + "\n... log truncated ...\n"
+	}
+	return string(b.buf)
+}
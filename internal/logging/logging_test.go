@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+func TestNew_JSONCarriesTaskAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.With(TaskAttrs(3, 1, common.TaskTypeReduce, "w1", 2)...).Info("done")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid JSON log line %q: %v", buf.String(), err)
+	}
+	expected := map[string]any{
+		KeyJobID:    float64(3),
+		KeyTaskID:   float64(1),
+		KeyTaskType: "reduce",
+		KeyWorkerID: "w1",
+		KeyAttempt:  float64(2),
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, line[k])
+		}
+	}
+
+	if _, err := New(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestTee_CapturesBelowProcessLevel(t *testing.T) {
+	var process, task bytes.Buffer
+	h := Tee(
+		slog.NewTextHandler(&process, &slog.HandlerOptions{Level: slog.LevelInfo}),
+		slog.NewTextHandler(&task, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	)
+	logger := slog.New(h).With(KeyJobID, 7)
+	logger.Debug("details")
+	logger.Info("progress")
+
+	if strings.Contains(process.String(), "details") {
+		t.Error("Process log should not contain debug line")
+	}
+	if !strings.Contains(task.String(), "details") || !strings.Contains(task.String(), "job_id=7") {
+		t.Errorf("Task log missing debug line or attrs: %q", task.String())
+	}
+	if !strings.Contains(process.String(), "progress") {
+		t.Error("Process log missing info line")
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &LimitedBuffer{Max: 5}
+	n, err := b.Write([]byte("abc"))
+	if n != 3 || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if n, _ := b.Write([]byte("defgh")); n != 5 {
+		t.Errorf("Write should report full length, got %d", n)
+	}
+	if got := b.String(); !strings.HasPrefix(got, "abcde") || !strings.Contains(got, "truncated") {
+		t.Errorf("Unexpected buffer contents %q", got)
+	}
+}
@@ -0,0 +1,362 @@
+// Package metrics is a minimal Prometheus-compatible metrics registry. It
+// supports counters, gauges and histograms with labels and renders them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram buckets (in seconds) suited to RPC latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DurationBuckets are histogram buckets (in seconds) suited to task runtimes.
+var DurationBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Registry holds a set of metric families and renders them on demand.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// family is implemented by every metric type the registry can render.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteText renders all registered metrics in Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP exposes the registry as a Prometheus scrape endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+// desc is the metadata shared by all metric types.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// vec stores one child per distinct set of label values.
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c := v.newChild()
+	v.children[key] = c
+	v.values[key] = append([]string(nil), labelValues...)
+	return c
+}
+
+// sorted returns the children ordered by label values so output is stable.
+func (v *vec[T]) sorted() ([]*T, [][]string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+		values[i] = v.values[k]
+	}
+	return children, values
+}
+
+func newVec[T any](name, help, kind string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{name: name, help: help, kind: kind, labels: labels},
+		children: make(map[string]*T),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds a non-negative delta to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.v += delta
+	c.mu.Unlock()
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct{ *vec[Counter] }
+
+// NewCounter registers a counter family with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	v := CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(v)
+	return &v
+}
+
+// With returns the counter for the given label values.
+func (v CounterVec) With(labelValues ...string) *Counter { return v.with(labelValues) }
+
+func (v CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	children, values := v.sorted()
+	for i, c := range children {
+		writeSample(w, v.name, v.labels, values[i], c.Value())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	mu sync.Mutex
+	v  float64
+}
+
+// Set replaces the gauge value.
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.v = v
+	g.mu.Unlock()
+}
+
+// Add adds delta (which may be negative) to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	g.v += delta
+	g.mu.Unlock()
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() { g.Add(1) }
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.v
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct{ *vec[Gauge] }
+
+// NewGauge registers a gauge family with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(v)
+	return &v
+}
+
+// With returns the gauge for the given label values.
+func (v GaugeVec) With(labelValues ...string) *Gauge { return v.with(labelValues) }
+
+func (v GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	children, values := v.sorted()
+	for i, g := range children {
+		writeSample(w, v.name, v.labels, values[i], g.Value())
+	}
+}
+
+// gaugeFunc is a gauge family whose samples are computed at scrape time.
+type gaugeFunc struct {
+	desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge family computed by collect on every scrape.
+// collect calls emit once per series.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(&gaugeFunc{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	type sample struct {
+		values []string
+		v      float64
+	}
+	var samples []sample
+	g.collect(func(v float64, labelValues ...string) {
+		samples = append(samples, sample{values: labelValues, v: v})
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].values, "\xff") < strings.Join(samples[j].values, "\xff")
+	})
+	for _, s := range samples {
+		writeSample(w, g.name, g.labels, s.values, s.v)
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Observe records a single value.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct{ *vec[Histogram] }
+
+// NewHistogram registers a histogram family with the given upper bounds and
+// label names. Buckets must be sorted in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	r.register(v)
+	return &v
+}
+
+// With returns the histogram for the given label values.
+func (v HistogramVec) With(labelValues ...string) *Histogram { return v.with(labelValues) }
+
+func (v HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	children, values := v.sorted()
+	bucketLabels := append(append([]string(nil), v.labels...), "le")
+	for i, h := range children {
+		h.mu.Lock()
+		for j, b := range h.buckets {
+			writeSample(w, v.name+"_bucket", bucketLabels, withLE(values[i], formatFloat(b)), float64(h.counts[j]))
+		}
+		writeSample(w, v.name+"_bucket", bucketLabels, withLE(values[i], "+Inf"), float64(h.count))
+		writeSample(w, v.name+"_sum", v.labels, values[i], h.sum)
+		writeSample(w, v.name+"_count", v.labels, values[i], float64(h.count))
+		h.mu.Unlock()
+	}
+}
+
+// withLE copies label values and appends the bucket bound, leaving the
+// stored slice untouched.
+func withLE(values []string, le string) []string {
+	out := make([]string, 0, len(values)+1)
+	return append(append(out, values...), le)
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
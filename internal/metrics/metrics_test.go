@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.", "method")
+	c.With("GET").Inc()
+	c.With("GET").Add(2)
+	c.With("POST").Inc()
+
+	h := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.5)
+	h.With().Observe(5)
+
+	r.NewGaugeFunc("queue_depth", "Items queued.", []string{"queue"}, func(emit func(float64, ...string)) {
+		emit(3, "b")
+		emit(1, "a\"x")
+	})
+
+	var sb strings.Builder
+	if err := r.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET"} 3
+requests_total{method="POST"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP queue_depth Items queued.
+# TYPE queue_depth gauge
+queue_depth{queue="a\"x"} 1
+queue_depth{queue="b"} 3
+`
+	if sb.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", sb.String(), expected)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("in_flight", "In-flight tasks.")
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+	if v := g.With().Value(); v != 1 {
+		t.Errorf("Expected gauge 1, got %v", v)
+	}
+}
+
+func TestCounter_IgnoresNegative(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("events_total", "Events.")
+	c.With().Add(-1)
+	if v := c.With().Value(); v != 0 {
+		t.Errorf("Expected counter to stay 0, got %v", v)
+	}
+}
@@ -0,0 +1,502 @@
+// Package mrtest runs a coordinator and several workers inside a test
+// process, talking real RPC over random local ports, and injects faults into
+// them: killed workers, delayed RPCs, corrupted intermediate files and
+// coordinator restarts. Results are checked against Reference, a sequential
+// implementation, in the style of the MIT 6.824 mr tests.
+package mrtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/worker"
+)
+
+// Options tunes a test cluster.
+type Options struct {
+	TaskTimeout  time.Duration // Defaults to 500ms so lost tasks are retried quickly
+	PollInterval time.Duration // Worker idle poll; defaults to 10ms
+	Slots        int           // Task slots per worker; defaults to 1
+	GracePeriod  time.Duration // How long StopWorker lets running tasks finish; defaults to 5s
+
+	// TLS and WorkerTLS, if set, make the coordinator serve RPCs and the
+	// workers dial it over TLS, see package mtls.
+	TLS       *tls.Config
+	WorkerTLS *tls.Config
+
+	// Replicas, if more than one, starts that many coordinator replicas
+	// sharing a FileLock and a FileLog, with a lease short enough to fail
+	// over within a second.
+	Replicas int
+}
+
+// replicaLeaseTTL is the lease of test replicas.
+const replicaLeaseTTL = 300 * time.Millisecond
+
+// Cluster is a coordinator plus workers sharing one data directory.
+type Cluster struct {
+	// Dir is the shared directory for intermediate and output files.
+	Dir string
+	// Addr is the coordinator's RPC address. It stays the same across
+	// restarts. With replicas it lists theirs, separated by commas.
+	Addr string
+
+	t         testing.TB
+	opts      Options
+	stateFile string
+
+	mu         sync.Mutex
+	coord      *coordinator.Coordinator
+	replicas   []*coordinator.Coordinator // Replicas still running, if Options.Replicas > 1
+	workers    map[string]*testWorker
+	nextWorker int
+	wg         sync.WaitGroup
+}
+
+// NewCluster starts a coordinator on a random port. It is shut down, along
+// with all workers, when the test ends.
+func NewCluster(t testing.TB, opts Options) *Cluster {
+	t.Helper()
+	if opts.TaskTimeout <= 0 {
+		opts.TaskTimeout = 500 * time.Millisecond
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 10 * time.Millisecond
+	}
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = 5 * time.Second
+	}
+	c := &Cluster{
+		Dir:       t.TempDir(),
+		t:         t,
+		opts:      opts,
+		stateFile: filepath.Join(t.TempDir(), "coordinator.json"),
+		workers:   make(map[string]*testWorker),
+	}
+	if opts.Replicas > 1 {
+		c.startReplicas()
+	} else {
+		c.startCoordinator("127.0.0.1:0")
+	}
+	t.Cleanup(c.shutdown)
+	return c
+}
+
+func (c *Cluster) startReplicas() {
+	c.t.Helper()
+	dir := c.t.TempDir()
+	var addrs []string
+	for i := 0; i < c.opts.Replicas; i++ {
+		coord := coordinator.NewCoordinator()
+		coord.SetTaskTimeout(c.opts.TaskTimeout)
+		coord.SetOutputDir(c.Dir)
+		coord.SetTLS(c.opts.TLS)
+		err := coord.SetReplica(coordinator.Replica{
+			ID:       fmt.Sprintf("replica-%d", i),
+			Lock:     &coordinator.FileLock{Path: filepath.Join(dir, "lease.json")},
+			Log:      &coordinator.FileLog{Dir: filepath.Join(dir, "log")},
+			LeaseTTL: replicaLeaseTTL,
+		})
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		bound, err := coord.Listen("127.0.0.1:0")
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		c.replicas = append(c.replicas, coord)
+		addrs = append(addrs, bound.String())
+	}
+	c.Addr = strings.Join(addrs, ",")
+}
+
+func (c *Cluster) startCoordinator(addr string) {
+	c.t.Helper()
+	coord := coordinator.NewCoordinator()
+	coord.SetTaskTimeout(c.opts.TaskTimeout)
+	coord.SetOutputDir(c.Dir)
+	coord.SetTLS(c.opts.TLS)
+	if err := coord.SetStateFile(c.stateFile); err != nil {
+		c.t.Fatal(err)
+	}
+	bound, err := coord.Listen(addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.coord = coord
+	c.Addr = bound.String()
+	c.mu.Unlock()
+}
+
+// Coordinator returns the running coordinator. With replicas it returns the
+// leader, waiting for one to be elected.
+func (c *Cluster) Coordinator() *coordinator.Coordinator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Replicas <= 1 {
+		return c.coord
+	}
+	c.t.Helper()
+	deadline := time.Now().Add(10 * replicaLeaseTTL)
+	for {
+		for _, coord := range c.replicas {
+			if coord.IsLeader() {
+				return coord
+			}
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("no coordinator replica became the leader within %s", 10*replicaLeaseTTL)
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		c.mu.Lock()
+	}
+}
+
+// KillLeader stops the leading coordinator replica without giving up its
+// lease, as if it had crashed, and returns the lease it held. Another
+// replica takes over once the lease runs out.
+func (c *Cluster) KillLeader() coordinator.Lease {
+	c.t.Helper()
+	leader := c.Coordinator()
+	lease, _ := leader.Leader()
+	leader.Close()
+	c.mu.Lock()
+	c.replicas = slices.DeleteFunc(c.replicas, func(r *coordinator.Coordinator) bool { return r == leader })
+	c.mu.Unlock()
+	return lease
+}
+
+// RestartCoordinator stops the coordinator and starts a new one on the same
+// address from the persisted state, as if the process had been restarted.
+// Clusters of replicas use KillLeader instead.
+func (c *Cluster) RestartCoordinator() {
+	c.t.Helper()
+	c.mu.Lock()
+	old, addr := c.coord, c.Addr
+	c.mu.Unlock()
+	old.Close()
+	c.startCoordinator(addr)
+}
+
+// StartWorker starts a worker connected directly to the coordinator and
+// returns its ID.
+func (c *Cluster) StartWorker() string {
+	c.mu.Lock()
+	addr := c.Addr
+	c.mu.Unlock()
+	return c.StartWorkerVia(addr)
+}
+
+// testWorker is a worker running in the test process.
+type testWorker struct {
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// StartWorkerVia starts a worker that reaches the coordinator at addr, such
+// as a DelayProxy in front of it.
+func (c *Cluster) StartWorkerVia(addr string) string {
+	c.mu.Lock()
+	id := fmt.Sprintf("test-worker-%d", c.nextWorker)
+	c.nextWorker++
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &testWorker{cancel: cancel, stop: make(chan struct{}), done: make(chan struct{})}
+	c.workers[id] = w
+	c.mu.Unlock()
+	workerID := id
+	if c.opts.WorkerTLS != nil {
+		workerID = "" // Named after the certificate by the coordinator
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(w.done)
+		err := worker.Run(ctx, worker.Config{
+			CoordinatorAddr:   addr,
+			ID:                workerID,
+			Dir:               c.Dir,
+			PollInterval:      c.opts.PollInterval,
+			Slots:             c.opts.Slots,
+			HeartbeatInterval: 50 * time.Millisecond,
+			ReconnectTimeout:  10 * time.Second,
+			TLS:               c.opts.WorkerTLS,
+			Stop:              w.stop,
+			GracePeriod:       c.opts.GracePeriod,
+		})
+		if err != nil {
+			c.t.Errorf("worker %s: %v", id, err)
+		}
+	}()
+	return id
+}
+
+// KillWorker stops a worker. A task it is running is never reported, so
+// the coordinator has to time it out and hand it to another worker.
+func (c *Cluster) KillWorker(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.workers[id]; ok {
+		w.cancel()
+		delete(c.workers, id)
+	}
+}
+
+// StopWorker stops a worker gracefully, as on SIGTERM, and waits for it to
+// exit. Tasks it is running get Options.GracePeriod to finish; the rest are
+// handed back to the coordinator.
+func (c *Cluster) StopWorker(id string) {
+	c.mu.Lock()
+	w, ok := c.workers[id]
+	delete(c.workers, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(w.stop)
+	<-w.done
+	w.cancel()
+}
+
+func (c *Cluster) shutdown() {
+	c.mu.Lock()
+	for id, w := range c.workers {
+		w.cancel()
+		delete(c.workers, id)
+	}
+	coords := append([]*coordinator.Coordinator{c.coord}, c.replicas...)
+	c.mu.Unlock()
+	for _, coord := range coords {
+		if coord != nil {
+			coord.Close()
+		}
+	}
+	c.wg.Wait()
+}
+
+// Submit submits a job to the current coordinator.
+func (c *Cluster) Submit(spec coordinator.JobSpec) int {
+	return c.Coordinator().Submit(spec)
+}
+
+// WaitJob waits for a job to stop running, following coordinator restarts,
+// and fails the test if it takes longer than timeout.
+func (c *Cluster) WaitJob(id int, timeout time.Duration) coordinator.Job {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		job, ok := c.Coordinator().Snapshot(id)
+		if !ok {
+			c.t.Fatalf("job %d not found", id)
+		}
+		if job.Done() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("job %d still %s after %s", id, job.Status, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SubmitWorkflow submits a workflow to the current coordinator.
+func (c *Cluster) SubmitWorkflow(spec coordinator.WorkflowSpec) int {
+	c.t.Helper()
+	id, err := c.Coordinator().SubmitWorkflow(spec)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return id
+}
+
+// WaitWorkflow is WaitJob for workflows.
+func (c *Cluster) WaitWorkflow(id int, timeout time.Duration) coordinator.Workflow {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		wf, ok := c.Coordinator().SnapshotWorkflow(id)
+		if !ok {
+			c.t.Fatalf("workflow %d not found", id)
+		}
+		if wf.Status != coordinator.StatusInProgress {
+			return wf
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("workflow %d still %s after %s", id, wf.Status, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitTask waits until cond holds for the job, e.g. until a given task has
+// completed, and returns the job as it was then.
+func (c *Cluster) WaitTask(id int, timeout time.Duration, cond func(coordinator.Job) bool) coordinator.Job {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		if job, ok := c.Coordinator().Snapshot(id); ok && cond(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("job %d did not reach the expected state within %s", id, timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Output returns a job's reduce output as sorted "key value" lines,
+// whatever format the job wrote it in.
+func (c *Cluster) Output(job coordinator.Job) string {
+	c.t.Helper()
+	var lines []string
+	for r := 0; r < job.NReduce; r++ {
+		f, err := storage.Open(job.Output.Path(c.Dir, job.ID, r))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rd := outputs.NewReader(f, job.Output)
+		for {
+			key, value, err := rd.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			lines = append(lines, key+" "+value)
+		}
+		f.Close()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Reference runs app sequentially over files, without partitioning, and
+// returns the expected output as sorted "key value" lines.
+func Reference(t testing.TB, app string, files []string) string {
+	t.Helper()
+	a, ok := worker.LookupApp(app)
+	if !ok {
+		t.Fatalf("unknown app %q", app)
+	}
+	ctr := worker.NewCounters()
+	groups := make(map[string][]string)
+	for _, f := range files {
+		b, err := storage.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range a.RunMap(&worker.Input{Filename: f, Contents: string(b)}, ctr) {
+			groups[kv.Key] = append(groups[kv.Key], kv.Value)
+		}
+	}
+	lines := make([]string, 0, len(groups))
+	for k, vs := range groups {
+		for _, kv := range a.RunReduce(&worker.Group{Key: k, Values: vs}, ctr) {
+			lines = append(lines, fmt.Sprintf("%s %s", kv.Key, kv.Value))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// WriteInputs writes each text to its own file in a temporary directory and
+// returns the paths.
+func WriteInputs(t testing.TB, texts ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for i, text := range texts {
+		path := filepath.Join(dir, fmt.Sprintf("input-%d.txt", i))
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+// Corrupt damages the file at path in place: it flips a byte of a non-empty
+// file and adds garbage to an empty one.
+func Corrupt(t testing.TB, path string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 {
+		b = []byte("garbage")
+	} else {
+		b[len(b)/2] ^= 0xff
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// DelayProxy forwards TCP connections to target, holding each chunk of data
+// for a random delay of up to maxDelay in either direction. It returns the
+// proxy's address, and stops when the test ends.
+func DelayProxy(t testing.TB, target string, maxDelay time.Duration) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer in.Close()
+				out, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer out.Close()
+				done := make(chan struct{}, 2)
+				go func() { copyDelayed(out, in, maxDelay); done <- struct{}{} }()
+				go func() { copyDelayed(in, out, maxDelay); done <- struct{}{} }()
+				<-done
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func copyDelayed(dst io.Writer, src io.Reader, maxDelay time.Duration) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			time.Sleep(rand.N(maxDelay + 1))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package mrtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/inputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/mtls"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage/s3test"
+	"github.com/sagarneeli/dist-mapreduce/internal/worker"
+)
+
+var texts = []string{
+	"the quick brown fox jumps over the lazy dog\nmany more words make more output\n",
+	"a map reduce job counts words\nthe job runs on many workers\n",
+	"quick quick quick\nmonkeys and queens need more nuts\n",
+	"over and over and over\nthe end\n",
+}
+
+// gate lets a test hold map tasks inside the app until it is ready.
+type gate struct {
+	started chan string // Receives the input file of each held map task
+	release chan struct{}
+	once    sync.Once
+}
+
+func newGate(t *testing.T) *gate {
+	g := &gate{started: make(chan string, 16), release: make(chan struct{})}
+	t.Cleanup(g.open)
+	return g
+}
+
+func (g *gate) open() { g.once.Do(func() { close(g.release) }) }
+
+// holding is the gate consulted by the "mrtest-gated" app. Map tasks whose
+// input file name contains "held" wait on it.
+var holding atomic.Pointer[gate]
+
+func init() {
+	wc, _ := worker.LookupApp("wordcount")
+	worker.RegisterApp("mrtest-gated", worker.App{
+		Map: func(filename, contents string, ctr *worker.Counters) []worker.KeyValue {
+			if g := holding.Load(); g != nil && strings.Contains(filepath.Base(filename), "held") {
+				g.started <- filename
+				<-g.release
+			}
+			return wc.Map(filename, contents, ctr)
+		},
+		Reduce: wc.Reduce,
+	})
+	worker.RegisterApp("mrtest-slow", worker.App{
+		Map: func(filename, contents string, ctr *worker.Counters) []worker.KeyValue {
+			time.Sleep(50 * time.Millisecond)
+			return wc.Map(filename, contents, ctr)
+		},
+		Reduce: wc.Reduce,
+	})
+}
+
+// writeHeld writes input files that "mrtest-gated" map tasks wait on.
+func writeHeld(t *testing.T, texts ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for i, text := range texts {
+		path := filepath.Join(dir, fmt.Sprintf("held-%d.txt", i))
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+func checkOutput(t *testing.T, c *Cluster, job coordinator.Job, app string, files []string) {
+	t.Helper()
+	if job.Status != coordinator.StatusCompleted {
+		t.Fatalf("Expected job to complete, got %s", job.Status)
+	}
+	if got, want := c.Output(job), Reference(t, app, files); got != want {
+		t.Errorf("Output differs from the sequential reference:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCluster_WordCount(t *testing.T) {
+	c := NewCluster(t, Options{})
+	for i := 0; i < 3; i++ {
+		c.StartWorker()
+	}
+	files := WriteInputs(t, texts...)
+
+	for _, app := range []string{"wordcount", "wordcount-mq", "word-lengths"} {
+		id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 3, App: app})
+		checkOutput(t, c, c.WaitJob(id, 10*time.Second), app, files)
+	}
+}
+
+func TestCluster_WorkerKilledMidTask(t *testing.T) {
+	g := newGate(t)
+	holding.Store(g)
+	defer holding.Store(nil)
+
+	c := NewCluster(t, Options{})
+	for i := 0; i < 3; i++ {
+		c.StartWorker()
+	}
+	files := append(WriteInputs(t, texts...), writeHeld(t, "held input read by a worker about to die\n")...)
+	held := len(files) - 1
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 2, App: "mrtest-gated"})
+
+	<-g.started
+	job, _ := c.Coordinator().Snapshot(id)
+	victim := job.MapTasks[held].WorkerID
+	c.KillWorker(victim)
+	// Stop holding so the replacement attempt runs; the dead worker's
+	// attempt finishes in the background but is never reported.
+	g.open()
+
+	job = c.WaitJob(id, 10*time.Second)
+	checkOutput(t, c, job, "mrtest-gated", files)
+	if task := job.MapTasks[held]; task.Attempt == 0 || task.WorkerID == victim {
+		t.Errorf("Expected the held map to be retried on another worker, got attempt %d on %s", task.Attempt, task.WorkerID)
+	}
+}
+
+func TestCluster_DelayedRPCs(t *testing.T) {
+	c := NewCluster(t, Options{TaskTimeout: 2 * time.Second})
+	proxy := DelayProxy(t, c.Addr, 30*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		c.StartWorkerVia(proxy)
+	}
+	files := WriteInputs(t, texts...)
+
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 4})
+	checkOutput(t, c, c.WaitJob(id, 20*time.Second), "wordcount", files)
+}
+
+func TestCluster_CorruptIntermediateFiles(t *testing.T) {
+	g := newGate(t)
+	holding.Store(g)
+	defer holding.Store(nil)
+
+	c := NewCluster(t, Options{})
+	for i := 0; i < 3; i++ {
+		c.StartWorker()
+	}
+	files := append(WriteInputs(t, texts[0]), writeHeld(t, "held input keeps reducers waiting\n")...)
+	nReduce := 3
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: nReduce, App: "mrtest-gated"})
+
+	// Corrupt map 0's output while map 1 keeps the reducers from starting.
+	<-g.started
+	c.WaitTask(id, 5*time.Second, func(job coordinator.Job) bool {
+		return job.MapTasks[0].Status == common.TaskStatusCompleted
+	})
+	for r := 0; r < nReduce; r++ {
+		Corrupt(t, filepath.Join(c.Dir, common.IntermediateName(id, 0, r)))
+	}
+	g.open()
+
+	job := c.WaitJob(id, 10*time.Second)
+	checkOutput(t, c, job, "mrtest-gated", files)
+	if job.MapTasks[0].Attempt == 0 {
+		t.Error("Expected map 0 to be rerun after its output was corrupted")
+	}
+	if got := job.Counters[worker.CounterMapInputRecords]; got != 3 {
+		t.Errorf("Expected counters from one attempt per map (3 input records), got %d", got)
+	}
+}
+
+func TestCluster_CoordinatorRestart(t *testing.T) {
+	c := NewCluster(t, Options{})
+	for i := 0; i < 3; i++ {
+		c.StartWorker()
+	}
+	files := WriteInputs(t, append(texts, texts...)...)
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 3, App: "mrtest-slow"})
+
+	c.WaitTask(id, 5*time.Second, func(job coordinator.Job) bool {
+		return job.MapTasks[0].Status == common.TaskStatusCompleted
+	})
+	c.RestartCoordinator()
+
+	job := c.WaitJob(id, 15*time.Second)
+	checkOutput(t, c, job, "mrtest-slow", files)
+	if got, want := job.Counters[worker.CounterMapInputRecords], int64(2*2*len(texts)); got != want {
+		t.Errorf("Expected %d map input records after the restart, got %d", want, got)
+	}
+}
+
+func TestCluster_WorkerSlots(t *testing.T) {
+	g := newGate(t)
+	holding.Store(g)
+	defer holding.Store(nil)
+
+	c := NewCluster(t, Options{Slots: 3, TaskTimeout: 5 * time.Second})
+	id := c.StartWorker()
+	files := writeHeld(t, texts...)
+	job := c.Submit(coordinator.JobSpec{Files: files, NReduce: 2, App: "mrtest-gated"})
+
+	// Three maps run at once on the one worker; the fourth has to wait for
+	// a free slot.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d tasks started concurrently", i)
+		}
+	}
+	select {
+	case f := <-g.started:
+		t.Fatalf("Expected no more than 3 tasks at once, %s started too", f)
+	case <-time.After(100 * time.Millisecond):
+	}
+	workers := c.Coordinator().Workers()
+	if len(workers) != 1 || workers[0].ID != id || workers[0].Slots != 3 || workers[0].RunningTasks != 3 {
+		t.Errorf("Unexpected workers %+v", workers)
+	}
+	g.open()
+
+	checkOutput(t, c, c.WaitJob(job, 10*time.Second), "mrtest-gated", files)
+}
+
+func TestCluster_OutputFormats(t *testing.T) {
+	c := NewCluster(t, Options{})
+	for i := 0; i < 2; i++ {
+		c.StartWorker()
+	}
+	files := WriteInputs(t, texts...)
+
+	for _, format := range outputs.Formats {
+		spec := &outputs.Spec{Dir: "out-" + format, Prefix: "part", Format: format, SuccessMarker: true, Manifest: true}
+		id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 3, Output: spec})
+		job := c.WaitJob(id, 10*time.Second)
+		checkOutput(t, c, job, "wordcount", files)
+
+		dir := spec.DirPath(c.Dir)
+		if _, err := os.Stat(filepath.Join(dir, outputs.SuccessName)); err != nil {
+			t.Errorf("%s: expected a _SUCCESS marker: %v", format, err)
+		}
+		m, err := outputs.ReadManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Records != job.Counters[worker.CounterReduceOutputRecords] || len(m.Partitions) != 3 {
+			t.Errorf("%s: manifest disagrees with the job's counters: %+v", format, m)
+		}
+		for _, p := range m.Partitions {
+			b, err := os.ReadFile(filepath.Join(dir, p.File))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(b)) != p.Bytes || crc32.ChecksumIEEE(b) != p.CRC32 {
+				t.Errorf("%s: partition %d does not match its manifest entry", format, p.Partition)
+			}
+		}
+	}
+}
+
+func TestCluster_S3(t *testing.T) {
+	srv := s3test.NewServer(t, "bucket")
+	srv.PageSize = 2
+	storage.Register("s3", srv.Backend(t))
+	for i, text := range texts {
+		srv.Put("bucket", fmt.Sprintf("in/part-%d.txt", i), []byte(text))
+	}
+	srv.Put("bucket", "in/_SUCCESS", nil)
+	srv.Put("bucket", "in/notes.md", []byte("not an input"))
+
+	files, err := inputs.Resolve(inputs.Spec{Paths: []string{"s3://bucket/in/*.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(texts) {
+		t.Fatalf("Expected %d inputs, got %v", len(texts), inputs.Paths(files))
+	}
+
+	c := NewCluster(t, Options{})
+	for i := 0; i < 2; i++ {
+		c.StartWorker()
+	}
+	spec := &outputs.Spec{Dir: "s3://bucket/results", Format: outputs.FormatJSONL, SuccessMarker: true, Manifest: true}
+	id := c.Submit(coordinator.JobSpec{Files: inputs.Paths(files), NReduce: 3, Output: spec})
+	job := c.WaitJob(id, 10*time.Second)
+	checkOutput(t, c, job, "wordcount", inputs.Paths(files))
+
+	want := []string{"results/_MANIFEST.json", "results/_SUCCESS"}
+	for p := 0; p < 3; p++ {
+		want = append(want, fmt.Sprintf("results/mr-out-%d-%d.jsonl", id, p))
+	}
+	var got []string
+	for _, k := range srv.Keys("bucket") {
+		if strings.HasPrefix(k, "results/") {
+			got = append(got, k)
+		}
+	}
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected objects %v, got %v", want, got)
+	}
+	m, err := outputs.ReadManifest(spec.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Records != job.Counters[worker.CounterReduceOutputRecords] {
+		t.Errorf("Expected %d records in the manifest, got %d", job.Counters[worker.CounterReduceOutputRecords], m.Records)
+	}
+}
+
+func TestCluster_Workflow(t *testing.T) {
+	c := NewCluster(t, Options{})
+	for i := 0; i < 2; i++ {
+		c.StartWorker()
+	}
+	files := WriteInputs(t, texts...)
+
+	// The second stage counts the words and counts of the first one's
+	// output, across a coordinator restart.
+	id := c.SubmitWorkflow(coordinator.WorkflowSpec{Name: "recount", Stages: []coordinator.StageSpec{
+		{Name: "count", Job: coordinator.JobSpec{Files: files, NReduce: 3, Output: &outputs.Spec{Dir: "count"}}},
+		{Name: "recount", After: []string{"count"}, Job: coordinator.JobSpec{NReduce: 2}},
+	}})
+	wf, _ := c.Coordinator().SnapshotWorkflow(id)
+	count := c.WaitJob(wf.Stages[0].JobID, 10*time.Second)
+	checkOutput(t, c, count, "wordcount", files)
+	c.RestartCoordinator()
+
+	wf = c.WaitWorkflow(id, 10*time.Second)
+	if wf.Status != coordinator.StatusCompleted || wf.Stages[1].Status != coordinator.StatusCompleted {
+		t.Fatalf("Expected the workflow to complete, got %s: %s", wf.Status, wf.Error)
+	}
+	var partitions []string
+	for p := 0; p < count.NReduce; p++ {
+		partitions = append(partitions, count.Output.Path(c.Dir, count.ID, p))
+	}
+	recount, _ := c.Coordinator().Snapshot(wf.Stages[1].JobID)
+	if strings.Join(recount.Files, ",") != strings.Join(partitions, ",") {
+		t.Errorf("Expected the second stage to read %v, got %v", partitions, recount.Files)
+	}
+	checkOutput(t, c, recount, "wordcount", partitions)
+}
+
+func TestCluster_Join(t *testing.T) {
+	c := NewCluster(t, Options{})
+	for i := 0; i < 2; i++ {
+		c.StartWorker()
+	}
+	users, err := filepath.Abs("../worker/testdata/users.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := filepath.Abs("../worker/testdata/events.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]string{"header": "true", "key.events": "1"}
+
+	id := c.Submit(coordinator.JobSpec{
+		App:     "join",
+		NReduce: 2,
+		Datasets: []common.Dataset{
+			{Tag: "users", Files: []string{users}},
+			{Tag: "events", Files: []string{events}},
+		},
+		Params: params,
+	})
+	job := c.WaitJob(id, 10*time.Second)
+	if job.Status != coordinator.StatusCompleted {
+		t.Fatalf("Expected the join to complete, got %s: %s", job.Status, job.Error)
+	}
+	want := "u1 alice,US,e1,click\nu1 alice,US,e3,purchase\nu2 bob,DE,e2,view"
+	if got := c.Output(job); got != want {
+		t.Errorf("Expected reduce-side join output\n%s\ngot\n%s", want, got)
+	}
+	if job.Counters[worker.CounterJoinUnmatchedKeys] != 2 || job.Counters[worker.CounterJoinMalformed] != 1 {
+		t.Errorf("Unexpected counters %v", job.Counters)
+	}
+
+	params["join"] = "left"
+	id = c.Submit(coordinator.JobSpec{
+		App:        "broadcast-join",
+		NReduce:    2,
+		Datasets:   []common.Dataset{{Tag: "events", Files: []string{events}}},
+		SideInputs: []common.Dataset{{Tag: "users", Files: []string{users}}},
+		Params:     params,
+	})
+	job = c.WaitJob(id, 10*time.Second)
+	if job.Status != coordinator.StatusCompleted {
+		t.Fatalf("Expected the broadcast join to complete, got %s: %s", job.Status, job.Error)
+	}
+	want = "u1 e1,click,alice,US\nu1 e3,purchase,alice,US\nu2 e2,view,bob,DE\nu4 e4,click"
+	if got := c.Output(job); got != want {
+		t.Errorf("Expected broadcast join output\n%s\ngot\n%s", want, got)
+	}
+	if job.Counters[worker.CounterJoinSideInputRecords] != 3 {
+		t.Errorf("Expected the side input to be loaded once, got %v", job.Counters)
+	}
+}
+
+// certs mints a CA and certificates in a temporary directory and returns
+// TLS configurations for them.
+type certs struct {
+	t   *testing.T
+	dir string
+	ca  *mtls.CA
+}
+
+func newCerts(t *testing.T) *certs {
+	t.Helper()
+	ca, err := mtls.NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := ca.Save(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	return &certs{t: t, dir: dir, ca: ca}
+}
+
+// files issues a certificate for name with role.
+func (c *certs) files(name, role string) mtls.Files {
+	c.t.Helper()
+	f := mtls.Files{
+		Cert: filepath.Join(c.dir, name+".pem"),
+		Key:  filepath.Join(c.dir, name+"-key.pem"),
+		CA:   filepath.Join(c.dir, "ca.pem"),
+	}
+	if err := c.ca.Issue(name, role, []string{"127.0.0.1"}, time.Hour, f.Cert, f.Key); err != nil {
+		c.t.Fatal(err)
+	}
+	return f
+}
+
+func TestCluster_MutualTLS(t *testing.T) {
+	pki, rogue := newCerts(t), newCerts(t)
+	server, err := mtls.ServerConfig(pki.files("coordinator", mtls.RoleCoordinator), mtls.RoleWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := mtls.ClientConfig(pki.files("worker-1", mtls.RoleWorker), mtls.RoleCoordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCluster(t, Options{TLS: server, WorkerTLS: client})
+
+	// Workers without a certificate from the cluster's CA for the worker
+	// role cannot register, let alone report tasks.
+	untrusted, err := mtls.ClientConfig(rogue.files("worker-2", mtls.RoleWorker), mtls.RoleCoordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted.RootCAs = client.RootCAs // Trusts the coordinator, which does not trust it
+	wrongRole, err := mtls.ClientConfig(pki.files("impostor", mtls.RoleCoordinator), mtls.RoleCoordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nor can a worker talk to a coordinator with the wrong certificate.
+	notCoordinator, err := mtls.ClientConfig(pki.files("worker-3", mtls.RoleWorker), mtls.RoleWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for name, cfg := range map[string]*tls.Config{"plaintext": nil, "untrusted CA": untrusted, "coordinator role": wrongRole, "worker as coordinator": notCoordinator} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := worker.Run(context.Background(), worker.Config{
+				CoordinatorAddr:  c.Addr,
+				Dir:              c.Dir,
+				ReconnectTimeout: 200 * time.Millisecond,
+				TLS:              cfg,
+			})
+			if err == nil {
+				t.Errorf("%s: expected the connection to be rejected", name)
+			}
+		}()
+	}
+	wg.Wait()
+	if workers := c.Coordinator().Workers(); len(workers) != 0 {
+		t.Errorf("Expected no registered workers, got %d", len(workers))
+	}
+
+	c.StartWorker()
+	c.StartWorker()
+	files := WriteInputs(t, texts...)
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 2})
+	checkOutput(t, c, c.WaitJob(id, 10*time.Second), "wordcount", files)
+
+	// Worker IDs are named after the certificate, and a worker with another
+	// certificate cannot take one over.
+	workers := c.Coordinator().Workers()
+	for _, w := range workers {
+		if !strings.HasPrefix(w.ID, "worker-1-") {
+			t.Errorf("Expected worker IDs named after the certificate, got %q", w.ID)
+		}
+	}
+	other, err := mtls.ClientConfig(pki.files("worker-4", mtls.RoleWorker), mtls.RoleCoordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worker.Run(context.Background(), worker.Config{
+		CoordinatorAddr:  c.Addr,
+		ID:               workers[0].ID,
+		Dir:              c.Dir,
+		ReconnectTimeout: 200 * time.Millisecond,
+		TLS:              other,
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not belong to certificate") {
+		t.Errorf("Expected a worker ID of another certificate to be rejected, got %v", err)
+	}
+}
+
+func TestCluster_LeaderFailover(t *testing.T) {
+	g := newGate(t)
+	holding.Store(g)
+	defer holding.Store(nil)
+
+	c := NewCluster(t, Options{Replicas: 3, TaskTimeout: 2 * time.Second})
+	for i := 0; i < 3; i++ {
+		c.StartWorker()
+	}
+	files := append(writeHeld(t, texts[:2]...), WriteInputs(t, texts[2:]...)...)
+	id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 3, App: "mrtest-gated"})
+
+	// Kill the leader while workers hold map tasks it handed out.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Held map tasks did not start")
+		}
+	}
+	old := c.KillLeader()
+	g.open()
+
+	job := c.WaitJob(id, 15*time.Second)
+	checkOutput(t, c, job, "mrtest-gated", files)
+	lease, _ := c.Coordinator().Leader()
+	if lease.Holder == old.Holder || lease.Term <= old.Term {
+		t.Errorf("Expected a new leader after %s in term %d, got %s in term %d", old.Holder, old.Term, lease.Holder, lease.Term)
+	}
+	if got, want := job.Counters[worker.CounterMapInputRecords], int64(2*len(texts)); got != want {
+		t.Errorf("Expected %d map input records across the failover, got %d", want, got)
+	}
+}
+
+func TestCluster_WorkerGracefulStop(t *testing.T) {
+	// The task timeout is far longer than the test: only deregistration
+	// can requeue a task.
+	t.Run("hand back", func(t *testing.T) {
+		g := newGate(t)
+		holding.Store(g)
+		defer holding.Store(nil)
+
+		c := NewCluster(t, Options{TaskTimeout: time.Minute, GracePeriod: 50 * time.Millisecond})
+		first := c.StartWorker()
+		files := writeHeld(t, texts[0])
+		id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 2, App: "mrtest-gated"})
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Held map task did not start")
+		}
+
+		start := time.Now()
+		c.StopWorker(first)
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("Expected the worker to exit soon after its grace period, took %s", d)
+		}
+		job, _ := c.Coordinator().Snapshot(id)
+		if task := job.MapTasks[0]; task.Status != common.TaskStatusIdle || task.Attempt != 1 {
+			t.Errorf("Expected the map task to be requeued at once, got %s attempt %d", task.Status, task.Attempt)
+		}
+		for _, w := range c.Coordinator().Workers() {
+			if w.ID == first {
+				t.Errorf("Expected %s to be deregistered", first)
+			}
+		}
+
+		c.StartWorker()
+		g.open()
+		checkOutput(t, c, c.WaitJob(id, 10*time.Second), "mrtest-gated", files)
+	})
+
+	t.Run("finish", func(t *testing.T) {
+		g := newGate(t)
+		holding.Store(g)
+		defer holding.Store(nil)
+
+		c := NewCluster(t, Options{TaskTimeout: time.Minute})
+		first := c.StartWorker()
+		files := writeHeld(t, texts[0])
+		id := c.Submit(coordinator.JobSpec{Files: files, NReduce: 2, App: "mrtest-gated"})
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Held map task did not start")
+		}
+
+		// The running task finishes within the grace period and is
+		// reported, but the stopping worker takes no reduce task.
+		time.AfterFunc(100*time.Millisecond, g.open)
+		c.StopWorker(first)
+		job, _ := c.Coordinator().Snapshot(id)
+		if task := job.MapTasks[0]; task.Status != common.TaskStatusCompleted || task.WorkerID != first || task.Attempt != 0 {
+			t.Errorf("Expected %s to complete the map task, got %s by %q attempt %d", first, task.Status, task.WorkerID, task.Attempt)
+		}
+		for _, task := range job.ReduceTasks {
+			if task.Status != common.TaskStatusIdle {
+				t.Errorf("Expected reduce task %d to wait for another worker, got %s", task.ID, task.Status)
+			}
+		}
+
+		c.StartWorker()
+		checkOutput(t, c, c.WaitJob(id, 10*time.Second), "mrtest-gated", files)
+	})
+}
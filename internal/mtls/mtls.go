@@ -0,0 +1,107 @@
+// Package mtls sets up mutual TLS between workers and the coordinator. Every
+// node holds a certificate issued by the cluster's CA whose organizational
+// unit names its role, so a worker certificate cannot be used to pose as the
+// coordinator and the other way round. CA mints those certificates for
+// clusters without a PKI of their own.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// Roles a certificate can be issued for.
+const (
+	RoleCoordinator = "coordinator"
+	RoleWorker      = "worker"
+)
+
+// Files names the PEM files of a node's certificate and key, and of the CA
+// certificate its peers' certificates must chain to.
+type Files struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// Enabled reports whether any file is set, i.e. TLS was asked for.
+func (f Files) Enabled() bool {
+	return f.Cert != "" || f.Key != "" || f.CA != ""
+}
+
+func (f Files) load() (tls.Certificate, *x509.CertPool, error) {
+	if f.Cert == "" || f.Key == "" || f.CA == "" {
+		return tls.Certificate{}, nil, errors.New("TLS needs a certificate, its key and the CA certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	ca, err := os.ReadFile(f.CA)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, fmt.Errorf("%s: no certificates found", f.CA)
+	}
+	return cert, pool, nil
+}
+
+// ServerConfig returns the configuration of a server that only accepts
+// clients presenting a certificate issued by the CA for peerRole.
+func ServerConfig(f Files, peerRole string) (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{cert},
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        pool,
+		VerifyConnection: verifyRole(peerRole),
+	}, nil
+}
+
+// ClientConfig returns the configuration of a client that presents its
+// certificate and only talks to servers whose certificate the CA issued for
+// peerRole and for the host dialed.
+func ClientConfig(f Files, peerRole string) (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{cert},
+		RootCAs:          pool,
+		VerifyConnection: verifyRole(peerRole),
+	}, nil
+}
+
+// verifyRole checks, after the chain has been verified, that the peer's
+// certificate was issued for role.
+func verifyRole(role string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("mtls: peer presented no certificate")
+		}
+		name, roles := Identity(cs.PeerCertificates[0])
+		if !slices.Contains(roles, role) {
+			slog.Warn("Rejected TLS peer", "name", name, "roles", roles, "want_role", role)
+			return fmt.Errorf("mtls: certificate of %q is not issued for role %s", name, role)
+		}
+		return nil
+	}
+}
+
+// Identity returns the name and roles a certificate was issued for.
+func Identity(cert *x509.Certificate) (name string, roles []string) {
+	return cert.Subject.CommonName, cert.Subject.OrganizationalUnit
+}
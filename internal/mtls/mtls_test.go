@@ -0,0 +1,139 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCA_IssueAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, caKey := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if err := ca.Save(caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCA(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, key := filepath.Join(dir, "coord.pem"), filepath.Join(dir, "coord-key.pem")
+	if err := loaded.Issue("coord", RoleCoordinator, []string{"coord.local", "10.0.0.1"}, time.Hour, cert, key); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, roles := Identity(leaf); name != "coord" || !slices.Equal(roles, []string{RoleCoordinator}) {
+		t.Errorf("Expected coord with the coordinator role, got %q %v", name, roles)
+	}
+	if !slices.Equal(leaf.DNSNames, []string{"coord.local"}) || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unexpected hosts %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if err := leaf.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("Expected a certificate signed by the CA: %v", err)
+	}
+
+	if err := ca.Issue("c", RoleCoordinator, nil, time.Hour, cert, key); err == nil {
+		t.Error("Expected an error for a coordinator certificate without hosts")
+	}
+	if err := ca.Issue("x", "admin", nil, time.Hour, cert, key); err == nil {
+		t.Error("Expected an error for an unknown role")
+	}
+	if _, err := LoadCA(cert, key); err == nil {
+		t.Error("Expected an error loading a node certificate as the CA")
+	}
+	// Issuing never overwrites existing files, such as the CA's.
+	if err := ca.Issue("ca", RoleWorker, nil, time.Hour, caCert, caKey); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected an error for existing files, got %v", err)
+	}
+	if _, err := LoadCA(caCert, caKey); err != nil {
+		t.Errorf("Expected the CA to be intact: %v", err)
+	}
+}
+
+func TestConfig_Roles(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := filepath.Join(dir, "ca.pem")
+	if err := ca.Save(caCert, filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	files := func(name, role string) Files {
+		f := Files{Cert: filepath.Join(dir, name+".pem"), Key: filepath.Join(dir, name+"-key.pem"), CA: caCert}
+		if err := ca.Issue(name, role, []string{"127.0.0.1"}, time.Hour, f.Cert, f.Key); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	server, err := ServerConfig(files("coord", RoleCoordinator), RoleWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handshake connects a client to the server over a pipe and returns the
+	// client's error.
+	handshake := func(client *tls.Config) error {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		go func() { _ = tls.Server(b, server).Handshake() }()
+		client = client.Clone()
+		client.ServerName = "127.0.0.1"
+		conn := tls.Client(a, client)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		// TLS 1.3 servers reject client certificates after the client's
+		// handshake is done; the first read reports it.
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		name     string
+		role     string
+		peerRole string
+		ok       bool
+	}{
+		{"worker", RoleWorker, RoleCoordinator, true},
+		{"impostor", RoleCoordinator, RoleCoordinator, false},
+		{"confused", RoleWorker, RoleWorker, false},
+	} {
+		client, err := ClientConfig(files(tc.name, tc.role), tc.peerRole)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handshake(client); (err == nil) != tc.ok {
+			t.Errorf("%s: expected success %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+
+	if _, err := ServerConfig(Files{Cert: "c.pem"}, RoleWorker); err == nil {
+		t.Error("Expected an error without a key and CA")
+	}
+}
@@ -0,0 +1,230 @@
+// Package outputs describes where and how a job writes its reduce output:
+// the directory and file names of the partitions, the record format, and
+// the _SUCCESS marker and manifest written once every reducer has
+// committed. Workers use it to write partitions and the REST API to read
+// them back.
+package outputs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// Output formats.
+const (
+	FormatText     = "text"     // key, separator, value, newline
+	FormatTSV      = "tsv"      // tab-separated, with \t, \n, \r and \\ escaped
+	FormatCSV      = "csv"      // RFC 4180 rows of key and value, no header
+	FormatJSONL    = "jsonl"    // one {"key": ..., "value": ...} object per line
+	FormatSequence = "sequence" // binary length-prefixed records, see NewWriter
+)
+
+// Formats lists the supported output formats.
+var Formats = []string{FormatText, FormatTSV, FormatCSV, FormatJSONL, FormatSequence}
+
+// Names of the files written next to the partitions when a job commits.
+// Both start with "_" so that a later job reading the directory skips them.
+const (
+	SuccessName  = "_SUCCESS"
+	ManifestName = "_MANIFEST.json"
+)
+
+// Spec describes a job's output. The zero value, like a nil *Spec, writes
+// mr-out-<job>-<partition> text files with a space separator into the
+// data directory.
+type Spec struct {
+	// Dir is the directory partitions are written to. A relative directory
+	// is taken relative to the data directory of each worker (and of the
+	// coordinator, which reads the output back), so they should share one.
+	// It may also be a storage URI such as s3://bucket/results.
+	Dir string `json:"dir,omitempty"`
+
+	// Prefix names the partition files <prefix>-<partition>; it defaults
+	// to mr-out-<job>. Formats other than text add an extension, e.g.
+	// part-3.csv.
+	Prefix string `json:"prefix,omitempty"`
+
+	Format    string `json:"format,omitempty"`    // One of Formats; defaults to text
+	Separator string `json:"separator,omitempty"` // Between key and value in text output; defaults to a space
+
+	// SuccessMarker writes an empty _SUCCESS file and Manifest a
+	// _MANIFEST.json listing every partition once all reducers commit.
+	SuccessMarker bool `json:"success_marker,omitempty"`
+	Manifest      bool `json:"manifest,omitempty"`
+}
+
+// Validate reports whether s can be used for a job.
+func (s *Spec) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if storage.IsURI(s.Dir) {
+		if err := storage.Check(s.Dir); err != nil {
+			return fmt.Errorf("invalid output directory: %w", err)
+		}
+	} else if s.Dir != "" && !filepath.IsAbs(s.Dir) && !filepath.IsLocal(s.Dir) {
+		return fmt.Errorf("output directory %q leaves the data directory", s.Dir)
+	}
+	if s.Prefix != "" && (strings.ContainsAny(s.Prefix, `/\`) || hidden(s.Prefix)) {
+		return fmt.Errorf("invalid output prefix %q", s.Prefix)
+	}
+	if !validFormat(s.format()) {
+		return fmt.Errorf("unknown output format %q (want %s)", s.Format, strings.Join(Formats, ", "))
+	}
+	if s.Separator != "" && s.format() != FormatText {
+		return fmt.Errorf("a separator only applies to text output, not %s", s.format())
+	}
+	if strings.Contains(s.Separator, "\n") {
+		return errors.New("the separator cannot contain a newline")
+	}
+	return nil
+}
+
+func validFormat(f string) bool {
+	for _, known := range Formats {
+		if f == known {
+			return true
+		}
+	}
+	return false
+}
+
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+func (s *Spec) format() string {
+	if s == nil || s.Format == "" {
+		return FormatText
+	}
+	return s.Format
+}
+
+func (s *Spec) separator() string {
+	if s == nil || s.Separator == "" {
+		return " "
+	}
+	return s.Separator
+}
+
+// DirPath returns the directory partitions are written to, given the data
+// directory base.
+func (s *Spec) DirPath(base string) string {
+	if s == nil || s.Dir == "" {
+		return base
+	}
+	if storage.IsAbs(s.Dir) {
+		return s.Dir
+	}
+	return storage.Join(base, s.Dir)
+}
+
+// FileName returns the name of the file holding one partition of a job's
+// output.
+func (s *Spec) FileName(jobID, partition int) string {
+	prefix := fmt.Sprintf("mr-out-%d", jobID)
+	if s != nil && s.Prefix != "" {
+		prefix = s.Prefix
+	}
+	return fmt.Sprintf("%s-%d%s", prefix, partition, extensions[s.format()])
+}
+
+var extensions = map[string]string{
+	FormatText:     "",
+	FormatTSV:      ".tsv",
+	FormatCSV:      ".csv",
+	FormatJSONL:    ".jsonl",
+	FormatSequence: ".seq",
+}
+
+// Path returns where one partition of a job's output is written, given the
+// data directory base.
+func (s *Spec) Path(base string, jobID, partition int) string {
+	return storage.Join(s.DirPath(base), s.FileName(jobID, partition))
+}
+
+// Partition describes one committed output file.
+type Partition struct {
+	Partition int    `json:"partition"`
+	File      string `json:"file"` // Name within the output directory
+	Records   int64  `json:"records"`
+	Bytes     int64  `json:"bytes"`
+	CRC32     uint32 `json:"crc32"` // IEEE CRC-32 of the whole file
+}
+
+// Manifest lists the output of a completed job.
+type Manifest struct {
+	JobID       int         `json:"job_id"`
+	App         string      `json:"app"`
+	Format      string      `json:"format"`
+	CompletedAt time.Time   `json:"completed_at"`
+	Records     int64       `json:"records"`
+	Bytes       int64       `json:"bytes"`
+	Partitions  []Partition `json:"partitions"`
+}
+
+// NewManifest builds the manifest of a job from its committed partitions,
+// which must be in partition order.
+func NewManifest(jobID int, app string, spec *Spec, partitions []Partition, completed time.Time) Manifest {
+	m := Manifest{
+		JobID:       jobID,
+		App:         app,
+		Format:      spec.format(),
+		CompletedAt: completed.UTC(),
+		Partitions:  partitions,
+	}
+	for _, p := range partitions {
+		m.Records += p.Records
+		m.Bytes += p.Bytes
+	}
+	return m
+}
+
+// Commit writes the manifest and then the _SUCCESS marker into dir, as far
+// as spec asks for them. The marker comes last so that a reader that sees
+// it can rely on everything else being in place.
+func Commit(dir string, spec *Spec, m Manifest) error {
+	if spec == nil || !spec.Manifest && !spec.SuccessMarker {
+		return nil
+	}
+	if spec.Manifest {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFile(storage.Join(dir, ManifestName), append(b, '\n')); err != nil {
+			return fmt.Errorf("cannot write manifest: %w", err)
+		}
+	}
+	if spec.SuccessMarker {
+		if err := writeFile(storage.Join(dir, SuccessName), nil); err != nil {
+			return fmt.Errorf("cannot write success marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest a committed job left in dir.
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	b, err := storage.ReadFile(storage.Join(dir, ManifestName))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+func writeFile(path string, data []byte) error {
+	return storage.WriteFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,169 @@
+package outputs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecords_RoundTrip(t *testing.T) {
+	records := [][2]string{
+		{"apple", "1"},
+		{"tab\there", "new\nline"},
+		{`back\slash`, `"quoted", comma`},
+		{"", "empty key"},
+	}
+	for _, spec := range []*Spec{
+		nil,
+		{Format: FormatText, Separator: " => "},
+		{Format: FormatTSV},
+		{Format: FormatCSV},
+		{Format: FormatJSONL},
+		{Format: FormatSequence},
+	} {
+		t.Run(spec.format()+spec.separator(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, spec)
+			for _, rec := range records {
+				if err := w.Write(rec[0], rec[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Text cannot carry newlines, so only its plain record survives.
+			want := records
+			if spec.format() == FormatText {
+				want = records[:1]
+			}
+			r := NewReader(&buf, spec)
+			for _, rec := range want {
+				key, value, err := r.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key != rec[0] || value != rec[1] {
+					t.Errorf("Expected %q, %q, got %q, %q", rec[0], rec[1], key, value)
+				}
+			}
+			if spec.format() != FormatText {
+				if _, _, err := r.Read(); err != io.EOF {
+					t.Errorf("Expected io.EOF after the last record, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecords_Text(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &Spec{Separator: ","})
+	w.Write("a", "1")
+	w.Flush()
+	if buf.String() != "a,1\n" {
+		t.Errorf("Unexpected text output %q", buf.String())
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf, nil)
+	w.Write("a", "1")
+	w.Flush()
+	if buf.String() != "a 1\n" {
+		t.Errorf("Expected the default space separator, got %q", buf.String())
+	}
+}
+
+func TestRecords_Sequence(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf, &Spec{Format: FormatSequence}).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != sequenceMagic {
+		t.Errorf("Expected an empty partition to hold just the header, got %q", buf.String())
+	}
+
+	_, _, err := NewReader(bytes.NewReader([]byte("a 1\n")), &Spec{Format: FormatSequence}).Read()
+	if !errors.Is(err, ErrNotSequence) {
+		t.Errorf("Expected ErrNotSequence, got %v", err)
+	}
+
+	buf.Reset()
+	w := NewWriter(&buf, &Spec{Format: FormatSequence})
+	w.Write("key", "value")
+	w.Flush()
+	r := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2]), &Spec{Format: FormatSequence})
+	if _, _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a truncated record, got %v", err)
+	}
+}
+
+func TestSpec(t *testing.T) {
+	var spec *Spec
+	if got := spec.FileName(4, 2); got != "mr-out-4-2" {
+		t.Errorf("Expected the default name, got %s", got)
+	}
+	if got := spec.Path("/data", 4, 2); got != filepath.Join("/data", "mr-out-4-2") {
+		t.Errorf("Unexpected default path %s", got)
+	}
+	spec = &Spec{Dir: "runs/7", Prefix: "part", Format: FormatSequence}
+	if got := spec.Path("/data", 4, 2); got != filepath.Join("/data", "runs", "7", "part-2.seq") {
+		t.Errorf("Unexpected path %s", got)
+	}
+	if got := (&Spec{Dir: "/abs"}).DirPath("/data"); got != "/abs" {
+		t.Errorf("Expected an absolute directory to be used as is, got %s", got)
+	}
+
+	for _, bad := range []Spec{
+		{Format: "xml"},
+		{Dir: "../elsewhere"},
+		{Prefix: "a/b"},
+		{Prefix: "_hidden"},
+		{Format: FormatCSV, Separator: ";"},
+		{Separator: "\n"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+	if err := (&Spec{Dir: "out", Format: FormatTSV, SuccessMarker: true}).Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	spec := &Spec{Format: FormatCSV, SuccessMarker: true, Manifest: true}
+	parts := []Partition{
+		{Partition: 0, File: "mr-out-1-0.csv", Records: 2, Bytes: 10, CRC32: 1},
+		{Partition: 1, File: "mr-out-1-1.csv", Records: 3, Bytes: 15, CRC32: 2},
+	}
+	done := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := Commit(dir, spec, NewManifest(1, "wordcount", spec, parts, done)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Records != 5 || m.Bytes != 25 || m.Format != FormatCSV || !m.CompletedAt.Equal(done) || len(m.Partitions) != 2 || m.Partitions[1] != parts[1] {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SuccessName)); err != nil {
+		t.Errorf("Expected a _SUCCESS marker: %v", err)
+	}
+
+	other := filepath.Join(t.TempDir(), "none")
+	if err := Commit(other, &Spec{Format: FormatCSV}, Manifest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be written when neither marker nor manifest is requested")
+	}
+}
@@ -0,0 +1,283 @@
+package outputs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sequenceMagic starts every file in the sequence format.
+const sequenceMagic = "MRSEQ1\n"
+
+// maxSequenceField bounds the length a sequence reader accepts for one key
+// or value, so a corrupt length cannot exhaust memory.
+const maxSequenceField = 64 << 20
+
+// Writer writes key/value records in one output format.
+type Writer interface {
+	Write(key, value string) error
+	// Flush writes any buffered data to the underlying writer.
+	Flush() error
+}
+
+// NewWriter returns a Writer producing spec's format on w.
+//
+// The sequence format is a header line "MRSEQ1\n" followed by each record
+// as the uvarint length of the key, the key, the uvarint length of the
+// value and the value. It round-trips any bytes, including newlines.
+func NewWriter(w io.Writer, spec *Spec) Writer {
+	bw := bufio.NewWriter(w)
+	switch spec.format() {
+	case FormatTSV:
+		return &tsvWriter{w: bw}
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(bw), bw: bw}
+	case FormatJSONL:
+		return &jsonlWriter{enc: json.NewEncoder(bw), w: bw}
+	case FormatSequence:
+		return &sequenceWriter{w: bw}
+	}
+	return &textWriter{w: bw, sep: spec.separator()}
+}
+
+// Reader reads the records of one output file. Read returns io.EOF after
+// the last record.
+type Reader interface {
+	Read() (key, value string, err error)
+}
+
+// NewReader returns a Reader for a file in spec's format.
+func NewReader(r io.Reader, spec *Spec) Reader {
+	br := bufio.NewReader(r)
+	switch spec.format() {
+	case FormatTSV:
+		return &lineReader{r: br, split: splitTSV}
+	case FormatCSV:
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = 2
+		return &csvReader{r: cr}
+	case FormatJSONL:
+		return &jsonlReader{dec: json.NewDecoder(br)}
+	case FormatSequence:
+		return &sequenceReader{r: br}
+	}
+	sep := spec.separator()
+	return &lineReader{r: br, split: func(line string) (string, string, error) {
+		key, value, _ := strings.Cut(line, sep)
+		return key, value, nil
+	}}
+}
+
+type textWriter struct {
+	w   *bufio.Writer
+	sep string
+}
+
+func (t *textWriter) Write(key, value string) error {
+	_, err := fmt.Fprintf(t.w, "%s%s%s\n", key, t.sep, value)
+	return err
+}
+
+func (t *textWriter) Flush() error { return t.w.Flush() }
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+type tsvWriter struct{ w *bufio.Writer }
+
+func (t *tsvWriter) Write(key, value string) error {
+	_, err := fmt.Fprintf(t.w, "%s\t%s\n", tsvEscaper.Replace(key), tsvEscaper.Replace(value))
+	return err
+}
+
+func (t *tsvWriter) Flush() error { return t.w.Flush() }
+
+func splitTSV(line string) (string, string, error) {
+	key, value, ok := strings.Cut(line, "\t")
+	if !ok {
+		return "", "", fmt.Errorf("tsv record without a tab: %q", line)
+	}
+	return unescapeTSV(key), unescapeTSV(value), nil
+}
+
+func unescapeTSV(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// lineReader reads newline-terminated records.
+type lineReader struct {
+	r     *bufio.Reader
+	split func(line string) (key, value string, err error)
+}
+
+func (l *lineReader) Read() (string, string, error) {
+	line, err := l.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	return l.split(strings.TrimSuffix(line, "\n"))
+}
+
+type csvWriter struct {
+	w  *csv.Writer
+	bw *bufio.Writer
+}
+
+func (c *csvWriter) Write(key, value string) error { return c.w.Write([]string{key, value}) }
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+type csvReader struct{ r *csv.Reader }
+
+func (c *csvReader) Read() (string, string, error) {
+	rec, err := c.r.Read()
+	if err != nil {
+		return "", "", err
+	}
+	return rec[0], rec[1], nil
+}
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+	w   *bufio.Writer
+}
+
+func (j *jsonlWriter) Write(key, value string) error {
+	return j.enc.Encode(jsonRecord{Key: key, Value: value})
+}
+
+func (j *jsonlWriter) Flush() error { return j.w.Flush() }
+
+type jsonlReader struct{ dec *json.Decoder }
+
+func (j *jsonlReader) Read() (string, string, error) {
+	var rec jsonRecord
+	if err := j.dec.Decode(&rec); err != nil {
+		return "", "", err
+	}
+	return rec.Key, rec.Value, nil
+}
+
+type sequenceWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+func (s *sequenceWriter) Write(key, value string) error {
+	if err := s.header(); err != nil {
+		return err
+	}
+	for _, field := range []string{key, value} {
+		var n [binary.MaxVarintLen64]byte
+		if _, err := s.w.Write(n[:binary.PutUvarint(n[:], uint64(len(field)))]); err != nil {
+			return err
+		}
+		if _, err := s.w.WriteString(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// header writes the magic line before the first record, or on Flush for an
+// empty partition, so that every sequence file is recognizable.
+func (s *sequenceWriter) header() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	_, err := s.w.WriteString(sequenceMagic)
+	return err
+}
+
+func (s *sequenceWriter) Flush() error {
+	if err := s.header(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// ErrNotSequence is returned when reading a file in the sequence format
+// that does not start with the expected header.
+var ErrNotSequence = errors.New("not a sequence file")
+
+type sequenceReader struct {
+	r       *bufio.Reader
+	started bool
+}
+
+func (s *sequenceReader) Read() (string, string, error) {
+	if !s.started {
+		s.started = true
+		magic := make([]byte, len(sequenceMagic))
+		if _, err := io.ReadFull(s.r, magic); err != nil || string(magic) != sequenceMagic {
+			return "", "", ErrNotSequence
+		}
+	}
+	key, err := s.field()
+	if err != nil {
+		return "", "", err
+	}
+	value, err := s.field()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return key, value, err
+}
+
+func (s *sequenceReader) field() (string, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxSequenceField {
+		return "", fmt.Errorf("sequence field of %d bytes exceeds the limit", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Local stores files on the local filesystem.
+type Local struct{}
+
+func (Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// Create writes to a temporary file in the target directory that Close
+// renames into place.
+func (Local) Create(name string) (Writer, error) {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{f: f, name: name}, nil
+}
+
+func (Local) Rename(oldname, newname string) error {
+	if err := os.MkdirAll(filepath.Dir(newname), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (Local) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Path: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (Local) List(dir string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	sortInfos(files)
+	return files, err
+}
+
+func (Local) Delete(name string) error {
+	return os.Remove(name)
+}
+
+type localWriter struct {
+	f    *os.File
+	name string
+	err  error // Set once the writer is closed or aborted
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.f.Write(p)
+}
+
+func (w *localWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = fs.ErrClosed
+	err := w.f.Close()
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.name)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+	}
+	return err
+}
+
+func (w *localWriter) Abort() {
+	if w.err != nil {
+		return
+	}
+	w.err = errAborted
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps files in memory. It is meant for tests and single-process
+// runs; names are slash-separated like object keys.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memFile)}
+}
+
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[path.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (m *Memory) Create(name string) (Writer, error) {
+	return &memWriter{m: m, name: path.Clean(name)}, nil
+}
+
+func (m *Memory) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	f, ok := m.files[oldname]
+	if !ok {
+		return notExist("rename", oldname)
+	}
+	delete(m.files, oldname)
+	m.files[newname] = f
+	return nil
+}
+
+func (m *Memory) Stat(name string) (FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[path.Clean(name)]
+	if !ok {
+		return FileInfo{}, notExist("stat", name)
+	}
+	return FileInfo{Path: path.Clean(name), Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (m *Memory) List(dir string) ([]FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := path.Clean(dir) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	var files []FileInfo
+	for name, f := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			files = append(files, FileInfo{Path: name, Size: int64(len(f.data)), ModTime: f.modTime})
+		}
+	}
+	sortInfos(files)
+	return files, nil
+}
+
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, path.Clean(name))
+	return nil
+}
+
+type memWriter struct {
+	m    *Memory
+	name string
+	buf  bytes.Buffer
+	err  error
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = fs.ErrClosed
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.m.files[w.name] = memFile{data: bytes.Clone(w.buf.Bytes()), modTime: time.Now()}
+	return nil
+}
+
+func (w *memWriter) Abort() {
+	if w.err == nil {
+		w.err = errAborted
+	}
+}
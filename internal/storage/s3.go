@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible backend such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// Buckets are addressed path-style: <endpoint>/<bucket>/<key>.
+	Endpoint string
+	// Region signs requests; defaults to us-east-1.
+	Region string
+	// AccessKey and SecretKey sign requests with AWS Signature Version 4.
+	// Requests are sent unsigned if AccessKey is empty.
+	AccessKey string
+	SecretKey string
+	// Client sends the requests; defaults to a client with a one-minute
+	// timeout.
+	Client *http.Client
+}
+
+// S3ConfigFromEnv reads S3_ENDPOINT, AWS_REGION, AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY. It reports false if no endpoint is set.
+func S3ConfigFromEnv() (S3Config, bool) {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	return cfg, cfg.Endpoint != ""
+}
+
+// RegisterS3FromEnv registers an S3 backend for s3:// URIs if
+// S3ConfigFromEnv finds an endpoint.
+func RegisterS3FromEnv() error {
+	cfg, ok := S3ConfigFromEnv()
+	if !ok {
+		return nil
+	}
+	b, err := NewS3(cfg)
+	if err != nil {
+		return err
+	}
+	Register("s3", b)
+	return nil
+}
+
+// S3 stores files as objects in an S3-compatible service. Names are
+// "<bucket>/<key>". Files are buffered in memory and uploaded with a single
+// PUT when closed, so they suit the partition-sized files jobs write.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+}
+
+// NewS3 returns a backend for the service described by cfg.
+func NewS3(cfg S3Config) (*S3, error) {
+	u, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: time.Minute}
+	}
+	return &S3{cfg: cfg, endpoint: u}, nil
+}
+
+func splitBucket(name string) (bucket, key string) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	return bucket, key
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	bucket, key := splitBucket(name)
+	resp, err := s.do(http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(resp, "open", name); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	bucket, key := splitBucket(name)
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3: %q is not a bucket and key", name)
+	}
+	return &s3Writer{s: s, name: name}, nil
+}
+
+// Rename copies the object server-side and deletes the original.
+func (s *S3) Rename(oldname, newname string) error {
+	bucket, key := splitBucket(newname)
+	header := http.Header{"X-Amz-Copy-Source": {"/" + escapePath(strings.TrimPrefix(oldname, "/"))}}
+	resp, err := s.do(http.MethodPut, bucket, key, nil, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := s3Error(resp, "rename", oldname); err != nil {
+		return err
+	}
+	return s.Delete(oldname)
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	bucket, key := splitBucket(name)
+	resp, err := s.do(http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer resp.Body.Close()
+	if err := s3Error(resp, "stat", name); err != nil {
+		return FileInfo{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Path: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// List pages through ListObjectsV2 for every key below dir.
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	bucket, prefix := splitBucket(dir)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := s3Error(resp, "list", dir); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil // No bucket, no files
+			}
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", dir, err)
+		}
+		for _, obj := range result.Contents {
+			files = append(files, FileInfo{Path: bucket + "/" + obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sortInfos(files)
+	return files, nil
+}
+
+func (s *S3) Delete(name string) error {
+	bucket, key := splitBucket(name)
+	resp, err := s.do(http.MethodDelete, bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, "delete", name)
+}
+
+// do sends one signed request for an object, or for the bucket if key is
+// empty.
+func (s *S3) do(method, bucket, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + escapePath(bucket)
+	if key != "" {
+		u.RawPath += "/" + escapePath(key)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.cfg.AccessKey != "" {
+		signV4(req, body, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, time.Now())
+	}
+	return s.cfg.Client.Do(req)
+}
+
+// s3Error turns a non-2xx response into an error, closing its body. Missing
+// keys and buckets become fs.ErrNotExist.
+func s3Error(resp *http.Response, op, name string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if resp.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchBucket" {
+		return notExist(op, name)
+	}
+	if e.Code == "" {
+		return fmt.Errorf("s3 %s %s: %s", op, name, resp.Status) // HEAD responses have no body
+	}
+	return fmt.Errorf("s3 %s %s: %s: %s", op, name, e.Code, e.Message)
+}
+
+type s3Writer struct {
+	s    *S3
+	name string
+	buf  bytes.Buffer
+	err  error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = fs.ErrClosed
+	bucket, key := splitBucket(w.name)
+	resp, err := w.s.do(http.MethodPut, bucket, key, nil, w.buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, "create", w.name)
+}
+
+func (w *s3Writer) Abort() {
+	if w.err == nil {
+		w.err = errAborted
+	}
+}
+
+// signV4 signs req with AWS Signature Version 4 for the s3 service,
+// covering the host and every header already set on req.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes everything but unreserved characters and
+// slashes, as SigV4 canonical URIs require.
+func escapePath(p string) string {
+	var b strings.Builder
+	for _, seg := range strings.SplitAfter(p, "/") {
+		seg, slash := strings.CutSuffix(seg, "/")
+		b.WriteString(escape(seg))
+		if slash {
+			b.WriteByte('/')
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key with SigV4 escaping.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,216 @@
+// Package s3test runs an in-memory stand-in for an S3-compatible service,
+// covering the requests storage.S3 makes: path-style GET, HEAD, PUT (with
+// server-side copy), DELETE and ListObjectsV2.
+package s3test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+)
+
+// Credentials the fake expects in every request's SigV4 Authorization
+// header.
+const (
+	AccessKey = "test-access-key"
+	SecretKey = "test-secret-key"
+)
+
+// Server is a fake S3 service.
+type Server struct {
+	*httptest.Server
+
+	// PageSize caps the keys in one ListObjectsV2 page; defaults to 1000.
+	PageSize int
+
+	mu      sync.Mutex
+	buckets map[string]map[string]object
+	counts  map[string]int // Requests by method
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewServer starts a fake with the given buckets and stops it when the test
+// ends.
+func NewServer(t testing.TB, buckets ...string) *Server {
+	s := &Server{buckets: make(map[string]map[string]object), counts: make(map[string]int)}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config returns the storage.S3Config for reaching the fake.
+func (s *Server) Config() storage.S3Config {
+	return storage.S3Config{Endpoint: s.URL, AccessKey: AccessKey, SecretKey: SecretKey}
+}
+
+// Backend returns a storage backend talking to the fake.
+func (s *Server) Backend(t testing.TB) *storage.S3 {
+	b, err := storage.NewS3(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Put stores an object directly.
+func (s *Server) Put(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = object{data: append([]byte(nil), data...), modTime: time.Now()}
+}
+
+// Get returns an object's contents.
+func (s *Server) Get(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	return obj.data, ok
+}
+
+// Keys returns the keys in a bucket in order.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns how many requests used method.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[method]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[r.Method]++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+AccessKey+"/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		writeError(w, http.StatusForbidden, "AccessDenied", "missing or unknown signature")
+		return
+	}
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if key == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			s.list(w, r.URL.Query(), bucket)
+			return
+		}
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" on a bucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		obj, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+			obj, ok := s.buckets[srcBucket][srcKey]
+			if !ok {
+				writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+				return
+			}
+			bucket[key] = object{data: obj.data, modTime: time.Now()}
+			fmt.Fprintf(w, "<CopyObjectResult><LastModified>%s</LastModified></CopyObjectResult>", time.Now().UTC().Format(time.RFC3339))
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		bucket[key] = object{data: data, modTime: time.Now()}
+	case http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []listEntry
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+type listEntry struct {
+	Key          string
+	Size         int
+	LastModified string
+}
+
+// list answers ListObjectsV2. The continuation token is simply the last
+// key of the previous page.
+func (s *Server) list(w http.ResponseWriter, q url.Values, bucket map[string]object) {
+	prefix, after := q.Get("prefix"), q.Get("continuation-token")
+	var keys []string
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	page := s.PageSize
+	if page <= 0 {
+		page = 1000
+	}
+	var res listResult
+	if len(keys) > page {
+		keys = keys[:page]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, listEntry{Key: k, Size: len(bucket[k].data), LastModified: bucket[k].modTime.UTC().Format(time.RFC3339Nano)})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, msg)
+}
@@ -0,0 +1,252 @@
+// Package storage gives workers, the coordinator and the REST API one way to
+// read and write job files wherever they live. A location is either a plain
+// local path or a URI whose scheme selects a registered Backend:
+//
+//	/data/input/part-0       local filesystem
+//	file:///data/input       local filesystem
+//	mem://scratch/mr-0-0-1   process-wide in-memory store, for tests
+//	s3://bucket/prefix/key   S3-compatible object store, see NewS3
+//
+// Object stores have no directories: a "directory" is a key prefix, files
+// are created with their parents, and a file becomes visible only once it
+// has been written completely.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Path    string // As passed to the package functions: a local path or a URI
+	Size    int64
+	ModTime time.Time
+	IsDir   bool // Only local directories; object stores have none
+}
+
+// Writer writes a new file. Nothing is visible at the file's name until
+// Close succeeds, at which point the whole file replaces any earlier one.
+// Abort discards what was written instead.
+type Writer interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// Backend stores files under names that are local paths or, for URI
+// schemes, whatever follows "scheme://". Errors for files that do not exist
+// satisfy errors.Is(err, fs.ErrNotExist).
+type Backend interface {
+	Open(name string) (io.ReadCloser, error)
+	// Create starts writing name, creating parent directories as needed.
+	Create(name string) (Writer, error)
+	Rename(oldname, newname string) error
+	Stat(name string) (FileInfo, error)
+	// List returns every file below dir, at any depth, sorted by name. A
+	// directory that does not exist has no files.
+	List(dir string) ([]FileInfo, error)
+	// Delete removes name. Deleting a file that does not exist may succeed.
+	Delete(name string) error
+}
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]Backend{
+		"file": Local{},
+		"mem":  Mem,
+	}
+)
+
+// Mem is the in-memory backend behind mem:// URIs. It is shared by
+// everything in the process, like a filesystem.
+var Mem = NewMemory()
+
+// Register makes b handle URIs with the given scheme, replacing any backend
+// registered for it before.
+func Register(scheme string, b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backends[scheme] = b
+}
+
+// IsURI reports whether p names a location with a scheme rather than a
+// local path.
+func IsURI(p string) bool {
+	scheme, _, ok := strings.Cut(p, "://")
+	return ok && scheme != "" && !strings.ContainsAny(scheme, `/\`)
+}
+
+// Check reports an error if p is a URI whose scheme has no backend.
+func Check(p string) error {
+	_, _, err := resolve(p)
+	return err
+}
+
+// resolve finds the backend for p and the name to pass it.
+func resolve(p string) (Backend, string, error) {
+	if !IsURI(p) {
+		return Local{}, p, nil
+	}
+	scheme, name, _ := strings.Cut(p, "://")
+	mu.RLock()
+	b, ok := backends[scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("no storage backend for %s:// URIs", scheme)
+	}
+	return b, name, nil
+}
+
+// uri turns a name returned by the backend for p back into a location.
+func uri(p, name string) string {
+	if !IsURI(p) {
+		return name
+	}
+	scheme, _, _ := strings.Cut(p, "://")
+	return scheme + "://" + name
+}
+
+// Open opens a file for reading.
+func Open(p string) (io.ReadCloser, error) {
+	b, name, err := resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(name)
+}
+
+// Create starts writing a file, see Writer.
+func Create(p string) (Writer, error) {
+	b, name, err := resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.Create(name)
+}
+
+// Rename moves a file. Both locations must use the same backend.
+func Rename(oldpath, newpath string) error {
+	b, oldname, err := resolve(oldpath)
+	if err != nil {
+		return err
+	}
+	b2, newname, err := resolve(newpath)
+	if err != nil {
+		return err
+	}
+	if b != b2 {
+		return fmt.Errorf("cannot rename %s to %s: different storage backends", oldpath, newpath)
+	}
+	return b.Rename(oldname, newname)
+}
+
+// Stat describes a file.
+func Stat(p string) (FileInfo, error) {
+	b, name, err := resolve(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := b.Stat(name)
+	info.Path = uri(p, info.Path)
+	return info, err
+}
+
+// List returns every file below dir, sorted by path.
+func List(dir string) ([]FileInfo, error) {
+	b, name, err := resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := b.List(name)
+	for i := range files {
+		files[i].Path = uri(dir, files[i].Path)
+	}
+	return files, err
+}
+
+// Delete removes a file.
+func Delete(p string) error {
+	b, name, err := resolve(p)
+	if err != nil {
+		return err
+	}
+	return b.Delete(name)
+}
+
+// ReadFile returns the contents of a file.
+func ReadFile(p string) ([]byte, error) {
+	r, err := Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WriteFile writes a file through write, so readers see either the old
+// file or the complete new one, even if the writer dies halfway.
+func WriteFile(p string, write func(io.Writer) error) error {
+	w, err := Create(p)
+	if err != nil {
+		return err
+	}
+	if err := write(w); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Join joins path elements onto a local path or a URI. An empty base
+// yields a path relative to the working directory.
+func Join(base string, elem ...string) string {
+	if !IsURI(base) {
+		return filepath.Join(append([]string{base}, elem...)...)
+	}
+	scheme, name, _ := strings.Cut(base, "://")
+	return scheme + "://" + path.Join(append([]string{name}, elem...)...)
+}
+
+// IsAbs reports whether p is a URI or an absolute local path, as opposed to
+// a path relative to some base directory.
+func IsAbs(p string) bool {
+	return IsURI(p) || filepath.IsAbs(p)
+}
+
+// Dir returns all but the last element of a local path or URI.
+func Dir(p string) string {
+	if IsURI(p) {
+		scheme, name, _ := strings.Cut(p, "://")
+		return scheme + "://" + path.Dir(name)
+	}
+	return filepath.Dir(p)
+}
+
+// Base returns the last element of a local path or URI.
+func Base(p string) string {
+	if IsURI(p) {
+		_, name, _ := strings.Cut(p, "://")
+		return path.Base(name)
+	}
+	return filepath.Base(p)
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func sortInfos(files []FileInfo) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+}
+
+// errAborted is returned by writes to a Writer after Abort.
+var errAborted = errors.New("write aborted")
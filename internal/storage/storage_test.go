@@ -0,0 +1,220 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage/s3test"
+)
+
+// testBackend runs the behaviour every backend must share against the
+// location root.
+func testBackend(t *testing.T, root string) {
+	p := func(name string) string { return storage.Join(root, name) }
+
+	if _, err := storage.Open(p("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist opening a missing file, got %v", err)
+	}
+	if _, err := storage.Stat(p("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for Stat of a missing file, got %v", err)
+	}
+	files, err := storage.List(p("nowhere"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("Expected no files in a missing directory, got %v, %v", files, err)
+	}
+
+	// Nothing is visible until Close, and Abort leaves nothing behind.
+	w, err := storage.Create(p("a/one.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if _, err := storage.Stat(p("a/one.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected file to be invisible before Close, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = storage.Create(p("a/aborted.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+	w.Abort()
+	if err := w.Close(); err == nil {
+		t.Error("Expected Close after Abort to fail")
+	}
+
+	if err := storage.WriteFile(p("a/b/two.txt"), func(w io.Writer) error {
+		_, err := io.WriteString(w, "world!")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile(p("a/one.txt"), func(w io.Writer) error {
+		io.WriteString(w, "clobbered")
+		return errors.New("boom")
+	}); err == nil || err.Error() != "boom" {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+
+	data, err := storage.ReadFile(p("a/one.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Expected %q, got %q, %v", "hello", data, err)
+	}
+	info, err := storage.Stat(p("a/b/two.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != p("a/b/two.txt") || info.Size != 6 {
+		t.Errorf("Expected %s with 6 bytes, got %+v", p("a/b/two.txt"), info)
+	}
+
+	files, err = storage.List(p("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{p("a/b/two.txt"), p("a/one.txt")}
+	if len(files) != len(want) {
+		t.Fatalf("Expected %v, got %+v", want, files)
+	}
+	for i, f := range files {
+		if f.Path != want[i] {
+			t.Errorf("Expected file %d to be %s, got %s", i, want[i], f.Path)
+		}
+	}
+
+	if err := storage.Rename(p("a/one.txt"), p("c/renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat(p("a/one.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the old name to be gone, got %v", err)
+	}
+	if data, _ := storage.ReadFile(p("c/renamed.txt")); string(data) != "hello" {
+		t.Errorf("Expected renamed contents %q, got %q", "hello", data)
+	}
+
+	if err := storage.Delete(p("c/renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat(p("c/renamed.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected deleted file to be gone, got %v", err)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		testBackend(t, t.TempDir())
+	})
+	t.Run("file", func(t *testing.T) {
+		testBackend(t, "file://"+filepath.ToSlash(t.TempDir()))
+	})
+	t.Run("mem", func(t *testing.T) {
+		testBackend(t, "mem://"+t.Name())
+	})
+	t.Run("s3", func(t *testing.T) {
+		srv := s3test.NewServer(t, "bucket")
+		srv.PageSize = 1 // Exercise continuation tokens
+		storage.Register("s3", srv.Backend(t))
+		testBackend(t, "s3://bucket/prefix")
+	})
+}
+
+func TestS3(t *testing.T) {
+	srv := s3test.NewServer(t, "bucket")
+	storage.Register("s3", srv.Backend(t))
+
+	if files, err := storage.List("s3://nobucket/x"); err != nil || len(files) != 0 {
+		t.Errorf("Expected no files in a missing bucket, got %v, %v", files, err)
+	}
+	if _, err := storage.Open("s3://nobucket/x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for a missing bucket, got %v", err)
+	}
+
+	// Keys with spaces and other characters must be escaped and signed.
+	name := "s3://bucket/dir with space/a+b=c.txt"
+	if err := storage.WriteFile(name, func(w io.Writer) error {
+		_, err := io.WriteString(w, "data")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := srv.Get("bucket", "dir with space/a+b=c.txt"); !ok || string(data) != "data" {
+		t.Errorf("Expected the object to be stored, got %q, %v", data, ok)
+	}
+	if n := srv.Requests("PUT"); n != 1 {
+		t.Errorf("Expected 1 PUT, got %d", n)
+	}
+
+	// A prefix only matches whole path elements.
+	srv.Put("bucket", "dirx/other.txt", []byte("x"))
+	files, err := storage.List("s3://bucket/dir")
+	if err != nil || len(files) != 0 {
+		t.Errorf("Expected no files under s3://bucket/dir, got %+v, %v", files, err)
+	}
+
+	wrong := srv.Config()
+	wrong.AccessKey = "someone-else"
+	b, err := storage.NewS3(wrong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("bucket/dirx/other.txt"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected 403 for Stat, got %v", err)
+	}
+	if _, err := b.Open("bucket/dirx/other.txt"); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Expected AccessDenied for Open, got %v", err)
+	}
+
+	if _, err := storage.NewS3(storage.S3Config{Endpoint: "localhost:9000"}); err == nil {
+		t.Error("Expected an endpoint without a scheme to be rejected")
+	}
+}
+
+func TestURIs(t *testing.T) {
+	tests := []struct {
+		base string
+		elem []string
+		want string
+	}{
+		{"/data", []string{"out", "mr-out-0"}, filepath.Join("/data", "out", "mr-out-0")},
+		{"", []string{"mr-1-0"}, "mr-1-0"},
+		{"s3://bucket/prefix/", []string{"out", "part-0"}, "s3://bucket/prefix/out/part-0"},
+		{"mem://x", []string{"../y"}, "mem://y"},
+	}
+	for _, tt := range tests {
+		if got := storage.Join(tt.base, tt.elem...); got != tt.want {
+			t.Errorf("Join(%q, %q): expected %q, got %q", tt.base, tt.elem, tt.want, got)
+		}
+	}
+
+	for p, want := range map[string]bool{
+		"s3://bucket/key": true,
+		"file:///tmp":     true,
+		"/tmp/a://b":      false,
+		"relative/path":   false,
+		"://nothing":      false,
+	} {
+		if got := storage.IsURI(p); got != want {
+			t.Errorf("IsURI(%q): expected %v, got %v", p, want, got)
+		}
+	}
+	if got := storage.Base("s3://bucket/a/b.txt"); got != "b.txt" {
+		t.Errorf("Expected base b.txt, got %q", got)
+	}
+
+	if err := storage.Check("gopher://host/x"); err == nil {
+		t.Error("Expected an unknown scheme to be rejected")
+	}
+	if _, err := storage.Open("gopher://host/x"); err == nil {
+		t.Error("Expected Open with an unknown scheme to fail")
+	}
+	if err := storage.Rename("mem://a", t.TempDir()+"/b"); err == nil {
+		t.Error("Expected a rename across backends to fail")
+	}
+}
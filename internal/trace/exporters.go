@@ -0,0 +1,238 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kind for spans that are neither client nor server calls.
+const spanKindInternal = 1
+
+// OTLP status codes.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+// OTLPJSONExporter writes each span as one line of OTLP/JSON, the format used
+// by the OpenTelemetry collector's file exporter and accepted by its file
+// receiver, so traces recorded offline can be replayed into any backend.
+type OTLPJSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewOTLPJSONExporter writes OTLP/JSON lines to w.
+func NewOTLPJSONExporter(w io.Writer) *OTLPJSONExporter {
+	return &OTLPJSONExporter{w: w}
+}
+
+// NewFileExporter appends OTLP/JSON lines to the file at path.
+func NewFileExporter(path string) (*OTLPJSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPJSONExporter{w: f, c: f}, nil
+}
+
+// ExportSpan writes one span.
+func (e *OTLPJSONExporter) ExportSpan(s SpanData) error {
+	b, err := json.Marshal(toOTLP(s))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying file, if the exporter opened one.
+func (e *OTLPJSONExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an OTLP AnyValue. Integers are strings in OTLP/JSON.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func toOTLPValue(v any) otlpValue {
+	switch v := v.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case string:
+		return otlpValue{StringValue: &v}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
+
+func toOTLPAttrs(attrs []Attr) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		out = append(out, otlpKeyValue{Key: a.Key, Value: toOTLPValue(a.Value)})
+	}
+	return out
+}
+
+func toOTLP(s SpanData) otlpRequest {
+	span := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:        toOTLPAttrs(s.Attributes),
+		Status:            otlpStatus{Code: statusUnset},
+	}
+	if s.ParentSpanID.IsValid() {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	if s.Error != "" {
+		span.Status = otlpStatus{Code: statusError, Message: s.Error}
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: toOTLPAttrs([]Attr{String("service.name", s.Service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "dist-mapreduce"}, Spans: []otlpSpan{span}}},
+	}}}
+}
+
+// WriterExporter prints one human-readable line per span, for following a
+// job on a terminal.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter prints spans to standard output.
+func NewStdoutExporter() *WriterExporter {
+	return &WriterExporter{w: os.Stdout}
+}
+
+// ExportSpan prints one span.
+func (e *WriterExporter) ExportSpan(s SpanData) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "span %s service=%s trace=%s span=%s", s.Name, s.Service, s.TraceID, s.SpanID)
+	if s.ParentSpanID.IsValid() {
+		fmt.Fprintf(&b, " parent=%s", s.ParentSpanID)
+	}
+	fmt.Fprintf(&b, " duration=%s", s.End.Sub(s.Start).Round(time.Microsecond))
+	for _, a := range s.Attributes {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&b, " error=%q", s.Error)
+	}
+	b.WriteByte('\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+// Recorder keeps finished spans in memory. It is meant for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan records one span.
+func (r *Recorder) ExportSpan(s SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+	return nil
+}
+
+// Spans returns the spans recorded so far in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+// NewExporter builds the exporter selected on the command line: "none",
+// "stdout", or "otlp-file" writing to path. The returned close function
+// flushes and releases the exporter.
+func NewExporter(kind, path string) (Exporter, func() error, error) {
+	noop := func() error { return nil }
+	switch kind {
+	case "", "none":
+		return nil, noop, nil
+	case "stdout":
+		return NewStdoutExporter(), noop, nil
+	case "otlp-file":
+		if path == "" {
+			return nil, nil, fmt.Errorf("otlp-file exporter needs a file path")
+		}
+		e, err := NewFileExporter(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return e, e.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown trace exporter %q (want none, stdout or otlp-file)", kind)
+}
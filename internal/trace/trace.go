@@ -0,0 +1,225 @@
+// Package trace records job lifecycle spans in an OpenTelemetry-compatible
+// shape. Span contexts travel between the coordinator and workers as W3C
+// traceparent strings inside the RPC messages, and finished spans are handed
+// to a pluggable Exporter.
+package trace
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies all spans belonging to one job.
+type TraceID [16]byte
+
+// SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the ID is non-zero.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether the ID is non-zero.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether the context refers to a real span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceParent encodes the context as a W3C traceparent header value. An
+// invalid context encodes as the empty string.
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent decodes a W3C traceparent value. The empty string yields
+// an invalid context and no error, so callers can pass RPC fields straight
+// through.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if s == "" {
+		return sc, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, fmt.Errorf("malformed trace id in %q: %w", s, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, fmt.Errorf("malformed span id in %q: %w", s, err)
+	}
+	return sc, nil
+}
+
+// Attr is a span attribute. Values are strings, integers or booleans.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String returns a string attribute.
+func String(key, value string) Attr { return Attr{Key: key, Value: value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attr { return Attr{Key: key, Value: int64(value)} }
+
+// Int64 returns an integer attribute.
+func Int64(key string, value int64) Attr { return Attr{Key: key, Value: value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attr { return Attr{Key: key, Value: value} }
+
+// SpanData is the immutable record of a finished span passed to exporters.
+type SpanData struct {
+	Name         string
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attr
+	Error        string // Non-empty when the span ended in failure
+	Service      string
+}
+
+// Span is an in-flight operation. Its methods are safe for concurrent use and
+// a span is exported exactly once, when it first ends.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Context returns the span's context for propagation to child spans.
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = msg
+}
+
+// End finishes the span now.
+func (s *Span) End() { s.EndAt(time.Now()) }
+
+// EndAt finishes the span at the given time and exports it.
+func (s *Span) EndAt(t time.Time) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = t
+	data := s.data
+	data.Attributes = append([]Attr(nil), s.data.Attributes...)
+	s.mu.Unlock()
+
+	s.tracer.export(data)
+}
+
+// Exporter receives finished spans.
+type Exporter interface {
+	ExportSpan(SpanData) error
+}
+
+// Tracer creates spans for one service and sends them to its exporter. A
+// tracer with a nil exporter still creates and propagates span contexts but
+// drops finished spans.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	onError  func(error)
+}
+
+// NewTracer returns a tracer that labels its spans with service.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// OnError registers a callback for export failures, which are otherwise
+// ignored so tracing never disrupts a job.
+func (t *Tracer) OnError(fn func(error)) {
+	t.onError = fn
+}
+
+// Start begins a span now. A zero parent starts a new trace.
+func (t *Tracer) Start(name string, parent SpanContext, attrs ...Attr) *Span {
+	return t.StartAt(name, parent, time.Now(), attrs...)
+}
+
+// StartAt begins a span at the given time. A zero parent starts a new trace.
+func (t *Tracer) StartAt(name string, parent SpanContext, start time.Time, attrs ...Attr) *Span {
+	data := SpanData{
+		Name:       name,
+		Start:      start,
+		Attributes: append([]Attr(nil), attrs...),
+		Service:    t.service,
+	}
+	if parent.IsValid() {
+		data.TraceID = parent.TraceID
+		data.ParentSpanID = parent.SpanID
+	} else {
+		data.TraceID = newTraceID()
+	}
+	data.SpanID = newSpanID()
+	return &Span{tracer: t, data: data}
+}
+
+func (t *Tracer) export(data SpanData) {
+	if t.exporter == nil {
+		return
+	}
+	if err := t.exporter.ExportSpan(data); err != nil && t.onError != nil {
+		t.onError(err)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		for i := range id {
+			id[i] = byte(rand.Uint32())
+		}
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		for i := range id {
+			id[i] = byte(rand.Uint32())
+		}
+	}
+	return id
+}
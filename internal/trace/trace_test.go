@@ -0,0 +1,75 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	tr := NewTracer("test", nil)
+	span := tr.Start("op", SpanContext{})
+	sc := span.Context()
+
+	parsed, err := ParseTraceParent(sc.TraceParent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != sc {
+		t.Errorf("Round trip changed context: %v != %v", parsed, sc)
+	}
+
+	if sc, err := ParseTraceParent(""); err != nil || sc.IsValid() {
+		t.Errorf("Empty traceparent should give invalid context and no error, got %v, %v", sc, err)
+	}
+	if _, err := ParseTraceParent("00-zz-11-01"); err == nil {
+		t.Error("Expected error for malformed traceparent")
+	}
+}
+
+func TestChildSpanInheritsTrace(t *testing.T) {
+	rec := &Recorder{}
+	tr := NewTracer("test", rec)
+	parent := tr.Start("parent", SpanContext{})
+	child := tr.Start("child", parent.Context())
+	child.End()
+	child.End() // exported once
+	parent.End()
+
+	spans := rec.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].TraceID != spans[1].TraceID || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("Child span not linked to parent: %+v", spans)
+	}
+}
+
+func TestOTLPJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer("coordinator", NewOTLPJSONExporter(&buf))
+	start := time.Unix(0, 1000)
+	span := tr.StartAt("job", SpanContext{}, start, Int("job_id", 4), String("app", "wordcount"))
+	span.SetError("boom")
+	span.EndAt(start.Add(time.Microsecond))
+
+	var req otlpRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatalf("Invalid OTLP JSON %q: %v", buf.String(), err)
+	}
+	rs := req.ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "coordinator" {
+		t.Errorf("Unexpected resource %+v", rs.Resource)
+	}
+	got := rs.ScopeSpans[0].Spans[0]
+	if got.Name != "job" || got.StartTimeUnixNano != "1000" || got.EndTimeUnixNano != "2000" {
+		t.Errorf("Unexpected span %+v", got)
+	}
+	if got.ParentSpanID != "" || got.Status.Code != statusError {
+		t.Errorf("Unexpected parent or status %+v", got)
+	}
+	if *got.Attributes[0].Value.IntValue != "4" {
+		t.Errorf("Integer attribute not encoded as OTLP intValue: %+v", got.Attributes[0])
+	}
+}
@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/appkeys"
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// App is a MapReduce application: the map and reduce functions a job runs.
+// Both receive the task's counters so they can record their own figures.
+type App struct {
+	Map    func(filename string, contents string, ctr *Counters) []KeyValue
+	Reduce func(key string, values []string, ctr *Counters) string
+
+	// MapInput and ReduceGroup, if set, are used instead of Map and Reduce.
+	// They also see the dataset tag of the input, the job's side inputs and
+	// its parameters, and ReduceGroup may write any number of records for
+	// a key, including none.
+	MapInput    func(in *Input, ctr *Counters) []KeyValue
+	ReduceGroup func(g *Group, ctr *Counters) []KeyValue
+
+	// CheckParams, if set, validates a job's parameters when it is
+	// submitted.
+	CheckParams func(params map[string]string) error
+
+	// SortKeys, GroupKeys and PartitionKey change how map output reaches
+	// the reducers, for the secondary sort pattern: the map function writes
+	// composite keys, SortKeys orders them, and consecutive keys GroupKeys
+	// finds equal go to one ReduceGroup call with their values in key
+	// order. PartitionKey picks the part of a key that chooses its reduce
+	// partition, and must agree with GroupKeys so no group is split across
+	// reducers. By default keys are sorted as strings, grouped when they
+	// are identical and partitioned by the whole key. WithSecondarySort
+	// sets all three for keys built with CompositeKey.
+	SortKeys     func(a, b string) int
+	GroupKeys    func(a, b string) int
+	PartitionKey func(key string) string
+
+	// KeyCodec and ValueCodec are set for apps with typed keys and values,
+	// usually by TypedApp. Their keys and values are JSON documents, which
+	// intermediate files keep as such, and keys are sorted with KeyCodec
+	// unless SortKeys is set.
+	KeyCodec   Codec
+	ValueCodec Codec
+}
+
+// Input is the file a map task reads, with the context of its job.
+type Input struct {
+	Filename string
+	Contents string
+	Tag      string            // Dataset of the file; empty if the job's inputs are not tagged
+	Datasets []string          // Tags of all the job's datasets, in submission order
+	Side     []SideInput       // The job's side inputs
+	Params   map[string]string // The job's parameters
+}
+
+// SideInput is a small table every map task of a job reads in full.
+type SideInput struct {
+	Tag      string
+	Contents []string // One entry per file
+}
+
+// Group is one reduce key with all of its values. For apps with GroupKeys,
+// Key is the first key of the group in sort order and Keys holds the key of
+// each value.
+type Group struct {
+	Key      string
+	Values   []string
+	Keys     []string
+	Datasets []string          // Tags of all the job's datasets, in submission order
+	Params   map[string]string // The job's parameters
+}
+
+// RunMap runs the app's map function over one input.
+func (a App) RunMap(in *Input, ctr *Counters) []KeyValue {
+	if a.MapInput != nil {
+		return a.MapInput(in, ctr)
+	}
+	return a.Map(in.Filename, in.Contents, ctr)
+}
+
+// RunReduce runs the app's reduce function over one group and returns the
+// records it writes.
+func (a App) RunReduce(g *Group, ctr *Counters) []KeyValue {
+	if a.ReduceGroup != nil {
+		return a.ReduceGroup(g, ctr)
+	}
+	return []KeyValue{{Key: g.Key, Value: a.Reduce(g.Key, g.Values, ctr)}}
+}
+
+// partition returns the reduce partition of key.
+func (a App) partition(key string, nReduce int) int {
+	if a.PartitionKey != nil {
+		key = a.PartitionKey(key)
+	}
+	return ihash(key) % nReduce
+}
+
+// sortKeys sorts the distinct keys of a reduce partition.
+func (a App) sortKeys(keys []string) {
+	if a.SortKeys == nil && a.KeyCodec == nil {
+		sort.Strings(keys)
+		return
+	}
+	slices.SortFunc(keys, a.CompareKeys)
+}
+
+// CompareKeys orders keys the way reduce tasks sort them: with SortKeys,
+// else KeyCodec, else as strings. Keys those find equal are ordered as
+// strings, so every attempt of a task writes the same output.
+func (a App) CompareKeys(x, y string) int {
+	compare := a.SortKeys
+	if compare == nil && a.KeyCodec != nil {
+		compare = a.KeyCodec.Compare
+	}
+	if compare == nil {
+		return strings.Compare(x, y)
+	}
+	return cmp.Or(compare(x, y), strings.Compare(x, y))
+}
+
+// typed reports whether the app's intermediate records hold JSON documents
+// rather than strings.
+func (a App) typed() bool {
+	return a.KeyCodec != nil || a.ValueCodec != nil
+}
+
+// groups calls fn with each group of sorted keys, given as the index range
+// of the group in keys.
+func (a App) groups(keys []string, fn func(start, end int) error) error {
+	for start := 0; start < len(keys); {
+		end := start + 1
+		for a.GroupKeys != nil && end < len(keys) && a.GroupKeys(keys[start], keys[end]) == 0 {
+			end++
+		}
+		if err := fn(start, end); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+var (
+	appsMu sync.RWMutex
+	apps   = map[string]App{
+		common.DefaultApp: {
+			Map: func(filename, contents string, _ *Counters) []KeyValue {
+				return MapFunc(filename, contents)
+			},
+			Reduce: func(key string, values []string, _ *Counters) string {
+				return ReduceFunc(key, values)
+			},
+		},
+		"wordcount-mq": {
+			Map:    mqMapFunc,
+			Reduce: sumReduceFunc,
+		},
+		"join": {
+			MapInput:    joinMap,
+			ReduceGroup: joinReduce,
+			CheckParams: checkJoinParams,
+		},
+		"broadcast-join": {
+			MapInput:    broadcastJoinMap,
+			ReduceGroup: identityReduce,
+			CheckParams: checkJoinParams,
+		},
+		"top-n": App{
+			MapInput:    topNMap,
+			ReduceGroup: topNReduce,
+			CheckParams: checkTopNParams,
+		}.WithSecondarySort(compareScores),
+		"word-lengths": wordLengths.App(),
+	}
+)
+
+// How every app orders and partitions its keys is also recorded in package
+// appkeys, for code that reads job output without the worker runtime.
+func init() {
+	for name, app := range apps {
+		app.registerKeys(name)
+	}
+}
+
+// RegisterApp makes an application available to jobs under name.
+func RegisterApp(name string, app App) {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	apps[name] = app
+	app.registerKeys(name)
+}
+
+func (a App) registerKeys(name string) {
+	appkeys.Register(name, appkeys.Keys{Compare: a.CompareKeys, Partition: a.partition})
+}
+
+// LookupApp returns the application registered under name. An empty name
+// selects the default word count application.
+func LookupApp(name string) (App, bool) {
+	if name == "" {
+		name = common.DefaultApp
+	}
+	appsMu.RLock()
+	defer appsMu.RUnlock()
+	app, ok := apps[name]
+	return app, ok
+}
+
+// Apps returns the names of all registered applications in sorted order.
+func Apps() []string {
+	appsMu.RLock()
+	defer appsMu.RUnlock()
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mqMapFunc counts only words starting with m through q, like the legacy
+// Hadoop hw02 variants, and records how many words it skipped.
+func mqMapFunc(filename string, contents string, ctr *Counters) []KeyValue {
+	kva := []KeyValue{}
+	for _, kv := range MapFunc(filename, contents) {
+		if c := strings.ToLower(kv.Key)[0]; c < 'm' || c > 'q' {
+			ctr.Inc("RECORDS_SKIPPED", 1)
+			continue
+		}
+		ctr.Inc("WORDS_MATCHING_M_TO_Q", 1)
+		kva = append(kva, kv)
+	}
+	return kva
+}
+
+// sumReduceFunc adds up integer values, unlike ReduceFunc which counts them.
+// Malformed values are counted and ignored.
+func sumReduceFunc(key string, values []string, ctr *Counters) string {
+	sum := 0
+	for _, v := range values {
+		var n int
+		if _, err := fmt.Sscanf(v, "%d", &n); err != nil {
+			ctr.Inc("MALFORMED_VALUES", 1)
+			continue
+		}
+		sum += n
+	}
+	return fmt.Sprintf("%d", sum)
+}
@@ -0,0 +1,42 @@
+package worker
+
+// Built-in counters maintained by the framework for every task.
+const (
+	CounterMapInputRecords     = "MAP_INPUT_RECORDS"
+	CounterMapOutputRecords    = "MAP_OUTPUT_RECORDS"
+	CounterReduceInputRecords  = "REDUCE_INPUT_RECORDS"
+	CounterReduceOutputRecords = "REDUCE_OUTPUT_RECORDS"
+	CounterIntermediateBytes   = "INTERMEDIATE_BYTES"
+	CounterSpilledRecords      = "SPILLED_RECORDS"
+)
+
+// Counters accumulates named counts while a task runs. The worker sends the
+// totals to the coordinator with the task's completion report, where they are
+// summed per job.
+type Counters struct {
+	values map[string]int64
+}
+
+// NewCounters returns an empty set of counters.
+func NewCounters() *Counters {
+	return &Counters{values: make(map[string]int64)}
+}
+
+// Inc adds delta to the named counter.
+func (c *Counters) Inc(name string, delta int64) {
+	c.values[name] += delta
+}
+
+// Get returns the current value of the named counter.
+func (c *Counters) Get(name string) int64 {
+	return c.values[name]
+}
+
+// Snapshot returns a copy of the counters suitable for sending over RPC.
+func (c *Counters) Snapshot() map[string]int64 {
+	out := make(map[string]int64, len(c.values))
+	for name, v := range c.values {
+		out[name] = v
+	}
+	return out
+}
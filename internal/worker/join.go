@@ -0,0 +1,289 @@
+package worker
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parameters of the join and broadcast-join apps, set in a job's Params.
+// Inputs are CSV files; the join key column of a dataset can be set with
+// "key.<tag>", which overrides ParamKey.
+const (
+	ParamJoin      = "join"      // JoinInner (the default) or JoinLeft
+	ParamKey       = "key"       // Column of the join key, counting from 0; default 0
+	ParamSeparator = "separator" // Field separator of the input and output rows; default ","
+	ParamHeader    = "header"    // "true" skips the first line of every file
+)
+
+// Join modes.
+const (
+	// JoinInner writes a row for every combination of matching rows, one
+	// from each dataset, and drops keys missing from any dataset.
+	JoinInner = "inner"
+	// JoinLeft also keeps rows of the first dataset (the main input of a
+	// broadcast join) that have no match, leaving the other datasets'
+	// columns out.
+	JoinLeft = "left"
+)
+
+// Counters of the join apps.
+const (
+	CounterJoinMalformed        = "JOIN_MALFORMED_RECORDS"  // Rows without a key column, or that are not valid CSV
+	CounterJoinUntagged         = "JOIN_UNTAGGED_RECORDS"   // Rows of inputs outside the job's datasets
+	CounterJoinUnmatchedKeys    = "JOIN_UNMATCHED_KEYS"     // Keys an inner reduce-side join dropped
+	CounterJoinUnmatchedRecords = "JOIN_UNMATCHED_RECORDS"  // Rows an inner broadcast join dropped
+	CounterJoinSideInputRecords = "JOIN_SIDE_INPUT_RECORDS" // Side input rows loaded, once per map task
+)
+
+// Tagged prefixes a map output value with the position of its dataset in
+// Input.Datasets, so the reducer can tell the datasets apart with
+// SplitByDataset.
+func Tagged(dataset int, value string) string {
+	return strconv.Itoa(dataset) + ":" + value
+}
+
+// SplitByDataset sorts the values of a reduce group, written with Tagged,
+// into one slice per dataset in dataset order. This is the secondary sort
+// of a reduce-side join: the reducer sees every row of the first dataset
+// before any row of the second, and so on. Values keep their order within a
+// dataset.
+func SplitByDataset(values []string, datasets int) ([][]string, error) {
+	split := make([][]string, datasets)
+	for _, v := range values {
+		prefix, value, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, errors.New("value is not tagged with its dataset")
+		}
+		i, err := strconv.Atoi(prefix)
+		if err != nil || i < 0 || i >= datasets {
+			return nil, fmt.Errorf("value tagged with unknown dataset %q", prefix)
+		}
+		split[i] = append(split[i], value)
+	}
+	return split, nil
+}
+
+// joinMap is the map function of the reduce-side join: it keys every row by
+// its join column and tags the rest of the row with its dataset.
+func joinMap(in *Input, ctr *Counters) []KeyValue {
+	dataset := slices.Index(in.Datasets, in.Tag)
+	col, sep := keyColumn(in.Params, in.Tag), separator(in.Params)
+	var kva []KeyValue
+	readRows(in.Contents, in.Params, ctr, func(row []string) {
+		if dataset < 0 {
+			ctr.Inc(CounterJoinUntagged, 1)
+			return
+		}
+		key, rest, ok := splitKey(row, col)
+		if !ok {
+			ctr.Inc(CounterJoinMalformed, 1)
+			return
+		}
+		kva = append(kva, KeyValue{Key: key, Value: Tagged(dataset, formatRow(rest, sep))})
+	})
+	return kva
+}
+
+// joinReduce joins the rows of one key across the job's datasets.
+func joinReduce(g *Group, ctr *Counters) []KeyValue {
+	rows, err := SplitByDataset(g.Values, len(g.Datasets))
+	if err != nil {
+		ctr.Inc(CounterJoinMalformed, int64(len(g.Values)))
+		return nil
+	}
+	left := g.Params[ParamJoin] == JoinLeft
+	for i := range rows {
+		if len(rows[i]) > 0 {
+			continue
+		}
+		if i == 0 || !left {
+			ctr.Inc(CounterJoinUnmatchedKeys, 1)
+			return nil
+		}
+		rows[i] = []string{""}
+	}
+	return crossJoin(g.Key, rows, separator(g.Params))
+}
+
+// broadcastJoinMap is the map function of the broadcast join: it loads the
+// side inputs into memory and joins every row of its input with them, so no
+// shuffle of the side tables is needed.
+func broadcastJoinMap(in *Input, ctr *Counters) []KeyValue {
+	sep := separator(in.Params)
+	tables := make([]map[string][]string, len(in.Side))
+	for i, side := range in.Side {
+		col := keyColumn(in.Params, side.Tag)
+		table := make(map[string][]string)
+		for _, contents := range side.Contents {
+			readRows(contents, in.Params, ctr, func(row []string) {
+				key, rest, ok := splitKey(row, col)
+				if !ok {
+					ctr.Inc(CounterJoinMalformed, 1)
+					return
+				}
+				ctr.Inc(CounterJoinSideInputRecords, 1)
+				table[key] = append(table[key], formatRow(rest, sep))
+			})
+		}
+		tables[i] = table
+	}
+
+	left := in.Params[ParamJoin] == JoinLeft
+	col := keyColumn(in.Params, in.Tag)
+	var kva []KeyValue
+	readRows(in.Contents, in.Params, ctr, func(row []string) {
+		key, rest, ok := splitKey(row, col)
+		if !ok {
+			ctr.Inc(CounterJoinMalformed, 1)
+			return
+		}
+		rows := [][]string{{formatRow(rest, sep)}}
+		for _, table := range tables {
+			matches := table[key]
+			if len(matches) == 0 {
+				if !left {
+					ctr.Inc(CounterJoinUnmatchedRecords, 1)
+					return
+				}
+				matches = []string{""}
+			}
+			rows = append(rows, matches)
+		}
+		kva = append(kva, crossJoin(key, rows, sep)...)
+	})
+	return kva
+}
+
+// identityReduce writes every value of a group unchanged.
+func identityReduce(g *Group, _ *Counters) []KeyValue {
+	kva := make([]KeyValue, 0, len(g.Values))
+	for _, v := range g.Values {
+		kva = append(kva, KeyValue{Key: g.Key, Value: v})
+	}
+	return kva
+}
+
+// crossJoin returns one record per combination of one row from each
+// dataset, concatenating the rows in dataset order. Empty rows stand for a
+// dataset without a match and add no columns.
+func crossJoin(key string, rows [][]string, sep rune) []KeyValue {
+	var kva []KeyValue
+	parts := make([]string, 0, len(rows))
+	var walk func(i int)
+	walk = func(i int) {
+		if i == len(rows) {
+			var cols []string
+			for _, p := range parts {
+				if p != "" {
+					cols = append(cols, p)
+				}
+			}
+			kva = append(kva, KeyValue{Key: key, Value: strings.Join(cols, string(sep))})
+			return
+		}
+		for _, r := range rows[i] {
+			parts = append(parts, r)
+			walk(i + 1)
+			parts = parts[:len(parts)-1]
+		}
+	}
+	walk(0)
+	return kva
+}
+
+// readRows calls fn with every row of a CSV file, skipping the header if the
+// job has one and counting rows that cannot be parsed.
+func readRows(contents string, params map[string]string, ctr *Counters, fn func([]string)) {
+	r := csv.NewReader(strings.NewReader(contents))
+	r.Comma = separator(params)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	skip, _ := strconv.ParseBool(params[ParamHeader])
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			ctr.Inc(CounterJoinMalformed, 1)
+			continue
+		}
+		if skip {
+			skip = false
+			continue
+		}
+		fn(row)
+	}
+}
+
+// splitKey separates the key column from the rest of a row.
+func splitKey(row []string, col int) (string, []string, bool) {
+	if col >= len(row) {
+		return "", nil, false
+	}
+	rest := make([]string, 0, len(row)-1)
+	rest = append(rest, row[:col]...)
+	rest = append(rest, row[col+1:]...)
+	return row[col], rest, true
+}
+
+// formatRow encodes fields as one CSV row without the line ending.
+func formatRow(fields []string, sep rune) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Comma = sep
+	_ = w.Write(fields) // Cannot fail writing to a strings.Builder
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// keyColumn returns the join key column of a dataset.
+func keyColumn(params map[string]string, tag string) int {
+	v, ok := params[ParamKey+"."+tag]
+	if !ok || tag == "" {
+		v = params[ParamKey]
+	}
+	col, _ := strconv.Atoi(v)
+	return col
+}
+
+func separator(params map[string]string) rune {
+	if sep := params[ParamSeparator]; sep != "" {
+		r, _ := utf8.DecodeRuneInString(sep)
+		return r
+	}
+	return ','
+}
+
+// checkJoinParams rejects parameters the join apps cannot use.
+func checkJoinParams(params map[string]string) error {
+	for name, v := range params {
+		switch {
+		case name == ParamJoin:
+			if v != JoinInner && v != JoinLeft {
+				return fmt.Errorf("%s must be %s or %s, got %q", ParamJoin, JoinInner, JoinLeft, v)
+			}
+		case name == ParamKey || strings.HasPrefix(name, ParamKey+"."):
+			if col, err := strconv.Atoi(v); err != nil || col < 0 {
+				return fmt.Errorf("%s must be a column number, got %q", name, v)
+			}
+		case name == ParamSeparator:
+			if r, size := utf8.DecodeRuneInString(v); size != len(v) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+				return fmt.Errorf("%s must be a single character other than a quote or line break, got %q", name, v)
+			}
+		case name == ParamHeader:
+			if _, err := strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("%s must be true or false, got %q", name, v)
+			}
+		default:
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package worker
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/metrics"
+)
+
+// workerMetrics holds the instruments updated while executing tasks.
+type workerMetrics struct {
+	registry     *metrics.Registry
+	tasks        *metrics.CounterVec
+	taskDuration *metrics.HistogramVec
+	bytesRead    *metrics.CounterVec
+	bytesWritten *metrics.CounterVec
+	rpcRequests  *metrics.CounterVec
+	rpcErrors    *metrics.CounterVec
+	busySlots    *metrics.GaugeVec
+}
+
+var stats = newWorkerMetrics()
+
+func newWorkerMetrics() *workerMetrics {
+	r := metrics.NewRegistry()
+	return &workerMetrics{
+		registry:     r,
+		tasks:        r.NewCounter("mr_worker_tasks_total", "Tasks executed by this worker.", "type"),
+		taskDuration: r.NewHistogram("mr_worker_task_duration_seconds", "Time spent executing a task.", metrics.DurationBuckets, "type"),
+		bytesRead:    r.NewCounter("mr_worker_bytes_read_total", "Bytes read from input and intermediate files.", "type"),
+		bytesWritten: r.NewCounter("mr_worker_bytes_written_total", "Bytes written to intermediate and output files.", "type"),
+		rpcRequests:  r.NewCounter("mr_worker_rpc_requests_total", "RPC calls made to the coordinator.", "method"),
+		rpcErrors:    r.NewCounter("mr_worker_rpc_errors_total", "RPC calls to the coordinator that failed.", "method"),
+		busySlots:    r.NewGauge("mr_worker_busy_slots", "Task slots currently running a task."),
+	}
+}
+
+// MetricsHandler serves the worker's metrics in Prometheus text format.
+func MetricsHandler() http.Handler {
+	return stats.registry
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+)
+
+// register announces the worker to the coordinator, retrying until it is
+// reachable or cfg.ReconnectTimeout passes, and returns the ID the
+// coordinator assigned. That is the worker's own ID, if it has one, unless
+// a live worker already uses it; the coordinator keeps the ID of a worker
+// registering again after a restart, so doing that is safe while slots run.
+func (w *runner) register(ctx context.Context) (string, error) {
+	args := common.RegisterArgs{
+		WorkerID:    w.id,
+		Hostname:    w.cfg.Hostname,
+		Slots:       w.cfg.Slots,
+		MemoryBytes: w.cfg.MemoryBytes,
+		Apps:        w.cfg.Apps,
+		Labels:      w.cfg.Labels,
+	}
+	start := time.Now()
+	for {
+		reply := common.RegisterReply{}
+		err := w.conn.call(ctx, "Coordinator.Register", &args, &reply)
+		if err == nil {
+			return reply.WorkerID, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if time.Since(start) > w.cfg.ReconnectTimeout {
+			return "", fmt.Errorf("cannot register with coordinator: %w", err)
+		}
+		sleep(ctx, w.cfg.PollInterval)
+	}
+}
+
+// deregister tells the coordinator the worker is leaving, so it requeues
+// the tasks the worker still holds at once. Failures are only logged: the
+// tasks then time out as if the worker had died.
+func (w *runner) deregister(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, deregisterTimeout)
+	defer cancel()
+	reply := common.DeregisterReply{}
+	if err := w.conn.call(ctx, "Coordinator.Deregister", &common.DeregisterArgs{WorkerID: w.id}, &reply); err != nil {
+		w.logger.Warn("Failed to deregister from the coordinator", "error", err)
+		return
+	}
+	w.logger.Info("Deregistered from the coordinator", "requeued", reply.Requeued)
+}
+
+// deregisterTimeout bounds how long a stopping worker waits to deregister.
+const deregisterTimeout = 5 * time.Second
+
+// totalMemory returns the machine's total memory in bytes, read from
+// /proc/meminfo, or 0 where that is not available.
+func totalMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// MemTotal:       16318480 kB
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// compositeSep separates the natural key of a composite key from its sort
+// part. Natural keys must not contain it.
+const compositeSep = "\x1f"
+
+// CompositeKey builds a map output key for the secondary sort pattern from a
+// natural key, which decides the reduce group, and a sort part, which orders
+// the values within the group.
+func CompositeKey(natural, secondary string) string {
+	return natural + compositeSep + secondary
+}
+
+// SplitCompositeKey returns the natural key and sort part of a key built
+// with CompositeKey. Other keys are returned whole as the natural key.
+func SplitCompositeKey(key string) (natural, secondary string) {
+	natural, secondary, _ = strings.Cut(key, compositeSep)
+	return natural, secondary
+}
+
+// NaturalKey returns the natural key of a key built with CompositeKey.
+func NaturalKey(key string) string {
+	natural, _ := SplitCompositeKey(key)
+	return natural
+}
+
+// WithSecondarySort returns a copy of the app that sorts keys built with
+// CompositeKey by natural key and then by their sort parts using secondary,
+// groups them by natural key and partitions them by natural key, so its
+// ReduceGroup sees every value of a natural key in secondary order. A nil
+// secondary compares sort parts as strings.
+func (a App) WithSecondarySort(secondary func(a, b string) int) App {
+	if secondary == nil {
+		secondary = strings.Compare
+	}
+	a.SortKeys = func(x, y string) int {
+		xn, xs := SplitCompositeKey(x)
+		yn, ys := SplitCompositeKey(y)
+		if c := strings.Compare(xn, yn); c != 0 {
+			return c
+		}
+		return secondary(xs, ys)
+	}
+	a.GroupKeys = func(x, y string) int {
+		return strings.Compare(NaturalKey(x), NaturalKey(y))
+	}
+	a.PartitionKey = NaturalKey
+	return a
+}
+
+// Parameters of the top-n app, which also takes ParamSeparator and
+// ParamHeader. Its inputs are CSV files.
+const (
+	ParamGroup = "group" // Column of the group key, counting from 0; default 0
+	ParamScore = "score" // Column of the numeric score; default 1
+	ParamN     = "n"     // Rows to keep per group; default 10
+)
+
+// CounterTopNMalformed counts rows the top-n app skipped because they have
+// no group or score column, or a score that is not a number.
+const CounterTopNMalformed = "TOP_N_MALFORMED_RECORDS"
+
+// topNMap keys every row by its group and score, so the rows of a group
+// reach the reducer highest score first.
+func topNMap(in *Input, ctr *Counters) []KeyValue {
+	group, score := intParam(in.Params, ParamGroup, 0), intParam(in.Params, ParamScore, 1)
+	sep := separator(in.Params)
+	var kva []KeyValue
+	readRows(in.Contents, in.Params, ctr, func(row []string) {
+		if group >= len(row) || score >= len(row) {
+			ctr.Inc(CounterTopNMalformed, 1)
+			return
+		}
+		if _, err := strconv.ParseFloat(row[score], 64); err != nil {
+			ctr.Inc(CounterTopNMalformed, 1)
+			return
+		}
+		_, rest, _ := splitKey(row, group)
+		kva = append(kva, KeyValue{Key: CompositeKey(row[group], row[score]), Value: formatRow(rest, sep)})
+	})
+	return kva
+}
+
+// topNReduce writes the first n rows of a group, which are its highest
+// scoring ones.
+func topNReduce(g *Group, _ *Counters) []KeyValue {
+	n := min(intParam(g.Params, ParamN, 10), len(g.Values))
+	key := NaturalKey(g.Key)
+	kva := make([]KeyValue, 0, n)
+	for _, v := range g.Values[:n] {
+		kva = append(kva, KeyValue{Key: key, Value: v})
+	}
+	return kva
+}
+
+// compareScores orders numeric scores from highest to lowest. Scores are
+// checked by the map function, so both parse.
+func compareScores(a, b string) int {
+	x, _ := strconv.ParseFloat(a, 64)
+	y, _ := strconv.ParseFloat(b, 64)
+	switch {
+	case x > y:
+		return -1
+	case x < y:
+		return 1
+	}
+	return 0
+}
+
+// intParam returns an integer parameter, or def if it is not set.
+func intParam(params map[string]string, name string, def int) int {
+	if v, ok := params[name]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// checkTopNParams rejects parameters the top-n app cannot use.
+func checkTopNParams(params map[string]string) error {
+	for name, v := range params {
+		switch name {
+		case ParamGroup, ParamScore:
+			if col, err := strconv.Atoi(v); err != nil || col < 0 {
+				return fmt.Errorf("%s must be a column number, got %q", name, v)
+			}
+		case ParamN:
+			if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+				return fmt.Errorf("%s must be a positive number, got %q", name, v)
+			}
+		case ParamSeparator, ParamHeader:
+			if err := checkJoinParams(map[string]string{name: v}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	if intParam(params, ParamGroup, 0) == intParam(params, ParamScore, 1) {
+		return fmt.Errorf("%s and %s must be different columns", ParamGroup, ParamScore)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package worker
+
+import "github.com/sagarneeli/dist-mapreduce/internal/trace"
+
+// tracer emits the worker's execution and shuffle spans. Without an exporter
+// spans are still created so trace context keeps flowing to the coordinator.
+var tracer = trace.NewTracer("worker", nil)
+
+// SetTracer replaces the tracer used for task spans. Call it before Worker.
+func SetTracer(t *trace.Tracer) {
+	tracer = t
+}
@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
+)
+
+func TestTracing_JobSpanTree(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(name, []byte("hello world"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := &trace.Recorder{}
+	c := coordinator.NewCoordinator()
+	c.SetTracer(trace.NewTracer("coordinator", rec))
+	oldTracer := tracer
+	SetTracer(trace.NewTracer("worker", rec))
+	defer SetTracer(oldTracer)
+
+	nMap, nReduce := 2, 2
+	jobID := c.SubmitJob([]string{"a.txt", "b.txt"}, nReduce)
+
+	// Drive the job in-process: the worker half runs RunTask directly instead
+	// of going through RPC.
+	for i := 0; i < nMap+nReduce+1; i++ {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.TaskType < 0 {
+			break
+		}
+		if reply.TraceParent == "" {
+			t.Fatalf("Task %v %d has no trace context", reply.TaskType, reply.TaskID)
+		}
+		report, err := RunTask(reply, "w1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.ReportTask(report, &common.ReportTaskReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job, _ := c.Snapshot(jobID); job.Status != "COMPLETED" {
+		t.Fatalf("Expected job to complete, got %s", job.Status)
+	}
+
+	spans := rec.Spans()
+	byID := make(map[trace.SpanID]trace.SpanData)
+	children := make(map[trace.SpanID][]trace.SpanData)
+	var roots []trace.SpanData
+	for _, s := range spans {
+		byID[s.SpanID] = s
+		if !s.ParentSpanID.IsValid() {
+			roots = append(roots, s)
+		} else {
+			children[s.ParentSpanID] = append(children[s.ParentSpanID], s)
+		}
+	}
+	if len(roots) != 1 || roots[0].Name != "job" {
+		t.Fatalf("Expected a single job root span, got %v", roots)
+	}
+	root := roots[0]
+	for _, s := range spans {
+		if s.TraceID != root.TraceID {
+			t.Errorf("Span %s belongs to trace %s, want %s", s.Name, s.TraceID, root.TraceID)
+		}
+		if s.ParentSpanID.IsValid() {
+			if _, ok := byID[s.ParentSpanID]; !ok {
+				t.Errorf("Span %s has unknown parent %s", s.Name, s.ParentSpanID)
+			}
+		}
+	}
+
+	count := func(list []trace.SpanData, name string) []trace.SpanData {
+		var out []trace.SpanData
+		for _, s := range list {
+			if s.Name == name {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	top := children[root.SpanID]
+	if n := len(count(top, "submit")); n != 1 {
+		t.Errorf("Expected 1 submit span, got %d", n)
+	}
+	if n := len(count(top, "queue_wait")); n != nMap+nReduce {
+		t.Errorf("Expected %d queue_wait spans, got %d", nMap+nReduce, n)
+	}
+
+	checkTask := func(task trace.SpanData, shuffleReads int) {
+		execs := count(children[task.SpanID], "execute")
+		if len(execs) != 1 {
+			t.Fatalf("Task span %s: expected 1 execute child, got %d", task.Name, len(execs))
+		}
+		exec := execs[0]
+		if exec.Service != "worker" {
+			t.Errorf("Execute span emitted by %q, want worker", exec.Service)
+		}
+		if n := len(count(children[exec.SpanID], "shuffle_read")); n != shuffleReads {
+			t.Errorf("Task span %s: expected %d shuffle_read spans, got %d", task.Name, shuffleReads, n)
+		}
+		if n := len(count(children[exec.SpanID], "commit")); n != 1 {
+			t.Errorf("Task span %s: expected commit under execute, got %d", task.Name, n)
+		}
+	}
+	maps, reduces := count(top, "map_task"), count(top, "reduce_task")
+	if len(maps) != nMap || len(reduces) != nReduce {
+		t.Fatalf("Expected %d map and %d reduce task spans, got %d and %d", nMap, nReduce, len(maps), len(reduces))
+	}
+	for _, s := range maps {
+		checkTask(s, 0)
+	}
+	for _, s := range reduces {
+		checkTask(s, nMap)
+	}
+}
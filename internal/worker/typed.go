@@ -0,0 +1,228 @@
+package worker
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codec orders the encoded keys or values of an app with typed data. Typed
+// keys and values are encoded as JSON, in KeyValue and in intermediate
+// files, so a reader of either sees numbers as numbers.
+type Codec interface {
+	TypeName() string
+	Compare(a, b string) int // Orders two encoded values
+}
+
+// Type is the Codec of keys or values of type T. They are encoded with
+// encoding/json, ordered by Compare once decoded and written to the job
+// output with Format.
+type Type[T any] struct {
+	Name    string
+	Cmp     func(a, b T) int // Nil compares the encodings as strings
+	Formatf func(v T) string // Nil writes the encoding
+}
+
+// Built-in types.
+var (
+	String  = Type[string]{Name: "string", Cmp: strings.Compare, Formatf: func(s string) string { return s }}
+	Int64   = Type[int64]{Name: "int64", Cmp: cmp.Compare[int64], Formatf: func(n int64) string { return strconv.FormatInt(n, 10) }}
+	Float64 = Type[float64]{Name: "float64", Cmp: cmp.Compare[float64], Formatf: func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }}
+	Bytes   = Type[[]byte]{Name: "bytes", Cmp: bytes.Compare, Formatf: func(b []byte) string { return string(b) }}
+)
+
+// JSON returns the type of JSON documents decoded into T, e.g. a struct.
+// They are ordered by their encoding.
+func JSON[T any]() Type[T] {
+	return Type[T]{Name: "json"}
+}
+
+// TypeName returns the name of the type.
+func (t Type[T]) TypeName() string { return t.Name }
+
+// Encode returns the encoding of v.
+func (t Type[T]) Encode(v T) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode %s: %w", t.Name, err)
+	}
+	return string(b), nil
+}
+
+// Decode returns the value encoded in s.
+func (t Type[T]) Decode(s string) (T, error) {
+	var v T
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return v, fmt.Errorf("cannot decode %s: %w", t.Name, err)
+	}
+	return v, nil
+}
+
+// Compare orders two encoded values. Values that do not decode sort after
+// the others.
+func (t Type[T]) Compare(a, b string) int {
+	if t.Cmp == nil {
+		return strings.Compare(a, b)
+	}
+	x, errA := t.Decode(a)
+	y, errB := t.Decode(b)
+	if errA != nil || errB != nil {
+		return cmp.Compare(boolInt(errA != nil), boolInt(errB != nil))
+	}
+	return t.Cmp(x, y)
+}
+
+// Format returns the text of v in the job output.
+func (t Type[T]) Format(v T) string {
+	if t.Formatf != nil {
+		return t.Formatf(v)
+	}
+	s, _ := t.Encode(v)
+	return s
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// typedRecord is a record of a typed app in an intermediate file. Its key
+// and value are kept as JSON documents, e.g. {"Key":5,"Value":2}.
+type typedRecord struct {
+	Key   json.RawMessage
+	Value json.RawMessage
+}
+
+// record returns what the app writes for kv in an intermediate file.
+func (a App) record(kv KeyValue) any {
+	if !a.typed() {
+		return &kv
+	}
+	return &typedRecord{Key: rawField(a.KeyCodec, kv.Key), Value: rawField(a.ValueCodec, kv.Value)}
+}
+
+// decodeRecord reads the next record of an intermediate file written for
+// the app.
+func (a App) decodeRecord(dec *json.Decoder) (KeyValue, error) {
+	var kv KeyValue
+	if !a.typed() {
+		err := dec.Decode(&kv)
+		return kv, err
+	}
+	var r typedRecord
+	if err := dec.Decode(&r); err != nil {
+		return kv, err
+	}
+	var err error
+	if kv.Key, err = fieldString(a.KeyCodec, r.Key); err != nil {
+		return kv, err
+	}
+	kv.Value, err = fieldString(a.ValueCodec, r.Value)
+	return kv, err
+}
+
+// rawField returns a key or value as JSON: typed ones already are, and
+// others are written as JSON strings.
+func rawField(c Codec, s string) json.RawMessage {
+	if c != nil {
+		return json.RawMessage(s)
+	}
+	b, _ := json.Marshal(s) // Cannot fail for a string
+	return b
+}
+
+func fieldString(c Codec, raw json.RawMessage) (string, error) {
+	if c != nil {
+		return string(raw), nil
+	}
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, err
+}
+
+// CounterCodecErrors counts keys and values a typed app could not encode or
+// decode, which it drops.
+const CounterCodecErrors = "CODEC_ERRORS"
+
+// TypedApp is a MapReduce application with keys of type K and values of type
+// V. Its App method returns the App to register: intermediate files then
+// keep the JSON types of keys and values, and keys are sorted with the key
+// type's comparator, e.g. numerically for Int64.
+type TypedApp[K, V any] struct {
+	Key   Type[K]
+	Value Type[V]
+
+	// Map calls emit for every record of its input, and Reduce for every
+	// record it writes for a key, whose values it receives decoded.
+	Map    func(in *Input, emit func(K, V), ctr *Counters)
+	Reduce func(key K, values []V, emit func(K, V), ctr *Counters)
+
+	CheckParams func(params map[string]string) error
+}
+
+// App returns the app with the typed functions wrapped.
+func (t TypedApp[K, V]) App() App {
+	return App{
+		MapInput: func(in *Input, ctr *Counters) []KeyValue {
+			var kva []KeyValue
+			t.Map(in, func(k K, v V) {
+				key, errK := t.Key.Encode(k)
+				value, errV := t.Value.Encode(v)
+				if errK != nil || errV != nil {
+					ctr.Inc(CounterCodecErrors, 1)
+					return
+				}
+				kva = append(kva, KeyValue{Key: key, Value: value})
+			}, ctr)
+			return kva
+		},
+		ReduceGroup: func(g *Group, ctr *Counters) []KeyValue {
+			key, err := t.Key.Decode(g.Key)
+			if err != nil {
+				ctr.Inc(CounterCodecErrors, int64(len(g.Values)))
+				return nil
+			}
+			values := make([]V, 0, len(g.Values))
+			for _, s := range g.Values {
+				v, err := t.Value.Decode(s)
+				if err != nil {
+					ctr.Inc(CounterCodecErrors, 1)
+					continue
+				}
+				values = append(values, v)
+			}
+			var kva []KeyValue
+			t.Reduce(key, values, func(k K, v V) {
+				kva = append(kva, KeyValue{Key: t.Key.Format(k), Value: t.Value.Format(v)})
+			}, ctr)
+			return kva
+		},
+		CheckParams: t.CheckParams,
+		KeyCodec:    t.Key,
+		ValueCodec:  t.Value,
+	}
+}
+
+// wordLengths counts the words of each length. Its keys are int64s, so the
+// output lists lengths in numeric order.
+var wordLengths = TypedApp[int64, int64]{
+	Key:   Int64,
+	Value: Int64,
+	Map: func(in *Input, emit func(int64, int64), _ *Counters) {
+		for _, kv := range MapFunc(in.Filename, in.Contents) {
+			emit(int64(len(kv.Key)), 1)
+		}
+	},
+	Reduce: func(length int64, counts []int64, emit func(int64, int64), _ *Counters) {
+		var sum int64
+		for _, n := range counts {
+			sum += n
+		}
+		emit(length, sum)
+	},
+}
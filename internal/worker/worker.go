@@ -1,17 +1,33 @@
 package worker
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/rpc"
 	"os"
-	"sort"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/logging"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
+	"github.com/sagarneeli/dist-mapreduce/internal/storage"
+	"github.com/sagarneeli/dist-mapreduce/internal/trace"
 )
 
 // KeyValue is a type for map tasks
@@ -43,125 +59,749 @@ func ReduceFunc(key string, values []string) string {
 	return fmt.Sprintf("%d", len(values))
 }
 
+// maxTaskLogBytes caps the log captured for each task attempt and uploaded
+// to the coordinator.
+const maxTaskLogBytes = 256 << 10
+
+// Config configures a worker.
+type Config struct {
+	// CoordinatorAddr is the coordinator's RPC address. A bare host uses the
+	// default port 1234. For replicated coordinators it lists the replicas
+	// separated by commas; the worker follows whichever leads.
+	CoordinatorAddr string
+	ID              string        // ID to register with; empty lets the coordinator assign one
+	Dir             string        // Directory for intermediate and output files; defaults to the working directory
+	PollInterval    time.Duration // Wait between requests while no task is ready; defaults to 1s
+
+	// Slots is how many tasks the worker runs at once. All slots share one
+	// coordinator connection, heartbeat and data directory. Defaults to 1.
+	Slots int
+
+	// Hostname, MemoryBytes, Apps and Labels are advertised when the worker
+	// registers. They default to the OS hostname, the machine's total memory
+	// and every registered app. Jobs can require labels, e.g. zone=us-east-1a.
+	Hostname    string
+	MemoryBytes int64
+	Apps        []string
+	Labels      map[string]string
+
+	// HeartbeatInterval is how often the worker tells the coordinator it is
+	// alive and how many of its slots are busy. Defaults to 2s.
+	HeartbeatInterval time.Duration
+
+	// ReconnectTimeout is how long the worker keeps retrying an unreachable
+	// coordinator, e.g. one that is restarting, before giving up. Defaults
+	// to 30s.
+	ReconnectTimeout time.Duration
+
+	// TLS, if set, makes the worker talk to the coordinator over TLS, e.g.
+	// with mtls.ClientConfig to present the worker's certificate.
+	TLS *tls.Config
+
+	// Stop, once closed, shuts the worker down gracefully: it takes no new
+	// tasks and gives running ones up to GracePeriod to finish and be
+	// reported. It then deregisters, so the coordinator requeues whatever
+	// is still running at once, and Run returns. GracePeriod defaults to
+	// 30s.
+	Stop        <-chan struct{}
+	GracePeriod time.Duration
+}
+
+// Worker runs a worker against the coordinator at coordinatorHost until the
+// coordinator goes away.
 func Worker(coordinatorHost string) {
-	workerID := fmt.Sprintf("worker-%d", os.Getpid())
-	log.Printf("Worker %s started", workerID)
+	if err := Run(context.Background(), Config{CoordinatorAddr: coordinatorHost}); err != nil {
+		slog.Error("Worker stopped", "error", err)
+	}
+}
 
-	for {
-		args := common.TaskArgs{WorkerID: workerID}
+// Run asks the coordinator for tasks and executes them, cfg.Slots at a time,
+// until ctx ends, cfg.Stop is closed or the coordinator stays unreachable
+// for longer than cfg.ReconnectTimeout. A task still running when ctx ends
+// is never reported, as if the worker had died.
+func Run(ctx context.Context, cfg Config) error {
+	var addrs []string
+	for _, addr := range strings.Split(cfg.CoordinatorAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "1234")
+		}
+		addrs = append(addrs, addr)
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Slots <= 0 {
+		cfg.Slots = 1
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 2 * time.Second
+	}
+	if cfg.ReconnectTimeout <= 0 {
+		cfg.ReconnectTimeout = 30 * time.Second
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = 30 * time.Second
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.MemoryBytes <= 0 {
+		cfg.MemoryBytes = totalMemory()
+	}
+	if cfg.Apps == nil {
+		cfg.Apps = Apps()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &runner{cfg: cfg, id: cfg.ID, conn: &conn{addrs: addrs, tls: cfg.TLS}}
+	defer w.conn.close()
+	id, err := w.register(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if cfg.ID != "" && id != cfg.ID {
+		slog.Warn("Worker ID already in use, registered under another", "requested", cfg.ID, logging.KeyWorkerID, id)
+	}
+	w.id = id
+	logger := slog.Default().With(logging.KeyWorkerID, w.id)
+	w.logger = logger
+	logger.Info("Worker started", "coordinator", w.conn.addr(), "slots", cfg.Slots)
+
+	// Slots stop asking for tasks when poll ends, but report the tasks
+	// they are running until ctx ends.
+	poll, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	var (
+		slots    sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for slot := 0; slot < cfg.Slots; slot++ {
+		slots.Add(1)
+		go func() {
+			defer slots.Done()
+			if err := w.runSlot(ctx, poll, slot); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	slotsDone := make(chan struct{})
+	go func() {
+		slots.Wait()
+		close(slotsDone)
+	}()
+	hbCtx, stopHeartbeat := context.WithCancel(ctx)
+	hbDone := make(chan struct{})
+	go func() {
+		defer close(hbDone)
+		w.heartbeat(hbCtx)
+	}()
+
+	select {
+	case <-slotsDone:
+		stopHeartbeat()
+		<-hbDone
+		logger.Info("Worker stopped")
+		return firstErr
+	case <-cfg.Stop:
+	}
+
+	logger.Info("Stopping worker", "grace_period", cfg.GracePeriod, "busy_slots", w.busy.Load())
+	stopPolling()
+	grace := time.NewTimer(cfg.GracePeriod)
+	defer grace.Stop()
+	select {
+	case <-slotsDone:
+	case <-grace.C:
+		logger.Warn("Tasks still running after the grace period, handing them back", "busy_slots", w.busy.Load())
+	}
+	stopHeartbeat()
+	<-hbDone
+	if ctx.Err() == nil {
+		w.deregister(ctx)
+	}
+	// Tasks still running are abandoned: their slots drop the results
+	// once ctx ends.
+	cancel()
+	logger.Info("Worker stopped")
+	return nil
+}
+
+// runner holds the state shared by a worker's task slots.
+type runner struct {
+	cfg    Config
+	id     string
+	conn   *conn
+	logger *slog.Logger
+	busy   atomic.Int32 // Slots currently running a task
+}
+
+// runSlot is one task slot: it asks for a task, runs it and reports it, over
+// and over until poll ends. A task running when ctx ends is not reported.
+func (w *runner) runSlot(ctx, poll context.Context, slot int) error {
+	logger := w.logger.With("slot", slot)
+	lastContact := time.Now()
+	for poll.Err() == nil {
+		args := common.TaskArgs{WorkerID: w.id, Slots: w.cfg.Slots}
 		reply := common.TaskReply{}
 
-		if !call(coordinatorHost, "Coordinator.GetTask", &args, &reply) {
-			log.Println("Coordinator unreachable, exiting.")
-			return
+		if err := w.conn.call(poll, "Coordinator.GetTask", &args, &reply); err != nil {
+			if poll.Err() != nil {
+				break
+			}
+			if time.Since(lastContact) > w.cfg.ReconnectTimeout {
+				return fmt.Errorf("coordinator unreachable for %s: %w", w.cfg.ReconnectTimeout, err)
+			}
+			sleep(poll, w.cfg.PollInterval)
+			continue
 		}
+		lastContact = time.Now()
 
 		switch reply.TaskType {
-		case common.TaskTypeMap:
-			doMap(reply.JobID, reply.TaskID, reply.FileName, reply.NReduce, MapFunc)
-			report(coordinatorHost, reply.JobID, reply.TaskID, common.TaskTypeMap, workerID)
-		case common.TaskTypeReduce:
-			doReduce(reply.JobID, reply.TaskID, reply.NMap, ReduceFunc)
-			report(coordinatorHost, reply.JobID, reply.TaskID, common.TaskTypeReduce, workerID)
-		case -1: // Wait
-			time.Sleep(time.Second)
-		case -2: // Done
-			log.Println("No tasks available, waiting...")
-			time.Sleep(time.Second)
+		case common.TaskTypeMap, common.TaskTypeReduce:
+			w.busy.Add(1)
+			stats.busySlots.With().Inc()
+			report, err := RunTask(&reply, w.id, w.cfg.Dir)
+			stats.busySlots.With().Dec()
+			w.busy.Add(-1)
+			if ctx.Err() != nil {
+				break // Stopped mid-task: drop the result like a crashed worker would
+			}
+			if err != nil {
+				// Leave the task to time out so another worker can retry it.
+				logger.Warn("Task not completed", logging.KeyJobID, reply.JobID, logging.KeyTaskID, reply.TaskID, "error", err)
+				sleep(poll, w.cfg.PollInterval)
+				continue
+			}
+			w.conn.call(ctx, "Coordinator.ReportTask", report, &common.ReportTaskReply{})
+		default: // No task ready yet
+			sleep(poll, w.cfg.PollInterval)
+		}
+	}
+	return nil
+}
+
+// heartbeat reports the worker's slot usage to the coordinator until ctx
+// ends. Failures are only logged: the slots decide when the coordinator has
+// been unreachable for too long.
+func (w *runner) heartbeat(ctx context.Context) {
+	t := time.NewTicker(w.cfg.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		args := common.HeartbeatArgs{WorkerID: w.id, Slots: w.cfg.Slots, Busy: int(w.busy.Load())}
+		reply := common.HeartbeatReply{}
+		err := w.conn.call(ctx, "Coordinator.Heartbeat", &args, &reply)
+		if err == nil && len(reply.Cleanup) > 0 {
+			go w.deleteIntermediate(reply.Cleanup)
+		}
+		if err == nil && !reply.Registered {
+			// The coordinator restarted and lost our registration.
+			w.logger.Info("Registering again with the coordinator")
+			if id, err := w.register(ctx); err == nil && id != w.id {
+				w.logger.Warn("Coordinator gave this worker's ID to another worker", "assigned", id)
+			}
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deleteIntermediate removes the intermediate files of finished jobs from
+// the worker's directory once the coordinator says they are no longer
+// needed. Files that do not exist, e.g. because the directory is shared
+// and another process deleted them first, are skipped.
+func (w *runner) deleteIntermediate(jobs []common.IntermediateFiles) {
+	for _, job := range jobs {
+		deleted := 0
+	files:
+		for m := 0; m < job.NMap; m++ {
+			for r := 0; r < job.NReduce; r++ {
+				err := storage.Delete(storage.Join(w.cfg.Dir, common.IntermediateName(job.JobID, m, r)))
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					w.logger.Warn("Failed to delete intermediate files", logging.KeyJobID, job.JobID, "error", err)
+					break files
+				}
+				deleted++
+			}
+		}
+		w.logger.Debug("Deleted intermediate files", logging.KeyJobID, job.JobID, "files", deleted)
+	}
+}
+
+// sleep waits for d or until ctx ends.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// taskContext carries the per-attempt logger, counters and trace span into
+// doMap and doReduce.
+type taskContext struct {
+	logger *slog.Logger
+	ctr    *Counters
+	span   trace.SpanContext
+	dir    string // Directory for intermediate and output files; empty means the working directory
+}
+
+// path returns where the task reads or writes the named intermediate or
+// output file.
+func (tc *taskContext) path(name string) string {
+	return storage.Join(tc.dir, name)
+}
+
+// RunTask executes one assigned map or reduce task, keeping intermediate and
+// output files in dir, and returns the report to send to the coordinator.
+// An error means the task could not run and should not be reported. A reduce
+// that found bad intermediate files is reported with BadInputs set.
+func RunTask(task *common.TaskReply, workerID, dir string) (*common.ReportTaskArgs, error) {
+	taskLog := &logging.LimitedBuffer{Max: maxTaskLogBytes}
+	logger := taskLogger(task, workerID, taskLog)
+
+	app, ok := LookupApp(task.App)
+	if !ok {
+		return nil, fmt.Errorf("unknown app %q", task.App)
+	}
+
+	parent, err := trace.ParseTraceParent(task.TraceParent)
+	if err != nil {
+		logger.Warn("Ignoring malformed trace context", "error", err)
+	}
+	span := tracer.Start("execute", parent,
+		trace.Int(logging.KeyJobID, task.JobID),
+		trace.Int(logging.KeyTaskID, task.TaskID),
+		trace.String(logging.KeyTaskType, task.TaskType.String()),
+		trace.String(logging.KeyWorkerID, workerID),
+		trace.Int(logging.KeyAttempt, task.Attempt),
+	)
+
+	start := time.Now()
+	tc := &taskContext{logger: logger, ctr: NewCounters(), span: span.Context(), dir: dir}
+	report := &common.ReportTaskArgs{
+		JobID:    task.JobID,
+		TaskID:   task.TaskID,
+		TaskType: task.TaskType,
+		WorkerID: workerID,
+		Attempt:  task.Attempt,
+	}
+	if task.TaskType == common.TaskTypeMap {
+		in := &Input{Filename: task.FileName, Tag: task.Tag, Datasets: task.Datasets, Params: task.Params}
+		if in.Side, err = readSideInputs(task.SideInputs); err == nil {
+			report.Checksums, err = doMap(tc, task.JobID, task.TaskID, in, task.NReduce, app)
 		}
+	} else {
+		g := &Group{Datasets: task.Datasets, Params: task.Params}
+		report.Output, err = doReduce(tc, task.JobID, task.TaskID, task.NMap, task.Checksums, task.Output, g, app)
 	}
+	var badInput *BadInputError
+	if errors.As(err, &badInput) {
+		// Tell the coordinator which map outputs to regenerate.
+		report.BadInputs = badInput.MapTasks
+	} else if err != nil {
+		logger.Error("Task failed", "error", err)
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.End()
+	observeTask(task.TaskType, start)
+
+	report.Counters = tc.ctr.Snapshot()
+	report.Logs = taskLog.String()
+	report.TraceParent = span.Context().TraceParent()
+	return report, nil
+}
+
+// taskLogger returns a logger tagged with the task's correlation fields that
+// also copies every line, including debug output, into buf for upload.
+func taskLogger(task *common.TaskReply, workerID string, buf *logging.LimitedBuffer) *slog.Logger {
+	capture := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	h := logging.Tee(slog.Default().Handler(), capture)
+	return slog.New(h).With(logging.TaskAttrs(task.JobID, task.TaskID, task.TaskType, workerID, task.Attempt)...)
 }
 
-func doMap(jobID int, taskID int, filename string, nReduce int, mapF func(string, string) []KeyValue) {
-	log.Printf("Starting Map Task %d for Job %d file %s", taskID, jobID, filename)
-	content, err := os.ReadFile(filename)
+// doMap runs the app's map function over one input file and writes its
+// output as nReduce intermediate files, partitioned as the app says. It
+// returns the CRC-32 of each file so reducers can detect corruption.
+func doMap(tc *taskContext, jobID int, taskID int, in *Input, nReduce int, app App) ([]uint32, error) {
+	logger, ctr := tc.logger, tc.ctr
+	logger.Info("Starting map task", "file", in.Filename, "tag", in.Tag)
+	content, err := storage.ReadFile(in.Filename)
 	if err != nil {
-		log.Fatalf("cannot read %v", filename)
+		return nil, fmt.Errorf("cannot read input: %w", err)
 	}
-	kva := mapF(filename, string(content))
+	stats.bytesRead.With("map").Add(float64(len(content)))
+	ctr.Inc(CounterMapInputRecords, int64(countLines(content)))
+	in.Contents = string(content)
+	kva := app.RunMap(in, ctr)
+	ctr.Inc(CounterMapOutputRecords, int64(len(kva)))
 
 	// Partitioning
 	buckets := make([][]KeyValue, nReduce)
 	for _, kv := range kva {
-		bucket := ihash(kv.Key) % nReduce
+		bucket := app.partition(kv.Key, nReduce)
 		buckets[bucket] = append(buckets[bucket], kv)
 	}
 
+	checksums := make([]uint32, nReduce)
 	for i := 0; i < nReduce; i++ {
 		// Include JobID in filename to prevent collisions
-		oname := fmt.Sprintf("mr-%d-%d-%d", jobID, taskID, i)
-		file, _ := os.Create(oname)
-		enc := json.NewEncoder(file)
-		for _, kv := range buckets[i] {
-			if err := enc.Encode(&kv); err != nil {
-				log.Fatalf("cannot encode %v: %v", kv, err)
+		oname := tc.path(common.IntermediateName(jobID, taskID, i))
+		crc := crc32.NewIEEE()
+		cw := &countingWriter{w: crc}
+		err := writeFileAtomic(oname, func(w io.Writer) error {
+			cw.w = io.MultiWriter(w, crc)
+			enc := json.NewEncoder(cw)
+			for _, kv := range buckets[i] {
+				if err := enc.Encode(app.record(kv)); err != nil {
+					return fmt.Errorf("cannot encode intermediate record for key %q: %w", kv.Key, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot write intermediate file: %w", err)
+		}
+		checksums[i] = crc.Sum32()
+		stats.bytesWritten.With("map").Add(float64(cw.n))
+		ctr.Inc(CounterIntermediateBytes, cw.n)
+		ctr.Inc(CounterSpilledRecords, int64(len(buckets[i])))
+	}
+	logger.Info("Finished map task", "output_records", len(kva))
+	return checksums, nil
+}
+
+// maxSideInputBytes caps the side inputs of a map task, which are held in
+// memory in full.
+const maxSideInputBytes = 64 << 20
+
+// readSideInputs reads the side inputs a map task ships with.
+func readSideInputs(datasets []common.Dataset) ([]SideInput, error) {
+	var side []SideInput
+	var total int
+	for _, ds := range datasets {
+		in := SideInput{Tag: ds.Tag}
+		for _, f := range ds.Files {
+			b, err := storage.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read side input %q: %w", ds.Tag, err)
 			}
+			if total += len(b); total > maxSideInputBytes {
+				return nil, fmt.Errorf("side inputs exceed %d bytes", maxSideInputBytes)
+			}
+			stats.bytesRead.With("map").Add(float64(len(b)))
+			in.Contents = append(in.Contents, string(b))
 		}
-		file.Close()
+		side = append(side, in)
 	}
-	log.Printf("Finished Map Task %d Job %d", taskID, jobID)
+	return side, nil
+}
+
+// BadInputError reports intermediate files a reduce task could not use. The
+// map tasks that wrote them must run again before the reduce can succeed.
+type BadInputError struct {
+	MapTasks []int
+}
+
+func (e *BadInputError) Error() string {
+	return fmt.Sprintf("missing or corrupt intermediate files from map tasks %v", e.MapTasks)
 }
 
-func doReduce(jobID int, taskID int, nMap int, reduceF func(string, []string) string) {
-	log.Printf("Starting Reduce Task %d for Job %d", taskID, jobID)
+// doReduce reads this partition's intermediate file from every map task,
+// verifying it against checksums when they are known, and writes the reduce
+// output as spec describes. Keys are sorted and grouped as the app says, and
+// each group is passed to its reduce function as a copy of g with the key
+// and values filled in. Unusable files are reported as a *BadInputError
+// before any output is written. It returns the size, record count and
+// checksum of the output file.
+func doReduce(tc *taskContext, jobID int, taskID int, nMap int, checksums []uint32, spec *outputs.Spec, g *Group, app App) (*outputs.Partition, error) {
+	logger, ctr := tc.logger, tc.ctr
+	logger.Info("Starting reduce task", "n_map", nMap)
 	intermediate := make(map[string][]string)
+	var bad []int
 
 	for i := 0; i < nMap; i++ {
 		// Read from JobID namespaced files
-		iname := fmt.Sprintf("mr-%d-%d-%d", jobID, i, taskID)
-		file, err := os.Open(iname)
+		iname := common.IntermediateName(jobID, i, taskID)
+		span := tracer.Start("shuffle_read", tc.span, trace.String("file", iname), trace.Int("map_task", i))
+		records, n, err := readIntermediate(tc.path(iname), checksums, i, app, intermediate)
+		stats.bytesRead.With("reduce").Add(float64(n))
 		if err != nil {
-			log.Printf("Failed to open intermediate file %s: %v", iname, err)
+			logger.Warn("Unusable intermediate file", "file", iname, "error", err)
+			span.SetError(err.Error())
+			span.End()
+			bad = append(bad, i)
 			continue
 		}
-		dec := json.NewDecoder(file)
-		for {
-			var kv KeyValue
-			if err := dec.Decode(&kv); err != nil {
-				break
-			}
-			intermediate[kv.Key] = append(intermediate[kv.Key], kv.Value)
-		}
-		file.Close()
+		ctr.Inc(CounterReduceInputRecords, int64(records))
+		span.SetAttributes(trace.Int64("bytes", n), trace.Int("records", records))
+		span.End()
+	}
+	if len(bad) > 0 {
+		return nil, &BadInputError{MapTasks: bad}
 	}
 
 	keys := []string{}
 	for k := range intermediate {
 		keys = append(keys, k)
 	}
-	sort.Strings(keys)
+	app.sortKeys(keys)
+
+	name := spec.FileName(jobID, taskID)
+	crc := crc32.NewIEEE()
+	cw := &countingWriter{}
+	records := 0
+	err := writeFileAtomic(spec.Path(tc.dir, jobID, taskID), func(w io.Writer) error {
+		cw.w = io.MultiWriter(w, crc)
+		out := outputs.NewWriter(cw, spec)
+		err := app.groups(keys, func(start, end int) error {
+			group := *g
+			group.Key, group.Values = keys[start], intermediate[keys[start]]
+			if app.GroupKeys != nil {
+				group.Values = nil
+				for _, k := range keys[start:end] {
+					for _, v := range intermediate[k] {
+						group.Keys = append(group.Keys, k)
+						group.Values = append(group.Values, v)
+					}
+				}
+			}
+			for _, kv := range app.RunReduce(&group, ctr) {
+				if err := out.Write(kv.Key, kv.Value); err != nil {
+					return err
+				}
+				records++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return out.Flush()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot write output file: %w", err)
+	}
+	ctr.Inc(CounterReduceOutputRecords, int64(records))
+	stats.bytesWritten.With("reduce").Add(float64(cw.n))
+	logger.Info("Finished reduce task", "output_records", records, "file", name)
+	return &outputs.Partition{
+		Partition: taskID,
+		File:      name,
+		Records:   int64(records),
+		Bytes:     cw.n,
+		CRC32:     crc.Sum32(),
+	}, nil
+}
+
+// readIntermediate decodes one intermediate file written for app into
+// groups. The file is checked against checksums[mapTask] when checksums is
+// non-nil. It returns the number of records and bytes read.
+func readIntermediate(path string, checksums []uint32, mapTask int, app App, groups map[string][]string) (int, int64, error) {
+	b, err := storage.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if checksums != nil && crc32.ChecksumIEEE(b) != checksums[mapTask] {
+		return 0, int64(len(b)), fmt.Errorf("checksum mismatch")
+	}
+	var kvs []KeyValue
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		kv, err := app.decodeRecord(dec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, int64(len(b)), err
+		}
+		kvs = append(kvs, kv)
+	}
+	for _, kv := range kvs {
+		groups[kv.Key] = append(groups[kv.Key], kv.Value)
+	}
+	return len(kvs), int64(len(b)), nil
+}
+
+// writeFileAtomic writes path through a buffer into storage, so readers
+// never see a partial file, even if the worker dies mid-write or a retried
+// attempt writes the same file concurrently.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	return storage.WriteFile(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := write(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
 
-	oname := fmt.Sprintf("mr-out-%d-%d", jobID, taskID)
-	ofile, _ := os.Create(oname)
+func observeTask(taskType common.TaskType, start time.Time) {
+	stats.tasks.With(taskType.String()).Inc()
+	stats.taskDuration.With(taskType.String()).Observe(time.Since(start).Seconds())
+}
 
-	for _, k := range keys {
-		output := reduceF(k, intermediate[k])
-		fmt.Fprintf(ofile, "%v %v\n", k, output)
+// countLines counts input records the way a line-oriented reader would: a
+// trailing line without a newline still counts.
+func countLines(content []byte) int {
+	n := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		n++
 	}
-	ofile.Close()
-	log.Printf("Finished Reduce Task %d Job %d", taskID, jobID)
+	return n
 }
 
-func report(coordinatorHost string, jobID int, taskID int, taskType common.TaskType, workerID string) {
-	args := common.ReportTaskArgs{JobID: jobID, TaskID: taskID, TaskType: taskType, WorkerID: workerID}
-	reply := common.ReportTaskReply{}
-	call(coordinatorHost, "Coordinator.ReportTask", &args, &reply)
+// conn is a connection to the coordinator shared by all of a worker's slots
+// and its heartbeat. It dials lazily and redials after a connection error,
+// trying the next of several replicas. A standby replica's answer moves it
+// to the leader.
+type conn struct {
+	addrs []string
+	tls   *tls.Config // Dial over TLS if set
+
+	mu     sync.Mutex
+	cur    int // Index in addrs of the address dialed
+	client *rpc.Client
 }
 
-func call(host, rpcname string, args interface{}, reply interface{}) bool {
-	c, err := rpc.DialHTTP("tcp", host+":1234")
+// call makes one RPC to the coordinator, giving up when ctx ends. A call
+// answered by a standby replica that knows the leader is retried there.
+func (c *conn) call(ctx context.Context, rpcname string, args interface{}, reply interface{}) error {
+	stats.rpcRequests.With(rpcname).Inc()
+	err := c.callOnce(ctx, rpcname, args, reply)
+	if leader, ok := common.ParseNotLeader(err); ok && leader != "" {
+		c.follow(leader)
+		err = c.callOnce(ctx, rpcname, args, reply)
+	}
 	if err != nil {
-		log.Fatal("dialing:", err)
+		stats.rpcErrors.With(rpcname).Inc()
+		slog.Warn("RPC failed", "method", rpcname, "error", err)
 	}
-	defer c.Close()
+	return err
+}
 
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+func (c *conn) callOnce(ctx context.Context, rpcname string, args interface{}, reply interface{}) error {
+	client, err := c.get()
+	if err != nil {
+		return err
 	}
+	select {
+	case res := <-client.Go(rpcname, args, reply, make(chan *rpc.Call, 1)).Done:
+		var serverErr rpc.ServerError
+		if res.Error != nil && !errors.As(res.Error, &serverErr) {
+			c.drop(client)
+		}
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	fmt.Println(err)
-	return false
+// addr returns the address dialed.
+func (c *conn) addr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addrs[c.cur]
+}
+
+// get returns the shared client, dialing the coordinator if needed. A
+// failed dial moves on to the next address.
+func (c *conn) get() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		client, err := dialRPC(c.addrs[c.cur], c.tls)
+		if err != nil {
+			c.cur = (c.cur + 1) % len(c.addrs)
+			return nil, err
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+// follow switches to the leader at addr, which joins the addresses tried
+// if it was not among them.
+func (c *conn) follow(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.Index(c.addrs, addr)
+	if i < 0 {
+		c.addrs = append(c.addrs, addr)
+		i = len(c.addrs) - 1
+	}
+	if i == c.cur && c.client != nil {
+		return
+	}
+	slog.Info("Following the coordinator leader", "addr", addr)
+	c.cur = i
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// dialRPC connects to the RPC server at addr like rpc.DialHTTP, over TLS
+// if cfg is not nil.
+func dialRPC(addr string, cfg *tls.Config) (*rpc.Client, error) {
+	if cfg == nil {
+		return rpc.DialHTTP("tcp", addr)
+	}
+	nc, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.WriteString(nc, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(nc), &http.Request{Method: http.MethodConnect})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+	}
+	return rpc.NewClient(nc), nil
+}
+
+// drop closes client after a connection error so the next call redials,
+// trying the next address.
+func (c *conn) drop(client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == client {
+		c.client.Close()
+		c.client = nil
+		c.cur = (c.cur + 1) % len(c.addrs)
+	}
+}
+
+func (c *conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
 }
 
 func ihash(key string) int {
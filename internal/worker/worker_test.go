@@ -1,7 +1,19 @@
 package worker
 
 import (
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/outputs"
 )
 
 func TestMapFunc(t *testing.T) {
@@ -68,3 +80,410 @@ func TestIHash(t *testing.T) {
 		t.Log("Hash collision observed (unlikely but possible)")
 	}
 }
+
+func TestMQMapFunc_Counters(t *testing.T) {
+	app, ok := LookupApp("wordcount-mq")
+	if !ok {
+		t.Fatal("wordcount-mq app not registered")
+	}
+	ctr := NewCounters()
+	result := app.Map("test.txt", "Moon apple noon zebra Quiet", ctr)
+
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 m-q words, got %v", result)
+	}
+	if got := ctr.Get("WORDS_MATCHING_M_TO_Q"); got != 3 {
+		t.Errorf("Expected 3 matching words, got %d", got)
+	}
+	if got := ctr.Get("RECORDS_SKIPPED"); got != 2 {
+		t.Errorf("Expected 2 skipped words, got %d", got)
+	}
+}
+
+func TestDoMapReduce_BuiltinCounters(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("input.txt", []byte("hello world\nhello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := LookupApp("")
+
+	mapCtr := NewCounters()
+	checksums, err := doMap(&taskContext{logger: slog.Default(), ctr: mapCtr}, 0, 0, &Input{Filename: "input.txt"}, 2, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mapCtr.Get(CounterMapInputRecords); got != 2 {
+		t.Errorf("Expected 2 input records, got %d", got)
+	}
+	if got := mapCtr.Get(CounterMapOutputRecords); got != 3 {
+		t.Errorf("Expected 3 map output records, got %d", got)
+	}
+	if got := mapCtr.Get(CounterSpilledRecords); got != 3 {
+		t.Errorf("Expected 3 spilled records, got %d", got)
+	}
+	if mapCtr.Get(CounterIntermediateBytes) == 0 {
+		t.Error("Expected intermediate bytes to be counted")
+	}
+
+	reduceIn, reduceOut := int64(0), int64(0)
+	for r := 0; r < 2; r++ {
+		ctr := NewCounters()
+		if _, err := doReduce(&taskContext{logger: slog.Default(), ctr: ctr}, 0, r, 1, []uint32{checksums[r]}, nil, &Group{}, app); err != nil {
+			t.Fatal(err)
+		}
+		reduceIn += ctr.Get(CounterReduceInputRecords)
+		reduceOut += ctr.Get(CounterReduceOutputRecords)
+	}
+	if reduceIn != 3 || reduceOut != 2 {
+		t.Errorf("Expected 3 reduce input and 2 output records, got %d and %d", reduceIn, reduceOut)
+	}
+}
+
+func TestDoReduce_BadInputs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("input.txt", []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := LookupApp("")
+	tc := &taskContext{logger: slog.Default(), ctr: NewCounters()}
+	checksums, err := doMap(tc, 0, 0, &Input{Filename: "input.txt"}, 1, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(common.IntermediateName(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if err := os.WriteFile(common.IntermediateName(0, 0, 0), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map 0's file is corrupt and map 1's is missing.
+	_, err = doReduce(tc, 0, 0, 2, []uint32{checksums[0], 0}, nil, &Group{}, app)
+	var bad *BadInputError
+	if !errors.As(err, &bad) || len(bad.MapTasks) != 2 || bad.MapTasks[0] != 0 || bad.MapTasks[1] != 1 {
+		t.Fatalf("Expected bad inputs from maps 0 and 1, got %v", err)
+	}
+	if _, err := os.Stat(common.OutputName(0, 0)); !os.IsNotExist(err) {
+		t.Error("Expected no output when inputs are bad")
+	}
+}
+
+func TestDoReduce_OutputSpec(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("input.txt", []byte("hello world, hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := LookupApp("")
+	tc := &taskContext{logger: slog.Default(), ctr: NewCounters()}
+	checksums, err := doMap(tc, 3, 0, &Input{Filename: "input.txt"}, 1, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &outputs.Spec{Dir: "out/run", Prefix: "part", Format: outputs.FormatCSV}
+	part, err := doReduce(tc, 3, 0, 1, checksums, spec, &Group{}, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join("out", "run", "part-0.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello,2\nworld,1\n" {
+		t.Errorf("Unexpected CSV output %q", b)
+	}
+	want := outputs.Partition{Partition: 0, File: "part-0.csv", Records: 2, Bytes: int64(len(b)), CRC32: crc32.ChecksumIEEE(b)}
+	if part == nil || *part != want {
+		t.Errorf("Expected %+v, got %+v", want, part)
+	}
+}
+
+// runJoin runs app over the testdata fixtures with one reduce partition and
+// returns the output lines and counters.
+func runJoin(t *testing.T, app string, inputs []*Input, side []common.Dataset, datasets []string, params map[string]string) ([]string, *Counters) {
+	t.Helper()
+	a, ok := LookupApp(app)
+	if !ok {
+		t.Fatalf("Unknown app %q", app)
+	}
+	if err := a.CheckParams(params); err != nil {
+		t.Fatal(err)
+	}
+	sideInputs, err := readSideInputs(side)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &taskContext{logger: slog.Default(), ctr: NewCounters(), dir: t.TempDir()}
+	var checksums []uint32
+	for i, in := range inputs {
+		in.Datasets, in.Side, in.Params = datasets, sideInputs, params
+		sums, err := doMap(tc, 0, i, in, 1, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksums = append(checksums, sums[0])
+	}
+	g := &Group{Datasets: datasets, Params: params}
+	if _, err := doReduce(tc, 0, 0, len(inputs), checksums, nil, g, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(tc.dir, common.OutputName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"), tc.ctr
+}
+
+func TestJoin_ReduceSide(t *testing.T) {
+	inputs := func() []*Input {
+		return []*Input{
+			{Filename: filepath.Join("testdata", "events.csv"), Tag: "events"},
+			{Filename: filepath.Join("testdata", "users.csv"), Tag: "users"},
+		}
+	}
+	params := map[string]string{ParamHeader: "true", "key.events": "1"}
+
+	// Users come first in every joined row, although their file was mapped
+	// last: values are ordered by dataset before they are joined.
+	got, ctr := runJoin(t, "join", inputs(), nil, []string{"users", "events"}, params)
+	want := []string{"u1 alice,US,e1,click", "u1 alice,US,e3,purchase", "u2 bob,DE,e2,view"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected inner join\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if n := ctr.Get(CounterJoinUnmatchedKeys); n != 2 {
+		t.Errorf("Expected u3 and u4 to be unmatched, got %d", n)
+	}
+	if n := ctr.Get(CounterJoinMalformed); n != 1 {
+		t.Errorf("Expected the short row e5 to be malformed, got %d", n)
+	}
+
+	params[ParamJoin] = JoinLeft
+	got, _ = runJoin(t, "join", inputs(), nil, []string{"users", "events"}, params)
+	want = []string{"u1 alice,US,e1,click", "u1 alice,US,e3,purchase", "u2 bob,DE,e2,view", `u3 "carol, jr",FR`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected left join\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestJoin_Broadcast(t *testing.T) {
+	side := []common.Dataset{{Tag: "users", Files: []string{filepath.Join("testdata", "users.csv")}}}
+	params := map[string]string{ParamHeader: "true", ParamKey: "1", "key.users": "0"}
+	inputs := func() []*Input {
+		return []*Input{{Filename: filepath.Join("testdata", "events.csv")}}
+	}
+
+	got, ctr := runJoin(t, "broadcast-join", inputs(), side, nil, params)
+	want := []string{"u1 e1,click,alice,US", "u1 e3,purchase,alice,US", "u2 e2,view,bob,DE"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected inner join\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if n := ctr.Get(CounterJoinUnmatchedRecords); n != 1 {
+		t.Errorf("Expected e4 to be unmatched, got %d", n)
+	}
+	if n := ctr.Get(CounterJoinSideInputRecords); n != 3 {
+		t.Errorf("Expected 3 side input rows, got %d", n)
+	}
+
+	params[ParamJoin] = JoinLeft
+	got, _ = runJoin(t, "broadcast-join", inputs(), side, nil, params)
+	want = []string{"u1 e1,click,alice,US", "u1 e3,purchase,alice,US", "u2 e2,view,bob,DE", "u4 e4,click"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected left join\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if _, err := readSideInputs([]common.Dataset{{Tag: "users", Files: []string{"testdata/missing.csv"}}}); err == nil {
+		t.Error("Expected an error for a missing side input")
+	}
+}
+
+func TestJoin_Params(t *testing.T) {
+	app, _ := LookupApp("join")
+	for _, params := range []map[string]string{
+		{ParamJoin: "outer"},
+		{ParamKey: "-1"},
+		{"key.users": "x"},
+		{ParamSeparator: ",,"},
+		{ParamHeader: "maybe"},
+		{"colour": "blue"},
+	} {
+		if err := app.CheckParams(params); err == nil {
+			t.Errorf("Expected %v to be rejected", params)
+		}
+	}
+	if err := app.CheckParams(map[string]string{ParamSeparator: "\t", ParamJoin: JoinLeft}); err != nil {
+		t.Errorf("Expected a tab separator to be accepted, got %v", err)
+	}
+
+	if _, err := SplitByDataset([]string{Tagged(0, "a"), "b"}, 1); err == nil {
+		t.Error("Expected an error for an untagged value")
+	}
+	split, err := SplitByDataset([]string{Tagged(1, "x:y"), Tagged(0, "a"), Tagged(1, "z")}, 2)
+	if err != nil || strings.Join(split[0], "|") != "a" || strings.Join(split[1], "|") != "x:y|z" {
+		t.Errorf("Unexpected split %q (%v)", split, err)
+	}
+}
+
+func TestSecondarySort_TopN(t *testing.T) {
+	app, _ := LookupApp("top-n")
+	params := map[string]string{ParamHeader: "true", ParamGroup: "1", ParamScore: "2", ParamN: "2"}
+	if err := app.CheckParams(params); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two map tasks and two reduce partitions: every game must still be
+	// reduced in one group, with its rows highest score first.
+	tc := &taskContext{logger: slog.Default(), ctr: NewCounters(), dir: t.TempDir()}
+	var checksums [][]uint32
+	for i, f := range []string{"scores-1.csv", "scores-2.csv"} {
+		sums, err := doMap(tc, 0, i, &Input{Filename: filepath.Join("testdata", f), Params: params}, 2, app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksums = append(checksums, sums)
+	}
+	var lines []string
+	for r := 0; r < 2; r++ {
+		var groups []*Group
+		probe := app
+		probe.ReduceGroup = func(g *Group, ctr *Counters) []KeyValue {
+			groups = append(groups, g)
+			return app.ReduceGroup(g, ctr)
+		}
+		if _, err := doReduce(tc, 0, r, 2, []uint32{checksums[0][r], checksums[1][r]}, nil, &Group{Params: params}, probe); err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range groups {
+			if len(g.Keys) != len(g.Values) {
+				t.Errorf("Expected a key for every value, got %q for %q", g.Keys, g.Values)
+			}
+		}
+		b, err := os.ReadFile(filepath.Join(tc.dir, common.OutputName(0, r)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 0 {
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+		}
+	}
+	sort.Strings(lines)
+	// bob and gina tie, and keep the order of their map tasks.
+	want := "chess bob,1350\nchess gina,1350\ngo erin,7.5\ngo hal,6"
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+	if n := tc.ctr.Get(CounterTopNMalformed); n != 1 {
+		t.Errorf("Expected frank's score to be malformed, got %d", n)
+	}
+
+	for _, bad := range []map[string]string{{ParamN: "0"}, {ParamScore: "0"}, {ParamGroup: "x"}, {"order": "asc"}} {
+		if err := app.CheckParams(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestSecondarySort_Comparators(t *testing.T) {
+	app := App{}.WithSecondarySort(func(a, b string) int {
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x - y
+	})
+	keys := []string{CompositeKey("b", "10"), CompositeKey("a", "9"), CompositeKey("b", "9"), CompositeKey("a", "10"), "c"}
+	app.sortKeys(keys)
+	var groups []string
+	_ = app.groups(keys, func(start, end int) error {
+		var parts []string
+		for _, k := range keys[start:end] {
+			natural, secondary := SplitCompositeKey(k)
+			parts = append(parts, natural+"/"+secondary)
+		}
+		groups = append(groups, strings.Join(parts, " "))
+		return nil
+	})
+	want := "a/9 a/10 | b/9 b/10 | c/"
+	if got := strings.Join(groups, " | "); got != want {
+		t.Errorf("Expected groups %q, got %q", want, got)
+	}
+	if app.partition(CompositeKey("a", "9"), 7) != app.partition(CompositeKey("a", "10"), 7) {
+		t.Error("Expected keys with the same natural key to share a partition")
+	}
+}
+
+func TestTypedApp_WordLengths(t *testing.T) {
+	app, _ := LookupApp("word-lengths")
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(input, []byte("a bb cc extraordinary ddd eeeee ffffffffff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tc := &taskContext{logger: slog.Default(), ctr: NewCounters(), dir: dir}
+	checksums, err := doMap(tc, 0, 0, &Input{Filename: input}, 1, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Intermediate records keep keys and values as JSON numbers.
+	b, err := os.ReadFile(filepath.Join(dir, common.IntermediateName(0, 0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `{"Key":13,"Value":1}`) {
+		t.Errorf("Expected typed intermediate records, got %s", b)
+	}
+
+	if _, err := doReduce(tc, 0, 0, 1, checksums, nil, &Group{}, app); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, common.OutputName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lengths sort numerically: 10 and 13 come after 5.
+	want := "1 1\n2 2\n3 1\n5 1\n10 1\n13 1\n"
+	if string(b) != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, b)
+	}
+}
+
+func TestTypes(t *testing.T) {
+	if Int64.Compare("9", "10") >= 0 || Float64.Compare("-1.5", "0.25") >= 0 || Bytes.Compare(`"YQ=="`, `"Yg=="`) >= 0 {
+		t.Error("Expected encoded values to compare by their decoded values")
+	}
+	if Int64.Compare("x", "1") <= 0 {
+		t.Error("Expected values that do not decode to sort last")
+	}
+
+	type point struct {
+		X, Y int
+	}
+	pt := JSON[point]()
+	enc, err := pt.Encode(point{1, 2})
+	if err != nil || enc != `{"X":1,"Y":2}` {
+		t.Fatalf("Unexpected encoding %q (%v)", enc, err)
+	}
+	if p, err := pt.Decode(enc); err != nil || p != (point{1, 2}) {
+		t.Errorf("Unexpected decoding %+v (%v)", p, err)
+	}
+	if enc, err := Bytes.Encode([]byte("hi")); err != nil || Bytes.Format([]byte("hi")) != "hi" || enc != `"aGk="` {
+		t.Errorf("Unexpected bytes encoding %q (%v)", enc, err)
+	}
+
+	// Values that cannot be encoded are counted and dropped.
+	app := TypedApp[string, float64]{
+		Key:   String,
+		Value: Float64,
+		Map: func(_ *Input, emit func(string, float64), _ *Counters) {
+			emit("ok", 1)
+			emit("nan", math.NaN())
+		},
+	}.App()
+	ctr := NewCounters()
+	if kva := app.RunMap(&Input{}, ctr); len(kva) != 1 || kva[0] != (KeyValue{Key: `"ok"`, Value: "1"}) {
+		t.Errorf("Unexpected map output %q", kva)
+	}
+	if n := ctr.Get(CounterCodecErrors); n != 1 {
+		t.Errorf("Expected 1 codec error, got %d", n)
+	}
+}
@@ -0,0 +1,644 @@
+// Package client is the Go SDK for the coordinator's REST API. It lets other
+// services submit jobs, follow them to completion and read their output
+// without re-declaring the API's JSON types.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states reported in Job.Status.
+const (
+	StatusQueued     = "QUEUED" // Waiting for running jobs to finish, see Job.QueuePosition
+	StatusInProgress = "IN_PROGRESS"
+	StatusCompleted  = "COMPLETED"
+	StatusFailed     = "FAILED"
+	StatusCancelled  = "CANCELLED"
+)
+
+// SubmitRequest describes a job to submit.
+type SubmitRequest struct {
+	// Files are input files, directories or glob patterns. They are
+	// resolved on the coordinator, which rejects inputs that do not exist.
+	Files   []string `json:"files"`
+	NReduce int      `json:"nReduce"`
+	App     string   `json:"app,omitempty"` // Empty selects the default app
+
+	// Labels restricts the job to workers registered with all of them.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Manifests are files on the coordinator listing further inputs, one
+	// per line. Recursive makes directories in Files contribute every file
+	// below them, and Include and Exclude filter the files found in
+	// directories and globs by base name, e.g. "*.txt".
+	Manifests []string `json:"manifests,omitempty"`
+	Recursive bool     `json:"recursive,omitempty"`
+	Include   []string `json:"include,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+
+	// PreferredHosts maps input files to the hosts that hold their data, so
+	// their map tasks run there when possible.
+	PreferredHosts map[string][]string `json:"preferred_hosts,omitempty"`
+
+	// Output sets where and how the job's reduce output is written; nil
+	// keeps the default mr-out-<job>-<partition> text files.
+	Output *OutputSpec `json:"output,omitempty"`
+
+	// Datasets are tagged inputs, resolved like Files, whose map tasks are
+	// told which dataset they read, e.g. for the "join" app. SideInputs are
+	// small tables every map task reads in full, e.g. for the
+	// "broadcast-join" app. Params configure the app.
+	Datasets   []Dataset         `json:"datasets,omitempty"`
+	SideInputs []Dataset         `json:"side_inputs,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+
+	// Queue and User select the coordinator's limits on running jobs that
+	// apply. Jobs over them wait as StatusQueued.
+	Queue string `json:"queue,omitempty"`
+	User  string `json:"user,omitempty"`
+}
+
+// Dataset is a set of input files under a tag.
+type Dataset struct {
+	Tag   string   `json:"tag"`
+	Files []string `json:"files"`
+}
+
+// Output formats accepted in OutputSpec.Format.
+const (
+	FormatText     = "text"
+	FormatTSV      = "tsv"
+	FormatCSV      = "csv"
+	FormatJSONL    = "jsonl"
+	FormatSequence = "sequence"
+)
+
+// OutputSpec describes a job's output files.
+type OutputSpec struct {
+	// Dir is the output directory, relative to the cluster's data
+	// directory unless absolute. Prefix names the files
+	// <prefix>-<partition> (default mr-out-<job>), with an extension for
+	// formats other than text.
+	Dir    string `json:"dir,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+
+	Format    string `json:"format,omitempty"`    // One of the Format* constants; default text
+	Separator string `json:"separator,omitempty"` // Between key and value in text output; default a space
+
+	// SuccessMarker writes an empty _SUCCESS file and Manifest a
+	// _MANIFEST.json with each partition's record count and CRC-32 once
+	// all reducers commit.
+	SuccessMarker bool `json:"success_marker,omitempty"`
+	Manifest      bool `json:"manifest,omitempty"`
+}
+
+// Job is a job's status as reported by the coordinator.
+type Job struct {
+	ID          int               `json:"id"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"` // Why the job failed, if it did
+	App         string            `json:"app"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	MapTasks    int               `json:"files_count"`
+	ReduceTasks int               `json:"reduce_tasks_total"`
+	MapDone     int               `json:"map_tasks_completed"`
+	ReduceDone  int               `json:"reduce_tasks_completed"`
+	Counters    map[string]int64  `json:"counters"`
+	Labels      map[string]string `json:"labels,omitempty"` // Labels a worker needs to run the job
+	Locality    Locality          `json:"locality"`
+	Output      *OutputSpec       `json:"output,omitempty"`
+	Datasets    []string          `json:"datasets,omitempty"` // Tags of the job's tagged inputs
+	Params      map[string]string `json:"params,omitempty"`
+	Queue       string            `json:"queue,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"` // Who submitted the job, if the API authenticates
+	Version     int64             `json:"version"`          // Changes whenever the job does
+
+	// QueuePosition is the job's place in its queue while it is
+	// StatusQueued, counting from 1, and AdmittedAt when it started.
+	QueuePosition int        `json:"queue_position,omitempty"`
+	AdmittedAt    *time.Time `json:"admitted_at,omitempty"`
+
+	// IntermediateDeleted reports that the job's intermediate files have
+	// been cleaned up.
+	IntermediateDeleted bool `json:"intermediate_deleted,omitempty"`
+}
+
+// Locality counts a job's map task assignments by where they ran relative to
+// their input.
+type Locality struct {
+	Local        int     `json:"local"`         // On a preferred host
+	Remote       int     `json:"remote"`        // Elsewhere, despite preferred hosts
+	NoPreference int     `json:"no_preference"` // Without preferred hosts
+	HitRate      float64 `json:"hit_rate"`      // Local / (Local + Remote)
+}
+
+// Done reports whether the job has stopped running.
+func (j *Job) Done() bool { return j.Status != StatusInProgress && j.Status != StatusQueued }
+
+// Succeeded reports whether the job completed successfully.
+func (j *Job) Succeeded() bool { return j.Status == StatusCompleted }
+
+// Worker describes a worker known to the coordinator.
+type Worker struct {
+	ID           string            `json:"id"`
+	Hostname     string            `json:"hostname,omitempty"`
+	LastSeen     time.Time         `json:"last_seen"`
+	RegisteredAt *time.Time        `json:"registered_at,omitempty"` // Nil for workers that never registered
+	Live         bool              `json:"live"`
+	Slots        int               `json:"slots"`
+	RunningTasks int               `json:"running_tasks"`
+	MemoryBytes  int64             `json:"memory_bytes,omitempty"`
+	Apps         []string          `json:"apps,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// InputFile is one resolved input file of a job.
+type InputFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Tag     string    `json:"tag,omitempty"` // Dataset the file belongs to, if any
+}
+
+// Inputs is the resolved input set of a job.
+type Inputs struct {
+	JobID      int         `json:"job_id"`
+	Files      []InputFile `json:"files"`
+	SideInputs []Dataset   `json:"side_inputs,omitempty"`
+}
+
+// Partition is one reduce output file of a completed job.
+type Partition struct {
+	Partition int     `json:"partition"`
+	File      string  `json:"file"`
+	Size      int64   `json:"size"`
+	Records   *int64  `json:"records,omitempty"` // Nil if the reducer did not report it
+	CRC32     *uint32 `json:"crc32,omitempty"`
+}
+
+// Partitions lists a completed job's output files.
+type Partitions struct {
+	JobID      int         `json:"id"`
+	Partitions []Partition `json:"partitions"`
+	TotalSize  int64       `json:"total_size"`
+}
+
+// APIError is returned when the API answers with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Message    string
+
+	// Leader is the API address of the leading coordinator replica when a
+	// standby answered, if one is elected.
+	Leader string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api: %s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err is an APIError for a missing resource.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Defaults for the retry policy and long polling.
+const (
+	DefaultMaxRetries   = 3
+	DefaultRetryBackoff = 200 * time.Millisecond
+	DefaultPollWait     = 30 * time.Second
+)
+
+// unchangedPollPause is how long Wait, Watch and WaitWorkflow pause after a
+// long poll that came back without a change. A draining server ends long
+// polls at once, and the pause keeps clients from hammering it until it
+// shuts down.
+const unchangedPollPause = 250 * time.Millisecond
+
+// Client talks to one coordinator's REST API. Its fields may be changed
+// before the first request.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+
+	// Replicas are the base URLs of further coordinator replicas. Requests
+	// go to the leader: a standby's answer names it, and an unreachable
+	// replica makes the client try the next one.
+	Replicas []string
+
+	// MaxRetries is how many times a request is retried after a transient
+	// failure, waiting RetryBackoff and doubling it after each attempt.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// PollWait is how long each long-poll request in Wait and Watch may be
+	// held by the server.
+	PollWait time.Duration
+
+	// Token is sent as a bearer token to a coordinator that authenticates
+	// its callers: an API key or a JWT. Alternatively Tenant and Secret
+	// sign every request, see SignRequest.
+	Token  string
+	Tenant string
+	Secret string
+
+	mu       sync.Mutex
+	endpoint string // Base URL requests go to; empty until the first request
+}
+
+// New returns a client for the API at baseURL, e.g. "http://localhost:8080".
+// A bare host:port is accepted as well. The base URLs of several
+// coordinator replicas are separated by commas; the first becomes BaseURL
+// and the others Replicas.
+func New(baseURL string) *Client {
+	urls := strings.Split(baseURL, ",")
+	for i, u := range urls {
+		urls[i] = normalizeURL(u)
+	}
+	return &Client{
+		BaseURL:      urls[0],
+		Replicas:     urls[1:],
+		HTTP:         http.DefaultClient,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+		PollWait:     DefaultPollWait,
+	}
+}
+
+// normalizeURL adds the scheme to a bare host:port and drops trailing
+// slashes.
+func normalizeURL(u string) string {
+	u = strings.TrimSpace(u)
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	return strings.TrimRight(u, "/")
+}
+
+// Submit submits a job and returns its ID.
+func (c *Client) Submit(ctx context.Context, req SubmitRequest) (int, error) {
+	var resp struct {
+		JobID int `json:"id"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, "/jobs", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.JobID, nil
+}
+
+// Get returns the current status of a job.
+func (c *Client) Get(ctx context.Context, id int) (*Job, error) {
+	var job Job
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/jobs/%d", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List returns the status of every job.
+func (c *Client) List(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	if err := c.doJSON(ctx, http.MethodGet, "/jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Wait blocks until the job stops running or ctx ends, and returns its final
+// status. A job that failed or was cancelled is not an error; check
+// Job.Succeeded.
+func (c *Client) Wait(ctx context.Context, id int) (*Job, error) {
+	return c.Watch(ctx, id, nil)
+}
+
+// Watch is like Wait but calls fn, if non-nil, with the job's status first
+// and then after every change. Changes are picked up by long polling, so fn
+// is called promptly without busy polling the server.
+func (c *Client) Watch(ctx context.Context, id int, fn func(*Job)) (*Job, error) {
+	job, err := c.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if fn != nil {
+		fn(job)
+	}
+	for !job.Done() {
+		next, err := c.poll(ctx, id, job.Version)
+		if err != nil {
+			return job, err
+		}
+		if next.Version == job.Version && !next.Done() {
+			// The wait expired or the server ended it without a change
+			if err := pause(ctx, unchangedPollPause); err != nil {
+				return job, err
+			}
+			continue
+		}
+		job = next
+		if fn != nil {
+			fn(job)
+		}
+	}
+	return job, nil
+}
+
+// pause waits for d, or returns ctx's error if it ends first.
+func pause(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// poll issues one long-poll status request.
+func (c *Client) poll(ctx context.Context, id int, version int64) (*Job, error) {
+	q := url.Values{}
+	q.Set("wait", c.PollWait.String())
+	q.Set("version", strconv.FormatInt(version, 10))
+	var job Job
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/jobs/%d?%s", id, q.Encode()), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel stops a running job and returns its final status.
+func (c *Client) Cancel(ctx context.Context, id int) (*Job, error) {
+	var job Job
+	if err := c.doJSON(ctx, http.MethodPost, fmt.Sprintf("/jobs/%d/cancel", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// DeleteData deletes a finished job's intermediate files now, without
+// waiting for the coordinator's retention policy.
+func (c *Client) DeleteData(ctx context.Context, id int) (*Job, error) {
+	var job Job
+	if err := c.doJSON(ctx, http.MethodDelete, fmt.Sprintf("/jobs/%d/data", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Workers lists the workers known to the coordinator.
+func (c *Client) Workers(ctx context.Context) ([]Worker, error) {
+	var workers []Worker
+	if err := c.doJSON(ctx, http.MethodGet, "/workers", nil, &workers); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+// OutputOptions selects which part of a job's output to read.
+type OutputOptions struct {
+	Sorted bool
+	Key    string // Only records with this key, if HasKey is set
+	HasKey bool
+	Offset int
+	Limit  int    // Zero means no limit
+	Format string // "text" (default), "csv" or "json"
+}
+
+// ReadOutput streams a completed job's merged output. The caller must close
+// the returned reader.
+func (c *Client) ReadOutput(ctx context.Context, id int, opts OutputOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	if opts.Sorted {
+		q.Set("sort", "true")
+	}
+	if opts.HasKey {
+		q.Set("key", opts.Key)
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Format != "" {
+		q.Set("format", opts.Format)
+	}
+	path := fmt.Sprintf("/jobs/%d/output", id)
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Inputs lists the files a job reads, as resolved when it was submitted.
+func (c *Client) Inputs(ctx context.Context, id int) (*Inputs, error) {
+	var resp Inputs
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/jobs/%d/inputs", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Partitions lists the output files of a completed job.
+func (c *Client) Partitions(ctx context.Context, id int) (*Partitions, error) {
+	var resp Partitions
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/jobs/%d/output/partitions", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TaskLogs returns the log captured by a task attempt. taskType is "map" or
+// "reduce"; a negative attempt selects the latest one.
+func (c *Client) TaskLogs(ctx context.Context, id int, taskType string, taskID, attempt int) (string, error) {
+	path := fmt.Sprintf("/jobs/%d/tasks/%s/%d/logs", id, url.PathEscape(taskType), taskID)
+	if attempt >= 0 {
+		path += "?attempt=" + strconv.Itoa(attempt)
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// do sends a request, retrying transient failures, and turns non-2xx
+// responses into *APIError.
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		base := c.baseURL()
+		resp, err := c.send(ctx, method, base+path, payload)
+		if attempt >= c.MaxRetries || !retryable(method, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Leader != "" && normalizeURL(apiErr.Leader) != base {
+			c.follow(base, normalizeURL(apiErr.Leader))
+			continue // Go to the leader at once
+		}
+		if dialFailed(err) {
+			c.follow(base, c.next(base))
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// baseURL returns the base URL requests go to: the leader, as far as the
+// client knows.
+func (c *Client) baseURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.endpoint == "" {
+		c.endpoint = c.BaseURL
+	}
+	return c.endpoint
+}
+
+// follow moves requests from the base URL from to to, unless another
+// request has moved them already.
+func (c *Client) follow(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.endpoint == from {
+		c.endpoint = to
+	}
+}
+
+// next returns the replica after base, wrapping around.
+func (c *Client) next(base string) string {
+	urls := append([]string{c.BaseURL}, c.Replicas...)
+	return urls[(slices.Index(urls, base)+1)%len(urls)]
+}
+
+func (c *Client) send(ctx context.Context, method, target string, payload []byte) (*http.Response, error) {
+	var r io.Reader
+	if payload != nil {
+		r = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.Secret != "":
+		SignRequest(req, payload, c.Tenant, c.Secret, time.Now())
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg)), Leader: resp.Header.Get("X-MR-Leader")}
+	}
+	return resp, nil
+}
+
+// SignRequest signs req, whose body is body, as tenant with the tenant's
+// HMAC secret. It sets the X-MR-Tenant and X-MR-Timestamp headers, the
+// X-MR-Nonce header to a fresh random nonce and the X-MR-Signature header to
+// the hex HMAC-SHA256 of
+//
+//	METHOD "\n" REQUEST-URI "\n" TIMESTAMP "\n" NONCE "\n" hex(SHA-256(body))
+//
+// The coordinator rejects requests signed more than a few minutes from its
+// clock, and requests whose nonce it has seen, so a signed request cannot be
+// sent twice.
+func SignRequest(req *http.Request, body []byte, tenant, secret string, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	nonce := rand.Text()
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), ts, nonce, hex.EncodeToString(sum[:]))
+	req.Header.Set("X-MR-Tenant", tenant)
+	req.Header.Set("X-MR-Timestamp", ts)
+	req.Header.Set("X-MR-Nonce", nonce)
+	req.Header.Set("X-MR-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// retryable reports whether a failed request may be sent again. Reads are
+// retried after network errors and gateway or overload responses. Writes
+// are only retried when the server refused them outright or could not be
+// reached, since a request lost in transit may already have taken effect.
+func retryable(method string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if dialFailed(err) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return method == http.MethodGet
+		}
+		return false
+	}
+	return method == http.MethodGet
+}
+
+// dialFailed reports whether err means the server could not be reached, so
+// the request was never sent.
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,418 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagarneeli/dist-mapreduce/internal/api"
+	"github.com/sagarneeli/dist-mapreduce/internal/common"
+	"github.com/sagarneeli/dist-mapreduce/internal/coordinator"
+)
+
+// newTestServer serves the REST API of a fresh coordinator in-process.
+func newTestServer(t *testing.T) (*coordinator.Coordinator, *api.Server, *Client) {
+	t.Helper()
+	c := coordinator.NewCoordinator()
+	s := api.NewServer(c)
+	s.OutputDir = t.TempDir()
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	cl := New(ts.URL)
+	cl.RetryBackoff = time.Millisecond
+	return c, s, cl
+}
+
+// runJob plays a worker that completes every task of the job, writing each
+// reduce partition's output into dir.
+func runJob(t *testing.T, c *coordinator.Coordinator, dir string, outputs []string) {
+	t.Helper()
+	for {
+		reply := &common.TaskReply{}
+		if err := c.GetTask(&common.TaskArgs{WorkerID: "w1"}, reply); err != nil {
+			t.Error(err)
+			return
+		}
+		if reply.TaskType == -1 {
+			return
+		}
+		if reply.TaskType == common.TaskTypeReduce {
+			path := filepath.Join(dir, common.OutputName(reply.JobID, reply.TaskID))
+			if err := os.WriteFile(path, []byte(outputs[reply.TaskID]), 0o644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		err := c.ReportTask(&common.ReportTaskArgs{
+			JobID:    reply.JobID,
+			TaskID:   reply.TaskID,
+			TaskType: reply.TaskType,
+			WorkerID: "w1",
+			Attempt:  reply.Attempt,
+		}, &common.ReportTaskReply{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+// inputFiles creates n empty input files the API will accept.
+func inputFiles(t *testing.T, n int) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("in-%d.txt", i))
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+func TestClient_SubmitWaitReadOutput(t *testing.T) {
+	c, s, cl := newTestServer(t)
+	ctx := context.Background()
+
+	id, err := cl.Submit(ctx, SubmitRequest{Files: inputFiles(t, 2), NReduce: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := cl.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Done() || job.MapTasks != 2 || job.ReduceTasks != 2 {
+		t.Errorf("Unexpected status %+v", job)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		runJob(t, c, s.OutputDir, []string{"b 2\n", "a 1\n"})
+	}()
+	var updates int
+	job, err = cl.Watch(ctx, id, func(*Job) { updates++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Succeeded() || job.MapDone != 2 || job.ReduceDone != 2 {
+		t.Errorf("Expected a completed job, got %+v", job)
+	}
+	if updates < 2 {
+		t.Errorf("Expected progress updates while waiting, got %d", updates)
+	}
+
+	body, err := cl.ReadOutput(ctx, id, OutputOptions{Sorted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	out, _ := io.ReadAll(body)
+	if string(out) != "a 1\nb 2\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	jobs, err := cl.List(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != id {
+		t.Errorf("Unexpected job list %+v %v", jobs, err)
+	}
+}
+
+func TestClient_CancelAndErrors(t *testing.T) {
+	_, _, cl := newTestServer(t)
+	ctx := context.Background()
+
+	id, err := cl.Submit(ctx, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := cl.Cancel(ctx, id)
+	if err != nil || job.Status != StatusCancelled {
+		t.Fatalf("Expected CANCELLED, got %+v %v", job, err)
+	}
+	job, err = cl.Wait(ctx, id)
+	if err != nil || job.Succeeded() {
+		t.Errorf("Expected Wait to return the cancelled job, got %+v %v", job, err)
+	}
+	job, err = cl.DeleteData(ctx, id)
+	if err != nil || !job.IntermediateDeleted || job.FinishedAt == nil {
+		t.Errorf("Expected the cancelled job's data to be deleted, got %+v %v", job, err)
+	}
+
+	if _, err := cl.Get(ctx, 42); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if _, err := cl.Submit(ctx, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1, App: "nope"}); err == nil {
+		t.Error("Expected an error submitting an unknown app")
+	}
+}
+
+func TestClient_WaitContext(t *testing.T) {
+	_, _, cl := newTestServer(t)
+	id, err := cl.Submit(context.Background(), SubmitRequest{Files: inputFiles(t, 1), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	job, err := cl.Wait(ctx, id)
+	if err == nil {
+		t.Fatal("Expected Wait to stop when the context ended")
+	}
+	if job == nil || job.Done() {
+		t.Errorf("Expected the last known running status, got %+v", job)
+	}
+}
+
+func TestClient_WaitWhileDraining(t *testing.T) {
+	c, s, _ := newTestServer(t)
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		s.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	cl := New(ts.URL)
+	bg := context.Background()
+	id, err := cl.Submit(bg, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wfID, err := cl.SubmitWorkflow(bg, WorkflowRequest{Stages: []StageRequest{{Name: "only", SubmitRequest: SubmitRequest{Files: inputFiles(t, 1), NReduce: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A draining server ends long polls at once; the client must not keep
+	// asking again without a pause.
+	c.Drain()
+	calls.Store(0)
+	ctx, cancel := context.WithTimeout(bg, 500*time.Millisecond)
+	defer cancel()
+	if _, err := cl.Wait(ctx, id); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Wait to run until the deadline, got %v", err)
+	}
+	if n := calls.Load(); n > 5 {
+		t.Errorf("Expected a pause between unchanged polls, got %d requests in 500ms", n)
+	}
+
+	calls.Store(0)
+	ctx, cancel = context.WithTimeout(bg, 500*time.Millisecond)
+	defer cancel()
+	if _, err := cl.WaitWorkflow(ctx, wfID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected WaitWorkflow to run until the deadline, got %v", err)
+	}
+	if n := calls.Load(); n > 5 {
+		t.Errorf("Expected a pause between unchanged workflow polls, got %d requests in 500ms", n)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	_, s, _ := newTestServer(t)
+	var failures, calls atomic.Int32
+	failures.Store(2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+			return
+		}
+		s.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	cl := New(ts.URL)
+	cl.RetryBackoff = time.Millisecond
+	ctx := context.Background()
+
+	if _, err := cl.List(ctx); err != nil {
+		t.Fatalf("Expected List to succeed after retries, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+
+	// A 502 on submit may hide a job that was created, so it is not retried.
+	failures.Store(1)
+	calls.Store(0)
+	if _, err := cl.Submit(ctx, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1}); err == nil {
+		t.Error("Expected submit to fail without retrying")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", calls.Load())
+	}
+
+	failures.Store(10)
+	calls.Store(0)
+	if _, err := cl.List(ctx); err == nil {
+		t.Error("Expected List to give up")
+	}
+	if calls.Load() != int32(cl.MaxRetries+1) {
+		t.Errorf("Expected %d attempts, got %d", cl.MaxRetries+1, calls.Load())
+	}
+}
+
+func TestClient_Workflow(t *testing.T) {
+	c, s, cl := newTestServer(t)
+	ctx := context.Background()
+
+	id, err := cl.SubmitWorkflow(ctx, WorkflowRequest{Name: "chain", Stages: []StageRequest{
+		{Name: "first", SubmitRequest: SubmitRequest{Files: inputFiles(t, 2), NReduce: 1}},
+		{Name: "second", After: []string{"first"}, SubmitRequest: SubmitRequest{NReduce: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, err := cl.GetWorkflow(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf.Done() || wf.Stage("first").JobID == nil || wf.Stage("second").Status != StagePending {
+		t.Errorf("Unexpected workflow %+v", wf)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		runJob(t, c, s.OutputDir, []string{"a 1\n"})
+	}()
+	wf, err = cl.WaitWorkflow(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wf.Succeeded() || wf.Stage("second").Status != StatusCompleted {
+		t.Errorf("Expected a completed workflow, got %+v", wf)
+	}
+	second, err := cl.Get(ctx, *wf.Stage("second").JobID)
+	if err != nil || second.MapTasks != 1 {
+		t.Errorf("Expected the second stage to read the first one's partition, got %+v %v", second, err)
+	}
+
+	if _, err := cl.CancelWorkflow(ctx, id); err == nil {
+		t.Error("Expected an error cancelling a finished workflow")
+	}
+	if _, err := cl.SubmitWorkflow(ctx, WorkflowRequest{Stages: []StageRequest{{Name: "x", After: []string{"x"}, SubmitRequest: SubmitRequest{NReduce: 1}}}}); err == nil {
+		t.Error("Expected an error submitting a cyclic workflow")
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	c := coordinator.NewCoordinator()
+	s := api.NewServer(c)
+	s.OutputDir = t.TempDir()
+	auth, err := api.AuthConfig{Tenants: []*api.Tenant{
+		{Name: "ann", APIKeys: []string{"ann-key"}, HMACSecret: "ann-secret", InputPrefixes: []string{"/"}, OutputPrefixes: []string{"."}},
+	}}.Authenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Auth = auth
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	ctx := context.Background()
+
+	anon := New(ts.URL)
+	var apiErr *APIError
+	if _, err := anon.List(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %v", err)
+	}
+
+	withKey := New(ts.URL)
+	withKey.Token = "ann-key"
+	id, err := withKey.Submit(ctx, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := withKey.Get(ctx, id); err != nil || job.Tenant != "ann" || job.User != "ann" {
+		t.Errorf("Expected a job of tenant ann, got %+v %v", job, err)
+	}
+
+	signed := New(ts.URL)
+	signed.Tenant, signed.Secret = "ann", "ann-secret"
+	if _, err := signed.Submit(ctx, SubmitRequest{Files: inputFiles(t, 1), NReduce: 1}); err != nil {
+		t.Errorf("Expected a signed request to be accepted, got %v", err)
+	}
+	if jobs, err := signed.List(ctx); err != nil || len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs, got %d %v", len(jobs), err)
+	}
+
+	signed.Secret = "wrong"
+	if _, err := signed.Get(ctx, id); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad signature, got %v", err)
+	}
+}
+
+func TestClient_FollowLeader(t *testing.T) {
+	dir := t.TempDir()
+	// replica starts a coordinator replica serving the API; the leader is
+	// the one started first.
+	replica := func(id string) (*coordinator.Coordinator, string) {
+		c := coordinator.NewCoordinator()
+		s := api.NewServer(c)
+		s.OutputDir = t.TempDir()
+		ts := httptest.NewServer(s.Handler())
+		t.Cleanup(ts.Close)
+		err := c.SetReplica(coordinator.Replica{
+			ID:       id,
+			APIAddr:  ts.URL,
+			Lock:     &coordinator.FileLock{Path: filepath.Join(dir, "lease.json")},
+			Log:      &coordinator.FileLog{Dir: filepath.Join(dir, "log")},
+			LeaseTTL: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		for deadline := time.Now().Add(3 * time.Second); ; {
+			if _, ok := c.Leader(); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("No leader elected")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return c, ts.URL
+	}
+	leader, leaderURL := replica("a")
+	_, standbyURL := replica("b")
+
+	var apiErr *APIError
+	if _, err := New(standbyURL).List(context.Background()); err != nil {
+		t.Errorf("Expected the client to follow the standby to the leader, got %v", err)
+	}
+	direct := New(standbyURL)
+	direct.MaxRetries = 0
+	if _, err := direct.List(context.Background()); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Leader != leaderURL {
+		t.Errorf("Expected 503 naming the leader at %s, got %v", leaderURL, err)
+	}
+
+	// An unreachable replica is skipped even for a submit, which cannot
+	// have reached it.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	cl := New(dead.URL + "," + standbyURL)
+	cl.RetryBackoff = time.Millisecond
+	id, err := cl.Submit(context.Background(), SubmitRequest{Files: inputFiles(t, 1), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := leader.Snapshot(id); !ok {
+		t.Errorf("Expected job %d on the leader", id)
+	}
+	if cl.baseURL() != leaderURL {
+		t.Errorf("Expected the client to stick to the leader, got %s", cl.baseURL())
+	}
+}
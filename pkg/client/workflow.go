@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Stage states reported in WorkflowStage.Status besides the job states,
+// which a stage takes over from its job once it has started.
+const (
+	StagePending = "PENDING" // Waiting for the stages it reads from
+	StageSkipped = "SKIPPED" // Not run because a stage it reads from did not complete
+)
+
+// WorkflowRequest describes a DAG of jobs to submit as one workflow.
+type WorkflowRequest struct {
+	Name   string         `json:"name,omitempty"`
+	Stages []StageRequest `json:"stages"`
+}
+
+// StageRequest is one stage of a workflow. Its job reads the reduce output
+// of every stage in After, in addition to its own Files, and starts once
+// they have all completed. Stages without After need Files.
+type StageRequest struct {
+	Name  string   `json:"name"`
+	After []string `json:"after,omitempty"`
+	SubmitRequest
+}
+
+// Workflow is a workflow's status as reported by the coordinator.
+type Workflow struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name,omitempty"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"` // Which stage failed, and why
+	SubmittedAt time.Time       `json:"submitted_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	Stages      []WorkflowStage `json:"stages"`
+	Version     int64           `json:"version"` // Changes whenever the workflow does
+	Tenant      string          `json:"tenant,omitempty"`
+}
+
+// WorkflowStage is the status of one stage of a workflow.
+type WorkflowStage struct {
+	Name   string   `json:"name"`
+	After  []string `json:"after,omitempty"`
+	Status string   `json:"status"`
+	JobID  *int     `json:"job_id,omitempty"` // Set once the stage has started
+}
+
+// Done reports whether the workflow has stopped running.
+func (w *Workflow) Done() bool { return w.Status != StatusInProgress }
+
+// Succeeded reports whether every stage of the workflow completed.
+func (w *Workflow) Succeeded() bool { return w.Status == StatusCompleted }
+
+// Stage returns the stage with the given name, or nil.
+func (w *Workflow) Stage(name string) *WorkflowStage {
+	for i := range w.Stages {
+		if w.Stages[i].Name == name {
+			return &w.Stages[i]
+		}
+	}
+	return nil
+}
+
+// SubmitWorkflow submits a workflow and returns its ID.
+func (c *Client) SubmitWorkflow(ctx context.Context, req WorkflowRequest) (int, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, "/workflows", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// GetWorkflow returns the current status of a workflow.
+func (c *Client) GetWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	var wf Workflow
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/workflows/%d", id), nil, &wf); err != nil {
+		return nil, err
+	}
+	return &wf, nil
+}
+
+// ListWorkflows returns the status of every workflow.
+func (c *Client) ListWorkflows(ctx context.Context) ([]Workflow, error) {
+	var wfs []Workflow
+	if err := c.doJSON(ctx, http.MethodGet, "/workflows", nil, &wfs); err != nil {
+		return nil, err
+	}
+	return wfs, nil
+}
+
+// WaitWorkflow is Wait for workflows: it long polls until the workflow stops
+// running or ctx ends, and returns its final status.
+func (c *Client) WaitWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	wf, err := c.GetWorkflow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for !wf.Done() {
+		q := url.Values{}
+		q.Set("wait", c.PollWait.String())
+		q.Set("version", strconv.FormatInt(wf.Version, 10))
+		var next Workflow
+		if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/workflows/%d?%s", id, q.Encode()), nil, &next); err != nil {
+			return wf, err
+		}
+		if next.Version == wf.Version && !next.Done() {
+			if err := pause(ctx, unchangedPollPause); err != nil {
+				return wf, err
+			}
+		}
+		wf = &next
+	}
+	return wf, nil
+}
+
+// CancelWorkflow cancels a workflow's running jobs, skips its remaining
+// stages and returns its final status.
+func (c *Client) CancelWorkflow(ctx context.Context, id int) (*Workflow, error) {
+	var wf Workflow
+	if err := c.doJSON(ctx, http.MethodPost, fmt.Sprintf("/workflows/%d/cancel", id), nil, &wf); err != nil {
+		return nil, err
+	}
+	return &wf, nil
+}